@@ -2,34 +2,80 @@ package api
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/bjornoj/txnotify/backend"
 	"github.com/bjornoj/txnotify/db"
 	"github.com/bjornoj/txnotify/email"
 	"github.com/bjornoj/txnotify/listeners"
+	"github.com/bjornoj/txnotify/outbox"
 	rpc "github.com/bjornoj/txnotify/proto"
 )
 
+// Network is a network we serve, along with where we get its blocks and transactions from
+type Network struct {
+	Params chaincfg.Params
+	Source backend.ChainSource
+	// AddressesOnly is set when the source only sees transactions touching watched
+	// addresses, e.g. Electrum. Txids and outpoints can't be watched on such networks.
+	AddressesOnly bool
+}
+
 type notifyService struct {
-	network  chaincfg.Params
-	btc      *rpcclient.Client
-	sender   email.EmailSender
-	database *db.DB
+	// networks are the networks we serve, keyed by name
+	networks map[string]Network
+	// defaultNetwork is used for notifications not specifying a network
+	defaultNetwork string
+	sender         email.EmailSender
+	database       *db.DB
 
 	rpc.UnsafeNotifyServer
 }
 
-func NewNotifyService(database *db.DB, network chaincfg.Params, btc *rpcclient.Client, sender email.EmailSender) notifyService {
-	return notifyService{
+// NewNotifyService creates the notify service for the given networks. The first network is
+// used for notifications not specifying one.
+func NewNotifyService(database *db.DB, networks []Network, sender email.EmailSender) notifyService {
+	service := notifyService{
 		database: database,
-		network:  network,
-		btc:      btc,
+		networks: make(map[string]Network, len(networks)),
 		sender:   sender,
 	}
+	for _, network := range networks {
+		service.networks[network.Params.Name] = network
+	}
+	if len(networks) > 0 {
+		service.defaultNetwork = networks[0].Params.Name
+	}
+	return service
+}
+
+// network looks up the network with the given name, or the default network if the name is empty
+func (n notifyService) network(name string) (Network, error) {
+	if name == "" {
+		name = n.defaultNetwork
+	}
+
+	network, ok := n.networks[name]
+	if !ok {
+		names := make([]string, 0, len(n.networks))
+		for served := range n.networks {
+			names = append(names, served)
+		}
+		sort.Strings(names)
+		return Network{}, fmt.Errorf("unknown network: %s. Valid: %s", name, strings.Join(names, ", "))
+	}
+	return network, nil
 }
 
 var _ rpc.NotifyServer = notifyService{}
@@ -47,31 +93,132 @@ confirmations: %d`, req.Email, req.Identifier, req.Confirmations)
 		return nil, err
 	}
 
-	err = listeners.WatchIdentifier(&n.network, req.Identifier, listeners.Notification{
-		Email:       req.Email,
-		SlackURL:    req.SlackWebhookUrl,
-		CallbackURL: req.CallbackUrl,
-	}, req.Description, int64(req.Confirmations))
+	network, err := n.network(req.Network)
+	if err != nil {
+		return nil, fmt.Errorf("could not register new notification: %w", err)
+	}
+
+	if err := listeners.ValidateIdentifier(&network.Params, req.Identifier); err != nil {
+		return nil, fmt.Errorf("could not register new notification: %w", err)
+	}
+
+	if network.AddressesOnly && !listeners.IsAddressIdentifier(&network.Params, req.Identifier) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"network %s can only watch addresses and wallets, not txids or outpoints", network.Params.Name)
+	}
+
+	if err := validateAmounts(req.MinAmountSats, req.MaxAmountSats); err != nil {
+		return nil, fmt.Errorf("could not register new notification: %w", err)
+	}
+
+	milestones, err := parseMilestones(req.ConfirmationMilestones)
+	if err != nil {
+		return nil, fmt.Errorf("could not register new notification: %w", err)
+	}
+
+	channels, err := parseChannels(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not register new notification: %w", err)
+	}
+
+	secret, err := outbox.NewSigningSecret()
 	if err != nil {
 		return nil, fmt.Errorf("could not register new notification: %w", err)
 	}
 
 	notification, err := db.Notification{
-		UserID:        userID,
-		Identifier:    req.Identifier,
-		Confirmations: req.Confirmations,
-		Email:         req.Email,
-		Description:   req.Description,
+		UserID:             userID,
+		Identifier:         req.Identifier,
+		Confirmations:      req.Confirmations,
+		Description:        req.Description,
+		Channels:           channels,
+		FollowReplacements: req.FollowReplacements,
+		Network:            network.Params.Name,
+		MinAmount:          req.MinAmountSats,
+		MaxAmount:          req.MaxAmountSats,
+		Milestones:         milestones,
+		SigningSecret:      secret,
 	}.Save(n.database)
 	if err != nil {
 		return nil, err
 	}
 
+	err = listeners.WatchIdentifier(n.database, network.Source, &network.Params, notification)
+	if err != nil {
+		// the notification would never fire, and would be restored on every startup
+		if err := db.DeleteNotification(n.database, notification.ID); err != nil {
+			log.WithError(err).WithField("id", notification.ID).Error("could not delete unwatched notification")
+		}
+		return nil, fmt.Errorf("could not register new notification: %w", err)
+	}
+
 	return &rpc.CreateNotificationResponse{
-		Id: notification.ID.String(),
+		Id:            notification.ID.String(),
+		SigningSecret: notification.SigningSecret,
 	}, nil
 }
 
+// validateAmounts checks the amount limits of a notification. Zero means no limit.
+func validateAmounts(min, max int64) error {
+	if min < 0 || max < 0 {
+		return errors.New("amount limits can not be negative")
+	}
+	if max != 0 && min > max {
+		return fmt.Errorf("minimum amount %d is above the maximum amount %d", min, max)
+	}
+	return nil
+}
+
+// parseMilestones sorts the confirmation milestones of a notification in ascending order
+func parseMilestones(milestones []uint32) ([]int64, error) {
+	parsed := make([]int64, 0, len(milestones))
+	for _, milestone := range milestones {
+		parsed = append(parsed, int64(milestone))
+	}
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i] < parsed[j] })
+
+	for i := 1; i < len(parsed); i++ {
+		if parsed[i] == parsed[i-1] {
+			return nil, fmt.Errorf("confirmation milestone %d is listed twice", parsed[i])
+		}
+	}
+	return parsed, nil
+}
+
+// parseChannels collects the channels of a notification, both the ones given by the shorthand
+// fields and the ones listed explicitly
+func parseChannels(req *rpc.Notification) (db.ChannelConfigs, error) {
+	var channels db.ChannelConfigs
+	for channelType, target := range map[string]string{
+		outbox.ChannelEmail:    req.Email,
+		outbox.ChannelSlack:    req.SlackWebhookUrl,
+		outbox.ChannelCallback: req.CallbackUrl,
+	} {
+		if target != "" {
+			channels = append(channels, db.ChannelConfig{Type: channelType, Target: target})
+		}
+	}
+	for _, channel := range req.Channels {
+		channels = append(channels, db.ChannelConfig{Type: channel.Type, Target: channel.Target})
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].Type != channels[j].Type {
+			return channels[i].Type < channels[j].Type
+		}
+		return channels[i].Target < channels[j].Target
+	})
+
+	for i, channel := range channels {
+		if err := outbox.Validate(channel); err != nil {
+			return nil, err
+		}
+		if i > 0 && channel == channels[i-1] {
+			return nil, fmt.Errorf("%s channel to %s is listed twice", channel.Type, channel.Target)
+		}
+	}
+	return channels, nil
+}
+
 func (n notifyService) ListNotifications(ctx context.Context, req *rpc.ListNotificationsRequest) (*rpc.ListNotificationsResponse, error) {
 
 	userID, err := uuid.Parse(req.UserId)
@@ -86,12 +233,30 @@ func (n notifyService) ListNotifications(ctx context.Context, req *rpc.ListNotif
 
 	var notifs []*rpc.Notification
 	for _, notification := range notifications {
+		milestones := make([]uint32, 0, len(notification.Milestones))
+		for _, milestone := range notification.Milestones {
+			milestones = append(milestones, uint32(milestone))
+		}
+
+		channels := make([]*rpc.ChannelConfig, 0, len(notification.Channels))
+		for _, channel := range notification.Channels {
+			channels = append(channels, &rpc.ChannelConfig{Type: channel.Type, Target: channel.Target})
+		}
+
 		notifs = append(notifs, &rpc.Notification{
-			UserId:        notification.UserID.String(),
-			Identifier:    notification.Identifier,
-			Confirmations: notification.Confirmations,
-			Email:         notification.Email,
-			Description:   notification.Description,
+			UserId:                 notification.UserID.String(),
+			Identifier:             notification.Identifier,
+			Confirmations:          notification.Confirmations,
+			Email:                  notification.Channels.Target(outbox.ChannelEmail),
+			Description:            notification.Description,
+			SlackWebhookUrl:        notification.Channels.Target(outbox.ChannelSlack),
+			CallbackUrl:            notification.Channels.Target(outbox.ChannelCallback),
+			Channels:               channels,
+			FollowReplacements:     notification.FollowReplacements,
+			Network:                notification.Network,
+			MinAmountSats:          notification.MinAmount,
+			MaxAmountSats:          notification.MaxAmount,
+			ConfirmationMilestones: milestones,
 		})
 	}
 
@@ -99,3 +264,158 @@ func (n notifyService) ListNotifications(ctx context.Context, req *rpc.ListNotif
 		Notifications: notifs,
 	}, nil
 }
+
+func (n notifyService) GetAddressBalance(ctx context.Context, req *rpc.GetAddressBalanceRequest) (*rpc.GetAddressBalanceResponse, error) {
+	network, err := n.network(req.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := btcutil.DecodeAddress(req.Address, &network.Params)
+	if err != nil || !address.IsForNet(&network.Params) {
+		return nil, fmt.Errorf("invalid %s address: %s", network.Params.Name, req.Address)
+	}
+
+	if !listeners.IsWatchedAddress(address.String(), network.Params.Name) {
+		return nil, fmt.Errorf("address %s is not watched", address.String())
+	}
+
+	balance, utxos := listeners.AddressBalance(address.String(), network.Params.Name)
+
+	response := &rpc.GetAddressBalanceResponse{
+		Address:         address.String(),
+		ConfirmedSats:   int64(balance.Confirmed),
+		UnconfirmedSats: int64(balance.Unconfirmed),
+	}
+	for _, utxo := range utxos {
+		converted := &rpc.Utxo{
+			Txid:       utxo.Outpoint.Hash.String(),
+			Vout:       utxo.Outpoint.Index,
+			AmountSats: int64(utxo.Amount),
+		}
+		if utxo.ConfirmedAtBlock != nil {
+			converted.Confirmed = true
+			converted.ConfirmedAtBlock = *utxo.ConfirmedAtBlock
+		}
+		if utxo.SpentBy != nil {
+			converted.SpentByTxid = utxo.SpentBy.String()
+		}
+		response.Utxos = append(response.Utxos, converted)
+	}
+
+	return response, nil
+}
+
+// userNotification looks up a notification, making sure it belongs to the given user
+func (n notifyService) userNotification(userID, notificationID string) (db.Notification, error) {
+	user, err := uuid.Parse(userID)
+	if err != nil {
+		return db.Notification{}, fmt.Errorf("invalid userID: %v", userID)
+	}
+
+	ID, err := uuid.Parse(notificationID)
+	if err != nil {
+		return db.Notification{}, fmt.Errorf("invalid notification ID: %v", notificationID)
+	}
+
+	notification, err := db.GetNotification(n.database, ID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && notification.UserID != user) {
+		return db.Notification{}, fmt.Errorf("notification %s not found", ID)
+	}
+	return notification, err
+}
+
+const (
+	// defaultSecretOverlap is how long a rotated signing secret keeps signing callbacks if the
+	// request doesn't say
+	defaultSecretOverlap = 24 * time.Hour
+	maxSecretOverlap     = 7 * 24 * time.Hour
+)
+
+func (n notifyService) RotateSigningSecret(ctx context.Context, req *rpc.RotateSigningSecretRequest) (*rpc.RotateSigningSecretResponse, error) {
+	overlap := time.Duration(req.OverlapSeconds) * time.Second
+	if overlap == 0 {
+		overlap = defaultSecretOverlap
+	}
+	if overlap > maxSecretOverlap {
+		return nil, fmt.Errorf("overlap can not be longer than %s", maxSecretOverlap)
+	}
+
+	notification, err := n.userNotification(req.UserId, req.NotificationId)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := outbox.NewSigningSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(overlap)
+	if err := db.RotateSigningSecret(n.database, notification.ID, secret, expiresAt); err != nil {
+		return nil, fmt.Errorf("could not rotate signing secret: %w", err)
+	}
+
+	return &rpc.RotateSigningSecretResponse{
+		SigningSecret:           secret,
+		PreviousSecretExpiresAt: expiresAt.Unix(),
+	}, nil
+}
+
+const (
+	defaultDeliveries = 100
+	maxDeliveries     = 1000
+)
+
+func (n notifyService) ListDeliveries(ctx context.Context, req *rpc.ListDeliveriesRequest) (*rpc.ListDeliveriesResponse, error) {
+	notification, err := n.userNotification(req.UserId, req.NotificationId)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultDeliveries
+	}
+	if limit > maxDeliveries {
+		return nil, fmt.Errorf("can not list more than %d deliveries", maxDeliveries)
+	}
+
+	from := time.Unix(req.From, 0)
+	to := time.Now()
+	if req.To != 0 {
+		to = time.Unix(req.To, 0)
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("from (%d) has to be before to (%d)", from.Unix(), to.Unix())
+	}
+
+	deliveries, err := db.ListDeliveries(n.database, notification.ID, from, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not list deliveries: %w", err)
+	}
+
+	response := &rpc.ListDeliveriesResponse{}
+	for _, delivery := range deliveries {
+		converted := &rpc.Delivery{
+			Id:           delivery.ID.String(),
+			MessageId:    delivery.OutboxID.String(),
+			Channel:      delivery.Channel,
+			Destination:  delivery.Destination,
+			Attempt:      uint32(delivery.Attempt),
+			RequestBody:  delivery.RequestBody,
+			ResponseBody: delivery.ResponseBody,
+			LatencyMs:    delivery.LatencyMs,
+			CreatedAt:    delivery.CreatedAt.Unix(),
+		}
+		if delivery.ResponseStatus != nil {
+			converted.ResponseStatus = uint32(*delivery.ResponseStatus)
+		}
+		if delivery.Error != nil {
+			converted.Error = *delivery.Error
+		}
+		response.Deliveries = append(response.Deliveries, converted)
+	}
+
+	return response, nil
+}
@@ -3,9 +3,16 @@ package api
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+	"github.com/bjornoj/txnotify/email"
+	"github.com/bjornoj/txnotify/listeners"
+	"github.com/bjornoj/txnotify/outbox"
 	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 	"gotest.tools/assert"
@@ -29,6 +36,8 @@ func TestNotifyService_CreateNotification(t *testing.T) {
 }
 
 func TestNotification_Save(t *testing.T) {
+	dbtest.Require(t, testDB)
+
 	user := createUserTest(t)
 
 	identifier := gofakeit.Sentence(5)
@@ -40,14 +49,14 @@ func TestNotification_Save(t *testing.T) {
 		UserID:        user.ID,
 		Identifier:    identifier,
 		Confirmations: confirmations,
-		Email:         email,
+		Channels:      db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: email}},
 		Description:   description,
 	}.Save(testDB)
 	require.NoError(t, err)
 
 	assert.Equal(t, identifier, notif.Identifier)
 	assert.Equal(t, confirmations, notif.Confirmations)
-	assert.Equal(t, email, notif.Email)
+	assert.Equal(t, email, notif.Channels.Target(outbox.ChannelEmail))
 	assert.Equal(t, description, notif.Description)
 
 	t.Run("can not save without user", func(t *testing.T) {
@@ -55,7 +64,7 @@ func TestNotification_Save(t *testing.T) {
 			UserID:        user.ID,
 			Identifier:    identifier,
 			Confirmations: confirmations,
-			Email:         email,
+			Channels:      db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: email}},
 			Description:   description,
 		}.Save(testDB)
 		require.Error(t, err)
@@ -66,7 +75,7 @@ func TestNotification_Save(t *testing.T) {
 			UserID:        uuid.New(),
 			Identifier:    identifier,
 			Confirmations: confirmations,
-			Email:         email,
+			Channels:      db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: email}},
 			Description:   description,
 		}.Save(testDB)
 		require.Error(t, err)
@@ -74,6 +83,8 @@ func TestNotification_Save(t *testing.T) {
 }
 
 func TestGetNotification(t *testing.T) {
+	dbtest.Require(t, testDB)
+
 	user := createUserTest(t)
 
 	identifier := gofakeit.Sentence(5)
@@ -85,7 +96,7 @@ func TestGetNotification(t *testing.T) {
 		UserID:        user.ID,
 		Identifier:    identifier,
 		Confirmations: confirmations,
-		Email:         email,
+		Channels:      db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: email}},
 		Description:   description,
 	}.Save(testDB)
 	require.NoError(t, err)
@@ -97,6 +108,8 @@ func TestGetNotification(t *testing.T) {
 }
 
 func TestListNotifications(t *testing.T) {
+	dbtest.Require(t, testDB)
+
 	user := createUserTest(t)
 
 	length := gofakeit.Number(3, 10)
@@ -105,7 +118,7 @@ func TestListNotifications(t *testing.T) {
 			UserID:        user.ID,
 			Identifier:    gofakeit.BitcoinAddress(),
 			Confirmations: gofakeit.Uint32(),
-			Email:         gofakeit.Email(),
+			Channels:      db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: gofakeit.Email()}},
 			Description:   gofakeit.JobDescriptor(),
 		}.Save(testDB)
 		require.NoError(t, err)
@@ -126,6 +139,259 @@ func TestListNotifications(t *testing.T) {
 	}
 }
 
+func TestNotifyService_Network(t *testing.T) {
+	service := NewNotifyService(testDB, []Network{
+		{Params: chaincfg.MainNetParams},
+		{Params: chaincfg.TestNet3Params},
+	}, email.EmailSender{})
+
+	t.Run("uses the first network by default", func(t *testing.T) {
+		network, err := service.network("")
+		require.NoError(t, err)
+		assert.Equal(t, chaincfg.MainNetParams.Name, network.Params.Name)
+	})
+
+	t.Run("looks up network by name", func(t *testing.T) {
+		network, err := service.network(chaincfg.TestNet3Params.Name)
+		require.NoError(t, err)
+		assert.Equal(t, chaincfg.TestNet3Params.Name, network.Params.Name)
+	})
+
+	t.Run("rejects networks we don't serve", func(t *testing.T) {
+		_, err := service.network(chaincfg.SigNetParams.Name)
+		assert.ErrorContains(t, err, "unknown network")
+	})
+}
+
+func TestNotifyService_GetAddressBalance(t *testing.T) {
+	service := NewNotifyService(testDB, []Network{{Params: chaincfg.RegressionNetParams}}, email.EmailSender{})
+
+	address, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	t.Run("rejects invalid address", func(t *testing.T) {
+		_, err := service.GetAddressBalance(context.Background(), &rpc.GetAddressBalanceRequest{
+			Address: gofakeit.Word(),
+		})
+		assert.ErrorContains(t, err, "invalid regtest address")
+	})
+
+	t.Run("rejects address nobody is watching", func(t *testing.T) {
+		_, err := service.GetAddressBalance(context.Background(), &rpc.GetAddressBalanceRequest{
+			Address: address.String(),
+		})
+		assert.ErrorContains(t, err, "is not watched")
+	})
+
+	t.Run("returns balance of watched address", func(t *testing.T) {
+		listeners.WatchAddress(address, listeners.AddressWatch{
+			ID:      uuid.New(),
+			Network: chaincfg.RegressionNetParams.Name,
+		})
+		defer delete(listeners.WatchedAddresses, address.String())
+
+		balance, err := service.GetAddressBalance(context.Background(), &rpc.GetAddressBalanceRequest{
+			Address: address.String(),
+			Network: chaincfg.RegressionNetParams.Name,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, address.String(), balance.Address)
+		assert.Equal(t, int64(0), balance.ConfirmedSats)
+		assert.Equal(t, 0, len(balance.Utxos))
+	})
+}
+
+func TestNotifyService_RotateSigningSecret(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	service := notifyService{database: testDB}
+	user := createUserTest(t)
+
+	notification, err := db.Notification{
+		UserID:        user.ID,
+		Identifier:    gofakeit.BitcoinAddress(),
+		SigningSecret: gofakeit.UUID(),
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	t.Run("rejects notification of other user", func(t *testing.T) {
+		_, err := service.RotateSigningSecret(context.Background(), &rpc.RotateSigningSecretRequest{
+			UserId:         uuid.New().String(),
+			NotificationId: notification.ID.String(),
+		})
+		assert.ErrorContains(t, err, "not found")
+	})
+
+	t.Run("rejects too long overlap", func(t *testing.T) {
+		_, err := service.RotateSigningSecret(context.Background(), &rpc.RotateSigningSecretRequest{
+			UserId:         user.ID.String(),
+			NotificationId: notification.ID.String(),
+			OverlapSeconds: uint32((8 * 24 * time.Hour).Seconds()),
+		})
+		assert.ErrorContains(t, err, "overlap can not be longer")
+	})
+
+	t.Run("keeps signing with previous secret during overlap", func(t *testing.T) {
+		res, err := service.RotateSigningSecret(context.Background(), &rpc.RotateSigningSecretRequest{
+			UserId:         user.ID.String(),
+			NotificationId: notification.ID.String(),
+			OverlapSeconds: 60,
+		})
+		require.NoError(t, err)
+		assert.Assert(t, res.SigningSecret != notification.SigningSecret)
+
+		rotated, err := db.GetNotification(testDB, notification.ID)
+		require.NoError(t, err)
+		assert.Equal(t, res.SigningSecret, rotated.SigningSecret)
+		assert.Equal(t, res.PreviousSecretExpiresAt, rotated.PreviousSecretExpiresAt.Unix())
+
+		assert.DeepEqual(t, []string{res.SigningSecret, notification.SigningSecret}, rotated.SigningSecrets(time.Now()))
+		assert.DeepEqual(t, []string{res.SigningSecret}, rotated.SigningSecrets(time.Now().Add(time.Minute)))
+	})
+}
+
+func TestNotifyService_ListDeliveries(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	service := notifyService{database: testDB}
+	user := createUserTest(t)
+
+	notification, err := db.Notification{
+		UserID:     user.ID,
+		Identifier: gofakeit.BitcoinAddress(),
+		Channels:   db.ChannelConfigs{{Type: outbox.ChannelCallback, Target: gofakeit.URL()}},
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	message, err := db.OutboxMessage{
+		NotificationID: notification.ID,
+		Channel:        "callback",
+		Destination:    notification.Channels.Target(outbox.ChannelCallback),
+		Body:           `{"event":"tx_confirmed"}`,
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	status := 500
+	reason := "callback response: 500 Internal Server Error"
+	for attempt := 1; attempt <= 3; attempt++ {
+		_, err := db.Delivery{
+			OutboxID:       message.ID,
+			NotificationID: notification.ID,
+			Channel:        message.Channel,
+			Destination:    message.Destination,
+			Attempt:        attempt,
+			RequestBody:    message.Body,
+			ResponseStatus: &status,
+			LatencyMs:      gofakeit.Int64(),
+			Error:          &reason,
+		}.Save(testDB)
+		require.NoError(t, err)
+	}
+
+	t.Run("rejects notification of other user", func(t *testing.T) {
+		_, err := service.ListDeliveries(context.Background(), &rpc.ListDeliveriesRequest{
+			UserId:         uuid.New().String(),
+			NotificationId: notification.ID.String(),
+		})
+		assert.ErrorContains(t, err, "not found")
+	})
+
+	t.Run("rejects too high limit", func(t *testing.T) {
+		_, err := service.ListDeliveries(context.Background(), &rpc.ListDeliveriesRequest{
+			UserId:         user.ID.String(),
+			NotificationId: notification.ID.String(),
+			Limit:          maxDeliveries + 1,
+		})
+		assert.ErrorContains(t, err, "can not list more than")
+	})
+
+	t.Run("lists newest attempts first", func(t *testing.T) {
+		res, err := service.ListDeliveries(context.Background(), &rpc.ListDeliveriesRequest{
+			UserId:         user.ID.String(),
+			NotificationId: notification.ID.String(),
+			Limit:          2,
+		})
+		require.NoError(t, err)
+		require.Len(t, res.Deliveries, 2)
+
+		newest := res.Deliveries[0]
+		assert.Equal(t, uint32(3), newest.Attempt)
+		assert.Equal(t, message.ID.String(), newest.MessageId)
+		assert.Equal(t, uint32(status), newest.ResponseStatus)
+		assert.Equal(t, reason, newest.Error)
+	})
+
+	t.Run("filters by time range", func(t *testing.T) {
+		res, err := service.ListDeliveries(context.Background(), &rpc.ListDeliveriesRequest{
+			UserId:         user.ID.String(),
+			NotificationId: notification.ID.String(),
+			From:           time.Now().Add(time.Hour).Unix(),
+			To:             time.Now().Add(2 * time.Hour).Unix(),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res.Deliveries))
+	})
+}
+
+func TestValidateAmounts(t *testing.T) {
+	assert.NilError(t, validateAmounts(0, 0))
+	assert.NilError(t, validateAmounts(1000, 0))
+	assert.NilError(t, validateAmounts(1000, 1000))
+	assert.ErrorContains(t, validateAmounts(1001, 1000), "above the maximum")
+	assert.ErrorContains(t, validateAmounts(-1, 0), "negative")
+}
+
+func TestParseMilestones(t *testing.T) {
+	milestones, err := parseMilestones([]uint32{6, 0, 1})
+	require.NoError(t, err)
+	assert.DeepEqual(t, []int64{0, 1, 6}, milestones)
+
+	milestones, err = parseMilestones(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(milestones))
+
+	_, err = parseMilestones([]uint32{1, 6, 1})
+	assert.ErrorContains(t, err, "listed twice")
+}
+
+func TestParseChannels(t *testing.T) {
+	outbox.RegisterBuiltin(testDB, email.EmailSender{})
+
+	channels, err := parseChannels(&rpc.Notification{
+		Email:       "satoshi@example.com",
+		CallbackUrl: "https://example.com/callback",
+		Channels: []*rpc.ChannelConfig{
+			{Type: outbox.ChannelEmail, Target: "hal@example.com"},
+		},
+	})
+	require.NoError(t, err)
+	assert.DeepEqual(t, db.ChannelConfigs{
+		{Type: outbox.ChannelCallback, Target: "https://example.com/callback"},
+		{Type: outbox.ChannelEmail, Target: "hal@example.com"},
+		{Type: outbox.ChannelEmail, Target: "satoshi@example.com"},
+	}, channels)
+
+	channels, err = parseChannels(&rpc.Notification{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(channels))
+
+	_, err = parseChannels(&rpc.Notification{
+		Channels: []*rpc.ChannelConfig{{Type: "carrier-pigeon", Target: "the roof"}},
+	})
+	assert.ErrorContains(t, err, "unknown channel")
+
+	_, err = parseChannels(&rpc.Notification{
+		SlackWebhookUrl: "not a url",
+	})
+	assert.ErrorContains(t, err, "invalid slack target")
+
+	_, err = parseChannels(&rpc.Notification{
+		Email:    "satoshi@example.com",
+		Channels: []*rpc.ChannelConfig{{Type: outbox.ChannelEmail, Target: "satoshi@example.com"}},
+	})
+	assert.ErrorContains(t, err, "listed twice")
+}
+
 func createUserTest(t *testing.T) User {
 	user, err := createUser(testDB)
 	require.NoError(t, err)
@@ -4,10 +4,10 @@ import (
 	"context"
 
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 
+	"github.com/bjornoj/txnotify/backend"
 	"github.com/bjornoj/txnotify/db"
 	"github.com/bjornoj/txnotify/email"
 	rpc "github.com/bjornoj/txnotify/proto"
@@ -16,17 +16,17 @@ import (
 type userService struct {
 	database *db.DB
 	network  chaincfg.Params
-	btc      *rpcclient.Client
+	source   backend.ChainSource
 	sender   email.EmailSender
 
 	rpc.UnsafeUserServer
 }
 
-func NewUserService(database *db.DB, network chaincfg.Params, btc *rpcclient.Client, sender email.EmailSender) userService {
+func NewUserService(database *db.DB, network chaincfg.Params, source backend.ChainSource, sender email.EmailSender) userService {
 	return userService{
 		database: database,
 		network:  network,
-		btc:      btc,
+		source:   source,
 		sender:   sender,
 	}
 }
@@ -8,13 +8,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
-	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
 	"github.com/bjornoj/txnotify/email"
 	rpc "github.com/bjornoj/txnotify/proto"
 )
-var testDB = db.NewTest("api_test")
+var testDB = dbtest.New("api_test")
 
 func TestUserService_CreateUser(t *testing.T) {
+	dbtest.Require(t, testDB)
 
 	 service := NewUserService(testDB, chaincfg.RegressionNetParams, nil, email.EmailSender{})
 
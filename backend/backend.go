@@ -0,0 +1,60 @@
+// Package backend contains the different sources txnotify can get its view of the blockchain
+// from. They all implement ChainSource, which is what the listeners consume.
+package backend
+
+import (
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// BlockEvent is a block being connected to or disconnected from the best chain
+type BlockEvent struct {
+	Block  *wire.MsgBlock
+	Height int64
+	// Disconnected is set if the block was disconnected from the best chain, e.g. by a reorg.
+	// Sources that can't tell only deliver connected blocks, and leave it to the receiver
+	// to notice that a block doesn't build on the previous one.
+	Disconnected bool
+}
+
+// Utxo is an unspent transaction output
+type Utxo struct {
+	Outpoint wire.OutPoint
+	Address  string
+	Amount   btcutil.Amount
+	// Height is the height of the block the output was confirmed in, 0 if it is unconfirmed
+	Height int64
+}
+
+// ChainSource delivers blocks and mempool transactions, and answers queries about the chain
+type ChainSource interface {
+	// Start connects to the source, and starts delivering events on the channels
+	Start() error
+	// Stop disconnects from the source
+	Stop()
+
+	// Blocks delivers blocks connected to and disconnected from the best chain
+	Blocks() <-chan BlockEvent
+	// Transactions delivers transactions entering the mempool
+	Transactions() <-chan *wire.MsgTx
+	// MempoolRemovals delivers the txids of transactions removed from the mempool for other
+	// reasons than being included in a block. Sources that can't tell return nil.
+	MempoolRemovals() <-chan chainhash.Hash
+
+	// BestBlock returns the height and hash of the tip of the best chain
+	BestBlock() (int64, chainhash.Hash, error)
+	// BlockHash returns the hash of the block at the given height of the best chain
+	BlockHash(height int64) (chainhash.Hash, error)
+	// Block fetches a block
+	Block(hash chainhash.Hash) (*wire.MsgBlock, error)
+	// BlockHeader fetches the header of a block, along with its height
+	BlockHeader(hash chainhash.Hash) (*wire.BlockHeader, int64, error)
+	// MempoolTransaction fetches a transaction from the mempool
+	MempoolTransaction(txid chainhash.Hash) (*wire.MsgTx, error)
+	// Unspent lists the unspent outputs paying to the addresses
+	Unspent(addresses []btcutil.Address) ([]Utxo, error)
+}
@@ -0,0 +1,292 @@
+package backend
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/sirupsen/logrus"
+)
+
+// BitcoindConfig contains everything we need to connect to bitcoind RPC
+type BitcoindConfig struct {
+	RpcPort  int
+	RpcHost  string
+	User     string
+	Password string
+	// Network is the network we're running on
+	Network chaincfg.Params
+}
+
+// ToConnConfig converts this BitcoindConfig to the format the rpcclient
+// library expects.
+func (conf *BitcoindConfig) ToConnConfig() *rpcclient.ConnConfig {
+	host := conf.RpcHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	log.WithFields(logrus.Fields{
+		"host":    conf.RpcHost,
+		"user":    conf.User,
+		"network": conf.Network.Name,
+		"rpcport": conf.RpcPort,
+	}).Info("converting config to rpc config")
+
+	return &rpcclient.ConnConfig{
+		Host:         fmt.Sprintf("%s:%d", host, conf.RpcPort),
+		User:         conf.User,
+		Pass:         conf.Password,
+		DisableTLS:   true, // Bitcoin Core doesn't do TLS
+		HTTPPostMode: true, // Bitcoin Core only supports HTTP POST mode
+	}
+}
+
+// bitcoind answers chain queries through bitcoind RPC. It is shared by the sources
+// getting their events from bitcoind, and by btcd, which understands the same calls
+// apart from scantxoutset.
+type bitcoind struct {
+	btcctl *rpcclient.Client
+	config BitcoindConfig
+
+	// scanMu makes sure we only run one scantxoutset at a time, as bitcoind refuses to
+	// run more than one
+	scanMu sync.Mutex
+}
+
+// dialBitcoind connects to bitcoind RPC, waiting for bitcoind to respond
+func dialBitcoind(conf BitcoindConfig) (*bitcoind, error) {
+	if conf.RpcPort == 0 {
+		switch conf.Network.Name {
+		case chaincfg.MainNetParams.Name:
+			conf.RpcPort = 8332
+		case chaincfg.TestNet3Params.Name:
+			conf.RpcPort = 18332
+		case chaincfg.RegressionNetParams.Name:
+			conf.RpcPort = 18443
+		case chaincfg.SigNetParams.Name:
+			conf.RpcPort = 38332
+		case "testnet4":
+			conf.RpcPort = 48332
+		case "":
+			return nil, errors.New("network is not set")
+		default:
+			return nil, fmt.Errorf("no default RPC port for %s, it has to be set", conf.Network.Name)
+		}
+	}
+
+	client, err := rpcclient.New(conf.ToConnConfig(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create new bitcoind rpcclient,"+
+			"is bitcoind running? %w", err)
+	}
+
+	node := &bitcoind{
+		btcctl: client,
+		config: conf,
+	}
+	if err = node.await(); err != nil {
+		return nil, err
+	}
+
+	log.Info("successfully connected to bitcoind")
+
+	return node, nil
+}
+
+// await tries to get a RPC response from the node, returning an error
+// if that isn't possible within a set of attempts. getblockcount is understood
+// by both bitcoind and btcd.
+func (b *bitcoind) await() error {
+	log := log.WithFields(logrus.Fields{
+		"host": b.config.RpcHost,
+		"port": b.config.RpcPort,
+		"user": b.config.User,
+	})
+
+	var err error
+	const attempts = 10
+	for i := 0; i < attempts; i++ {
+		_, err = b.btcctl.GetBlockCount()
+		switch {
+		case err == nil:
+			return nil
+
+			// invalid credentials, no point in continuing
+		case strings.Contains(err.Error(), "status code: 401"):
+			return errors.New("invalid RPC credentials")
+
+		default:
+			err = fmt.Errorf("awaitBitcoind(%s:%d): %w", b.config.RpcHost, b.config.RpcPort, err)
+		}
+
+		log.WithField("attempt", i).WithError(err).Error("tried connecting to bitcoin")
+
+		time.Sleep(time.Second)
+	}
+
+	log.WithError(err).Error("error is")
+	return err
+}
+
+func (b *bitcoind) BestBlock() (int64, chainhash.Hash, error) {
+	height, err := b.btcctl.GetBlockCount()
+	if err != nil {
+		return 0, chainhash.Hash{}, fmt.Errorf("could not get block count: %w", err)
+	}
+
+	hash, err := b.BlockHash(height)
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	return height, hash, nil
+}
+
+func (b *bitcoind) BlockHash(height int64) (chainhash.Hash, error) {
+	hash, err := b.btcctl.GetBlockHash(height)
+	if err != nil {
+		return chainhash.Hash{}, fmt.Errorf("could not get block hash at height %d: %w", height, err)
+	}
+	return *hash, nil
+}
+
+func (b *bitcoind) Block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	block, err := b.btcctl.GetBlock(&hash)
+	if err != nil {
+		return nil, fmt.Errorf("could not get block %s: %w", hash, err)
+	}
+	return block, nil
+}
+
+func (b *bitcoind) BlockHeader(hash chainhash.Hash) (*wire.BlockHeader, int64, error) {
+	verbose, err := b.btcctl.GetBlockHeaderVerbose(&hash)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get block header %s: %w", hash, err)
+	}
+
+	header, err := b.btcctl.GetBlockHeader(&hash)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not get block header %s: %w", hash, err)
+	}
+	return header, int64(verbose.Height), nil
+}
+
+func (b *bitcoind) MempoolTransaction(txid chainhash.Hash) (*wire.MsgTx, error) {
+	// with txindex enabled, bitcoind serves confirmed transactions as well
+	verbose, err := b.btcctl.GetRawTransactionVerbose(&txid)
+	if err != nil {
+		return nil, fmt.Errorf("could not get transaction %s: %w", txid, err)
+	}
+	if verbose.Confirmations > 0 {
+		return nil, fmt.Errorf("transaction %s is confirmed", txid)
+	}
+
+	raw, err := hex.DecodeString(verbose.Hex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction hex: %w", err)
+	}
+	tx, err := btcutil.NewTxFromBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize transaction %s: %w", txid, err)
+	}
+	return tx.MsgTx(), nil
+}
+
+// mempool lists the txids of every transaction in the mempool
+func (b *bitcoind) mempool() ([]chainhash.Hash, error) {
+	txids, err := b.btcctl.GetRawMempool()
+	if err != nil {
+		return nil, fmt.Errorf("could not get mempool: %w", err)
+	}
+
+	hashes := make([]chainhash.Hash, len(txids))
+	for i, txid := range txids {
+		hashes[i] = *txid
+	}
+	return hashes, nil
+}
+
+// Unspent scans the UTXO set for outputs paying to the addresses.
+//
+// NOTE: This scans the entire UTXO set, and might take a few minutes.
+func (b *bitcoind) Unspent(addresses []btcutil.Address) ([]Utxo, error) {
+	b.scanMu.Lock()
+	defer b.scanMu.Unlock()
+
+	// the scan tells us the script of every output it finds, so we need to be able to
+	// go from a script back to the address
+	var scanObjects []map[string]string
+	scriptAddresses := make(map[string]string, len(addresses))
+	for _, address := range addresses {
+		pkScript, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			return nil, fmt.Errorf("could not create script for address %s: %w", address, err)
+		}
+		scriptAddresses[hex.EncodeToString(pkScript)] = address.String()
+
+		scanObjects = append(scanObjects, map[string]string{
+			"desc": fmt.Sprintf("addr(%s)", address.EncodeAddress()),
+		})
+	}
+
+	descriptors, err := json.Marshal(scanObjects)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal scan descriptors: %w", err)
+	}
+
+	res, err := b.btcctl.RawRequest("scantxoutset", []json.RawMessage{json.RawMessage(`"start"`), descriptors})
+	if err != nil {
+		return nil, fmt.Errorf("could not scan UTXO set: %w", err)
+	}
+
+	var scan struct {
+		Unspents []struct {
+			Txid         string  `json:"txid"`
+			Vout         uint32  `json:"vout"`
+			ScriptPubKey string  `json:"scriptPubKey"`
+			Amount       float64 `json:"amount"`
+			Height       int64   `json:"height"`
+		} `json:"unspents"`
+	}
+	if err := json.Unmarshal(res, &scan); err != nil {
+		return nil, fmt.Errorf("could not unmarshal UTXO set scan: %w", err)
+	}
+
+	var utxos []Utxo
+	for _, unspent := range scan.Unspents {
+		address, ok := scriptAddresses[unspent.ScriptPubKey]
+		if !ok {
+			log.WithField("scriptPubKey", unspent.ScriptPubKey).Error("UTXO set scan returned unknown script")
+			continue
+		}
+		txid, err := chainhash.NewHashFromStr(unspent.Txid)
+		if err != nil {
+			log.WithError(err).Error("invalid txid in UTXO set scan")
+			continue
+		}
+		amount, err := btcutil.NewAmount(unspent.Amount)
+		if err != nil {
+			log.WithError(err).Error("invalid amount in UTXO set scan")
+			continue
+		}
+
+		utxos = append(utxos, Utxo{
+			Outpoint: wire.OutPoint{Hash: *txid, Index: unspent.Vout},
+			Address:  address,
+			Amount:   amount,
+			Height:   unspent.Height,
+		})
+	}
+
+	return utxos, nil
+}
@@ -0,0 +1,428 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// btcdSearchPage is how many transactions we ask btcd for at a time when looking for
+// unspent outputs
+const btcdSearchPage = 100
+
+// BtcdConfig contains everything we need to connect to btcd over websockets
+type BtcdConfig struct {
+	RpcPort  int
+	RpcHost  string
+	User     string
+	Password string
+	// Certificate is the path to btcd's TLS certificate, usually rpc.cert in the btcd
+	// directory. TLS is disabled if it's empty.
+	Certificate string
+	// Network is the network we're running on
+	Network chaincfg.Params
+}
+
+// btcdEvent is a notification from btcd, waiting to be handled
+type btcdEvent struct {
+	connected    *wire.BlockHeader
+	disconnected *wire.BlockHeader
+	height       int32
+	tx           []byte
+	// reconnected is set when we've (re)connected to btcd
+	reconnected bool
+	// refresh is set when it's time to update the transaction filter
+	refresh bool
+}
+
+// Btcd gets blocks and transactions from btcd's websocket notifications. btcd filters the
+// mempool transactions server side, so we only hear about transactions touching watched
+// addresses and outpoints.
+type Btcd struct {
+	*bitcoind
+
+	interval time.Duration
+	// watchedAddresses and watchedOutpoints list what we load into btcd's transaction filter
+	watchedAddresses func() []string
+	watchedOutpoints func() []wire.OutPoint
+
+	// filteredAddresses and filteredOutpoints are what we've loaded into the filter so far
+	filteredAddresses map[string]bool
+	filteredOutpoints map[wire.OutPoint]bool
+
+	// rpcclient delivers notifications on the goroutine reading responses, so we can't do
+	// any RPC calls while handling them. They are queued up and handled separately.
+	queueMu sync.Mutex
+	queue   []btcdEvent
+	wake    chan struct{}
+
+	blocks chan BlockEvent
+	txs    chan *wire.MsgTx
+	quit   chan struct{}
+}
+
+// NewBtcd connects to btcd over websockets. Notifications are requested on Start, and the
+// transaction filter is kept up to date with the watched addresses and outpoints at the
+// given interval.
+func NewBtcd(conf BtcdConfig, interval time.Duration, watchedAddresses func() []string,
+	watchedOutpoints func() []wire.OutPoint) (*Btcd, error) {
+	if conf.RpcPort == 0 {
+		switch conf.Network.Name {
+		case chaincfg.MainNetParams.Name:
+			conf.RpcPort = 8334
+		case chaincfg.TestNet3Params.Name, chaincfg.RegressionNetParams.Name:
+			conf.RpcPort = 18334
+		case chaincfg.SigNetParams.Name:
+			conf.RpcPort = 38332
+		case "testnet4":
+			conf.RpcPort = 48334
+		case "":
+			return nil, errors.New("network is not set")
+		default:
+			return nil, fmt.Errorf("no default RPC port for %s, it has to be set", conf.Network.Name)
+		}
+	}
+
+	connConfig := &rpcclient.ConnConfig{
+		Host:       fmt.Sprintf("%s:%d", conf.RpcHost, conf.RpcPort),
+		Endpoint:   "ws",
+		User:       conf.User,
+		Pass:       conf.Password,
+		DisableTLS: conf.Certificate == "",
+	}
+	if conf.Certificate != "" {
+		certificate, err := ioutil.ReadFile(conf.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("could not read btcd certificate: %w", err)
+		}
+		connConfig.Certificates = certificate
+	}
+
+	b := &Btcd{
+		interval:          interval,
+		watchedAddresses:  watchedAddresses,
+		watchedOutpoints:  watchedOutpoints,
+		filteredAddresses: make(map[string]bool),
+		filteredOutpoints: make(map[wire.OutPoint]bool),
+		wake:              make(chan struct{}, 1),
+		blocks:            make(chan BlockEvent),
+		txs:               make(chan *wire.MsgTx),
+		quit:              make(chan struct{}),
+	}
+
+	client, err := rpcclient.New(connConfig, &rpcclient.NotificationHandlers{
+		OnClientConnected: func() {
+			b.enqueue(btcdEvent{reconnected: true})
+		},
+		OnFilteredBlockConnected: func(height int32, header *wire.BlockHeader, _ []*btcutil.Tx) {
+			b.enqueue(btcdEvent{connected: header, height: height})
+		},
+		OnFilteredBlockDisconnected: func(height int32, header *wire.BlockHeader) {
+			b.enqueue(btcdEvent{disconnected: header, height: height})
+		},
+		OnRelevantTxAccepted: func(transaction []byte) {
+			b.enqueue(btcdEvent{tx: transaction})
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create new btcd rpcclient, is btcd running? %w", err)
+	}
+
+	b.bitcoind = &bitcoind{
+		btcctl: client,
+		config: BitcoindConfig{
+			RpcHost:  conf.RpcHost,
+			RpcPort:  conf.RpcPort,
+			User:     conf.User,
+			Password: conf.Password,
+			Network:  conf.Network,
+		},
+	}
+	if err := b.await(); err != nil {
+		return nil, err
+	}
+
+	log.Info("successfully connected to btcd")
+
+	return b, nil
+}
+
+func (b *Btcd) Blocks() <-chan BlockEvent {
+	return b.blocks
+}
+
+func (b *Btcd) Transactions() <-chan *wire.MsgTx {
+	return b.txs
+}
+
+// MempoolRemovals returns nil, as btcd doesn't tell us when transactions leave the mempool
+func (b *Btcd) MempoolRemovals() <-chan chainhash.Hash {
+	return nil
+}
+
+// Start asks btcd for block notifications and loads the transaction filter
+func (b *Btcd) Start() error {
+	if err := b.btcctl.NotifyBlocks(); err != nil {
+		return fmt.Errorf("could not register for block notifications: %w", err)
+	}
+	if err := b.refreshFilter(); err != nil {
+		return err
+	}
+
+	go b.handleEvents()
+	go b.keepFilterUpdated()
+
+	return nil
+}
+
+// Stop disconnects from btcd
+func (b *Btcd) Stop() {
+	close(b.quit)
+	b.btcctl.Shutdown()
+}
+
+func (b *Btcd) enqueue(event btcdEvent) {
+	b.queueMu.Lock()
+	b.queue = append(b.queue, event)
+	b.queueMu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+		// the handler is already awake
+	}
+}
+
+// handleEvents handles the queued up notifications in order
+//
+// NOTE: This must be run as a goroutine.
+func (b *Btcd) handleEvents() {
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-b.wake:
+		}
+
+		for {
+			b.queueMu.Lock()
+			if len(b.queue) == 0 {
+				b.queueMu.Unlock()
+				break
+			}
+			event := b.queue[0]
+			b.queue = b.queue[1:]
+			b.queueMu.Unlock()
+
+			if err := b.handleEvent(event); err != nil {
+				log.WithError(err).Error("could not handle btcd notification")
+			}
+		}
+	}
+}
+
+func (b *Btcd) handleEvent(event btcdEvent) error {
+	switch {
+	case event.reconnected:
+		// rpcclient registers for block notifications again on reconnect, but the
+		// transaction filter is gone
+		b.filteredAddresses = make(map[string]bool)
+		b.filteredOutpoints = make(map[wire.OutPoint]bool)
+		return b.refreshFilter()
+
+	case event.refresh:
+		return b.refreshFilter()
+
+	case event.connected != nil:
+		// the notification only contains the transactions matching our filter, while
+		// watched transactions might not touch a watched address
+		block, err := b.Block(event.connected.BlockHash())
+		if err != nil {
+			return err
+		}
+		b.blocks <- BlockEvent{Block: block, Height: int64(event.height)}
+
+	case event.disconnected != nil:
+		b.blocks <- BlockEvent{
+			Block:        wire.NewMsgBlock(event.disconnected),
+			Height:       int64(event.height),
+			Disconnected: true,
+		}
+
+	case event.tx != nil:
+		var tx wire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(event.tx)); err != nil {
+			return fmt.Errorf("could not deserialize transaction: %w", err)
+		}
+		b.txs <- &tx
+	}
+
+	return nil
+}
+
+// keepFilterUpdated adds newly watched addresses and outpoints to the transaction filter
+//
+// NOTE: This must be run as a goroutine.
+func (b *Btcd) keepFilterUpdated() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+		}
+
+		// the filter is reset by the event handler on reconnect, so it's updated there
+		b.enqueue(btcdEvent{refresh: true})
+	}
+}
+
+// refreshFilter loads the addresses and outpoints we haven't loaded yet into btcd's
+// transaction filter. btcd adds outputs paying to filtered addresses to the filter by
+// itself, so it notices when they are spent.
+func (b *Btcd) refreshFilter() error {
+	var addresses []btcutil.Address
+	var added []string
+	for _, encoded := range b.watchedAddresses() {
+		if b.filteredAddresses[encoded] {
+			continue
+		}
+
+		address, err := btcutil.DecodeAddress(encoded, &b.config.Network)
+		if err != nil {
+			return fmt.Errorf("invalid watched address %s: %w", encoded, err)
+		}
+		addresses = append(addresses, address)
+		added = append(added, encoded)
+	}
+
+	var outpoints []wire.OutPoint
+	for _, outpoint := range b.watchedOutpoints() {
+		if !b.filteredOutpoints[outpoint] {
+			outpoints = append(outpoints, outpoint)
+		}
+	}
+
+	if len(addresses) == 0 && len(outpoints) == 0 {
+		return nil
+	}
+
+	if err := b.btcctl.LoadTxFilter(false, addresses, outpoints); err != nil {
+		return fmt.Errorf("could not load transaction filter: %w", err)
+	}
+
+	for _, address := range added {
+		b.filteredAddresses[address] = true
+	}
+	for _, outpoint := range outpoints {
+		b.filteredOutpoints[outpoint] = true
+	}
+
+	log.WithField("addresses", len(addresses)).WithField("outpoints", len(outpoints)).
+		Debug("loaded transaction filter")
+	return nil
+}
+
+// Unspent goes through every transaction involving the addresses, finding the outputs
+// paying to them. btcd has no UTXO set scan, and needs to run with --addrindex for this to
+// work. The search only finds spends from the addresses themselves, so every output left
+// is checked against the UTXO set and mempool with gettxout.
+func (b *Btcd) Unspent(addresses []btcutil.Address) ([]Utxo, error) {
+	// the search only tells us how deep transactions are buried
+	best, _, err := b.BestBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var utxos []Utxo
+	for _, address := range addresses {
+		pkScript, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			return nil, fmt.Errorf("could not create script for address %s: %w", address, err)
+		}
+
+		unspent := make(map[wire.OutPoint]Utxo)
+		var order []wire.OutPoint
+		spent := make(map[wire.OutPoint]bool)
+		for skip := 0; ; skip += btcdSearchPage {
+			results, err := b.btcctl.SearchRawTransactionsVerbose(address, skip, btcdSearchPage, false, false, nil)
+			if err != nil {
+				// btcd responds with an error when there's nothing more to find
+				var rpcErr *btcjson.RPCError
+				if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCNoTxInfo {
+					break
+				}
+				return nil, fmt.Errorf("could not search transactions, is btcd running with --addrindex? %w", err)
+			}
+
+			for _, result := range results {
+				raw, err := hex.DecodeString(result.Hex)
+				if err != nil {
+					return nil, fmt.Errorf("invalid transaction hex: %w", err)
+				}
+				var tx wire.MsgTx
+				if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+					return nil, fmt.Errorf("could not deserialize transaction %s: %w", result.Txid, err)
+				}
+
+				var height int64
+				if result.Confirmations > 0 {
+					height = best - int64(result.Confirmations) + 1
+				}
+
+				for _, input := range tx.TxIn {
+					spent[input.PreviousOutPoint] = true
+				}
+				for vout, output := range tx.TxOut {
+					if bytes.Equal(output.PkScript, pkScript) {
+						outpoint := wire.OutPoint{Hash: tx.TxHash(), Index: uint32(vout)}
+						unspent[outpoint] = Utxo{
+							Outpoint: outpoint,
+							Address:  address.String(),
+							Amount:   btcutil.Amount(output.Value),
+							Height:   height,
+						}
+						order = append(order, outpoint)
+					}
+				}
+			}
+
+			if len(results) < btcdSearchPage {
+				break
+			}
+		}
+
+		for _, outpoint := range order {
+			if spent[outpoint] {
+				continue
+			}
+
+			// outputs spent by a transaction not involving the address again don't show up
+			// in the search
+			txOut, err := b.btcctl.GetTxOut(&outpoint.Hash, outpoint.Index, true)
+			if err != nil {
+				return nil, fmt.Errorf("could not look up output %s: %w", outpoint, err)
+			}
+			if txOut == nil {
+				continue
+			}
+			utxos = append(utxos, unspent[outpoint])
+		}
+	}
+
+	return utxos, nil
+}
@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBtcdHandleEvent(t *testing.T) {
+	// events not needing a round trip to btcd can be handled without a connection
+	b := &Btcd{
+		bitcoind:          &bitcoind{config: BitcoindConfig{Network: chaincfg.RegressionNetParams}},
+		watchedAddresses:  func() []string { return nil },
+		watchedOutpoints:  func() []wire.OutPoint { return nil },
+		filteredAddresses: make(map[string]bool),
+		filteredOutpoints: make(map[wire.OutPoint]bool),
+		blocks:            make(chan BlockEvent, 1),
+		txs:               make(chan *wire.MsgTx, 1),
+	}
+
+	t.Run("deserializes relevant transactions", func(t *testing.T) {
+		tx := mockTx(1)
+		var buf bytes.Buffer
+		require.NoError(t, tx.Serialize(&buf))
+
+		require.NoError(t, b.handleEvent(btcdEvent{tx: buf.Bytes()}))
+		assert.Equal(t, tx.TxHash(), (<-b.txs).TxHash())
+	})
+
+	t.Run("rejects invalid transactions", func(t *testing.T) {
+		assert.Error(t, b.handleEvent(btcdEvent{tx: []byte{1, 2, 3}}))
+		assert.Empty(t, b.txs)
+	})
+
+	t.Run("delivers disconnected blocks", func(t *testing.T) {
+		header := chaincfg.RegressionNetParams.GenesisBlock.Header
+		require.NoError(t, b.handleEvent(btcdEvent{disconnected: &header, height: 10}))
+
+		event := <-b.blocks
+		assert.True(t, event.Disconnected)
+		assert.Equal(t, int64(10), event.Height)
+		assert.Equal(t, header.BlockHash(), event.Block.BlockHash())
+	})
+
+	t.Run("skips loading the filter when nothing new is watched", func(t *testing.T) {
+		assert.NoError(t, b.handleEvent(btcdEvent{refresh: true}))
+	})
+}
@@ -0,0 +1,452 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// electrumSettle is how long we wait after a notification before looking at what changed.
+// A new block comes with a header notification and a status change for every scripthash
+// it touches, and we want all of them in place before we put the block together.
+const electrumSettle = 500 * time.Millisecond
+
+// historyItem is a transaction in the history of a scripthash. Height is 0 or -1 for
+// mempool transactions.
+type historyItem struct {
+	TxHash string `json:"tx_hash"`
+	Height int64  `json:"height"`
+}
+
+// electrum answers chain queries through an Electrum server, e.g. electrs or Fulcrum.
+//
+// Electrum servers don't serve blocks. Blocks are put together from the histories of the
+// watched addresses, meaning they only contain transactions paying to or spending from
+// those addresses. Transactions and outpoints not touching a watched address are never
+// seen, which is why notifications can't watch txids or outpoints on Electrum networks.
+type electrum struct {
+	client  *electrumClient
+	network chaincfg.Params
+	// watched lists the addresses we subscribe to
+	watched func() []string
+
+	mu sync.Mutex
+	// scripthashes are the scripthashes we're subscribed to
+	scripthashes map[string]bool
+	// stale are the scripthashes whose status changed since we fetched their history
+	stale map[string]bool
+	// histories are the last histories we fetched
+	histories map[string][]historyItem
+	// headers are the block headers we have seen, along with their height
+	headers map[chainhash.Hash]*wire.BlockHeader
+	heights map[chainhash.Hash]int64
+	tip     int64
+
+	changed chan struct{}
+	settle  *time.Timer
+}
+
+// NewElectrum creates a source subscribing to the Electrum server at the given host:port.
+// The server pushes changes to the watched addresses and new blocks to us, and we poll at
+// the given interval in case a notification goes missing.
+func NewElectrum(address string, useTLS bool, network chaincfg.Params, interval time.Duration,
+	watched func() []string) (*Polling, error) {
+	node := &electrum{
+		network:      network,
+		watched:      watched,
+		scripthashes: make(map[string]bool),
+		stale:        make(map[string]bool),
+		histories:    make(map[string][]historyItem),
+		headers:      make(map[chainhash.Hash]*wire.BlockHeader),
+		heights:      make(map[chainhash.Hash]int64),
+		changed:      make(chan struct{}, 1),
+	}
+
+	client, err := dialElectrum(address, useTLS, node.onNotification)
+	if err != nil {
+		return nil, err
+	}
+	node.client = client
+
+	return newPolling(node, interval), nil
+}
+
+// scripthash converts the address to the scripthash Electrum indexes it by, which is the
+// reversed sha256 of its script
+func scripthash(address btcutil.Address) (string, error) {
+	pkScript, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return "", fmt.Errorf("could not create script for address %s: %w", address, err)
+	}
+
+	hash := sha256.Sum256(pkScript)
+	for left, right := 0, len(hash)-1; left < right; left, right = left+1, right-1 {
+		hash[left], hash[right] = hash[right], hash[left]
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Close disconnects from the Electrum server
+func (e *electrum) Close() error {
+	e.client.close()
+	return nil
+}
+
+func (e *electrum) changes() <-chan struct{} {
+	return e.changed
+}
+
+// onNotification handles notifications pushed by the server, waking the poller up once
+// things have settled
+func (e *electrum) onNotification(method string, params json.RawMessage) {
+	switch method {
+	case "blockchain.headers.subscribe":
+		var headers []struct {
+			Height int64  `json:"height"`
+			Hex    string `json:"hex"`
+		}
+		if err := json.Unmarshal(params, &headers); err != nil || len(headers) == 0 {
+			log.WithError(err).Warn("received invalid header notification")
+			return
+		}
+		if _, err := e.rememberHeader(headers[0].Hex, headers[0].Height); err != nil {
+			log.WithError(err).Warn("received invalid header notification")
+			return
+		}
+
+	case "blockchain.scripthash.subscribe":
+		var status []json.RawMessage
+		if err := json.Unmarshal(params, &status); err != nil || len(status) == 0 {
+			log.WithError(err).Warn("received invalid scripthash notification")
+			return
+		}
+		var hash string
+		if err := json.Unmarshal(status[0], &hash); err != nil {
+			log.WithError(err).Warn("received invalid scripthash notification")
+			return
+		}
+
+		e.mu.Lock()
+		e.stale[hash] = true
+		e.mu.Unlock()
+
+	default:
+		log.WithField("method", method).Debug("ignoring electrum notification")
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.settle != nil {
+		e.settle.Stop()
+	}
+	e.settle = time.AfterFunc(electrumSettle, func() {
+		select {
+		case e.changed <- struct{}{}:
+		default:
+			// the poller is already awake
+		}
+	})
+}
+
+// rememberHeader parses a hex encoded header, and stores it along with its height
+func (e *electrum) rememberHeader(headerHex string, height int64) (chainhash.Hash, error) {
+	raw, err := hex.DecodeString(headerHex)
+	if err != nil {
+		return chainhash.Hash{}, fmt.Errorf("invalid header hex: %w", err)
+	}
+
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(raw)); err != nil {
+		return chainhash.Hash{}, fmt.Errorf("could not deserialize header: %w", err)
+	}
+
+	hash := header.BlockHash()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.headers[hash] = &header
+	e.heights[hash] = height
+	if height > e.tip {
+		e.tip = height
+	}
+	return hash, nil
+}
+
+func (e *electrum) BestBlock() (int64, chainhash.Hash, error) {
+	// subscribing again is how we ask for the current tip
+	var tip struct {
+		Height int64  `json:"height"`
+		Hex    string `json:"hex"`
+	}
+	if err := e.client.call("blockchain.headers.subscribe", &tip); err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+
+	hash, err := e.rememberHeader(tip.Hex, tip.Height)
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	return tip.Height, hash, nil
+}
+
+func (e *electrum) BlockHash(height int64) (chainhash.Hash, error) {
+	var headerHex string
+	if err := e.client.call("blockchain.block.header", &headerHex, height); err != nil {
+		return chainhash.Hash{}, err
+	}
+
+	return e.rememberHeader(headerHex, height)
+}
+
+// fetchRecentHeaders fetches the headers of the most recent blocks. Electrum can't look up
+// blocks by hash, so this is how we find blocks we haven't seen yet.
+func (e *electrum) fetchRecentHeaders() error {
+	e.mu.Lock()
+	start := e.tip - maxPollDepth + 1
+	e.mu.Unlock()
+	if start < 0 {
+		start = 0
+	}
+
+	var headers struct {
+		Count int    `json:"count"`
+		Hex   string `json:"hex"`
+	}
+	if err := e.client.call("blockchain.block.headers", &headers, start, maxPollDepth); err != nil {
+		return err
+	}
+
+	const headerSize = 80 * 2
+	for i := 0; i < headers.Count && (i+1)*headerSize <= len(headers.Hex); i++ {
+		_, err := e.rememberHeader(headers.Hex[i*headerSize:(i+1)*headerSize], start+int64(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *electrum) BlockHeader(hash chainhash.Hash) (*wire.BlockHeader, int64, error) {
+	lookup := func() (*wire.BlockHeader, int64, bool) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		header, ok := e.headers[hash]
+		return header, e.heights[hash], ok
+	}
+
+	if header, height, ok := lookup(); ok {
+		return header, height, nil
+	}
+
+	if err := e.fetchRecentHeaders(); err != nil {
+		return nil, 0, err
+	}
+	if header, height, ok := lookup(); ok {
+		return header, height, nil
+	}
+	return nil, 0, fmt.Errorf("unknown block %s", hash)
+}
+
+// subscribe subscribes to the watched addresses we're not subscribed to yet
+func (e *electrum) subscribe() error {
+	for _, encoded := range e.watched() {
+		address, err := btcutil.DecodeAddress(encoded, &e.network)
+		if err != nil {
+			return fmt.Errorf("invalid watched address %s: %w", encoded, err)
+		}
+		hash, err := scripthash(address)
+		if err != nil {
+			return err
+		}
+
+		e.mu.Lock()
+		subscribed := e.scripthashes[hash]
+		e.mu.Unlock()
+		if subscribed {
+			continue
+		}
+
+		// the status is a hash of the history, we fetch the history itself when needed
+		if err := e.client.call("blockchain.scripthash.subscribe", nil, hash); err != nil {
+			return err
+		}
+
+		e.mu.Lock()
+		e.scripthashes[hash] = true
+		e.stale[hash] = true
+		e.mu.Unlock()
+	}
+
+	return nil
+}
+
+// refreshHistories fetches the histories of the scripthashes that changed since we last
+// looked, and returns every history
+func (e *electrum) refreshHistories() (map[string][]historyItem, error) {
+	if err := e.subscribe(); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	var stale []string
+	for hash := range e.stale {
+		stale = append(stale, hash)
+	}
+	e.mu.Unlock()
+
+	for _, hash := range stale {
+		var history []historyItem
+		if err := e.client.call("blockchain.scripthash.get_history", &history, hash); err != nil {
+			return nil, err
+		}
+
+		e.mu.Lock()
+		e.histories[hash] = history
+		delete(e.stale, hash)
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	histories := make(map[string][]historyItem, len(e.histories))
+	for hash, history := range e.histories {
+		histories[hash] = history
+	}
+	return histories, nil
+}
+
+// txidsAt lists the transactions in the histories at the given height. Heights below 1
+// match every mempool transaction.
+func txidsAt(histories map[string][]historyItem, height int64) ([]chainhash.Hash, error) {
+	seen := make(map[chainhash.Hash]bool)
+	var txids []chainhash.Hash
+	for _, history := range histories {
+		for _, item := range history {
+			if item.Height != height && (height > 0 || item.Height > 0) {
+				continue
+			}
+
+			txid, err := chainhash.NewHashFromStr(item.TxHash)
+			if err != nil {
+				return nil, fmt.Errorf("invalid txid from electrum: %w", err)
+			}
+			if !seen[*txid] {
+				seen[*txid] = true
+				txids = append(txids, *txid)
+			}
+		}
+	}
+	return txids, nil
+}
+
+// Block puts together a block from the header and the transactions in it touching the
+// watched addresses
+func (e *electrum) Block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	header, height, err := e.BlockHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	histories, err := e.refreshHistories()
+	if err != nil {
+		return nil, err
+	}
+	txids, err := txidsAt(histories, height)
+	if err != nil {
+		return nil, err
+	}
+
+	block := wire.NewMsgBlock(header)
+	for _, txid := range txids {
+		tx, err := e.MempoolTransaction(txid)
+		if err != nil {
+			return nil, err
+		}
+		if err := block.AddTransaction(tx); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// MempoolTransaction fetches a transaction. Electrum servers serve confirmed transactions
+// as well.
+func (e *electrum) MempoolTransaction(txid chainhash.Hash) (*wire.MsgTx, error) {
+	var txHex string
+	if err := e.client.call("blockchain.transaction.get", &txHex, txid.String()); err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction hex: %w", err)
+	}
+
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("could not deserialize transaction %s: %w", txid, err)
+	}
+	return &tx, nil
+}
+
+// mempool lists the mempool transactions paying to or spending from the watched addresses
+func (e *electrum) mempool() ([]chainhash.Hash, error) {
+	histories, err := e.refreshHistories()
+	if err != nil {
+		return nil, err
+	}
+
+	return txidsAt(histories, 0)
+}
+
+func (e *electrum) Unspent(addresses []btcutil.Address) ([]Utxo, error) {
+	var utxos []Utxo
+	for _, address := range addresses {
+		hash, err := scripthash(address)
+		if err != nil {
+			return nil, err
+		}
+
+		var unspent []struct {
+			TxHash string `json:"tx_hash"`
+			TxPos  uint32 `json:"tx_pos"`
+			Value  int64  `json:"value"`
+			// Height is 0 for mempool transactions
+			Height int64 `json:"height"`
+		}
+		if err := e.client.call("blockchain.scripthash.listunspent", &unspent, hash); err != nil {
+			return nil, err
+		}
+
+		for _, output := range unspent {
+			txid, err := chainhash.NewHashFromStr(output.TxHash)
+			if err != nil {
+				return nil, fmt.Errorf("invalid txid from electrum: %w", err)
+			}
+
+			utxos = append(utxos, Utxo{
+				Outpoint: wire.OutPoint{Hash: *txid, Index: output.TxPos},
+				Address:  address.String(),
+				Amount:   btcutil.Amount(output.Value),
+				Height:   output.Height,
+			})
+		}
+	}
+
+	return utxos, nil
+}
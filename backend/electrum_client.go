@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// electrumTimeout is how long we wait for an Electrum server to respond
+const electrumTimeout = 30 * time.Second
+
+var errElectrumClosed = errors.New("electrum connection is closed")
+
+type electrumRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// electrumMessage is either a response to one of our requests, or a notification
+type electrumMessage struct {
+	ID     *uint64         `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// electrumClient speaks the Electrum protocol, which is newline delimited JSON-RPC over
+// TCP or TLS
+type electrumClient struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan electrumMessage
+	closed  bool
+
+	// notify is called with every notification the server pushes to us
+	notify func(method string, params json.RawMessage)
+}
+
+// dialElectrum connects to the Electrum server at the given host:port, and negotiates the
+// protocol version
+func dialElectrum(address string, useTLS bool, notify func(string, json.RawMessage)) (*electrumClient, error) {
+	dialer := &net.Dialer{Timeout: electrumTimeout}
+
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to electrum server %s: %w", address, err)
+	}
+
+	client := &electrumClient{
+		conn:    conn,
+		pending: make(map[uint64]chan electrumMessage),
+		notify:  notify,
+	}
+	go client.readLoop()
+
+	var version []string
+	if err := client.call("server.version", &version, "txnotify", "1.4"); err != nil {
+		client.close()
+		return nil, fmt.Errorf("could not negotiate electrum protocol version: %w", err)
+	}
+	log.WithField("server", version).Info("connected to electrum server")
+
+	return client, nil
+}
+
+// call sends the request to the server, and unmarshals the result into result
+func (c *electrumClient) call(method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errElectrumClosed
+	}
+	c.nextID++
+	id := c.nextID
+	response := make(chan electrumMessage, 1)
+	c.pending[id] = response
+
+	request, err := json.Marshal(electrumRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err == nil {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(electrumTimeout))
+		_, err = c.conn.Write(append(request, '\n'))
+	}
+	if err != nil {
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not send %s: %w", method, err)
+	}
+
+	select {
+	case msg, ok := <-response:
+		if !ok {
+			return errElectrumClosed
+		}
+		if len(msg.Error) > 0 && string(msg.Error) != "null" {
+			return fmt.Errorf("%s failed: %s", method, msg.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		if err := json.Unmarshal(msg.Result, result); err != nil {
+			return fmt.Errorf("could not unmarshal %s result: %w", method, err)
+		}
+		return nil
+
+	case <-time.After(electrumTimeout):
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return fmt.Errorf("%s timed out", method)
+	}
+}
+
+// readLoop reads messages from the server, handing responses to whoever is waiting on them
+//
+// NOTE: This must be run as a goroutine.
+func (c *electrumClient) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			c.mu.Lock()
+			wasClosed := c.closed
+			c.mu.Unlock()
+			if !wasClosed {
+				log.WithError(err).Error("lost connection to electrum server")
+			}
+			c.close()
+			return
+		}
+
+		var msg electrumMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			log.WithError(err).Warn("received invalid message from electrum server")
+			continue
+		}
+
+		if msg.ID == nil {
+			if msg.Method != "" && c.notify != nil {
+				c.notify(msg.Method, msg.Params)
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		response, ok := c.pending[*msg.ID]
+		delete(c.pending, *msg.ID)
+		c.mu.Unlock()
+		if ok {
+			response <- msg
+		}
+	}
+}
+
+// close closes the connection, failing every call waiting on a response
+func (c *electrumClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	_ = c.conn.Close()
+
+	for id, response := range c.pending {
+		close(response)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,282 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// electrumStandIn serves the parts of the Electrum protocol we use from a fake chain
+type electrumStandIn struct {
+	t     *testing.T
+	chain *Fake
+	// scripts maps scripthashes back to their script
+	scripts map[string][]byte
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newElectrumStandIn(t *testing.T, chain *Fake) (*electrumStandIn, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server := &electrumStandIn{t: t, chain: chain, scripts: make(map[string][]byte)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			go server.serve(conn)
+		}
+	}()
+
+	return server, listener.Addr().String()
+}
+
+// history lists the transactions paying to or spending from the script, along with their height
+func (s *electrumStandIn) history(pkScript []byte) []historyItem {
+	s.chain.mu.Lock()
+	defer s.chain.mu.Unlock()
+
+	var history []historyItem
+	owned := make(map[wire.OutPoint]bool)
+	touches := func(tx *wire.MsgTx) bool {
+		found := false
+		for _, input := range tx.TxIn {
+			found = found || owned[input.PreviousOutPoint]
+		}
+		for vout, output := range tx.TxOut {
+			if bytes.Equal(output.PkScript, pkScript) {
+				owned[wire.OutPoint{Hash: tx.TxHash(), Index: uint32(vout)}] = true
+				found = true
+			}
+		}
+		return found
+	}
+
+	for height, block := range s.chain.chain {
+		for _, tx := range block.Transactions {
+			if touches(tx) {
+				history = append(history, historyItem{TxHash: tx.TxHash().String(), Height: int64(height)})
+			}
+		}
+	}
+	for _, tx := range s.chain.unconfirmed {
+		if touches(tx) {
+			history = append(history, historyItem{TxHash: tx.TxHash().String(), Height: 0})
+		}
+	}
+	return history
+}
+
+func (s *electrumStandIn) header(height int64) string {
+	hash, err := s.chain.BlockHash(height)
+	require.NoError(s.t, err)
+	header, _, err := s.chain.BlockHeader(hash)
+	require.NoError(s.t, err)
+
+	var buf bytes.Buffer
+	require.NoError(s.t, header.Serialize(&buf))
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func (s *electrumStandIn) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var request struct {
+			ID     uint64            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		require.NoError(s.t, json.Unmarshal(line, &request))
+
+		var param string
+		if len(request.Params) > 0 {
+			_ = json.Unmarshal(request.Params[0], &param)
+		}
+
+		var result interface{}
+		switch request.Method {
+		case "server.version":
+			result = []string{"stand-in 1.0", "1.4"}
+		case "blockchain.headers.subscribe":
+			height, _, _ := s.chain.BestBlock()
+			result = map[string]interface{}{"height": height, "hex": s.header(height)}
+		case "blockchain.block.header":
+			var height int64
+			require.NoError(s.t, json.Unmarshal(request.Params[0], &height))
+			result = s.header(height)
+		case "blockchain.block.headers":
+			var start, count int64
+			require.NoError(s.t, json.Unmarshal(request.Params[0], &start))
+			require.NoError(s.t, json.Unmarshal(request.Params[1], &count))
+			tip, _, _ := s.chain.BestBlock()
+			headers := ""
+			var n int64
+			for height := start; height <= tip && n < count; height++ {
+				headers += s.header(height)
+				n++
+			}
+			result = map[string]interface{}{"count": n, "hex": headers}
+		case "blockchain.scripthash.subscribe":
+			result = nil
+		case "blockchain.scripthash.get_history":
+			result = s.history(s.scripts[param])
+		case "blockchain.transaction.get":
+			txid, err := chainhash.NewHashFromStr(param)
+			require.NoError(s.t, err)
+			tx := s.chain.findTx(*txid)
+			require.NotNil(s.t, tx)
+			var buf bytes.Buffer
+			require.NoError(s.t, tx.Serialize(&buf))
+			result = hex.EncodeToString(buf.Bytes())
+		default:
+			s.t.Errorf("unexpected electrum method %s", request.Method)
+		}
+
+		response, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": request.ID, "result": result})
+		require.NoError(s.t, err)
+		_, _ = conn.Write(append(response, '\n'))
+	}
+}
+
+// push sends a notification to every connected client
+func (s *electrumStandIn) push(method string, params ...interface{}) {
+	notification, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+	require.NoError(s.t, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_, _ = conn.Write(append(notification, '\n'))
+	}
+}
+
+// findTx looks for the transaction in the mempool and the best chain
+func (f *Fake) findTx(txid chainhash.Hash) *wire.MsgTx {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if tx, ok := f.unconfirmed[txid]; ok {
+		return tx
+	}
+	for _, block := range f.chain {
+		for _, tx := range block.Transactions {
+			if tx.TxHash() == txid {
+				return tx
+			}
+		}
+	}
+	return nil
+}
+
+func TestScripthash(t *testing.T) {
+	// the example from the electrum protocol documentation
+	address, err := btcutil.DecodeAddress("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", &chaincfg.MainNetParams)
+	require.NoError(t, err)
+
+	hash, err := scripthash(address)
+	require.NoError(t, err)
+	assert.Equal(t, "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161", hash)
+}
+
+func TestElectrum(t *testing.T) {
+	chain := NewFake(chaincfg.RegressionNetParams)
+	chain.Mine()
+
+	address, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+	pkScript, err := txscript.PayToAddrScript(address)
+	require.NoError(t, err)
+	hash, err := scripthash(address)
+	require.NoError(t, err)
+
+	server, serverAddress := newElectrumStandIn(t, chain)
+	server.scripts[hash] = pkScript
+	source, err := NewElectrum(serverAddress, false, chaincfg.RegressionNetParams, time.Hour, func() []string {
+		return []string{address.String()}
+	})
+	require.NoError(t, err)
+	source.blocks = make(chan BlockEvent, fakeBuffer)
+	source.txs = make(chan *wire.MsgTx, fakeBuffer)
+	source.removals = make(chan chainhash.Hash, fakeBuffer)
+	require.NoError(t, source.Start())
+	defer source.Stop()
+
+	deposit := mockTx(1)
+	deposit.AddTxOut(wire.NewTxOut(100_000, pkScript))
+
+	t.Run("delivers mempool transactions on status change", func(t *testing.T) {
+		chain.Broadcast(deposit)
+		server.push("blockchain.scripthash.subscribe", hash, "status")
+
+		select {
+		case tx := <-source.txs:
+			assert.Equal(t, deposit.TxHash(), tx.TxHash())
+		case <-time.After(5 * time.Second):
+			t.Fatal("transaction was not delivered")
+		}
+	})
+
+	t.Run("delivers blocks with the transactions touching watched addresses", func(t *testing.T) {
+		unrelated := mockTx(2)
+		block := chain.Mine(deposit, unrelated)
+		server.push("blockchain.scripthash.subscribe", hash, "new status")
+		server.push("blockchain.headers.subscribe", map[string]interface{}{"height": 2, "hex": server.header(2)})
+
+		select {
+		case event := <-source.blocks:
+			assert.Equal(t, block.BlockHash(), event.Block.BlockHash())
+			assert.Equal(t, int64(2), event.Height)
+			require.Len(t, event.Block.Transactions, 1)
+			assert.Equal(t, deposit.TxHash(), event.Block.Transactions[0].TxHash())
+		case <-time.After(5 * time.Second):
+			t.Fatal("block was not delivered")
+		}
+		assert.Empty(t, source.removals)
+	})
+}
+
+func TestTxidsAt(t *testing.T) {
+	txid := func(seed byte) string {
+		return chainhash.Hash(sha256.Sum256([]byte{seed})).String()
+	}
+	histories := map[string][]historyItem{
+		"first":  {{TxHash: txid(1), Height: 10}, {TxHash: txid(2), Height: 0}},
+		"second": {{TxHash: txid(1), Height: 10}, {TxHash: txid(3), Height: -1}, {TxHash: txid(4), Height: 11}},
+	}
+
+	confirmed, err := txidsAt(histories, 10)
+	require.NoError(t, err)
+	require.Len(t, confirmed, 1)
+	assert.Equal(t, txid(1), confirmed[0].String())
+
+	unconfirmed, err := txidsAt(histories, 0)
+	require.NoError(t, err)
+	assert.Len(t, unconfirmed, 2)
+}
@@ -0,0 +1,246 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// esplora answers chain queries through an Esplora compatible REST API, e.g. mempool.space
+// or blockstream.info
+type esplora struct {
+	url    string
+	client *http.Client
+	// watched lists the addresses we look for mempool transactions paying to or spending
+	// from. Esplora can't list the entire mempool in a reasonable way.
+	watched func() []string
+}
+
+// NewEsplora creates a source polling the Esplora API at the given URL. Esplora doesn't
+// hand out every mempool transaction, so we only see mempool transactions touching the
+// addresses listed by watched. Other transactions are noticed once they confirm.
+func NewEsplora(url string, interval time.Duration, watched func() []string) *Polling {
+	return newPolling(&esplora{
+		url:     strings.TrimSuffix(url, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+		watched: watched,
+	}, interval)
+}
+
+// get fetches the path from the API, returning the body of the response
+func (e *esplora) get(path string) ([]byte, error) {
+	res, err := e.client.Get(e.url + path)
+	if err != nil {
+		return nil, fmt.Errorf("could not query esplora: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read esplora response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("esplora responded to %s with %d: %s", path, res.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+// getHash fetches a path responding with a hash in plain text
+func (e *esplora) getHash(path string) (chainhash.Hash, error) {
+	body, err := e.get(path)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+
+	hash, err := chainhash.NewHashFromStr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return chainhash.Hash{}, fmt.Errorf("invalid hash from esplora: %w", err)
+	}
+	return *hash, nil
+}
+
+// getJSON fetches a path responding with JSON, unmarshaling it into dest
+func (e *esplora) getJSON(path string, dest interface{}) error {
+	body, err := e.get(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, dest); err != nil {
+		return fmt.Errorf("could not unmarshal esplora response: %w", err)
+	}
+	return nil
+}
+
+func (e *esplora) BestBlock() (int64, chainhash.Hash, error) {
+	hash, err := e.getHash("/blocks/tip/hash")
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+
+	// we look up the height of the hash, the tip might change in between two requests
+	_, height, err := e.BlockHeader(hash)
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	return height, hash, nil
+}
+
+func (e *esplora) BlockHash(height int64) (chainhash.Hash, error) {
+	return e.getHash("/block-height/" + strconv.FormatInt(height, 10))
+}
+
+func (e *esplora) Block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	body, err := e.get("/block/" + hash.String() + "/raw")
+	if err != nil {
+		return nil, err
+	}
+
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(body)); err != nil {
+		return nil, fmt.Errorf("could not deserialize block %s: %w", hash, err)
+	}
+	return &block, nil
+}
+
+// esploraBlock is a block as described by Esplora
+type esploraBlock struct {
+	Height            int64  `json:"height"`
+	Version           int32  `json:"version"`
+	Timestamp         int64  `json:"timestamp"`
+	Bits              uint32 `json:"bits"`
+	Nonce             uint32 `json:"nonce"`
+	MerkleRoot        string `json:"merkle_root"`
+	PreviousBlockHash string `json:"previousblockhash"`
+}
+
+func (e *esplora) BlockHeader(hash chainhash.Hash) (*wire.BlockHeader, int64, error) {
+	var block esploraBlock
+	if err := e.getJSON("/block/"+hash.String(), &block); err != nil {
+		return nil, 0, err
+	}
+
+	merkleRoot, err := chainhash.NewHashFromStr(block.MerkleRoot)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid merkle root: %w", err)
+	}
+
+	// the genesis block has no previous block
+	var prev chainhash.Hash
+	if block.PreviousBlockHash != "" {
+		hash, err := chainhash.NewHashFromStr(block.PreviousBlockHash)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid previous block hash: %w", err)
+		}
+		prev = *hash
+	}
+
+	header := wire.NewBlockHeader(block.Version, &prev, merkleRoot, block.Bits, block.Nonce)
+	header.Timestamp = time.Unix(block.Timestamp, 0)
+	return header, block.Height, nil
+}
+
+func (e *esplora) MempoolTransaction(txid chainhash.Hash) (*wire.MsgTx, error) {
+	// esplora serves confirmed transactions as well
+	body, err := e.get("/tx/" + txid.String() + "/status")
+	if err != nil {
+		return nil, err
+	}
+	var status struct {
+		Confirmed bool `json:"confirmed"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("invalid transaction status from esplora: %w", err)
+	}
+	if status.Confirmed {
+		return nil, fmt.Errorf("transaction %s is confirmed", txid)
+	}
+
+	body, err = e.get("/tx/" + txid.String() + "/hex")
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction hex: %w", err)
+	}
+
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("could not deserialize transaction %s: %w", txid, err)
+	}
+	return &tx, nil
+}
+
+// mempool lists the mempool transactions paying to or spending from the watched addresses
+func (e *esplora) mempool() ([]chainhash.Hash, error) {
+	seen := make(map[chainhash.Hash]bool)
+	var txids []chainhash.Hash
+	for _, address := range e.watched() {
+		var txs []struct {
+			Txid string `json:"txid"`
+		}
+		if err := e.getJSON("/address/"+address+"/txs/mempool", &txs); err != nil {
+			return nil, err
+		}
+
+		for _, tx := range txs {
+			txid, err := chainhash.NewHashFromStr(tx.Txid)
+			if err != nil {
+				return nil, fmt.Errorf("invalid txid from esplora: %w", err)
+			}
+			if !seen[*txid] {
+				seen[*txid] = true
+				txids = append(txids, *txid)
+			}
+		}
+	}
+
+	return txids, nil
+}
+
+func (e *esplora) Unspent(addresses []btcutil.Address) ([]Utxo, error) {
+	var utxos []Utxo
+	for _, address := range addresses {
+		var unspent []struct {
+			Txid   string `json:"txid"`
+			Vout   uint32 `json:"vout"`
+			Value  int64  `json:"value"`
+			Status struct {
+				BlockHeight int64 `json:"block_height"`
+			} `json:"status"`
+		}
+		if err := e.getJSON("/address/"+address.EncodeAddress()+"/utxo", &unspent); err != nil {
+			return nil, err
+		}
+
+		for _, output := range unspent {
+			txid, err := chainhash.NewHashFromStr(output.Txid)
+			if err != nil {
+				return nil, fmt.Errorf("invalid txid from esplora: %w", err)
+			}
+
+			utxos = append(utxos, Utxo{
+				Outpoint: wire.OutPoint{Hash: *txid, Index: output.Vout},
+				Address:  address.String(),
+				Amount:   btcutil.Amount(output.Value),
+				Height:   output.Status.BlockHeight,
+			})
+		}
+	}
+
+	return utxos, nil
+}
@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// esploraStandIn serves the parts of the Esplora API we use from a fake chain. mempoolTxs
+// maps addresses to the mempool transactions touching them.
+func esploraStandIn(t *testing.T, chain *Fake, mempoolTxs map[string][]chainhash.Hash) *httptest.Server {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		parse := func(s string) chainhash.Hash {
+			hash, err := chainhash.NewHashFromStr(s)
+			require.NoError(t, err)
+			return *hash
+		}
+
+		switch {
+		case r.URL.Path == "/blocks/tip/hash":
+			_, hash, _ := chain.BestBlock()
+			_, _ = fmt.Fprint(w, hash.String())
+
+		case parts[0] == "block-height":
+			height, _ := strconv.ParseInt(parts[1], 10, 64)
+			hash, err := chain.BlockHash(height)
+			if err != nil {
+				http.Error(w, "Block not found", http.StatusNotFound)
+				return
+			}
+			_, _ = fmt.Fprint(w, hash.String())
+
+		case parts[0] == "block" && len(parts) == 3 && parts[2] == "raw":
+			block, err := chain.Block(parse(parts[1]))
+			require.NoError(t, err)
+			require.NoError(t, block.Serialize(w))
+
+		case parts[0] == "block" && len(parts) == 2:
+			header, height, err := chain.BlockHeader(parse(parts[1]))
+			require.NoError(t, err)
+			prev := ""
+			if height > 0 {
+				prev = header.PrevBlock.String()
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"height":            height,
+				"version":           header.Version,
+				"timestamp":         header.Timestamp.Unix(),
+				"bits":              header.Bits,
+				"nonce":             header.Nonce,
+				"merkle_root":       header.MerkleRoot.String(),
+				"previousblockhash": prev,
+			})
+
+		case parts[0] == "tx" && parts[2] == "status":
+			// the fake chain only serves transactions from the mempool
+			_, err := chain.MempoolTransaction(parse(parts[1]))
+			_ = json.NewEncoder(w).Encode(map[string]bool{"confirmed": err != nil})
+
+		case parts[0] == "tx" && parts[2] == "hex":
+			tx, err := chain.MempoolTransaction(parse(parts[1]))
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			require.NoError(t, tx.Serialize(&buf))
+			_, _ = fmt.Fprint(w, hex.EncodeToString(buf.Bytes()))
+
+		case parts[0] == "address" && parts[2] == "txs":
+			var txs []map[string]string
+			for _, txid := range mempoolTxs[parts[1]] {
+				txs = append(txs, map[string]string{"txid": txid.String()})
+			}
+			_ = json.NewEncoder(w).Encode(txs)
+
+		case parts[0] == "address" && parts[2] == "utxo":
+			address, err := btcutil.DecodeAddress(parts[1], &chaincfg.RegressionNetParams)
+			require.NoError(t, err)
+			unspent, err := chain.Unspent([]btcutil.Address{address})
+			require.NoError(t, err)
+
+			var utxos []map[string]interface{}
+			for _, utxo := range unspent {
+				utxos = append(utxos, map[string]interface{}{
+					"txid":  utxo.Outpoint.Hash.String(),
+					"vout":  utxo.Outpoint.Index,
+					"value": int64(utxo.Amount),
+					"status": map[string]interface{}{
+						"confirmed":    true,
+						"block_height": utxo.Height,
+					},
+				})
+			}
+			_ = json.NewEncoder(w).Encode(utxos)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEsplora(t *testing.T) {
+	chain := NewFake(chaincfg.RegressionNetParams)
+	address, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+	pkScript, err := txscript.PayToAddrScript(address)
+	require.NoError(t, err)
+
+	mempoolTxs := make(map[string][]chainhash.Hash)
+	server := esploraStandIn(t, chain, mempoolTxs)
+
+	source := NewEsplora(server.URL+"/", 0, func() []string {
+		return []string{address.String()}
+	})
+	source.blocks = make(chan BlockEvent, fakeBuffer)
+	source.txs = make(chan *wire.MsgTx, fakeBuffer)
+	source.removals = make(chan chainhash.Hash, fakeBuffer)
+
+	_, err = source.pollBlocks()
+	require.NoError(t, err)
+	require.NoError(t, source.pollMempool(nil))
+
+	deposit := mockTx(1)
+	deposit.AddTxOut(wire.NewTxOut(100_000, pkScript))
+
+	t.Run("delivers mempool transactions touching watched addresses", func(t *testing.T) {
+		chain.Broadcast(deposit)
+		mempoolTxs[address.String()] = []chainhash.Hash{deposit.TxHash()}
+		require.NoError(t, source.poll())
+
+		require.Len(t, source.txs, 1)
+		assert.Equal(t, deposit.TxHash(), (<-source.txs).TxHash())
+	})
+
+	t.Run("delivers blocks", func(t *testing.T) {
+		block := chain.Mine(deposit)
+		delete(mempoolTxs, address.String())
+		require.NoError(t, source.poll())
+
+		require.Len(t, source.blocks, 1)
+		event := <-source.blocks
+		assert.Equal(t, block.BlockHash(), event.Block.BlockHash())
+		assert.Equal(t, int64(1), event.Height)
+		assert.Empty(t, source.removals)
+	})
+
+	t.Run("does not serve confirmed transactions from the mempool", func(t *testing.T) {
+		_, err := source.MempoolTransaction(deposit.TxHash())
+		assert.Error(t, err)
+	})
+
+	t.Run("lists unspent outputs", func(t *testing.T) {
+		utxos, err := source.Unspent([]btcutil.Address{address})
+		require.NoError(t, err)
+
+		require.Len(t, utxos, 1)
+		assert.Equal(t, wire.OutPoint{Hash: deposit.TxHash(), Index: 1}, utxos[0].Outpoint)
+		assert.Equal(t, btcutil.Amount(100_000), utxos[0].Amount)
+		assert.Equal(t, address.String(), utxos[0].Address)
+		assert.Equal(t, int64(1), utxos[0].Height)
+	})
+}
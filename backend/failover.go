@@ -0,0 +1,483 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// failoverOverlap is how long we keep forwarding events from a node after switching
+	// away from it, so nothing published during the switch is lost
+	failoverOverlap = 30 * time.Second
+
+	// failoverDedupeWindow is how long we remember the events we've forwarded
+	failoverDedupeWindow = 10 * time.Minute
+)
+
+// FailoverNode is one of the nodes Failover can get its events from
+type FailoverNode struct {
+	// Name identifies the node in logs, e.g. its host
+	Name string
+	// Priority decides which node we prefer when several are at the best tip, lowest first
+	Priority int
+	Source   ChainSource
+}
+
+// FailoverNodeState is how a node looked at the last health check
+type FailoverNodeState struct {
+	Name     string
+	Priority int
+	Active   bool
+	Healthy  bool
+	Height   int64
+	// BehindSince is when we noticed the node falling behind the best tip, if it is
+	BehindSince time.Time
+}
+
+type failoverNode struct {
+	FailoverNode
+
+	started bool
+	healthy bool
+	height  int64
+	hash    chainhash.Hash
+	// behindSince is when we first noticed the node behind the best tip, zero if it isn't
+	behindSince time.Time
+}
+
+// atTip returns true if the node was healthy and at the best tip at the last check
+func (n *failoverNode) atTip() bool {
+	return n.healthy && n.behindSince.IsZero()
+}
+
+// Failover follows one of several nodes, switching to another one when the active node
+// disconnects or falls behind the best tip. The nodes are health checked at an interval,
+// and the one with the best priority among the ones at the best tip is preferred.
+//
+// Events are only forwarded from the active node, and for a short while from the node we
+// switched away from. Events delivered by both are only forwarded once.
+type Failover struct {
+	// nodes are sorted by priority
+	nodes []*failoverNode
+
+	checkInterval time.Duration
+	staleAfter    time.Duration
+
+	mu       sync.Mutex
+	active   *failoverNode
+	previous *failoverNode
+	// switchedAt is when we switched from previous to active
+	switchedAt time.Time
+
+	seenMu sync.Mutex
+	// seen are the events we've forwarded recently, along with when we did it
+	seen      map[string]time.Time
+	lastPrune time.Time
+
+	blocks   chan BlockEvent
+	txs      chan *wire.MsgTx
+	removals chan chainhash.Hash
+	quit     chan struct{}
+}
+
+// NewFailover creates a source following the best of the nodes. The nodes are checked
+// every checkInterval, and a node behind the best tip for longer than staleAfter is
+// switched away from.
+func NewFailover(nodes []FailoverNode, checkInterval, staleAfter time.Duration) (*Failover, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodes to fail over between")
+	}
+
+	f := &Failover{
+		checkInterval: checkInterval,
+		staleAfter:    staleAfter,
+		seen:          make(map[string]time.Time),
+		blocks:        make(chan BlockEvent),
+		txs:           make(chan *wire.MsgTx),
+		quit:          make(chan struct{}),
+	}
+	for _, node := range nodes {
+		f.nodes = append(f.nodes, &failoverNode{FailoverNode: node})
+		if node.Source.MempoolRemovals() != nil {
+			f.removals = make(chan chainhash.Hash)
+		}
+	}
+	sort.SliceStable(f.nodes, func(i, j int) bool {
+		return f.nodes[i].Priority < f.nodes[j].Priority
+	})
+
+	return f, nil
+}
+
+func (f *Failover) Blocks() <-chan BlockEvent {
+	return f.blocks
+}
+
+func (f *Failover) Transactions() <-chan *wire.MsgTx {
+	return f.txs
+}
+
+// MempoolRemovals returns nil if none of the nodes can tell when transactions are removed
+// from the mempool
+func (f *Failover) MempoolRemovals() <-chan chainhash.Hash {
+	return f.removals
+}
+
+// Start starts every node, and picks the one to follow. Nodes failing to start are tried
+// again at every health check, but at least one has to start right away.
+func (f *Failover) Start() error {
+	f.check()
+
+	f.mu.Lock()
+	active := f.active
+	f.mu.Unlock()
+	if active == nil {
+		return errors.New("none of the nodes are available")
+	}
+
+	for _, node := range f.nodes {
+		go f.forward(node)
+	}
+	go f.run()
+
+	return nil
+}
+
+// Stop stops every node
+func (f *Failover) Stop() {
+	close(f.quit)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, node := range f.nodes {
+		if node.started {
+			node.Source.Stop()
+		}
+	}
+}
+
+// State returns the state of every node at the last health check
+func (f *Failover) State() []FailoverNodeState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	states := make([]FailoverNodeState, len(f.nodes))
+	for i, node := range f.nodes {
+		states[i] = FailoverNodeState{
+			Name:        node.Name,
+			Priority:    node.Priority,
+			Active:      node == f.active,
+			Healthy:     node.healthy,
+			Height:      node.height,
+			BehindSince: node.behindSince,
+		}
+	}
+	return states
+}
+
+// run health checks the nodes at an interval
+//
+// NOTE: This must be run as a goroutine.
+func (f *Failover) run() {
+	ticker := time.NewTicker(f.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-ticker.C:
+			f.check()
+		}
+	}
+}
+
+// check asks every node for its tip, starting the ones that aren't started yet, and
+// switches to another node if the active one is no longer fit to follow
+func (f *Failover) check() {
+	// the nodes are asked without holding the lock, so a slow node doesn't hold up the
+	// events of the others
+	type probe struct {
+		started, healthy bool
+		height           int64
+		hash             chainhash.Hash
+	}
+	probes := make([]probe, len(f.nodes))
+	for i, node := range f.nodes {
+		log := log.WithField("node", node.Name)
+
+		f.mu.Lock()
+		probes[i].started = node.started
+		f.mu.Unlock()
+
+		if !probes[i].started {
+			if err := node.Source.Start(); err != nil {
+				log.WithError(err).Error("could not start node")
+				continue
+			}
+			probes[i].started = true
+		}
+
+		height, hash, err := node.Source.BestBlock()
+		if err != nil {
+			log.WithError(err).Debug("node failed health check")
+			continue
+		}
+		probes[i].healthy, probes[i].height, probes[i].hash = true, height, hash
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	var best int64 = -1
+	for i, node := range f.nodes {
+		if node.healthy && !probes[i].healthy {
+			log.WithField("node", node.Name).Error("node failed health check")
+		}
+		node.started, node.healthy = probes[i].started, probes[i].healthy
+		if !node.healthy {
+			continue
+		}
+
+		node.height, node.hash = probes[i].height, probes[i].hash
+		if node.height > best {
+			best = node.height
+		}
+	}
+
+	for _, node := range f.nodes {
+		switch {
+		case !node.healthy, node.height >= best:
+			node.behindSince = time.Time{}
+		case node.behindSince.IsZero():
+			node.behindSince = now
+		}
+	}
+
+	// the active node is kept as long as it's healthy and hasn't been behind for too long,
+	// unless a node we prefer is at the best tip
+	activeFit := f.active != nil && f.active.healthy &&
+		(f.active.behindSince.IsZero() || now.Sub(f.active.behindSince) < f.staleAfter)
+
+	var candidate *failoverNode
+	for _, node := range f.nodes {
+		if node.atTip() {
+			candidate = node
+			break
+		}
+	}
+
+	switch {
+	case candidate == nil:
+		if !activeFit {
+			log.Error("none of the nodes are healthy")
+		}
+		return
+	case candidate == f.active:
+		return
+	case activeFit && candidate.Priority >= f.active.Priority:
+		return
+	}
+
+	if f.active != nil {
+		log.WithFields(logrus.Fields{
+			"from": f.active.Name,
+			"to":   candidate.Name,
+		}).Warn("switching to another node")
+	} else {
+		log.WithField("node", candidate.Name).Info("following node")
+	}
+
+	f.previous, f.active, f.switchedAt = f.active, candidate, now
+
+	// blocks connected while we were switching might never be forwarded, so we deliver
+	// the tip of the new node. The receiver notices any gap and catches up.
+	if f.previous != nil {
+		go f.deliverTip(candidate)
+	}
+}
+
+// deliverTip forwards the tip of the node to the block channel
+func (f *Failover) deliverTip(node *failoverNode) {
+	height, hash, err := node.Source.BestBlock()
+	if err == nil {
+		var block *wire.MsgBlock
+		block, err = node.Source.Block(hash)
+		if err == nil {
+			f.forwardBlock(BlockEvent{Block: block, Height: height})
+			return
+		}
+	}
+	log.WithField("node", node.Name).WithError(err).Error("could not get tip after switching")
+}
+
+// forwarding returns true if we're forwarding the events of the node
+func (f *Failover) forwarding(node *failoverNode) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return node == f.active || (node == f.previous && time.Since(f.switchedAt) < failoverOverlap)
+}
+
+// forward reads the events of the node, forwarding them if we're following it. The events
+// of the other nodes are read and dropped, so they don't block.
+//
+// NOTE: This must be run as a goroutine.
+func (f *Failover) forward(node *failoverNode) {
+	for {
+		select {
+		case <-f.quit:
+			return
+
+		case event := <-node.Source.Blocks():
+			if f.forwarding(node) {
+				f.forwardBlock(event)
+			}
+
+		case tx := <-node.Source.Transactions():
+			if !f.forwarding(node) {
+				continue
+			}
+			txid := tx.TxHash()
+			if f.firstTime("tx:"+txid.String(), "removal:"+txid.String()) {
+				f.txs <- tx
+			}
+
+		// a nil channel is never ready, so nodes without removals are skipped
+		case txid := <-node.Source.MempoolRemovals():
+			if f.forwarding(node) && f.firstTime("removal:"+txid.String(), "tx:"+txid.String()) {
+				f.removals <- txid
+			}
+		}
+	}
+}
+
+func (f *Failover) forwardBlock(event BlockEvent) {
+	hash := event.Block.BlockHash().String()
+	connected, disconnected := "block:"+hash, "disconnect:"+hash
+	if event.Disconnected {
+		connected, disconnected = disconnected, connected
+	}
+
+	if f.firstTime(connected, disconnected) {
+		f.blocks <- event
+	}
+}
+
+// firstTime returns true if we haven't forwarded the event recently, and remembers that
+// we have. The opposite event, e.g. the transaction leaving the mempool again, is
+// forgotten, so it's forwarded if it happens again.
+func (f *Failover) firstTime(key, opposite string) bool {
+	f.seenMu.Lock()
+	defer f.seenMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.lastPrune) > time.Minute {
+		for seen, at := range f.seen {
+			if now.Sub(at) > failoverDedupeWindow {
+				delete(f.seen, seen)
+			}
+		}
+		f.lastPrune = now
+	}
+
+	delete(f.seen, opposite)
+	if _, ok := f.seen[key]; ok {
+		return false
+	}
+	f.seen[key] = now
+	return true
+}
+
+// query asks the active node first, and then the others in order of priority, until one
+// of them answers
+func (f *Failover) query(do func(source ChainSource) error) error {
+	f.mu.Lock()
+	order := make([]*failoverNode, 0, len(f.nodes))
+	if f.active != nil {
+		order = append(order, f.active)
+	}
+	for _, node := range f.nodes {
+		if node != f.active && node.started {
+			order = append(order, node)
+		}
+	}
+	f.mu.Unlock()
+
+	err := errors.New("none of the nodes are available")
+	for _, node := range order {
+		if err = do(node.Source); err == nil {
+			return nil
+		}
+		log.WithField("node", node.Name).WithError(err).Debug("node could not answer query")
+	}
+	return err
+}
+
+func (f *Failover) BestBlock() (int64, chainhash.Hash, error) {
+	var height int64
+	var hash chainhash.Hash
+	err := f.query(func(source ChainSource) (err error) {
+		height, hash, err = source.BestBlock()
+		return err
+	})
+	return height, hash, err
+}
+
+func (f *Failover) BlockHash(height int64) (chainhash.Hash, error) {
+	var hash chainhash.Hash
+	err := f.query(func(source ChainSource) (err error) {
+		hash, err = source.BlockHash(height)
+		return err
+	})
+	return hash, err
+}
+
+func (f *Failover) Block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	var block *wire.MsgBlock
+	err := f.query(func(source ChainSource) (err error) {
+		block, err = source.Block(hash)
+		return err
+	})
+	return block, err
+}
+
+func (f *Failover) BlockHeader(hash chainhash.Hash) (*wire.BlockHeader, int64, error) {
+	var header *wire.BlockHeader
+	var height int64
+	err := f.query(func(source ChainSource) (err error) {
+		header, height, err = source.BlockHeader(hash)
+		return err
+	})
+	return header, height, err
+}
+
+func (f *Failover) MempoolTransaction(txid chainhash.Hash) (*wire.MsgTx, error) {
+	var tx *wire.MsgTx
+	err := f.query(func(source ChainSource) (err error) {
+		tx, err = source.MempoolTransaction(txid)
+		return err
+	})
+	return tx, err
+}
+
+func (f *Failover) Unspent(addresses []btcutil.Address) ([]Utxo, error) {
+	var utxos []Utxo
+	err := f.query(func(source ChainSource) (err error) {
+		utxos, err = source.Unspent(addresses)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list unspent outputs: %w", err)
+	}
+	return utxos, nil
+}
@@ -0,0 +1,216 @@
+package backend
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyFake is a fake chain we can take down. It counts how many times the failover asks
+// for its transactions, which happens once before every event it reads, so tests can wait
+// for the failover to be done with the events they caused.
+type flakyFake struct {
+	*Fake
+
+	mu    sync.Mutex
+	down  bool
+	polls int
+	// polled is signalled every time polls goes up
+	polled chan struct{}
+}
+
+func newFlakyFake() *flakyFake {
+	return &flakyFake{
+		Fake:   NewFake(chaincfg.RegressionNetParams),
+		polled: make(chan struct{}, 1),
+	}
+}
+
+func (f *flakyFake) Transactions() <-chan *wire.MsgTx {
+	f.mu.Lock()
+	f.polls++
+	f.mu.Unlock()
+
+	select {
+	case f.polled <- struct{}{}:
+	default:
+	}
+	return f.Fake.Transactions()
+}
+
+// handled returns how many events the failover is done with
+func (f *flakyFake) handled() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the first poll happens before any event is read
+	return f.polls - 1
+}
+
+// waitHandled waits until the failover is done with the given number of events
+func (f *flakyFake) waitHandled(t *testing.T, events int) {
+	for f.handled() < events {
+		select {
+		case <-f.polled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("failover handled %d events, expected %d", f.handled(), events)
+		}
+	}
+}
+
+func (f *flakyFake) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flakyFake) BestBlock() (int64, chainhash.Hash, error) {
+	f.mu.Lock()
+	down := f.down
+	f.mu.Unlock()
+	if down {
+		return 0, chainhash.Hash{}, errors.New("connection refused")
+	}
+	return f.Fake.BestBlock()
+}
+
+func receiveBlock(t *testing.T, blocks <-chan BlockEvent) BlockEvent {
+	select {
+	case event := <-blocks:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("block was not delivered")
+		return BlockEvent{}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	primary := newFlakyFake()
+	secondary := newFlakyFake()
+
+	// the health checks are run by hand
+	failover, err := NewFailover([]FailoverNode{
+		{Name: "secondary", Priority: 2, Source: secondary},
+		{Name: "primary", Priority: 1, Source: primary},
+	}, time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, failover.Start())
+	defer failover.Stop()
+	// wait for the failover to start reading the events of both nodes
+	primary.waitHandled(t, 0)
+	secondary.waitHandled(t, 0)
+
+	active := func() string {
+		for _, node := range failover.State() {
+			if node.Active {
+				return node.Name
+			}
+		}
+		return ""
+	}
+
+	t.Run("follows the node with the best priority", func(t *testing.T) {
+		assert.Equal(t, "primary", active())
+	})
+
+	t.Run("forwards blocks seen by both nodes once", func(t *testing.T) {
+		handled := secondary.handled()
+		block := primary.Mine()
+		secondary.Mine()
+
+		event := receiveBlock(t, failover.Blocks())
+		assert.Equal(t, block.BlockHash(), event.Block.BlockHash())
+		assert.Equal(t, int64(1), event.Height)
+
+		// the secondary block is dropped, as we're not following it
+		secondary.waitHandled(t, handled+1)
+		assert.Empty(t, failover.blocks)
+	})
+
+	t.Run("ignores transactions from other nodes", func(t *testing.T) {
+		handled := secondary.handled()
+		secondary.Broadcast(mockTx(1))
+		tx := mockTx(2)
+		primary.Broadcast(tx)
+
+		select {
+		case received := <-failover.Transactions():
+			assert.Equal(t, tx.TxHash(), received.TxHash())
+		case <-time.After(5 * time.Second):
+			t.Fatal("transaction was not delivered")
+		}
+		// the dropped transaction has to be handled before we switch over to the secondary,
+		// otherwise it would be forwarded once we follow it
+		secondary.waitHandled(t, handled+1)
+	})
+
+	t.Run("switches over when the active node goes down", func(t *testing.T) {
+		primary.setDown(true)
+		failover.check()
+		assert.Equal(t, "secondary", active())
+
+		// we deliver the tip of the new node, which we've already forwarded
+		block := secondary.Mine()
+		event := receiveBlock(t, failover.Blocks())
+		assert.Equal(t, block.BlockHash(), event.Block.BlockHash())
+	})
+
+	t.Run("switches back once the preferred node catches up", func(t *testing.T) {
+		primary.setDown(false)
+		failover.check()
+		assert.Equal(t, "secondary", active(), "the primary is behind")
+
+		primary.Mine()
+		failover.check()
+		assert.Equal(t, "primary", active())
+
+		// both nodes deliver the block during the switch, but it's only forwarded once
+		handled := secondary.handled()
+		block := primary.Mine()
+		secondary.Mine()
+		event := receiveBlock(t, failover.Blocks())
+		assert.Equal(t, block.BlockHash(), event.Block.BlockHash())
+		secondary.waitHandled(t, handled+1)
+		assert.Empty(t, failover.blocks)
+	})
+
+	t.Run("keeps a node that is briefly behind", func(t *testing.T) {
+		secondary.Mine()
+		<-failover.Blocks()
+		failover.check()
+		assert.Equal(t, "primary", active())
+
+		for _, node := range failover.State() {
+			if node.Name == "primary" {
+				assert.False(t, node.BehindSince.IsZero())
+			}
+		}
+	})
+
+	t.Run("switches over when the active node stays behind", func(t *testing.T) {
+		failover.mu.Lock()
+		failover.active.behindSince = time.Now().Add(-2 * time.Minute)
+		failover.mu.Unlock()
+
+		failover.check()
+		assert.Equal(t, "secondary", active())
+	})
+}
+
+func TestFailoverDedupe(t *testing.T) {
+	failover, err := NewFailover([]FailoverNode{{Source: NewFake(chaincfg.RegressionNetParams)}}, time.Hour, time.Minute)
+	require.NoError(t, err)
+
+	assert.True(t, failover.firstTime("tx:a", "removal:a"))
+	assert.False(t, failover.firstTime("tx:a", "removal:a"))
+
+	// the transaction leaving the mempool and entering it again is forwarded
+	assert.True(t, failover.firstTime("removal:a", "tx:a"))
+	assert.True(t, failover.firstTime("tx:a", "removal:a"))
+}
@@ -0,0 +1,263 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// fakeBuffer is how many events of each kind the fake holds on to before blocking
+const fakeBuffer = 100
+
+// Fake is an in-memory chain for unit tests. Tests mine blocks, reorg them out and add
+// transactions to the mempool, and the fake delivers the events once it is started.
+type Fake struct {
+	mu sync.Mutex
+
+	network chaincfg.Params
+	// chain is the best chain, indexed by height
+	chain []*wire.MsgBlock
+	// known is every block ever mined, including the ones reorged out
+	known       map[chainhash.Hash]*wire.MsgBlock
+	heights     map[chainhash.Hash]int64
+	unconfirmed map[chainhash.Hash]*wire.MsgTx
+	// mined makes blocks mined on top of the same block differ
+	mined uint32
+	// started is set once Start is called, events are only delivered after that
+	started bool
+
+	blocks   chan BlockEvent
+	txs      chan *wire.MsgTx
+	removals chan chainhash.Hash
+}
+
+// NewFake creates a fake chain consisting of the genesis block of the network
+func NewFake(network chaincfg.Params) *Fake {
+	genesis := network.GenesisBlock
+	return &Fake{
+		network:     network,
+		chain:       []*wire.MsgBlock{genesis},
+		known:       map[chainhash.Hash]*wire.MsgBlock{*network.GenesisHash: genesis},
+		heights:     map[chainhash.Hash]int64{*network.GenesisHash: 0},
+		unconfirmed: make(map[chainhash.Hash]*wire.MsgTx),
+		blocks:      make(chan BlockEvent, fakeBuffer),
+		txs:         make(chan *wire.MsgTx, fakeBuffer),
+		removals:    make(chan chainhash.Hash, fakeBuffer),
+	}
+}
+
+func (f *Fake) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.started = true
+	return nil
+}
+
+func (f *Fake) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.started = false
+}
+
+func (f *Fake) Blocks() <-chan BlockEvent {
+	return f.blocks
+}
+
+func (f *Fake) Transactions() <-chan *wire.MsgTx {
+	return f.txs
+}
+
+func (f *Fake) MempoolRemovals() <-chan chainhash.Hash {
+	return f.removals
+}
+
+// Mine adds a block with the transactions on top of the best chain. The transactions are
+// removed from the mempool.
+func (f *Fake) Mine(txs ...*wire.MsgTx) *wire.MsgBlock {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tip := f.chain[len(f.chain)-1]
+	f.mined++
+	block := wire.NewMsgBlock(wire.NewBlockHeader(tip.Header.Version, &chainhash.Hash{}, &chainhash.Hash{},
+		tip.Header.Bits, f.mined))
+	block.Header.PrevBlock = tip.BlockHash()
+	block.Header.Timestamp = tip.Header.Timestamp.Add(10 * time.Minute)
+
+	for _, tx := range txs {
+		if err := block.AddTransaction(tx); err != nil {
+			panic(err)
+		}
+		delete(f.unconfirmed, tx.TxHash())
+	}
+
+	height := int64(len(f.chain))
+	hash := block.BlockHash()
+	f.chain = append(f.chain, block)
+	f.known[hash] = block
+	f.heights[hash] = height
+
+	if f.started {
+		f.blocks <- BlockEvent{Block: block, Height: height}
+	}
+	return block
+}
+
+// Disconnect removes the tip of the best chain. Its transactions are not put back in the
+// mempool.
+func (f *Fake) Disconnect() *wire.MsgBlock {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.chain) == 1 {
+		panic("cannot disconnect the genesis block")
+	}
+
+	height := int64(len(f.chain) - 1)
+	block := f.chain[height]
+	f.chain = f.chain[:height]
+
+	if f.started {
+		f.blocks <- BlockEvent{Block: block, Height: height, Disconnected: true}
+	}
+	return block
+}
+
+// Broadcast adds the transaction to the mempool
+func (f *Fake) Broadcast(tx *wire.MsgTx) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.unconfirmed[tx.TxHash()] = tx
+	if f.started {
+		f.txs <- tx
+	}
+}
+
+// Evict removes the transaction from the mempool without confirming it
+func (f *Fake) Evict(txid chainhash.Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.unconfirmed[txid]; !ok {
+		return
+	}
+
+	delete(f.unconfirmed, txid)
+	if f.started {
+		f.removals <- txid
+	}
+}
+
+func (f *Fake) BestBlock() (int64, chainhash.Hash, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	height := len(f.chain) - 1
+	return int64(height), f.chain[height].BlockHash(), nil
+}
+
+func (f *Fake) BlockHash(height int64) (chainhash.Hash, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if height < 0 || height >= int64(len(f.chain)) {
+		return chainhash.Hash{}, fmt.Errorf("no block at height %d", height)
+	}
+	return f.chain[height].BlockHash(), nil
+}
+
+func (f *Fake) Block(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	block, ok := f.known[hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown block %s", hash)
+	}
+	return block, nil
+}
+
+func (f *Fake) BlockHeader(hash chainhash.Hash) (*wire.BlockHeader, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	block, ok := f.known[hash]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown block %s", hash)
+	}
+	return &block.Header, f.heights[hash], nil
+}
+
+func (f *Fake) MempoolTransaction(txid chainhash.Hash) (*wire.MsgTx, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tx, ok := f.unconfirmed[txid]
+	if !ok {
+		return nil, errors.New("transaction not in mempool")
+	}
+	return tx, nil
+}
+
+func (f *Fake) mempool() ([]chainhash.Hash, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var txids []chainhash.Hash
+	for txid := range f.unconfirmed {
+		txids = append(txids, txid)
+	}
+	return txids, nil
+}
+
+// Unspent goes through the best chain, finding the outputs paying to the addresses that
+// are not spent in a later block
+func (f *Fake) Unspent(addresses []btcutil.Address) ([]Utxo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	watched := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		watched[address.String()] = true
+	}
+
+	var unspent []Utxo
+	for height, block := range f.chain {
+		for _, tx := range block.Transactions {
+			for _, input := range tx.TxIn {
+				for i, utxo := range unspent {
+					if utxo.Outpoint == input.PreviousOutPoint {
+						unspent = append(unspent[:i], unspent[i+1:]...)
+						break
+					}
+				}
+			}
+
+			for vout, output := range tx.TxOut {
+				_, paysTo, _, err := txscript.ExtractPkScriptAddrs(output.PkScript, &f.network)
+				if err != nil || len(paysTo) != 1 || !watched[paysTo[0].String()] {
+					continue
+				}
+
+				unspent = append(unspent, Utxo{
+					Outpoint: wire.OutPoint{Hash: tx.TxHash(), Index: uint32(vout)},
+					Address:  paysTo[0].String(),
+					Amount:   btcutil.Amount(output.Value),
+					Height:   int64(height),
+				})
+			}
+		}
+	}
+
+	return unspent, nil
+}
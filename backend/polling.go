@@ -0,0 +1,276 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// maxPollDepth is how many blocks the polling source remembers, and how far back it
+// looks for a fork when the tip changes
+const maxPollDepth = 100
+
+// pollable is a node we can poll for changes
+type pollable interface {
+	BestBlock() (int64, chainhash.Hash, error)
+	BlockHash(height int64) (chainhash.Hash, error)
+	Block(hash chainhash.Hash) (*wire.MsgBlock, error)
+	BlockHeader(hash chainhash.Hash) (*wire.BlockHeader, int64, error)
+	MempoolTransaction(txid chainhash.Hash) (*wire.MsgTx, error)
+	Unspent(addresses []btcutil.Address) ([]Utxo, error)
+
+	// mempool lists the txids of the mempool transactions we're interested in
+	mempool() ([]chainhash.Hash, error)
+}
+
+// pusher is implemented by nodes that tell us when something changed, so we don't have to
+// wait for the next poll to notice
+type pusher interface {
+	changes() <-chan struct{}
+}
+
+// blockRef identifies a block on the chain
+type blockRef struct {
+	height int64
+	hash   chainhash.Hash
+}
+
+// Polling asks a node for changes to the chain and mempool at an interval. It's used for
+// bitcoind nodes without ZMQ and for Esplora, and notices everything a bit later than the
+// Zmq source.
+type Polling struct {
+	pollable
+
+	interval time.Duration
+
+	// chain is the most recent blocks we have delivered, lowest first. It's empty until
+	// the first poll.
+	chain []blockRef
+	// mempoolTxs is the mempool as of the last poll. It's nil until the first poll.
+	mempoolTxs map[chainhash.Hash]bool
+
+	blocks   chan BlockEvent
+	txs      chan *wire.MsgTx
+	removals chan chainhash.Hash
+	quit     chan struct{}
+}
+
+// NewPolling connects to bitcoind RPC, and polls it once started
+func NewPolling(conf BitcoindConfig, interval time.Duration) (*Polling, error) {
+	node, err := dialBitcoind(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPolling(node, interval), nil
+}
+
+func newPolling(node pollable, interval time.Duration) *Polling {
+	return &Polling{
+		pollable: node,
+		interval: interval,
+		blocks:   make(chan BlockEvent),
+		txs:      make(chan *wire.MsgTx),
+		removals: make(chan chainhash.Hash),
+		quit:     make(chan struct{}),
+	}
+}
+
+func (p *Polling) Blocks() <-chan BlockEvent {
+	return p.blocks
+}
+
+func (p *Polling) Transactions() <-chan *wire.MsgTx {
+	return p.txs
+}
+
+func (p *Polling) MempoolRemovals() <-chan chainhash.Hash {
+	return p.removals
+}
+
+// Start takes note of the current tip and mempool, and starts polling for changes
+func (p *Polling) Start() error {
+	if _, err := p.pollBlocks(); err != nil {
+		return err
+	}
+	if err := p.pollMempool(nil); err != nil {
+		return err
+	}
+
+	log.WithField("interval", p.interval).Info("started polling for changes")
+	go p.run()
+
+	return nil
+}
+
+// Stop stops polling
+func (p *Polling) Stop() {
+	close(p.quit)
+
+	// nodes keeping a connection open are disconnected as well
+	if node, ok := p.pollable.(io.Closer); ok {
+		if err := node.Close(); err != nil {
+			log.WithError(err).Error("could not close connection to node")
+		}
+	}
+}
+
+// NOTE: This must be run as a goroutine.
+func (p *Polling) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	// a nil channel never delivers, so nodes that don't push are only polled on the ticker
+	var changes <-chan struct{}
+	if node, ok := p.pollable.(pusher); ok {
+		changes = node.changes()
+	}
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		case <-changes:
+		}
+
+		if err := p.poll(); err != nil {
+			log.WithError(err).Error("could not poll for changes")
+		}
+	}
+}
+
+// poll delivers every change since the last poll
+func (p *Polling) poll() error {
+	confirmed, err := p.pollBlocks()
+	if err != nil {
+		return err
+	}
+
+	return p.pollMempool(confirmed)
+}
+
+// known checks if the block is one we have delivered
+func (p *Polling) known(block blockRef) bool {
+	for _, delivered := range p.chain {
+		if delivered == block {
+			return true
+		}
+	}
+	return false
+}
+
+// remember adds the block to the chain we have delivered
+func (p *Polling) remember(block blockRef) {
+	p.chain = append(p.chain, block)
+	if len(p.chain) > maxPollDepth {
+		p.chain = p.chain[len(p.chain)-maxPollDepth:]
+	}
+}
+
+// pollBlocks delivers the blocks connected and disconnected since the last poll. It returns
+// the txids of the transactions confirmed in the connected blocks.
+func (p *Polling) pollBlocks() (map[chainhash.Hash]bool, error) {
+	height, hash, err := p.BestBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the first poll is our starting point, there's nothing to compare it to
+	if len(p.chain) == 0 {
+		p.remember(blockRef{height: height, hash: hash})
+		return nil, nil
+	}
+
+	tip := p.chain[len(p.chain)-1]
+	if tip.hash == hash {
+		return nil, nil
+	}
+
+	// walk backwards from the new tip until we reach a block we have delivered. These
+	// are collected highest first.
+	var connected []BlockEvent
+	cursor := blockRef{height: height, hash: hash}
+	for !p.known(cursor) {
+		block, err := p.Block(cursor.hash)
+		if err != nil {
+			return nil, err
+		}
+		connected = append(connected, BlockEvent{Block: block, Height: cursor.height})
+
+		// we've been gone for a long time, or the reorg is deeper than we can tell. We
+		// only deliver the new tip, and leave it to the receiver to catch up.
+		if len(connected) > maxPollDepth {
+			log.WithField("height", height).Warn("could not find fork point, only delivering the new tip")
+			connected = connected[:1]
+			p.chain = nil
+			break
+		}
+
+		cursor = blockRef{height: cursor.height - 1, hash: block.Header.PrevBlock}
+	}
+
+	// our blocks above the fork point were disconnected, highest first
+	for len(p.chain) > 0 && p.chain[len(p.chain)-1] != cursor {
+		stale := p.chain[len(p.chain)-1]
+		p.chain = p.chain[:len(p.chain)-1]
+
+		block, err := p.Block(stale.hash)
+		if err != nil {
+			return nil, fmt.Errorf("could not get disconnected block: %w", err)
+		}
+		p.blocks <- BlockEvent{Block: block, Height: stale.height, Disconnected: true}
+	}
+
+	confirmed := make(map[chainhash.Hash]bool)
+	for i := len(connected) - 1; i >= 0; i-- {
+		for _, tx := range connected[i].Block.Transactions {
+			confirmed[tx.TxHash()] = true
+		}
+
+		p.remember(blockRef{height: connected[i].Height, hash: connected[i].Block.BlockHash()})
+		p.blocks <- connected[i]
+	}
+
+	return confirmed, nil
+}
+
+// pollMempool delivers the transactions that entered and left the mempool since the last
+// poll. Transactions confirmed in a block are not considered removed.
+func (p *Polling) pollMempool(confirmed map[chainhash.Hash]bool) error {
+	txids, err := p.mempool()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[chainhash.Hash]bool, len(txids))
+	for _, txid := range txids {
+		current[txid] = true
+
+		// the first poll is our starting point
+		if p.mempoolTxs == nil || p.mempoolTxs[txid] {
+			continue
+		}
+
+		tx, err := p.MempoolTransaction(txid)
+		if err != nil {
+			// it might have left the mempool since we listed it
+			log.WithField("txid", txid).WithError(err).Debug("could not get mempool transaction")
+			continue
+		}
+		p.txs <- tx
+	}
+
+	for txid := range p.mempoolTxs {
+		if !current[txid] && !confirmed[txid] {
+			p.removals <- txid
+		}
+	}
+
+	p.mempoolTxs = current
+	return nil
+}
@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockTx creates a transaction spending a made up output
+func mockTx(seed byte) *wire.MsgTx {
+	var tx wire.MsgTx
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.DoubleHashH([]byte{seed})}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(50_000, nil))
+	return &tx
+}
+
+func TestPolling(t *testing.T) {
+	node := NewFake(chaincfg.RegressionNetParams)
+	node.Mine()
+	pending := mockTx(1)
+	node.Broadcast(pending)
+
+	polling := newPolling(node, 0)
+	// buffered, so we can poll without anyone listening
+	polling.blocks = make(chan BlockEvent, fakeBuffer)
+	polling.txs = make(chan *wire.MsgTx, fakeBuffer)
+	polling.removals = make(chan chainhash.Hash, fakeBuffer)
+
+	_, err := polling.pollBlocks()
+	require.NoError(t, err)
+	require.NoError(t, polling.pollMempool(nil))
+
+	t.Run("first poll delivers nothing", func(t *testing.T) {
+		assert.Empty(t, polling.blocks)
+		assert.Empty(t, polling.txs)
+		assert.Empty(t, polling.removals)
+	})
+
+	t.Run("delivers new transactions and removals", func(t *testing.T) {
+		arrived := mockTx(2)
+		node.Broadcast(arrived)
+		node.Evict(pending.TxHash())
+		require.NoError(t, polling.poll())
+
+		require.Len(t, polling.txs, 1)
+		assert.Equal(t, arrived.TxHash(), (<-polling.txs).TxHash())
+		require.Len(t, polling.removals, 1)
+		assert.Equal(t, pending.TxHash(), <-polling.removals)
+	})
+
+	t.Run("confirmed transactions are not removals", func(t *testing.T) {
+		confirmed := mockTx(3)
+		node.Broadcast(confirmed)
+		require.NoError(t, polling.poll())
+		<-polling.txs
+
+		block := node.Mine(confirmed)
+		require.NoError(t, polling.poll())
+
+		require.Len(t, polling.blocks, 1)
+		event := <-polling.blocks
+		assert.Equal(t, block.BlockHash(), event.Block.BlockHash())
+		assert.Equal(t, int64(2), event.Height)
+		assert.False(t, event.Disconnected)
+		assert.Empty(t, polling.removals)
+	})
+
+	t.Run("delivers reorgs", func(t *testing.T) {
+		stale := node.Mine()
+		require.NoError(t, polling.poll())
+		<-polling.blocks
+
+		node.Disconnect()
+		first, second := node.Mine(), node.Mine()
+		require.NoError(t, polling.poll())
+
+		require.Len(t, polling.blocks, 3)
+		disconnected := <-polling.blocks
+		assert.True(t, disconnected.Disconnected)
+		assert.Equal(t, stale.BlockHash(), disconnected.Block.BlockHash())
+
+		for i, block := range []*wire.MsgBlock{first, second} {
+			event := <-polling.blocks
+			assert.False(t, event.Disconnected)
+			assert.Equal(t, int64(3+i), event.Height)
+			assert.Equal(t, block.BlockHash(), event.Block.BlockHash())
+		}
+	})
+}
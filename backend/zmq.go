@@ -0,0 +1,639 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/lightninglabs/gozmq"
+)
+
+const (
+	// zmqTimeout is how long gozmq waits for the rest of a message once it has started
+	// arriving
+	zmqTimeout = time.Second
+	// zmqMinBackoff and zmqMaxBackoff bound how long we wait between attempts to
+	// resubscribe to a ZMQ channel
+	zmqMinBackoff = time.Second
+	zmqMaxBackoff = time.Minute
+)
+
+// ZmqConfig contains what we need to connect to bitcoind ZMQ channels
+type ZmqConfig struct {
+	Transactions int
+	Blocks       int
+	// Sequence is optional, as it's only needed to notice transactions being dropped
+	// from the mempool
+	Sequence int
+
+	// AlertAfter is how long a subscription can be down before we raise an alert
+	AlertAfter time.Duration
+	// Alert is called when a subscription has been down for AlertAfter, and again once
+	// it's back up. It's optional.
+	Alert func(subject, message string)
+
+	// MempoolTxids lists the watched transactions we've seen entering the mempool, and
+	// expect to still be there. It's used to notice removals we might have missed, and is
+	// optional.
+	MempoolTxids func() []chainhash.Hash
+}
+
+// ZmqState is the state of one of the ZMQ subscriptions
+type ZmqState struct {
+	Topic     string
+	Connected bool
+	// Since is when the subscription last connected or disconnected
+	Since time.Time
+	// Reconnects is how many times we've had to resubscribe
+	Reconnects int
+	// Gaps is how many times we've noticed messages missing from the subscription
+	Gaps int
+}
+
+// zmqSubscription is a ZMQ subscription kept alive by the supervisor
+type zmqSubscription struct {
+	topic string
+	url   string
+	// handle is called with every message received
+	handle func(msg [][]byte)
+	// resync is called when we might have missed messages: after we've resubscribed, and
+	// when there's a gap in the sequence numbers. It's optional.
+	resync func()
+
+	mu         sync.Mutex
+	conn       *gozmq.Conn
+	connected  bool
+	since      time.Time
+	reconnects int
+	gaps       int
+	// sequence is the sequence number of the last message received, if haveSequence is set
+	sequence     uint32
+	haveSequence bool
+	// alerted is set if we've raised an alert for the current outage
+	alerted bool
+}
+
+// up marks the subscription as connected, returning how long it was down for
+func (s *zmqSubscription) up(conn *gozmq.Conn, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var downFor time.Duration
+	if !s.since.IsZero() {
+		downFor = now.Sub(s.since)
+		s.reconnects++
+	}
+	s.conn = conn
+	s.connected = true
+	s.since = now
+	s.haveSequence = false
+	return downFor
+}
+
+// checkSequence records the sequence number bitcoind gave the message, returning false
+// if we've missed any messages since the last one
+func (s *zmqSubscription) checkSequence(sequence uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// bitcoind counts messages per topic, wrapping around at the end
+	inOrder := !s.haveSequence || sequence == s.sequence+1
+	if !inOrder {
+		s.gaps++
+	}
+	s.sequence = sequence
+	s.haveSequence = true
+	return inOrder
+}
+
+// down marks the subscription as disconnected, unless it already is
+func (s *zmqSubscription) down(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.connected {
+		return
+	}
+	s.connected = false
+	s.since = now
+	s.alerted = false
+}
+
+// shouldAlert returns true the first time we notice the subscription has been down for
+// longer than alertAfter
+func (s *zmqSubscription) shouldAlert(now time.Time, alertAfter time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connected || s.alerted || alertAfter <= 0 || now.Sub(s.since) < alertAfter {
+		return false
+	}
+	s.alerted = true
+	return true
+}
+
+// recovered returns true if we raised an alert for the outage that just ended
+func (s *zmqSubscription) recovered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alerted := s.alerted
+	s.alerted = false
+	return alerted
+}
+
+func (s *zmqSubscription) state() ZmqState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return ZmqState{
+		Topic:      s.topic,
+		Connected:  s.connected,
+		Since:      s.since,
+		Reconnects: s.reconnects,
+		Gaps:       s.gaps,
+	}
+}
+
+// close closes the current connection, if any
+func (s *zmqSubscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+	if err := s.conn.Close(); err != nil {
+		log.WithError(err).Errorf("could not close ZMQ %s connection", s.topic)
+	}
+	s.conn = nil
+}
+
+// Zmq gets blocks and transactions pushed from bitcoind over ZMQ, and queries bitcoind
+// RPC for everything else. Each ZMQ channel is supervised, and resubscribed to if the
+// connection drops.
+type Zmq struct {
+	*bitcoind
+
+	zmqConfig ZmqConfig
+
+	// subscriptions are the block, transaction and (if configured) sequence
+	// subscriptions. We use one connection for each as a separation of concern to
+	// ensure one type of event isn't dropped from the connection queue due to another
+	// type of event filling it up.
+	subscriptions []*zmqSubscription
+
+	blocks   chan BlockEvent
+	txs      chan *wire.MsgTx
+	removals chan chainhash.Hash
+	quit     chan struct{}
+
+	seenMu sync.Mutex
+	// seen are the transactions in the mempool we've delivered, or that were there when we
+	// started. Resynchronizing delivers the ones in the mempool we haven't seen.
+	seen map[chainhash.Hash]bool
+}
+
+// NewZmq connects to bitcoind RPC. The ZMQ connections are established on Start.
+func NewZmq(conf BitcoindConfig, zmqConfig ZmqConfig) (*Zmq, error) {
+	node, err := dialBitcoind(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	z := &Zmq{
+		bitcoind:  node,
+		zmqConfig: zmqConfig,
+		blocks:    make(chan BlockEvent),
+		txs:       make(chan *wire.MsgTx),
+		quit:      make(chan struct{}),
+		seen:      make(map[chainhash.Hash]bool),
+	}
+
+	url := func(port int) string {
+		return fmt.Sprintf("tcp://%s:%d", conf.RpcHost, port)
+	}
+	z.subscriptions = []*zmqSubscription{
+		{
+			topic:  "rawblock",
+			url:    url(zmqConfig.Blocks),
+			handle: z.handleBlock,
+			// missed blocks are never published again, so we deliver the current tip.
+			// The receiver notices the gap and catches up from the last block it knows.
+			resync: z.deliverTip,
+		},
+		{
+			topic:  "rawtx",
+			url:    url(zmqConfig.Transactions),
+			handle: z.handleTx,
+			// missed transactions are never published again. We catch up on blocks in case
+			// any of them confirmed, and deliver the ones still in the mempool. Transactions
+			// that left the mempool for other reasons in the meantime are lost, so we let the
+			// operator know.
+			resync: func() {
+				z.alert("ZMQ transactions were missed",
+					fmt.Sprintf("We might have missed transactions published over ZMQ rawtx at %s. "+
+						"Transactions that entered and were dropped from the mempool in the meantime "+
+						"can't be recovered.", url(zmqConfig.Transactions)))
+				z.deliverTip()
+				z.resyncMempool()
+			},
+		},
+	}
+	if zmqConfig.Sequence != 0 {
+		z.removals = make(chan chainhash.Hash)
+		z.subscriptions = append(z.subscriptions, &zmqSubscription{
+			topic:  "sequence",
+			url:    url(zmqConfig.Sequence),
+			handle: z.handleSequence,
+			resync: z.resyncMempool,
+		})
+	}
+
+	return z, nil
+}
+
+func (z *Zmq) Blocks() <-chan BlockEvent {
+	return z.blocks
+}
+
+func (z *Zmq) Transactions() <-chan *wire.MsgTx {
+	return z.txs
+}
+
+// MempoolRemovals returns nil if no sequence port is configured
+func (z *Zmq) MempoolRemovals() <-chan chainhash.Hash {
+	return z.removals
+}
+
+// State returns the state of every ZMQ subscription
+func (z *Zmq) State() []ZmqState {
+	states := make([]ZmqState, len(z.subscriptions))
+	for i, subscription := range z.subscriptions {
+		states[i] = subscription.state()
+	}
+	return states
+}
+
+// Start establishes the ZMQ connections to bitcoind, and spawns a goroutine supervising
+// each of them. Failing to connect at first is an error, as it's most likely caused by
+// a misconfiguration. After that we keep trying to reconnect.
+func (z *Zmq) Start() error {
+	for _, subscription := range z.subscriptions {
+		conn, err := gozmq.Subscribe(subscription.url, []string{subscription.topic}, zmqTimeout)
+		if err != nil {
+			for _, started := range z.subscriptions {
+				started.close()
+			}
+			return fmt.Errorf("gozmq.Subscribe %s: %w", subscription.topic, err)
+		}
+		subscription.up(conn, time.Now())
+	}
+
+	// the transactions already in the mempool are not ours to deliver
+	mempool, err := z.mempool()
+	if err != nil {
+		log.WithError(err).Warn("could not list mempool, resynchronizing will deliver all of it")
+	}
+	z.seenMu.Lock()
+	for _, txid := range mempool {
+		z.seen[txid] = true
+	}
+	z.seenMu.Unlock()
+
+	for _, subscription := range z.subscriptions {
+		go z.supervise(subscription)
+	}
+
+	if z.removals == nil {
+		log.Warn("no ZMQ sequence port configured, transactions dropped from the mempool won't be noticed")
+	}
+
+	return nil
+}
+
+// Stop closes the ZMQ connections
+func (z *Zmq) Stop() {
+	close(z.quit)
+	for _, subscription := range z.subscriptions {
+		subscription.close()
+	}
+}
+
+func (z *Zmq) stopped() bool {
+	select {
+	case <-z.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// supervise reads from the subscription until the connection drops, and then
+// resubscribes with an increasing backoff. If the subscription stays down for longer than
+// configured, we raise an alert.
+//
+// NOTE: This must be run as a goroutine.
+func (z *Zmq) supervise(subscription *zmqSubscription) {
+	log := log.WithField("topic", subscription.topic)
+	log.Info("started listening for ZMQ notifications")
+
+	for {
+		subscription.mu.Lock()
+		conn := subscription.conn
+		subscription.mu.Unlock()
+
+		if conn != nil {
+			z.receiveAll(subscription, conn)
+		}
+		if z.stopped() {
+			return
+		}
+
+		subscription.down(time.Now())
+		subscription.close()
+		log.Error("lost ZMQ connection, resubscribing")
+
+		conn, ok := z.resubscribe(subscription)
+		if !ok {
+			return
+		}
+
+		downFor := subscription.up(conn, time.Now())
+		if z.stopped() {
+			// we might have been stopped right as we resubscribed
+			subscription.close()
+			return
+		}
+		log.WithField("downFor", downFor).Info("resubscribed to ZMQ")
+		if subscription.recovered() {
+			z.alert(fmt.Sprintf("ZMQ %s subscription is back up", subscription.topic),
+				fmt.Sprintf("We resubscribed to ZMQ %s at %s after being disconnected for %s.",
+					subscription.topic, subscription.url, downFor.Round(time.Second)))
+		}
+		if subscription.resync != nil {
+			subscription.resync()
+		}
+	}
+}
+
+// resubscribe tries subscribing until it succeeds, returning false if we're stopped in
+// the meantime
+func (z *Zmq) resubscribe(subscription *zmqSubscription) (*gozmq.Conn, bool) {
+	backoff := zmqMinBackoff
+	for {
+		select {
+		case <-z.quit:
+			return nil, false
+		case <-time.After(backoff):
+		}
+
+		conn, err := gozmq.Subscribe(subscription.url, []string{subscription.topic}, zmqTimeout)
+		if err == nil {
+			return conn, true
+		}
+
+		log.WithField("topic", subscription.topic).WithField("backoff", backoff).WithError(err).
+			Warn("could not resubscribe to ZMQ")
+
+		if subscription.shouldAlert(time.Now(), z.zmqConfig.AlertAfter) {
+			state := subscription.state()
+			z.alert(fmt.Sprintf("ZMQ %s subscription is down", subscription.topic),
+				fmt.Sprintf("We've been unable to subscribe to ZMQ %s at %s since %s. "+
+					"No notifications relying on it are sent until it's back up.\n\nLast error: %s",
+					subscription.topic, subscription.url, state.Since.Format(time.RFC3339), err))
+		}
+
+		backoff *= 2
+		if backoff > zmqMaxBackoff {
+			backoff = zmqMaxBackoff
+		}
+	}
+}
+
+func (z *Zmq) alert(subject, message string) {
+	log.WithField("subject", subject).Warn("raising operator alert")
+	if z.zmqConfig.Alert != nil {
+		z.zmqConfig.Alert(subject, message)
+	}
+}
+
+// receiveAll hands every message received to the subscription, until the connection
+// drops or is closed
+func (z *Zmq) receiveAll(subscription *zmqSubscription, conn *gozmq.Conn) {
+	for {
+		msgBytes, err := conn.Receive(nil)
+		if err != nil {
+			// gozmq tries to reconnect by itself when the connection drops, and tells us
+			// about it with a timeout error. We'd rather resubscribe ourselves, so we know
+			// the connection is down. Other timeouts only happen mid message, which leaves
+			// the stream in an unknown state anyway.
+			if err != io.EOF && !z.stopped() {
+				log.WithField("topic", subscription.topic).WithError(err).Error("unable to receive ZMQ message")
+			}
+			return
+		}
+
+		// It's possible that the message wasn't fully read if bitcoind shuts down,
+		// which will produce an unreadable event type. To prevent from logging it,
+		// we'll make sure it conforms to the ASCII standard.
+		eventType := string(msgBytes[0])
+		if eventType == "" {
+			continue
+		}
+		if eventType != subscription.topic || len(msgBytes) < 2 {
+			log.WithField("eventType", eventType).
+				Warnf("Received unexpected event type from %s subscription", subscription.topic)
+			continue
+		}
+
+		// bitcoind numbers the messages of every topic, so we can tell if any were dropped,
+		// e.g. because we didn't keep up and hit the high water mark
+		if len(msgBytes) >= 3 && len(msgBytes[2]) == 4 {
+			sequence := binary.LittleEndian.Uint32(msgBytes[2])
+			if !subscription.checkSequence(sequence) {
+				log.WithField("topic", subscription.topic).WithField("sequence", sequence).
+					Error("missed ZMQ messages, resynchronizing")
+				if subscription.resync != nil {
+					subscription.resync()
+				}
+			}
+		}
+
+		subscription.handle(msgBytes)
+	}
+}
+
+// handleBlock deserializes a raw block and forwards it to the block channel, along with
+// its height
+func (z *Zmq) handleBlock(msgBytes [][]byte) {
+	block := &wire.MsgBlock{}
+	if err := block.Deserialize(bytes.NewReader(msgBytes[1])); err != nil {
+		log.WithError(err).Error("Unable to deserialize block")
+		return
+	}
+
+	hash := block.BlockHash()
+	log.WithField("hash", hash).Trace("received new block")
+
+	// confirmed transactions have left the mempool
+	z.seenMu.Lock()
+	for _, tx := range block.Transactions {
+		delete(z.seen, tx.TxHash())
+	}
+	z.seenMu.Unlock()
+
+	// ZMQ doesn't tell us the height of the block
+	_, height, err := z.BlockHeader(hash)
+	if err != nil {
+		log.WithError(err).Error("could not get height of block")
+		return
+	}
+
+	z.blocks <- BlockEvent{Block: block, Height: height}
+}
+
+// deliverTip forwards the tip of the best chain to the block channel
+func (z *Zmq) deliverTip() {
+	height, hash, err := z.BestBlock()
+	if err != nil {
+		log.WithError(err).Error("could not get best block to catch up from")
+		return
+	}
+	block, err := z.Block(hash)
+	if err != nil {
+		log.WithError(err).Error("could not get best block to catch up from")
+		return
+	}
+
+	z.blocks <- BlockEvent{Block: block, Height: height}
+}
+
+// resyncMempool compares the mempool to what we've delivered. Transactions we haven't seen
+// are delivered, and the watched transactions we expect to be in the mempool but aren't are
+// delivered as removals. A block might have confirmed them, which the receiver has to
+// account for like any other removal.
+func (z *Zmq) resyncMempool() {
+	mempool, err := z.mempool()
+	if err != nil {
+		log.WithError(err).Error("could not resync mempool")
+		return
+	}
+	inMempool := make(map[chainhash.Hash]bool, len(mempool))
+	for _, txid := range mempool {
+		inMempool[txid] = true
+	}
+
+	z.deliverMissed(mempool, inMempool)
+	z.deliverMissedRemovals(inMempool)
+}
+
+// deliverMissed delivers the transactions in the mempool we haven't seen. What we've seen is
+// replaced by the mempool, so transactions that left it since are forgotten.
+func (z *Zmq) deliverMissed(mempool []chainhash.Hash, inMempool map[chainhash.Hash]bool) {
+	z.seenMu.Lock()
+	var missed []chainhash.Hash
+	for _, txid := range mempool {
+		if !z.seen[txid] {
+			missed = append(missed, txid)
+		}
+	}
+	z.seen = inMempool
+	z.seenMu.Unlock()
+
+	if len(missed) > 0 {
+		log.WithField("transactions", len(missed)).Info("delivering transactions that entered the mempool while we weren't listening")
+	}
+	for _, txid := range missed {
+		tx, err := z.MempoolTransaction(txid)
+		if err != nil {
+			// it might have left the mempool since we listed it
+			log.WithField("txid", txid).WithError(err).Debug("could not get missed transaction")
+			continue
+		}
+		z.txs <- tx
+	}
+}
+
+// deliverMissedRemovals delivers removals for the watched transactions we expect to be in
+// the mempool, but aren't
+func (z *Zmq) deliverMissedRemovals(inMempool map[chainhash.Hash]bool) {
+	if z.zmqConfig.MempoolTxids == nil || z.removals == nil {
+		return
+	}
+
+	for _, txid := range z.zmqConfig.MempoolTxids() {
+		if inMempool[txid] {
+			continue
+		}
+
+		// the transaction might have entered the mempool again since we listed it
+		if _, err := z.btcctl.GetMempoolEntry(txid.String()); err == nil {
+			continue
+		}
+
+		log.WithField("txid", txid).Info("watched transaction left the mempool while we weren't listening")
+		z.removals <- txid
+	}
+}
+
+// handleTx deserializes a raw transaction and forwards it to the transaction channel
+func (z *Zmq) handleTx(msgBytes [][]byte) {
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(msgBytes[1])); err != nil {
+		log.WithError(err).Error("Unable to deserialize transaction")
+		return
+	}
+
+	z.seenMu.Lock()
+	z.seen[tx.TxHash()] = true
+	z.seenMu.Unlock()
+
+	z.txs <- tx
+}
+
+// parseRemoval parses the body of a ZMQ sequence message, returning the txid if
+// it's a transaction being removed from the mempool
+func parseRemoval(body []byte) (chainhash.Hash, bool) {
+	// the body is a 32 byte hash followed by a label, and for mempool
+	// events the mempool sequence number
+	if len(body) < chainhash.HashSize+1 {
+		log.WithField("length", len(body)).Warn("Received too short sequence message")
+		return chainhash.Hash{}, false
+	}
+
+	// we only care about transactions removed from the mempool
+	if body[chainhash.HashSize] != 'R' {
+		return chainhash.Hash{}, false
+	}
+
+	// bitcoind sends the hash in RPC byte order, which is the reverse
+	// of what chainhash expects
+	var txid chainhash.Hash
+	for i := 0; i < chainhash.HashSize; i++ {
+		txid[i] = body[chainhash.HashSize-1-i]
+	}
+	return txid, true
+}
+
+// handleSequence forwards the txids of transactions removed from the mempool to the
+// channel. Removals caused by a block are not published by bitcoind, so these are
+// removals due to expiry, the mempool being full, conflicts and the like.
+func (z *Zmq) handleSequence(msgBytes [][]byte) {
+	txid, ok := parseRemoval(msgBytes[1])
+	if !ok {
+		return
+	}
+
+	log.WithField("txid", txid).Trace("transaction removed from mempool")
+	z.seenMu.Lock()
+	delete(z.seen, txid)
+	z.seenMu.Unlock()
+
+	z.removals <- txid
+}
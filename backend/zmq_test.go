@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRemoval(t *testing.T) {
+	txid := chainhash.DoubleHashH([]byte("removed"))
+
+	// bitcoind sends the hash reversed, followed by the label and the sequence number
+	var body []byte
+	for i := chainhash.HashSize - 1; i >= 0; i-- {
+		body = append(body, txid[i])
+	}
+
+	t.Run("parses removals", func(t *testing.T) {
+		parsed, ok := parseRemoval(append(append([]byte{}, body...), 'R', 1, 0, 0, 0, 0, 0, 0, 0))
+		assert.True(t, ok)
+		assert.Equal(t, txid, parsed)
+	})
+
+	t.Run("ignores other events", func(t *testing.T) {
+		_, ok := parseRemoval(append(append([]byte{}, body...), 'A', 1, 0, 0, 0, 0, 0, 0, 0))
+		assert.False(t, ok)
+	})
+
+	t.Run("ignores short messages", func(t *testing.T) {
+		_, ok := parseRemoval(body)
+		assert.False(t, ok)
+	})
+}
+
+func TestZmqSubscription(t *testing.T) {
+	start := time.Now()
+	subscription := &zmqSubscription{topic: "rawblock"}
+	subscription.up(nil, start)
+
+	t.Run("doesn't count the first connection as a reconnect", func(t *testing.T) {
+		state := subscription.state()
+		assert.True(t, state.Connected)
+		assert.Equal(t, 0, state.Reconnects)
+	})
+
+	t.Run("alerts once when down for too long", func(t *testing.T) {
+		subscription.down(start.Add(time.Minute))
+		assert.False(t, subscription.state().Connected)
+
+		assert.False(t, subscription.shouldAlert(start.Add(2*time.Minute), 5*time.Minute))
+		assert.True(t, subscription.shouldAlert(start.Add(6*time.Minute), 5*time.Minute))
+		assert.False(t, subscription.shouldAlert(start.Add(7*time.Minute), 5*time.Minute))
+	})
+
+	t.Run("reports recovering from an alerted outage", func(t *testing.T) {
+		downFor := subscription.up(nil, start.Add(8*time.Minute))
+		assert.Equal(t, 7*time.Minute, downFor)
+		assert.True(t, subscription.recovered())
+		assert.Equal(t, 1, subscription.state().Reconnects)
+	})
+
+	t.Run("short outages are not alerted", func(t *testing.T) {
+		subscription.down(start.Add(9 * time.Minute))
+		subscription.up(nil, start.Add(10*time.Minute))
+		assert.False(t, subscription.recovered())
+		assert.False(t, subscription.shouldAlert(start.Add(time.Hour), 5*time.Minute))
+	})
+
+	t.Run("alerts can be disabled", func(t *testing.T) {
+		subscription.down(start.Add(11 * time.Minute))
+		assert.False(t, subscription.shouldAlert(start.Add(time.Hour), 0))
+	})
+}
+
+func TestCheckSequence(t *testing.T) {
+	subscription := &zmqSubscription{topic: "rawtx"}
+
+	assert.True(t, subscription.checkSequence(7), "the first message can have any number")
+	assert.True(t, subscription.checkSequence(8))
+	assert.False(t, subscription.checkSequence(10))
+	assert.True(t, subscription.checkSequence(11))
+	assert.Equal(t, 1, subscription.state().Gaps)
+
+	t.Run("starts over after resubscribing", func(t *testing.T) {
+		subscription.up(nil, time.Now())
+		assert.True(t, subscription.checkSequence(100))
+		assert.Equal(t, 1, subscription.state().Gaps)
+	})
+
+	t.Run("wraps around", func(t *testing.T) {
+		wrapping := &zmqSubscription{topic: "rawtx"}
+		assert.True(t, wrapping.checkSequence(math.MaxUint32))
+		assert.True(t, wrapping.checkSequence(0))
+	})
+}
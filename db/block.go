@@ -0,0 +1,42 @@
+package db
+
+// Block is a block we have processed
+type Block struct {
+	// Network is the name of the network the block belongs to
+	Network string `db:"network"`
+	Height  int64  `db:"height"`
+	Hash    string `db:"hash"`
+}
+
+// Save stores the block as processed, replacing any other block we processed at the same height
+func (b Block) Save(database *DB) error {
+	_, err := database.NamedExec("INSERT INTO blocks (network, height, hash) VALUES (:network, :height, :hash) "+
+		"ON CONFLICT (network, height) DO UPDATE SET hash = excluded.hash", b)
+	return err
+}
+
+// ListRecentBlocks lists the last processed blocks of the network, the highest block first
+func ListRecentBlocks(database *DB, network string, limit int) ([]Block, error) {
+	var blocks []Block
+
+	err := database.Select(&blocks, `SELECT * FROM blocks WHERE network = $1 ORDER BY height DESC LIMIT $2`,
+		network, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// DeleteBlocksAbove deletes every block of the network above the given height. This happens
+// when blocks are disconnected from the best chain.
+func DeleteBlocksAbove(database *DB, network string, height int64) error {
+	_, err := database.Exec(`DELETE FROM blocks WHERE network = $1 AND height > $2`, network, height)
+	return err
+}
+
+// PruneBlocks deletes every block of the network below the given height
+func PruneBlocks(database *DB, network string, height int64) error {
+	_, err := database.Exec(`DELETE FROM blocks WHERE network = $1 AND height < $2`, network, height)
+	return err
+}
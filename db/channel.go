@@ -0,0 +1,63 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// ChannelConfig is a way a notification wants to be contacted
+type ChannelConfig struct {
+	// Type is the name of the channel to deliver through, e.g. email
+	Type string `json:"type"`
+	// Target is where the channel delivers to, e.g. an email address or a URL
+	Target string `json:"target"`
+}
+
+// ChannelConfigs are stored as a JSON array
+type ChannelConfigs []ChannelConfig
+
+// Target returns the target of the first channel of the given type, or an empty string if
+// there is none
+func (c ChannelConfigs) Target(channelType string) string {
+	for _, config := range c {
+		if config.Type == channelType {
+			return config.Target
+		}
+	}
+	return ""
+}
+
+func (c ChannelConfigs) Value() (driver.Value, error) {
+	if c == nil {
+		return "[]", nil
+	}
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+func (c *ChannelConfigs) Scan(src interface{}) error {
+	var encoded []byte
+	switch src := src.(type) {
+	case []byte:
+		encoded = src
+	case string:
+		encoded = []byte(src)
+	default:
+		return fmt.Errorf("can not scan %T into channel configs", src)
+	}
+
+	var configs ChannelConfigs
+	if err := json.Unmarshal(encoded, &configs); err != nil {
+		return err
+	}
+	// we don't distinguish between no channels and an empty list of channels
+	if len(configs) == 0 {
+		configs = nil
+	}
+	*c = configs
+	return nil
+}
@@ -41,6 +41,29 @@ type DB struct {
 	*sqlx.DB
 }
 
+// Querier runs queries, either straight on the database or as part of a transaction
+type Querier interface {
+	sqlx.Ext
+}
+
+// Transact runs fn in a transaction, which is committed if fn succeeds and rolled back
+// otherwise
+func (d *DB) Transact(fn func(tx Querier) error) error {
+	tx, err := d.Beginx()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.WithError(rollbackErr).Error("could not roll back transaction")
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func open(c *cli.Context, name string) (*DB, error) {
 
 	var port int
@@ -267,19 +290,3 @@ func (d *DB) CreateMigration(name string) (string, error) {
 	}
 	return baseFileName, nil
 }
-
-func NewTest(name string) *DB {
-	database, err := New(nil, name)
-	if err != nil {
-		panic(fmt.Errorf("could not create new: %w", err))
-	}
-
-	defer func() {
-		// just in case it isnt created yet
-		_, _ = database.Exec("DROP DATABASE " + name)
-		// just in case it isnt created yet
-		_, _ = database.Exec("UPDATE schema_migrations SET version = 0, dirty = f")
-	}()
-
-	return database
-}
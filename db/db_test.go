@@ -1,14 +1,16 @@
-package db
+package db_test
 
 import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/db/dbtest"
 )
 
 func TestDB_MigrateUp(t *testing.T) {
-	db, err := New(nil)
-	require.NoError(t, err)
+	database := dbtest.New("db_test")
+	dbtest.Require(t, database)
 
-	require.NoError(t, db.MigrateUp())
+	require.NoError(t, database.MigrateUp())
 }
@@ -0,0 +1,47 @@
+// Package dbtest connects tests to the test database started by `make test-db`.
+package dbtest
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/bjornoj/txnotify/db"
+)
+
+// SkipEnv is the environment variable letting tests skip instead of fail when the test
+// database is unavailable, e.g. on machines without Docker
+const SkipEnv = "TXNOTIFY_SKIP_DB_TESTS"
+
+// New connects to the test database with the given name. It panics if the database is
+// unavailable, unless SkipEnv is set, in which case it returns nil and the tests using the
+// database are skipped by Require.
+func New(name string) *db.DB {
+	database, err := db.New(nil, name)
+	if err != nil {
+		if os.Getenv(SkipEnv) == "" {
+			panic(fmt.Errorf("could not connect to the test database, start it with `make test-db` "+
+				"or set %s to skip the tests using it: %w", SkipEnv, err))
+		}
+		fmt.Fprintf(os.Stderr, "test database unavailable, skipping tests using it: %v\n", err)
+		return nil
+	}
+
+	defer func() {
+		// just in case it isnt created yet
+		_, _ = database.Exec("DROP DATABASE " + name)
+		// just in case it isnt created yet
+		_, _ = database.Exec("UPDATE schema_migrations SET version = 0, dirty = f")
+	}()
+
+	return database
+}
+
+// Require skips the test if the test database is unavailable. That only happens when
+// SkipEnv is set.
+func Require(t testing.TB, database *db.DB) {
+	t.Helper()
+	if database == nil {
+		t.Skipf("test database unavailable and %s is set", SkipEnv)
+	}
+}
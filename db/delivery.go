@@ -0,0 +1,68 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Delivery is a single attempt at delivering an outbox message
+type Delivery struct {
+	ID             uuid.UUID `db:"id"`
+	OutboxID       uuid.UUID `db:"outbox_id"`
+	NotificationID uuid.UUID `db:"notification_id"`
+	Channel        string    `db:"channel"`
+	Destination    string    `db:"destination"`
+	// Attempt is 1 for the first attempt at delivering the message
+	Attempt int `db:"attempt"`
+	// RequestBody is what we sent: the email text, or the JSON posted to the URL
+	RequestBody string `db:"request_body"`
+	// ResponseStatus is the HTTP status of the response. Nil for emails, and when we got no
+	// response.
+	ResponseStatus *int `db:"response_status"`
+	// ResponseBody is the start of the response body
+	ResponseBody string `db:"response_body"`
+	LatencyMs    int64  `db:"latency_ms"`
+	// Error is why the attempt failed. Nil if it succeeded.
+	Error     *string   `db:"error"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (d Delivery) Save(database *DB) (Delivery, error) {
+	rows, err := database.NamedQuery("INSERT INTO deliveries (outbox_id, notification_id, channel, destination, "+
+		"attempt, request_body, response_status, response_body, latency_ms, error) "+
+		"VALUES (:outbox_id, :notification_id, :channel, :destination, :attempt, :request_body, "+
+		":response_status, :response_body, :latency_ms, :error) RETURNING *", d)
+	if err != nil {
+		return Delivery{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return Delivery{}, err
+		}
+		return Delivery{}, fmt.Errorf("could not insert delivery")
+	}
+	if err := rows.StructScan(&d); err != nil {
+		return Delivery{}, fmt.Errorf("could not scan into struct: %w", err)
+	}
+
+	return d, nil
+}
+
+// ListDeliveries lists the delivery attempts of a notification made in [from, to), newest
+// first, returning at most limit attempts
+func ListDeliveries(database *DB, notificationID uuid.UUID, from, to time.Time, limit int) ([]Delivery, error) {
+	var deliveries []Delivery
+
+	err := database.Select(&deliveries, `SELECT * FROM deliveries
+		WHERE notification_id = $1 AND created_at >= $2 AND created_at < $3
+		ORDER BY created_at DESC LIMIT $4`, notificationID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
@@ -2,8 +2,10 @@ package db
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type Notification struct {
@@ -11,17 +13,55 @@ type Notification struct {
 	UserID        uuid.UUID `db:"user_id"`
 	Identifier    string    `db:"identifier"`
 	Confirmations uint32    `db:"confirmations"`
-	Email         string    `db:"email"`
 	Description   string    `db:"description"`
+	// Channels are the ways the user wants to be contacted
+	Channels ChannelConfigs `db:"channels"`
+	// FollowReplacements moves watches over to the replacement when a watched transaction
+	// is replaced or double-spent
+	FollowReplacements bool `db:"follow_replacements"`
+	// Network is the name of the network the identifier belongs to
+	Network string `db:"network"`
+	// MinAmount and MaxAmount limit which payments to a watched address we notify about, in
+	// satoshis. Zero means no limit.
+	MinAmount int64 `db:"min_amount_sats"`
+	MaxAmount int64 `db:"max_amount_sats"`
+	// Milestones are the confirmation counts to notify at, in ascending order. If empty, we
+	// only notify at Confirmations.
+	Milestones pq.Int64Array `db:"confirmation_milestones"`
+	// SigningSecret signs the callbacks of the notification. It is empty for notifications
+	// created before we signed callbacks.
+	SigningSecret string `db:"signing_secret"`
+	// PreviousSigningSecret is the secret replaced by the last rotation. It keeps signing
+	// callbacks until PreviousSecretExpiresAt, so receivers have time to switch over.
+	PreviousSigningSecret   *string    `db:"previous_signing_secret"`
+	PreviousSecretExpiresAt *time.Time `db:"previous_secret_expires_at"`
+}
+
+// SigningSecrets returns the secrets callbacks should be signed with at the given time, the
+// current one first
+func (n Notification) SigningSecrets(now time.Time) []string {
+	var secrets []string
+	if n.SigningSecret != "" {
+		secrets = append(secrets, n.SigningSecret)
+	}
+	if n.PreviousSigningSecret != nil && n.PreviousSecretExpiresAt != nil && now.Before(*n.PreviousSecretExpiresAt) {
+		secrets = append(secrets, *n.PreviousSigningSecret)
+	}
+	return secrets
 }
 
 func (n Notification) Save(database *DB) (Notification, error) {
 	var id uuid.UUID
-	rows, err := database.NamedQuery("INSERT INTO notifications (user_id, identifier, confirmations, email, description)"+
-		"VALUES (:user_id, :identifier, :confirmations, :email, :description) RETURNING id", n)
+	rows, err := database.NamedQuery("INSERT INTO notifications (user_id, identifier, confirmations, description, "+
+		"channels, follow_replacements, network, min_amount_sats, max_amount_sats, confirmation_milestones, "+
+		"signing_secret) "+
+		"VALUES (:user_id, :identifier, :confirmations, :description, :channels, :follow_replacements, :network, "+
+		":min_amount_sats, :max_amount_sats, :confirmation_milestones, :signing_secret) RETURNING id", n)
 	if err != nil {
 		return Notification{}, err
 	}
+	defer rows.Close()
+
 	next := rows.Next()
 	if !next {
 		return Notification{}, fmt.Errorf("could not insert notification")
@@ -45,7 +85,46 @@ func ListNotifications(database *DB, userID uuid.UUID) ([]Notification, error) {
 	return notifications, nil
 }
 
+// ListAllNotifications lists the notifications of every user. It is used to rebuild the
+// watch state on startup.
+func ListAllNotifications(database *DB) ([]Notification, error) {
+	var notifications []Notification
+
+	err := database.Select(&notifications, `SELECT * FROM notifications`)
+	if err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+// ClaimNetwork assigns the notifications, blocks and outpoints saved before we kept track of
+// networks to the given network
+func ClaimNetwork(database *DB, network string) error {
+	for _, table := range []string{"notifications", "blocks", "address_outpoints"} {
+		_, err := database.Exec(`UPDATE `+table+` SET network = $1 WHERE network = ''`, network)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteNotification deletes a notification, along with everything belonging to it
+func DeleteNotification(database *DB, ID uuid.UUID) error {
+	_, err := database.Exec(`DELETE FROM notifications WHERE id = $1`, ID)
+	return err
+}
+
 func GetNotification(database *DB, ID uuid.UUID) (Notification, error) {
 	var notification Notification
 	return notification, database.Get(&notification, `SELECT * FROM notifications WHERE id = $1`, ID)
 }
+
+// RotateSigningSecret replaces the signing secret of a notification. The replaced secret keeps
+// signing callbacks until overlapUntil.
+func RotateSigningSecret(database *DB, ID uuid.UUID, secret string, overlapUntil time.Time) error {
+	_, err := database.Exec(`UPDATE notifications SET previous_signing_secret = NULLIF(signing_secret, ''),
+		previous_secret_expires_at = $1, signing_secret = $2 WHERE id = $3`, overlapUntil, secret, ID)
+	return err
+}
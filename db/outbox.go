@@ -0,0 +1,146 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// States of an outbox message
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	// OutboxDead messages have used up their delivery attempts
+	OutboxDead = "dead"
+)
+
+// ErrOutboxMessageNotFound is returned when requeueing a message that doesn't exist, or
+// isn't dead
+var ErrOutboxMessageNotFound = errors.New("no dead outbox message with that ID")
+
+// OutboxMessage is a message to a user waiting to be delivered through a single channel
+type OutboxMessage struct {
+	ID             uuid.UUID `db:"id"`
+	NotificationID uuid.UUID `db:"notification_id"`
+	// Channel is email, callback or slack
+	Channel string `db:"channel"`
+	// Destination is the email address or URL to deliver to
+	Destination string `db:"destination"`
+	// Subject is the email subject or Slack header
+	Subject string `db:"subject"`
+	// Body is the text of emails, or the JSON payload of callbacks and Slack messages
+	Body     string `db:"body"`
+	Status   string `db:"status"`
+	Attempts int    `db:"attempts"`
+	// NextAttemptAt is when the message is due for delivery
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	// LastError is why the last delivery attempt failed
+	LastError   *string    `db:"last_error"`
+	CreatedAt   time.Time  `db:"created_at"`
+	DeliveredAt *time.Time `db:"delivered_at"`
+}
+
+// Save writes the message to the outbox, due for delivery right away
+func (o OutboxMessage) Save(database Querier) (OutboxMessage, error) {
+	rows, err := sqlx.NamedQuery(database, "INSERT INTO outbox (notification_id, channel, destination, subject, body) "+
+		"VALUES (:notification_id, :channel, :destination, :subject, :body) RETURNING *", o)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return OutboxMessage{}, err
+		}
+		return OutboxMessage{}, fmt.Errorf("could not insert outbox message")
+	}
+	if err := rows.StructScan(&o); err != nil {
+		return OutboxMessage{}, fmt.Errorf("could not scan into struct: %w", err)
+	}
+
+	return o, nil
+}
+
+// ClaimOutboxMessages claims up to limit pending messages that are due for delivery. The
+// messages are not due again until the lease runs out, so other workers leave them alone.
+// If the worker dies before reporting back, the messages are retried after the lease.
+func ClaimOutboxMessages(database *DB, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+
+	err := database.Select(&messages, `UPDATE outbox SET next_attempt_at = now() + $1 * interval '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM outbox WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at LIMIT $2 FOR UPDATE SKIP LOCKED
+		) RETURNING *`, lease.Milliseconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkOutboxDelivered marks that the message was delivered
+func MarkOutboxDelivered(database *DB, ID uuid.UUID) error {
+	_, err := database.Exec(`UPDATE outbox SET status = 'delivered', attempts = attempts + 1,
+		delivered_at = now(), last_error = NULL WHERE id = $1`, ID)
+	return err
+}
+
+// MarkOutboxFailed records a failed delivery attempt, and when to try again
+func MarkOutboxFailed(database *DB, ID uuid.UUID, nextAttempt time.Time, reason string) error {
+	_, err := database.Exec(`UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $1, last_error = $2
+		WHERE id = $3`, nextAttempt, reason, ID)
+	return err
+}
+
+// MarkOutboxDead records the last failed delivery attempt of a message we're giving up on
+func MarkOutboxDead(database *DB, ID uuid.UUID, reason string) error {
+	_, err := database.Exec(`UPDATE outbox SET status = 'dead', attempts = attempts + 1, last_error = $1
+		WHERE id = $2`, reason, ID)
+	return err
+}
+
+// ListDeadOutboxMessages lists the messages we gave up delivering, oldest first
+func ListDeadOutboxMessages(database *DB) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+
+	err := database.Select(&messages, `SELECT * FROM outbox WHERE status = 'dead' ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// RequeueOutboxMessage gives a dead message a fresh set of delivery attempts, starting right away
+func RequeueOutboxMessage(database *DB, ID uuid.UUID) error {
+	res, err := database.Exec(`UPDATE outbox SET status = 'pending', attempts = 0, next_attempt_at = now()
+		WHERE id = $1 AND status = 'dead'`, ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrOutboxMessageNotFound
+	}
+	return nil
+}
+
+// RequeueDeadOutboxMessages requeues every dead message, returning how many there were
+func RequeueDeadOutboxMessages(database *DB) (int64, error) {
+	res, err := database.Exec(`UPDATE outbox SET status = 'pending', attempts = 0, next_attempt_at = now()
+		WHERE status = 'dead'`)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
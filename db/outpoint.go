@@ -0,0 +1,90 @@
+package db
+
+// Outpoint is an output paying to a watched address
+type Outpoint struct {
+	// Network is the name of the network the output belongs to
+	Network string `db:"network"`
+	Txid    string `db:"txid"`
+	Vout    uint32 `db:"vout"`
+	Address string `db:"address"`
+	// Amount is denominated in satoshis
+	Amount int64 `db:"amount"`
+	// ConfirmedAtBlock is the height of the block the output was confirmed in. Nil if the
+	// output is unconfirmed.
+	ConfirmedAtBlock *int64 `db:"confirmed_at_block"`
+	// SpentByTxid is the transaction spending this output, if any
+	SpentByTxid *string `db:"spent_by_txid"`
+	// SpentAtBlock is the height of the block the spending transaction was confirmed in
+	SpentAtBlock *int64 `db:"spent_at_block"`
+}
+
+// Save inserts the outpoint, doing nothing if it already exists
+func (o Outpoint) Save(database *DB) error {
+	_, err := database.NamedExec("INSERT INTO address_outpoints (network, txid, vout, address, amount, "+
+		"confirmed_at_block) VALUES (:network, :txid, :vout, :address, :amount, :confirmed_at_block) "+
+		"ON CONFLICT (network, txid, vout) DO NOTHING", o)
+	return err
+}
+
+// ListUnspentOutpoints lists every outpoint that has not been spent in a block
+func ListUnspentOutpoints(database *DB) ([]Outpoint, error) {
+	var outpoints []Outpoint
+
+	err := database.Select(&outpoints, `SELECT * FROM address_outpoints WHERE spent_at_block IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+
+	return outpoints, nil
+}
+
+// ListOutpointsSpentAt lists the outpoints of the network spent in the block at the given height
+func ListOutpointsSpentAt(database *DB, network string, height int64) ([]Outpoint, error) {
+	var outpoints []Outpoint
+
+	err := database.Select(&outpoints, `SELECT * FROM address_outpoints WHERE network = $1 AND spent_at_block = $2`,
+		network, height)
+	if err != nil {
+		return nil, err
+	}
+
+	return outpoints, nil
+}
+
+// MarkOutpointSpent marks the outpoint as spent by the given transaction. height is nil if
+// the spending transaction is unconfirmed.
+func MarkOutpointSpent(database *DB, network, txid string, vout uint32, spentBy string, height *int64) error {
+	_, err := database.Exec(`UPDATE address_outpoints SET spent_by_txid = $1, spent_at_block = $2
+		WHERE network = $3 AND txid = $4 AND vout = $5`, spentBy, height, network, txid, vout)
+	return err
+}
+
+// MarkOutpointConfirmed sets the height of the block the outpoint was confirmed in. height is
+// nil if the block was disconnected.
+func MarkOutpointConfirmed(database *DB, network, txid string, vout uint32, height *int64) error {
+	_, err := database.Exec(`UPDATE address_outpoints SET confirmed_at_block = $1
+		WHERE network = $2 AND txid = $3 AND vout = $4`, height, network, txid, vout)
+	return err
+}
+
+// MarkOutpointUnspent forgets the transaction spending the outpoint, e.g. because it was replaced
+func MarkOutpointUnspent(database *DB, network, txid string, vout uint32) error {
+	_, err := database.Exec(`UPDATE address_outpoints SET spent_by_txid = NULL, spent_at_block = NULL
+		WHERE network = $1 AND txid = $2 AND vout = $3`, network, txid, vout)
+	return err
+}
+
+// DeleteUnconfirmedOutpoints deletes the unconfirmed outputs of the transaction. This happens
+// when the transaction is replaced, and will never confirm.
+func DeleteUnconfirmedOutpoints(database *DB, network, txid string) error {
+	_, err := database.Exec(`DELETE FROM address_outpoints WHERE network = $1 AND txid = $2 AND confirmed_at_block IS NULL`,
+		network, txid)
+	return err
+}
+
+// PruneSpentOutpoints deletes the outpoints of the network spent in a block below the given
+// height. Those blocks are too deep to be disconnected, so the outpoints stay spent.
+func PruneSpentOutpoints(database *DB, network string, height int64) error {
+	_, err := database.Exec(`DELETE FROM address_outpoints WHERE network = $1 AND spent_at_block < $2`, network, height)
+	return err
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// uniqueViolation is the Postgres error code for inserts and updates breaking a unique
+// constraint
+const uniqueViolation = "23505"
+
+// ErrTxWatchExists is returned when a notification is already watching a transaction
+var ErrTxWatchExists = errors.New("notification is already watching transaction")
+
+// TxWatch is a transaction a notification is waiting on. A notification watching an address
+// gets a TxWatch for every transaction paying to that address, while a notification watching
+// a txid gets exactly one. A notification watching an outpoint gets one for the transaction
+// spending it.
+type TxWatch struct {
+	ID             uuid.UUID `db:"id"`
+	NotificationID uuid.UUID `db:"notification_id"`
+	Txid           string    `db:"txid"`
+	// ConfirmedAtBlock is the height of the block the transaction was confirmed in. Nil if
+	// the transaction is unconfirmed.
+	ConfirmedAtBlock *int64 `db:"confirmed_at_block"`
+	// Fired is set once the notification for the last milestone of this transaction has
+	// been sent
+	Fired bool `db:"fired"`
+	// MilestonesSent is how many of the confirmation milestones of the notification we've
+	// notified about
+	MilestonesSent int `db:"milestones_sent"`
+	// InputIndex is the input spending the watched outpoint. Nil if the notification is
+	// not watching an outpoint.
+	InputIndex *uint32 `db:"input_index"`
+	// Address is the watched address the transaction pays to. Nil if the notification is
+	// not watching an address.
+	Address *string `db:"address"`
+}
+
+// Save inserts the TxWatch, returning ErrTxWatchExists if the notification already has a
+// watch for the same transaction.
+func (t TxWatch) Save(database *DB) (TxWatch, error) {
+	rows, err := database.NamedQuery("INSERT INTO tx_watches (notification_id, txid, confirmed_at_block, fired, input_index, address) "+
+		"VALUES (:notification_id, :txid, :confirmed_at_block, :fired, :input_index, :address) "+
+		"ON CONFLICT (notification_id, txid) DO NOTHING RETURNING id", t)
+	if err != nil {
+		return TxWatch{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return TxWatch{}, err
+		}
+		return TxWatch{}, ErrTxWatchExists
+	}
+	if err := rows.Scan(&t.ID); err != nil {
+		return TxWatch{}, fmt.Errorf("could not scan into struct: %w", err)
+	}
+
+	return t, nil
+}
+
+// ListUnfiredTxWatches lists every TxWatch we have not sent a notification for yet
+func ListUnfiredTxWatches(database *DB) ([]TxWatch, error) {
+	var watches []TxWatch
+
+	err := database.Select(&watches, `SELECT * FROM tx_watches WHERE NOT fired`)
+	if err != nil {
+		return nil, err
+	}
+
+	return watches, nil
+}
+
+// ListActiveTxWatches lists every TxWatch on the network we have not sent a notification for
+// yet, along with fired watches confirmed at or above the given height. The latter can still
+// be unconfirmed by a reorg.
+func ListActiveTxWatches(database *DB, network string, confirmedSince int64) ([]TxWatch, error) {
+	var watches []TxWatch
+
+	err := database.Select(&watches, `SELECT tx_watches.* FROM tx_watches
+		JOIN notifications ON notifications.id = tx_watches.notification_id
+		WHERE notifications.network = $1 AND (NOT fired OR confirmed_at_block >= $2)`,
+		network, confirmedSince)
+	if err != nil {
+		return nil, err
+	}
+
+	return watches, nil
+}
+
+// HasTxWatch checks if the notification has any TxWatch, fired or not
+func HasTxWatch(database *DB, notificationID uuid.UUID) (bool, error) {
+	var exists bool
+
+	err := database.Get(&exists, `SELECT EXISTS (SELECT 1 FROM tx_watches WHERE notification_id = $1)`,
+		notificationID)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// SetTxWatchConfirmedAt sets the height the transaction was confirmed at. Passing nil marks
+// the transaction as unconfirmed.
+func SetTxWatchConfirmedAt(database *DB, ID uuid.UUID, height *int64) error {
+	_, err := database.Exec(`UPDATE tx_watches SET confirmed_at_block = $1 WHERE id = $2`, height, ID)
+	return err
+}
+
+// MarkTxWatchFired marks that the notification for the TxWatch has been sent
+func MarkTxWatchFired(database Querier, ID uuid.UUID) error {
+	_, err := database.Exec(`UPDATE tx_watches SET fired = true WHERE id = $1`, ID)
+	return err
+}
+
+// ReplaceTxWatch moves the TxWatch over to the transaction replacing the one it was watching,
+// returning ErrTxWatchExists if the notification is already watching the replacement.
+func ReplaceTxWatch(database *DB, ID uuid.UUID, txid string, inputIndex *uint32) error {
+	_, err := database.Exec(`UPDATE tx_watches SET txid = $1, input_index = $2 WHERE id = $3`, txid, inputIndex, ID)
+	pqErr := new(pq.Error)
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrTxWatchExists
+	}
+	return err
+}
+
+// DeleteTxWatch deletes the TxWatch
+func DeleteTxWatch(database *DB, ID uuid.UUID) error {
+	_, err := database.Exec(`DELETE FROM tx_watches WHERE id = $1`, ID)
+	return err
+}
+
+// SetTxWatchMilestonesSent sets how many of the milestones of the TxWatch have been sent
+func SetTxWatchMilestonesSent(database Querier, ID uuid.UUID, sent int) error {
+	_, err := database.Exec(`UPDATE tx_watches SET milestones_sent = $1 WHERE id = $2`, sent, ID)
+	return err
+}
+
+// UnconfirmTxWatch marks the transaction as unconfirmed again, and rearms the notification
+// from the given milestone. This happens when the block the transaction was confirmed in is
+// reorged out.
+func UnconfirmTxWatch(database Querier, ID uuid.UUID, milestonesSent int) error {
+	_, err := database.Exec(`UPDATE tx_watches SET confirmed_at_block = NULL, fired = false, milestones_sent = $1
+		WHERE id = $2`, milestonesSent, ID)
+	return err
+}
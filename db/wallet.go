@@ -0,0 +1,32 @@
+package db
+
+import "github.com/google/uuid"
+
+// WalletBranch is a branch of a watched wallet, e.g. its receive or change addresses
+type WalletBranch struct {
+	NotificationID uuid.UUID `db:"notification_id"`
+	Branch         int       `db:"branch"`
+	// LastUsedIndex is the highest index of an address on this branch that has received funds
+	LastUsedIndex int64 `db:"last_used_index"`
+}
+
+// Save upserts the branch. The last used index never decreases.
+func (w WalletBranch) Save(database *DB) error {
+	_, err := database.NamedExec("INSERT INTO wallet_branches (notification_id, branch, last_used_index) "+
+		"VALUES (:notification_id, :branch, :last_used_index) ON CONFLICT (notification_id, branch) "+
+		"DO UPDATE SET last_used_index = GREATEST(wallet_branches.last_used_index, EXCLUDED.last_used_index)", w)
+	return err
+}
+
+// ListWalletBranches lists the branches of the wallet watched by the given notification
+func ListWalletBranches(database *DB, notificationID uuid.UUID) ([]WalletBranch, error) {
+	var branches []WalletBranch
+
+	err := database.Select(&branches, `SELECT * FROM wallet_branches WHERE notification_id = $1`,
+		notificationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return branches, nil
+}
@@ -271,7 +271,7 @@ const Home: React.FC<HomeProps> = ({ userID, recreateUser }) => {
       </div>
       <div className="field">
         <TextField
-          label="Bitcoin address or txid"
+          label="Bitcoin address, txid, txid:vout, xpub or descriptor"
           type="text"
           value={identifier}
           onChange={(e) => {
@@ -3,18 +3,98 @@
 
 import React from "react";
 import { Get, GetProps, useGet, UseGetProps, Mutate, MutateProps, useMutate, UseMutateProps } from "restful-react";
+export interface ChannelConfig {
+  /**
+   * the channel to deliver through. The server ships with email, callback and slack.
+   */
+  type?: string;
+  /**
+   * where the channel delivers to, e.g. an email address or a URL
+   */
+  target?: string;
+}
+
 export interface CreateNotificationResponse {
   /**
    * the id of your notification. Can be used to get more specific information about your subscription,
    * or to delete it.
    */
   id?: string;
+  /**
+   * the secret callbacks are signed with. It is only returned here, so keep it somewhere
+   * safe. If lost, you can rotate it.
+   */
+  signing_secret?: string;
 }
 
 export interface CreateUserResponse {
   id?: string;
 }
 
+export interface Delivery {
+  id?: string;
+  /**
+   * the message that was attempted delivered. Retries of a message share the id, which is
+   * sent as X-Txnotify-Event-Id with callbacks.
+   */
+  message_id?: string;
+  /**
+   * email, callback or slack
+   */
+  channel?: string;
+  /**
+   * the email address or URL the message was sent to
+   */
+  destination?: string;
+  /**
+   * 1 for the first attempt at delivering the message
+   */
+  attempt?: number;
+  /**
+   * what we sent: the email text, or the JSON posted to the URL
+   */
+  request_body?: string;
+  /**
+   * the HTTP status of the response. 0 for emails, and when there was no response.
+   */
+  response_status?: number;
+  /**
+   * the start of the response body
+   */
+  response_body?: string;
+  latency_ms?: string;
+  /**
+   * why the attempt failed. Empty if it succeeded.
+   */
+  error?: string;
+  /**
+   * when the attempt was made, as a unix timestamp
+   */
+  created_at?: string;
+}
+
+export interface GetAddressBalanceResponse {
+  address?: string;
+  /**
+   * the sum of the confirmed outputs paying to the address, including the ones spent by
+   * unconfirmed transactions
+   */
+  confirmed_sats?: string;
+  /**
+   * the change to the balance from unconfirmed transactions. Negative if unconfirmed
+   * transactions spend more from the address than they pay to it.
+   */
+  unconfirmed_sats?: string;
+  /**
+   * the outputs paying to the address that are not spent in a block
+   */
+  utxos?: Utxo[];
+}
+
+export interface ListDeliveriesResponse {
+  deliveries?: Delivery[];
+}
+
 export interface ListNotificationsResponse {
   notifications?: Notification[];
 }
@@ -24,7 +104,10 @@ export interface Notification {
   /**
    * The bitcoin blockchain id of the transaction you want to monitor or
    * the bitcoin blockchain address you want to monitor. You will be notified about all
-   * new transactions sent to and from this address.
+   * new transactions sent to and from this address. You can also monitor a single
+   * outpoint on the form txid:vout, in which case you will be notified when it is spent.
+   * An entire wallet can be monitored by passing an extended public key (xpub, ypub or
+   * zpub) or an output descriptor such as wpkh(xpub.../0/*).
    */
   identifier?: string;
   /**
@@ -35,9 +118,124 @@ export interface Notification {
   email?: string;
   description?: string;
   slack_webhook_url?: string;
+  /**
+   * callbacks are POSTed here as JSON. Every callback carries an X-Txnotify-Event-Id header,
+   * which stays the same when a delivery is retried, and an X-Txnotify-Signature header on
+   * the form t=<unix timestamp>,v1=<signature>. The signature is the hex encoded HMAC-SHA256
+   * of "<timestamp>.<body>", keyed with the signing secret of the notification. While the
+   * secret is being rotated, there is a v1 entry for both the new and the previous secret.
+   */
   callback_url?: string;
+  /**
+   * if set, the notification follows a watched transaction over to its replacement when it
+   * is replaced (BIP125) or double-spent. You are notified about the replacement either way.
+   */
+  follow_replacements?: boolean;
+  /**
+   * the network the identifier belongs to, e.g. mainnet or testnet. If omitted, the default
+   * network of the server is used.
+   */
+  network?: string;
+  /**
+   * only notify about payments to a watched address of at least this many satoshis. Both the
+   * output paying to the address and the total the transaction pays to it have to be within
+   * the limits. If omitted, there is no lower limit.
+   */
+  min_amount_sats?: string;
+  /**
+   * only notify about payments to a watched address of at most this many satoshis. If omitted,
+   * there is no upper limit.
+   */
+  max_amount_sats?: string;
+  /**
+   * the confirmation counts you want to be notified at, e.g. [0, 1, 6] to be notified when
+   * the transaction is seen in the mempool, when it confirms and when it has 6 confirmations.
+   * Every milestone is notified about once, in ascending order. If set, confirmations is
+   * ignored.
+   */
+  confirmation_milestones?: number[];
+  /**
+   * the ways you want to be notified. email, slack_webhook_url and callback_url are shorthands
+   * for channels of type email, slack and callback.
+   */
+  channels?: ChannelConfig[];
+}
+
+export interface RotateSigningSecretRequest {
+  user_id?: string;
+  notification_id?: string;
+  /**
+   * how long the previous secret keeps signing callbacks, in seconds. Can not be longer than
+   * 7 days. If omitted, it keeps signing callbacks for 24 hours.
+   */
+  overlap_seconds?: number;
 }
 
+export interface RotateSigningSecretResponse {
+  /**
+   * the new secret callbacks are signed with. It is only returned here, so keep it somewhere
+   * safe.
+   */
+  signing_secret?: string;
+  /**
+   * when the previous secret stops signing callbacks, as a unix timestamp
+   */
+  previous_secret_expires_at?: string;
+}
+
+export interface Utxo {
+  txid?: string;
+  vout?: number;
+  amount_sats?: string;
+  /**
+   * the height of the block the output was confirmed in. 0 if the output is unconfirmed, or
+   * was confirmed before the server kept track of heights.
+   */
+  confirmed_at_block?: string;
+  /**
+   * set if an unconfirmed transaction spends the output
+   */
+  spent_by_txid?: string;
+  confirmed?: boolean;
+}
+
+export interface GetAddressBalanceQueryParams {
+  /**
+   * the network the address belongs to. If omitted, the default network of the server is used.
+   */
+  network?: string;
+}
+
+export interface GetAddressBalancePathParams {
+  /**
+   * the address has to be watched by a notification
+   */
+  address: string
+}
+
+export type GetAddressBalanceProps = Omit<GetProps<GetAddressBalanceResponse, unknown, GetAddressBalanceQueryParams, GetAddressBalancePathParams>, "path"> & GetAddressBalancePathParams;
+
+/**
+ * GetAddressBalance returns the balance of a watched address, along with the outputs
+ * making up the balance
+ */
+export const GetAddressBalance = ({address, ...props}: GetAddressBalanceProps) => (
+  <Get<GetAddressBalanceResponse, unknown, GetAddressBalanceQueryParams, GetAddressBalancePathParams>
+    path={`/addresses/${address}/balance`}
+    
+    {...props}
+  />
+);
+
+export type UseGetAddressBalanceProps = Omit<UseGetProps<GetAddressBalanceResponse, unknown, GetAddressBalanceQueryParams, GetAddressBalancePathParams>, "path"> & GetAddressBalancePathParams;
+
+/**
+ * GetAddressBalance returns the balance of a watched address, along with the outputs
+ * making up the balance
+ */
+export const useGetAddressBalance = ({address, ...props}: UseGetAddressBalanceProps) => useGet<GetAddressBalanceResponse, unknown, GetAddressBalanceQueryParams, GetAddressBalancePathParams>((paramsInPath: GetAddressBalancePathParams) => `/addresses/${paramsInPath.address}/balance`, { pathParams: { address }, ...props });
+
+
 export interface ListNotificationsQueryParams {
   user_id?: string;
 }
@@ -79,6 +277,82 @@ export type UseCreateNotificationProps = Omit<UseMutateProps<CreateNotificationR
 export const useCreateNotification = (props: UseCreateNotificationProps) => useMutate<CreateNotificationResponse, unknown, void, Notification, void>("POST", `/notifications`, props);
 
 
+export interface RotateSigningSecretPathParams {
+  notification_id: string
+}
+
+export type RotateSigningSecretProps = Omit<MutateProps<RotateSigningSecretResponse, unknown, void, RotateSigningSecretRequest, RotateSigningSecretPathParams>, "path" | "verb"> & RotateSigningSecretPathParams;
+
+/**
+ * RotateSigningSecret replaces the secret callbacks of a notification are signed with. The
+ * previous secret keeps signing callbacks alongside the new one during the overlap window,
+ * so you can switch over without rejecting any callbacks.
+ */
+export const RotateSigningSecret = ({notification_id, ...props}: RotateSigningSecretProps) => (
+  <Mutate<RotateSigningSecretResponse, unknown, void, RotateSigningSecretRequest, RotateSigningSecretPathParams>
+    verb="POST"
+    path={`/notifications/${notification_id}/signing-secret/rotate`}
+    
+    {...props}
+  />
+);
+
+export type UseRotateSigningSecretProps = Omit<UseMutateProps<RotateSigningSecretResponse, unknown, void, RotateSigningSecretRequest, RotateSigningSecretPathParams>, "path" | "verb"> & RotateSigningSecretPathParams;
+
+/**
+ * RotateSigningSecret replaces the secret callbacks of a notification are signed with. The
+ * previous secret keeps signing callbacks alongside the new one during the overlap window,
+ * so you can switch over without rejecting any callbacks.
+ */
+export const useRotateSigningSecret = ({notification_id, ...props}: UseRotateSigningSecretProps) => useMutate<RotateSigningSecretResponse, unknown, void, RotateSigningSecretRequest, RotateSigningSecretPathParams>("POST", (paramsInPath: RotateSigningSecretPathParams) => `/notifications/${paramsInPath.notification_id}/signing-secret/rotate`, { pathParams: { notification_id }, ...props });
+
+
+export interface ListDeliveriesQueryParams {
+  user_id?: string;
+  /**
+   * only list attempts made at or after this unix timestamp. If omitted, there is no lower
+   * limit.
+   */
+  from?: string;
+  /**
+   * only list attempts made before this unix timestamp. If omitted, attempts up until now
+   * are listed.
+   */
+  to?: string;
+  /**
+   * the maximum number of attempts to list. Can not be higher than 1000. If omitted, 100
+   * attempts are listed.
+   */
+  limit?: number;
+}
+
+export interface ListDeliveriesPathParams {
+  notification_id: string
+}
+
+export type ListDeliveriesProps = Omit<GetProps<ListDeliveriesResponse, unknown, ListDeliveriesQueryParams, ListDeliveriesPathParams>, "path"> & ListDeliveriesPathParams;
+
+/**
+ * ListDeliveries lists the attempts at delivering the messages of a notification, newest
+ * first. Useful for finding out why your endpoint didn't get a callback.
+ */
+export const ListDeliveries = ({notification_id, ...props}: ListDeliveriesProps) => (
+  <Get<ListDeliveriesResponse, unknown, ListDeliveriesQueryParams, ListDeliveriesPathParams>
+    path={`/notifications/${notification_id}/deliveries`}
+    
+    {...props}
+  />
+);
+
+export type UseListDeliveriesProps = Omit<UseGetProps<ListDeliveriesResponse, unknown, ListDeliveriesQueryParams, ListDeliveriesPathParams>, "path"> & ListDeliveriesPathParams;
+
+/**
+ * ListDeliveries lists the attempts at delivering the messages of a notification, newest
+ * first. Useful for finding out why your endpoint didn't get a callback.
+ */
+export const useListDeliveries = ({notification_id, ...props}: UseListDeliveriesProps) => useGet<ListDeliveriesResponse, unknown, ListDeliveriesQueryParams, ListDeliveriesPathParams>((paramsInPath: ListDeliveriesPathParams) => `/notifications/${paramsInPath.notification_id}/deliveries`, { pathParams: { notification_id }, ...props });
+
+
 export type CreateUserProps = Omit<MutateProps<CreateUserResponse, unknown, void, void, void>, "path" | "verb">;
 
 export const CreateUser = (props: CreateUserProps) => (
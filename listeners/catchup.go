@@ -0,0 +1,98 @@
+package listeners
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+)
+
+// CatchUp processes every block mined since the last block we processed, e.g. while we were
+// down. If we have never processed a block before, the current tip becomes our starting point.
+func CatchUp(source backend.ChainSource, database *db.DB, network chaincfg.Params) error {
+	bestHeight, bestHash, err := source.BestBlock()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := recentBlocks(network.Name).tip(); !ok {
+		log.WithFields(logrus.Fields{
+			"network": network.Name,
+			"height":  bestHeight,
+		}).Info("no processed blocks found, starting from current tip")
+		return markProcessed(database, network.Name, blockRef{height: bestHeight, hash: bestHash})
+	}
+
+	return catchUp(source, database, network, bestHeight)
+}
+
+// catchUp fetches and processes every block up to the given height that we haven't processed
+// yet. Blocks replacing ones we have processed are handled as reorgs.
+func catchUp(source backend.ChainSource, database *db.DB, network chaincfg.Params, toHeight int64) error {
+	history := recentBlocks(network.Name)
+	tip, ok := history.tip()
+	if !ok {
+		return nil
+	}
+
+	// we start at our own tip, in case it was reorged out while we weren't looking
+	from := tip.height
+	if toHeight < from {
+		from = toHeight
+	}
+
+	if toHeight > tip.height {
+		log.WithFields(logrus.Fields{
+			"network": network.Name,
+			"from":    tip.height + 1,
+			"to":      toHeight,
+		}).Info("catching up on missed blocks")
+	}
+
+	for height := from; height <= toHeight; height++ {
+		hash, err := source.BlockHash(height)
+		if err != nil {
+			return err
+		}
+
+		if history.contains(blockRef{height: height, hash: hash}) {
+			continue
+		}
+
+		block, err := source.Block(hash)
+		if err != nil {
+			return err
+		}
+
+		if err := processBlock(source, database, network, block, height); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreBlocks loads the blocks we processed on the network before we were shut down
+func restoreBlocks(database *db.DB, network string) error {
+	blocks, err := db.ListRecentBlocks(database, network, maxReorgDepth)
+	if err != nil {
+		return err
+	}
+
+	// the blocks are listed highest first, while our history wants the lowest first
+	history := recentBlocks(network)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		hash, err := chainhash.NewHashFromStr(blocks[i].Hash)
+		if err != nil {
+			return fmt.Errorf("invalid block hash %s: %w", blocks[i].Hash, err)
+		}
+
+		history.add(blockRef{height: blocks[i].Height, hash: *hash})
+	}
+
+	return nil
+}
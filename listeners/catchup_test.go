@@ -0,0 +1,61 @@
+package listeners
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+)
+
+func TestRestoreBlocks(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	network := chaincfg.RegressionNetParams.Name
+
+	// start from a clean slate, both in memory and in the database
+	delete(histories, network)
+	require.NoError(t, db.DeleteBlocksAbove(testDB, network, -1))
+	defer delete(histories, network)
+
+	var blocks []blockRef
+	for height := int64(1); height <= maxReorgDepth+10; height++ {
+		block := mockBlockRef(height)
+		blocks = append(blocks, block)
+		require.NoError(t, markProcessed(testDB, network, block))
+	}
+
+	// blocks of other networks are kept apart
+	require.NoError(t, markProcessed(testDB, chaincfg.SigNetParams.Name, mockBlockRef(maxReorgDepth+20)))
+	defer func() {
+		require.NoError(t, db.DeleteBlocksAbove(testDB, chaincfg.SigNetParams.Name, -1))
+		delete(histories, chaincfg.SigNetParams.Name)
+	}()
+
+	delete(histories, network)
+	require.NoError(t, restoreBlocks(testDB, network))
+
+	t.Run("restores the tip", func(t *testing.T) {
+		tip, ok := recentBlocks(network).tip()
+		require.True(t, ok)
+		assert.Equal(t, blocks[len(blocks)-1], tip)
+	})
+
+	t.Run("restores blocks in order", func(t *testing.T) {
+		assert.Equal(t, blocks[len(blocks)-maxReorgDepth:], recentBlocks(network).blocks)
+	})
+
+	t.Run("forgets disconnected blocks", func(t *testing.T) {
+		require.NoError(t, db.DeleteBlocksAbove(testDB, network, 50))
+
+		delete(histories, network)
+		require.NoError(t, restoreBlocks(testDB, network))
+
+		tip, ok := recentBlocks(network).tip()
+		require.True(t, ok)
+		assert.Equal(t, int64(50), tip.height)
+	})
+}
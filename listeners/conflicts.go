@@ -0,0 +1,399 @@
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/outbox"
+)
+
+const eventTxReplaced = "tx_replaced"
+
+// mempoolTx is a watched transaction that is not confirmed yet
+type mempoolTx struct {
+	// network is the name of the network the transaction belongs to
+	network string
+	txid    chainhash.Hash
+	inputs  []wire.OutPoint
+	// outputValue is the sum of all outputs of the transaction
+	outputValue btcutil.Amount
+	// firstSeen is when we indexed the transaction
+	firstSeen time.Time
+}
+
+var (
+	conflictMu sync.Mutex
+	// spentInputs connects the inputs of watched mempool transactions to the transaction
+	// spending them. Any other transaction spending one of these inputs conflicts with the
+	// watched transaction.
+	spentInputs = make(map[wire.OutPoint]*mempoolTx)
+	// mempoolTxs are the watched mempool transactions we have indexed the inputs of
+	mempoolTxs = make(map[chainhash.Hash]*mempoolTx)
+)
+
+// outputValue sums up the outputs of the transaction
+func outputValue(tx *wire.MsgTx) btcutil.Amount {
+	var value btcutil.Amount
+	for _, output := range tx.TxOut {
+		value += btcutil.Amount(output.Value)
+	}
+	return value
+}
+
+// isWatchedUnconfirmed checks if anyone is waiting on the transaction to confirm
+func isWatchedUnconfirmed(txid chainhash.Hash) bool {
+	txidMu.Lock()
+	defer txidMu.Unlock()
+
+	for _, tx := range WatchedTxids[txid.String()] {
+		if tx.confirmedAtBlock == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ListMempoolTxids lists the watched transactions we've seen in the mempool of the network,
+// and that haven't confirmed or left it since
+func ListMempoolTxids(network string) []chainhash.Hash {
+	conflictMu.Lock()
+	defer conflictMu.Unlock()
+
+	txids := make([]chainhash.Hash, 0, len(mempoolTxs))
+	for txid, indexed := range mempoolTxs {
+		if indexed.network == network {
+			txids = append(txids, txid)
+		}
+	}
+	return txids
+}
+
+// indexInputs indexes the inputs of the transaction if it's a watched mempool transaction,
+// so we can tell if it is replaced or double-spent later on
+func indexInputs(tx *wire.MsgTx, network string) {
+	txid := tx.TxHash()
+	if !isWatchedUnconfirmed(txid) {
+		return
+	}
+
+	conflictMu.Lock()
+	defer conflictMu.Unlock()
+
+	if _, ok := mempoolTxs[txid]; ok {
+		return
+	}
+
+	indexed := &mempoolTx{
+		network:     network,
+		txid:        txid,
+		outputValue: outputValue(tx),
+		firstSeen:   time.Now(),
+	}
+	for _, input := range tx.TxIn {
+		indexed.inputs = append(indexed.inputs, input.PreviousOutPoint)
+		spentInputs[input.PreviousOutPoint] = indexed
+	}
+	mempoolTxs[txid] = indexed
+}
+
+// forgetInputs removes the transaction from the index. The caller must hold conflictMu.
+func forgetInputs(txid chainhash.Hash) {
+	indexed, ok := mempoolTxs[txid]
+	if !ok {
+		return
+	}
+
+	for _, input := range indexed.inputs {
+		if spentInputs[input] == indexed {
+			delete(spentInputs, input)
+		}
+	}
+	delete(mempoolTxs, txid)
+}
+
+// restoreInputs puts a transaction forgotten by matchConflicts back in the index
+func restoreInputs(indexed *mempoolTx) {
+	conflictMu.Lock()
+	defer conflictMu.Unlock()
+
+	if _, ok := mempoolTxs[indexed.txid]; ok {
+		return
+	}
+	for _, input := range indexed.inputs {
+		if _, ok := spentInputs[input]; !ok {
+			spentInputs[input] = indexed
+		}
+	}
+	mempoolTxs[indexed.txid] = indexed
+}
+
+// forgetConfirmedInputs removes a transaction that was just confirmed from the index
+func forgetConfirmedInputs(txid chainhash.Hash) {
+	conflictMu.Lock()
+	defer conflictMu.Unlock()
+
+	forgetInputs(txid)
+}
+
+// matchConflicts looks for watched mempool transactions spending the same inputs as the given
+// transaction. Those transactions have been replaced (e.g. through BIP125) or double-spent,
+// and will never confirm.
+func matchConflicts(database *db.DB, tx *wire.MsgTx) {
+	txid := tx.TxHash()
+
+	conflictMu.Lock()
+	var replaced []*mempoolTx
+	for _, input := range tx.TxIn {
+		indexed, ok := spentInputs[input.PreviousOutPoint]
+		if !ok || indexed.txid == txid {
+			continue
+		}
+
+		replaced = append(replaced, indexed)
+		forgetInputs(indexed.txid)
+		rememberReplaced(indexed.txid)
+	}
+	conflictMu.Unlock()
+
+	for _, original := range replaced {
+		replaceTx(database, original, tx)
+	}
+}
+
+// sameInputs checks if the replacement spends exactly the same inputs as the original
+func sameInputs(original *mempoolTx, replacement *wire.MsgTx) bool {
+	if len(original.inputs) != len(replacement.TxIn) {
+		return false
+	}
+
+	inputs := make(map[wire.OutPoint]bool, len(original.inputs))
+	for _, input := range original.inputs {
+		inputs[input] = true
+	}
+	for _, input := range replacement.TxIn {
+		if !inputs[input.PreviousOutPoint] {
+			return false
+		}
+	}
+	return true
+}
+
+// replacement describes a transaction replacing a watched transaction
+type replacement struct {
+	txid chainhash.Hash
+	// amountDelta is how much more the replacement sends to its outputs
+	amountDelta btcutil.Amount
+	// feeDelta is how much more fee the replacement pays. It is only known if the replacement
+	// spends the same inputs as the original transaction.
+	feeDelta *btcutil.Amount
+}
+
+// replaceTx notifies everyone waiting on the original transaction that it was replaced. The
+// watches either follow the replacement, or are dropped.
+func replaceTx(database *db.DB, original *mempoolTx, tx *wire.MsgTx) {
+	replaced := replacement{
+		txid:        tx.TxHash(),
+		amountDelta: outputValue(tx) - original.outputValue,
+	}
+	if sameInputs(original, tx) {
+		// with the same inputs, every satoshi not sent to the outputs goes to fees
+		feeDelta := -replaced.amountDelta
+		replaced.feeDelta = &feeDelta
+	}
+
+	txidMu.Lock()
+	var watches []TxWatch
+	for _, watch := range WatchedTxids[original.txid.String()] {
+		if watch.confirmedAtBlock == nil {
+			watches = append(watches, watch)
+		}
+	}
+	txidMu.Unlock()
+
+	var retry bool
+	for _, watch := range watches {
+		log := log.WithFields(logrus.Fields{
+			"txid":        watch.txid.String(),
+			"replacement": replaced.txid.String(),
+			"ID":          watch.ID,
+		})
+		log.Info("watched transaction was replaced")
+
+		// the replacement spends the outpoint as well, so it is the new answer to who spent it
+		follow := watch.followReplacements || watch.spends != nil
+		err := database.Transact(func(q db.Querier) error {
+			return SendTxReplaced(q, watch, replaced, follow)
+		})
+		if err != nil {
+			log.WithError(err).Error("could not notify about replaced tx, retrying once the replacement is mined")
+			retry = true
+			continue
+		}
+
+		if follow {
+			err = followReplacement(database, watch, tx)
+		} else {
+			err = dropTxWatch(database, watch)
+		}
+		if err != nil {
+			log.WithError(err).Error("could not handle replaced tx watch")
+		}
+	}
+
+	// the watches we couldn't notify are still on the original transaction, which conflicts
+	// with the replacement again once it's in a block
+	if retry {
+		restoreInputs(original)
+	}
+}
+
+// followReplacement moves the watch over to the replacement transaction. The watch is only
+// removed from memory once the database agrees, so a failure leaves it as it was.
+func followReplacement(database *db.DB, watch TxWatch, tx *wire.MsgTx) error {
+	replaced := watch
+
+	// the notification might already be watching the replacement, e.g. if it pays to the
+	// same address. There's no need for two watches.
+	txidMu.Lock()
+	var duplicate bool
+	for _, existing := range WatchedTxids[tx.TxHash().String()] {
+		duplicate = duplicate || existing.notificationID == watch.notificationID
+	}
+	txidMu.Unlock()
+
+	if duplicate {
+		return dropTxWatch(database, replaced)
+	}
+
+	if watch.spends != nil {
+		spends := false
+		for index, input := range tx.TxIn {
+			if input.PreviousOutPoint == watch.spends.outpoint {
+				watch.spends = &spend{outpoint: watch.spends.outpoint, inputIndex: uint32(index)}
+				spends = true
+				break
+			}
+		}
+
+		// the replacement conflicts on another input, leaving the outpoint unspent
+		if !spends {
+			if err := db.DeleteTxWatch(database, watch.ID); err != nil {
+				return err
+			}
+			forgetTxWatch(replaced)
+			WatchOutpoint(watch.spends.outpoint, OutpointWatch{
+				ID:          watch.notificationID,
+				Network:     watch.network,
+				Notify:      watch.notify,
+				Milestones:  watch.milestones,
+				Description: watch.description,
+			})
+			return nil
+		}
+	}
+
+	watch.txid = tx.TxHash()
+	var inputIndex *uint32
+	if watch.spends != nil {
+		inputIndex = &watch.spends.inputIndex
+	}
+	err := db.ReplaceTxWatch(database, watch.ID, watch.txid.String(), inputIndex)
+	switch {
+	case errors.Is(err, db.ErrTxWatchExists):
+		// we haven't loaded the watch for the replacement yet, but it's in the database
+		return dropTxWatch(database, replaced)
+	case err != nil:
+		return fmt.Errorf("could not move tx watch to replacement: %w", err)
+	}
+
+	forgetTxWatch(replaced)
+	return WatchTX(watch)
+}
+
+// indexMempoolTx fetches a watched transaction from the mempool and indexes its inputs, and
+// notifies the watches waiting for it to enter the mempool. Transactions the source doesn't
+// know about are ignored, we'll index them when they show up.
+func indexMempoolTx(source backend.ChainSource, database *db.DB, network string, txid chainhash.Hash) {
+	tx, err := source.MempoolTransaction(txid)
+	if err != nil {
+		log.WithField("txid", txid.String()).WithError(err).Debug("could not get watched transaction")
+		return
+	}
+
+	matchTxids(database, tx, network)
+	indexInputs(tx, network)
+}
+
+// dropTxWatch stops watching a transaction that will never confirm
+func dropTxWatch(database *db.DB, watch TxWatch) error {
+	if err := db.MarkTxWatchFired(database, watch.ID); err != nil {
+		return err
+	}
+
+	forgetTxWatch(watch)
+	return nil
+}
+
+// forgetTxWatch removes a single watch from memory
+func forgetTxWatch(watch TxWatch) {
+	txidMu.Lock()
+	defer txidMu.Unlock()
+
+	deleteTxWatch(watch)
+}
+
+func txReplacedEmail(tx TxWatch, replaced replacement, follow bool) string {
+	body := fmt.Sprintf(`Transaction was replaced or double-spent
+txid: %s
+replaced by txid: %s
+amount delta: %f BTC`, tx.txid.String(), replaced.txid.String(), replaced.amountDelta.ToBTC())
+	if replaced.feeDelta != nil {
+		body += fmt.Sprintf("\nfee delta: %f BTC", replaced.feeDelta.ToBTC())
+	}
+	if follow {
+		body += fmt.Sprintf("\n\nYou will be notified when the replacement has %d confirmations.", tx.wantConfirmations())
+	}
+	if tx.description != "" {
+		body += fmt.Sprintf("\ndescription: %s", tx.description)
+	}
+
+	return body
+}
+
+// SendTxReplaced notifies that a watched transaction was replaced or double-spent
+func SendTxReplaced(database db.Querier, tx TxWatch, replaced replacement, follow bool) error {
+	log := log.WithFields(logrus.Fields{
+		"channels":    tx.notify.Channels,
+		"txid":        tx.txid,
+		"replacement": replaced.txid,
+		"ID":          tx.ID,
+	})
+
+	payload := txPayload(tx, eventTxReplaced)
+	payload["replacementTxid"] = replaced.txid.String()
+	payload["amountDelta"] = replaced.amountDelta
+	payload["feeDelta"] = replaced.feeDelta
+	payload["followsReplacement"] = follow
+
+	err := outbox.EnqueueTx(database, tx.notify.Channels, outbox.Message{
+		NotificationID: tx.notificationID,
+		Subject:        "Transaction was replaced",
+		Text:           txReplacedEmail(tx, replaced, follow),
+		Header:         "Transaction replaced",
+		Payload:        payload,
+	})
+	if err != nil {
+		log.WithError(err).Error("could not queue notification")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package listeners
+
+import (
+	"testing"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/db/dbtest"
+)
+
+// mockConflictingTxs creates a transaction along with a replacement spending the same input,
+// paying 1000 satoshis more in fees
+func mockConflictingTxs() (*wire.MsgTx, *wire.MsgTx) {
+	input := wire.OutPoint{Hash: chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))}
+
+	var original wire.MsgTx
+	original.AddTxIn(wire.NewTxIn(&input, nil, nil))
+	original.AddTxOut(wire.NewTxOut(50_000, nil))
+
+	var replacement wire.MsgTx
+	replacement.AddTxIn(wire.NewTxIn(&input, nil, nil))
+	replacement.AddTxOut(wire.NewTxOut(49_000, nil))
+
+	return &original, &replacement
+}
+
+func TestSameInputs(t *testing.T) {
+	original, replacement := mockConflictingTxs()
+	indexed := &mempoolTx{inputs: []wire.OutPoint{original.TxIn[0].PreviousOutPoint}}
+
+	assert.True(t, sameInputs(indexed, replacement))
+
+	replacement.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))},
+		nil, nil))
+	assert.False(t, sameInputs(indexed, replacement))
+}
+
+func TestMatchConflicts(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	t.Run("drops replaced watch", func(t *testing.T) {
+		original, replacement := mockConflictingTxs()
+		notification := createNotificationTest(t, original.TxHash().String(), 1)
+		require.NoError(t, AddTXFromString(testDB, chaincfg.RegressionNetParams.Name, notification.ID, notification.Identifier, []int64{1},
+			Notification{}, notification.Description, false))
+		defer delete(WatchedTxids, original.TxHash().String())
+
+		indexInputs(original, chaincfg.RegressionNetParams.Name)
+		require.Contains(t, mempoolTxs, original.TxHash())
+
+		matchConflicts(testDB, replacement)
+
+		assert.NotContains(t, WatchedTxids, original.TxHash().String())
+		assert.NotContains(t, WatchedTxids, replacement.TxHash().String())
+		assert.NotContains(t, mempoolTxs, original.TxHash())
+	})
+
+	t.Run("follows replacement", func(t *testing.T) {
+		original, replacement := mockConflictingTxs()
+		notification := createNotificationTest(t, original.TxHash().String(), 1)
+		require.NoError(t, AddTXFromString(testDB, chaincfg.RegressionNetParams.Name, notification.ID, notification.Identifier, []int64{1},
+			Notification{}, notification.Description, true))
+		defer delete(WatchedTxids, replacement.TxHash().String())
+
+		indexInputs(original, chaincfg.RegressionNetParams.Name)
+		matchConflicts(testDB, replacement)
+
+		assert.NotContains(t, WatchedTxids, original.TxHash().String())
+		require.Len(t, WatchedTxids[replacement.TxHash().String()], 1)
+		for _, watch := range WatchedTxids[replacement.TxHash().String()] {
+			assert.Equal(t, notification.ID, watch.notificationID)
+		}
+
+		// the replacement can be replaced as well
+		indexInputs(replacement, chaincfg.RegressionNetParams.Name)
+		assert.Contains(t, mempoolTxs, replacement.TxHash())
+		forgetConfirmedInputs(replacement.TxHash())
+	})
+
+	t.Run("ignores the transaction itself", func(t *testing.T) {
+		original, _ := mockConflictingTxs()
+		notification := createNotificationTest(t, original.TxHash().String(), 1)
+		require.NoError(t, AddTXFromString(testDB, chaincfg.RegressionNetParams.Name, notification.ID, notification.Identifier, []int64{1},
+			Notification{}, notification.Description, false))
+		defer delete(WatchedTxids, original.TxHash().String())
+
+		indexInputs(original, chaincfg.RegressionNetParams.Name)
+		defer forgetConfirmedInputs(original.TxHash())
+		matchConflicts(testDB, original)
+
+		assert.Contains(t, WatchedTxids, original.TxHash().String())
+	})
+}
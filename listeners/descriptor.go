@@ -0,0 +1,349 @@
+package listeners
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// scriptType is the kind of output script addresses of a wallet are made of
+type scriptType int
+
+const (
+	scriptP2PKH scriptType = iota
+	scriptP2SHP2WPKH
+	scriptP2WPKH
+	scriptP2WSHMulti
+	// scriptP2TR outputs pay to the BIP-86 tweak of the key, with no script path
+	scriptP2TR
+)
+
+// extendedKeyVersions maps SLIP-132 version bytes to the script type they imply, along with
+// the xpub/tpub version bytes of the network they belong to
+var extendedKeyVersions = map[string]struct {
+	script scriptType
+	base   string
+}{
+	"0488b21e": {script: scriptP2PKH, base: "0488b21e"},      // xpub
+	"049d7cb2": {script: scriptP2SHP2WPKH, base: "0488b21e"}, // ypub
+	"04b24746": {script: scriptP2WPKH, base: "0488b21e"},     // zpub
+	"043587cf": {script: scriptP2PKH, base: "043587cf"},      // tpub
+	"044a5262": {script: scriptP2SHP2WPKH, base: "043587cf"}, // upub
+	"045f1cf6": {script: scriptP2WPKH, base: "043587cf"},     // vpub
+}
+
+// descriptorKey is an extended public key, along with the derivation paths leading up to
+// the addresses of every branch of the wallet
+type descriptorKey struct {
+	key *hdkeychain.ExtendedKey
+	// branches are the paths from the key to the parent of the addresses, usually /0 for
+	// receive addresses and /1 for change addresses
+	branches [][]uint32
+}
+
+// walletDescriptor describes how to derive the addresses of a wallet
+type walletDescriptor struct {
+	script scriptType
+	keys   []descriptorKey
+	// threshold is the number of signatures required by multisig wallets
+	threshold int
+	// sorted is set for sortedmulti, where the public keys are sorted before creating the script
+	sorted bool
+}
+
+// isDescriptor checks if the identifier looks like an output descriptor, as opposed to a
+// plain extended public key
+func isDescriptor(identifier string) bool {
+	return strings.Contains(identifier, "(")
+}
+
+// parseWallet parses an extended public key (xpub, ypub, zpub and their testnet counterparts)
+// or an output descriptor. Plain extended public keys derive receive addresses at /0/* and
+// change addresses at /1/*, with the address type given by the key version.
+//
+// Supported descriptors are pkh(), wpkh(), sh(wpkh()), tr(), wsh(multi()) and wsh(sortedmulti()).
+// tr() takes a single key, script trees are not supported.
+// Key expressions have to be ranged, e.g. xpub.../0/* or xpub.../<0;1>/*. A key ending in
+// /0/* gets a change branch at /1/* as well.
+func parseWallet(identifier string, network *chaincfg.Params) (walletDescriptor, error) {
+	// we don't verify the checksum, it's there to catch typos when copying descriptors around
+	// and a typo will most likely make the descriptor invalid anyway
+	if index := strings.LastIndex(identifier, "#"); index != -1 {
+		identifier = identifier[:index]
+	}
+	identifier = strings.TrimSpace(identifier)
+
+	if !isDescriptor(identifier) {
+		key, script, err := parseExtendedKey(identifier, network)
+		if err != nil {
+			return walletDescriptor{}, err
+		}
+		return walletDescriptor{
+			script: script,
+			keys: []descriptorKey{{
+				key:      key,
+				branches: [][]uint32{{0}, {1}},
+			}},
+		}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(identifier, "tr("):
+		if strings.Contains(identifier, ",") {
+			return walletDescriptor{}, errors.New("taproot script trees are not supported")
+		}
+		return parseSingleKeyDescriptor(identifier, "tr(", ")", scriptP2TR, network)
+
+	case strings.HasPrefix(identifier, "pkh("):
+		return parseSingleKeyDescriptor(identifier, "pkh(", ")", scriptP2PKH, network)
+
+	case strings.HasPrefix(identifier, "wpkh("):
+		return parseSingleKeyDescriptor(identifier, "wpkh(", ")", scriptP2WPKH, network)
+
+	case strings.HasPrefix(identifier, "sh(wpkh("):
+		return parseSingleKeyDescriptor(identifier, "sh(wpkh(", "))", scriptP2SHP2WPKH, network)
+
+	case strings.HasPrefix(identifier, "wsh(multi("):
+		return parseMultiDescriptor(identifier, "wsh(multi(", false, network)
+
+	case strings.HasPrefix(identifier, "wsh(sortedmulti("):
+		return parseMultiDescriptor(identifier, "wsh(sortedmulti(", true, network)
+	}
+
+	return walletDescriptor{}, errors.New("unsupported output descriptor")
+}
+
+func parseSingleKeyDescriptor(identifier, prefix, suffix string, script scriptType,
+	network *chaincfg.Params) (walletDescriptor, error) {
+	if !strings.HasSuffix(identifier, suffix) {
+		return walletDescriptor{}, fmt.Errorf("descriptor is missing closing %q", suffix)
+	}
+
+	key, err := parseKeyExpression(strings.TrimSuffix(strings.TrimPrefix(identifier, prefix), suffix), network)
+	if err != nil {
+		return walletDescriptor{}, err
+	}
+
+	return walletDescriptor{script: script, keys: []descriptorKey{key}}, nil
+}
+
+func parseMultiDescriptor(identifier, prefix string, sorted bool, network *chaincfg.Params) (walletDescriptor,
+	error) {
+	if !strings.HasSuffix(identifier, "))") {
+		return walletDescriptor{}, errors.New(`descriptor is missing closing "))"`)
+	}
+
+	args := strings.Split(strings.TrimSuffix(strings.TrimPrefix(identifier, prefix), "))"), ",")
+	if len(args) < 2 {
+		return walletDescriptor{}, errors.New("multisig descriptor needs a threshold and at least one key")
+	}
+
+	threshold, err := strconv.Atoi(args[0])
+	if err != nil {
+		return walletDescriptor{}, fmt.Errorf("invalid multisig threshold: %w", err)
+	}
+	if threshold < 1 || threshold > len(args)-1 {
+		return walletDescriptor{}, fmt.Errorf("multisig threshold must be between 1 and %d", len(args)-1)
+	}
+
+	descriptor := walletDescriptor{
+		script:    scriptP2WSHMulti,
+		threshold: threshold,
+		sorted:    sorted,
+	}
+	for _, arg := range args[1:] {
+		key, err := parseKeyExpression(arg, network)
+		if err != nil {
+			return walletDescriptor{}, err
+		}
+		if len(descriptor.keys) > 0 && len(key.branches) != len(descriptor.keys[0].branches) {
+			return walletDescriptor{}, errors.New("every multisig key must have the same number of branches")
+		}
+		descriptor.keys = append(descriptor.keys, key)
+	}
+
+	return descriptor, nil
+}
+
+// parseKeyExpression parses a ranged key expression, e.g. [d34db33f/84'/0'/0']xpub.../0/*
+func parseKeyExpression(expression string, network *chaincfg.Params) (descriptorKey, error) {
+	// the key origin is informational only
+	if strings.HasPrefix(expression, "[") {
+		end := strings.Index(expression, "]")
+		if end == -1 {
+			return descriptorKey{}, errors.New("key origin is missing closing ]")
+		}
+		expression = expression[end+1:]
+	}
+
+	steps := strings.Split(expression, "/")
+	key, _, err := parseExtendedKey(steps[0], network)
+	if err != nil {
+		return descriptorKey{}, err
+	}
+
+	steps = steps[1:]
+	if len(steps) == 0 || steps[len(steps)-1] != "*" {
+		return descriptorKey{}, errors.New("key must be ranged, e.g. xpub.../0/*")
+	}
+	steps = steps[:len(steps)-1]
+
+	branches := [][]uint32{nil}
+	for _, step := range steps {
+		// multipath steps like <0;1> split the key into several branches
+		if strings.HasPrefix(step, "<") && strings.HasSuffix(step, ">") {
+			if len(branches) > 1 {
+				return descriptorKey{}, errors.New("only one multipath step is allowed")
+			}
+
+			var split [][]uint32
+			for _, alternative := range strings.Split(strings.Trim(step, "<>"), ";") {
+				index, err := parseDerivationStep(alternative)
+				if err != nil {
+					return descriptorKey{}, err
+				}
+				split = append(split, append(append([]uint32{}, branches[0]...), index))
+			}
+			branches = split
+			continue
+		}
+
+		index, err := parseDerivationStep(step)
+		if err != nil {
+			return descriptorKey{}, err
+		}
+		for i := range branches {
+			branches[i] = append(branches[i], index)
+		}
+	}
+
+	// by convention, wallets keep their change addresses next to the receive addresses
+	if len(branches) == 1 && len(steps) > 0 && branches[0][len(branches[0])-1] == 0 {
+		change := append([]uint32{}, branches[0]...)
+		change[len(change)-1] = 1
+		branches = append(branches, change)
+	}
+
+	return descriptorKey{key: key, branches: branches}, nil
+}
+
+func parseDerivationStep(step string) (uint32, error) {
+	if strings.HasSuffix(step, "'") || strings.HasSuffix(step, "h") {
+		return 0, errors.New("hardened derivation requires a private key")
+	}
+
+	index, err := strconv.ParseUint(step, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("invalid derivation step %q: %w", step, err)
+	}
+	return uint32(index), nil
+}
+
+// parseExtendedKey parses an extended public key, returning the script type implied by
+// its version
+func parseExtendedKey(encoded string, network *chaincfg.Params) (*hdkeychain.ExtendedKey, scriptType, error) {
+	key, err := hdkeychain.NewKeyFromString(encoded)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid extended key: %w", err)
+	}
+	if key.IsPrivate() {
+		return nil, 0, errors.New("extended private keys are not accepted, use the public key instead")
+	}
+
+	version, ok := extendedKeyVersions[hex.EncodeToString(key.Version())]
+	if !ok {
+		return nil, 0, errors.New("unknown extended key version")
+	}
+	if version.base != hex.EncodeToString(network.HDPublicKeyID[:]) {
+		return nil, 0, fmt.Errorf("extended key is not for %s", network.Name)
+	}
+
+	return key, version.script, nil
+}
+
+// branches returns how many branches the wallet derives addresses on
+func (w walletDescriptor) branches() int {
+	return len(w.keys[0].branches)
+}
+
+// address derives the address at the given index of the given branch
+func (w walletDescriptor) address(branch int, index uint32, network *chaincfg.Params) (btcutil.Address, error) {
+	var pubKeys []*btcec.PublicKey
+	for _, key := range w.keys {
+		path := append(append([]uint32{}, key.branches[branch]...), index)
+
+		derived := key.key
+		for _, step := range path {
+			var err error
+			derived, err = derived.Derive(step)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pubKey, err := derived.ECPubKey()
+		if err != nil {
+			return nil, err
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	switch w.script {
+	case scriptP2PKH:
+		return btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKeys[0].SerializeCompressed()), network)
+
+	case scriptP2WPKH:
+		return btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKeys[0].SerializeCompressed()), network)
+
+	case scriptP2SHP2WPKH:
+		witnessProgram, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_0).
+			AddData(btcutil.Hash160(pubKeys[0].SerializeCompressed())).
+			Script()
+		if err != nil {
+			return nil, err
+		}
+		return btcutil.NewAddressScriptHash(witnessProgram, network)
+
+	case scriptP2TR:
+		outputKey := txscript.ComputeTaprootKeyNoScript(pubKeys[0])
+		return btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), network)
+
+	case scriptP2WSHMulti:
+		if w.sorted {
+			sort.Slice(pubKeys, func(i, j int) bool {
+				return bytes.Compare(pubKeys[i].SerializeCompressed(), pubKeys[j].SerializeCompressed()) < 0
+			})
+		}
+
+		var addresses []*btcutil.AddressPubKey
+		for _, pubKey := range pubKeys {
+			address, err := btcutil.NewAddressPubKey(pubKey.SerializeCompressed(), network)
+			if err != nil {
+				return nil, err
+			}
+			addresses = append(addresses, address)
+		}
+
+		script, err := txscript.MultiSigScript(addresses, w.threshold)
+		if err != nil {
+			return nil, err
+		}
+		scriptHash := sha256.Sum256(script)
+		return btcutil.NewAddressWitnessScriptHash(scriptHash[:], network)
+	}
+
+	return nil, fmt.Errorf("unknown script type %d", w.script)
+}
@@ -0,0 +1,96 @@
+package listeners
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// zpub, ypub and xpub from the BIP84, BIP49 and BIP86 test vectors
+const (
+	bip84Zpub = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+	bip49Ypub = "ypub6Ww3ibxVfGzLrAH1PNcjyAWenMTbbAosGNB6VvmSEgytSER9azLDWCxoJwW7Ke7icmizBMXrzBx9979FfaHxHcrArf3zbeJJJUZPf663zsP"
+	bip86Xpub = "xpub6BgBgsespWvERF3LHQu6CnqdvfEvtMcQjYrcRzx53QJjSxarj2afYWcLteoGVky7D3UKDP9QyrLprQ3VCECoY49yfdDEHGCtMMj92pReUsQ"
+)
+
+func mockExtendedKey(t *testing.T, network *chaincfg.Params) *hdkeychain.ExtendedKey {
+	seed := []byte(gofakeit.LetterN(hdkeychain.RecommendedSeedLen))
+	key, err := hdkeychain.NewMaster(seed, network)
+	require.NoError(t, err)
+	return key
+}
+
+func mockXpub(t *testing.T, network *chaincfg.Params) string {
+	key, err := mockExtendedKey(t, network).Neuter()
+	require.NoError(t, err)
+	return key.String()
+}
+
+func deriveTest(t *testing.T, identifier string, branch int, index uint32) string {
+	descriptor, err := parseWallet(identifier, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+
+	address, err := descriptor.address(branch, index, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	return address.String()
+}
+
+func TestParseWallet(t *testing.T) {
+	t.Run("derives native segwit addresses from zpub", func(t *testing.T) {
+		assert.Equal(t, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", deriveTest(t, bip84Zpub, 0, 0))
+		assert.Equal(t, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g", deriveTest(t, bip84Zpub, 0, 1))
+		assert.Equal(t, "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el", deriveTest(t, bip84Zpub, 1, 0))
+	})
+
+	t.Run("derives nested segwit addresses from ypub", func(t *testing.T) {
+		assert.Equal(t, "37VucYSaXLCAsxYyAPfbSi9eh4iEcbShgf", deriveTest(t, bip49Ypub, 0, 0))
+	})
+
+	t.Run("derives taproot addresses from tr descriptor", func(t *testing.T) {
+		descriptor := fmt.Sprintf("tr([73c5da0a/86'/0'/0']%s/0/*)", bip86Xpub)
+		assert.Equal(t, "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr", deriveTest(t, descriptor, 0, 0))
+		assert.Equal(t, "bc1p4qhjn9zdvkux4e44uhx8tc55attvtyu358kutcqkudyccelu0was9fqzwh", deriveTest(t, descriptor, 0, 1))
+		assert.Equal(t, "bc1p3qkhfews2uk44qtvauqyr2ttdsw7svhkl9nkm9s9c3x4ax5h60wqwruhk7", deriveTest(t, descriptor, 1, 0))
+	})
+
+	t.Run("descriptor derives the same addresses as extended key", func(t *testing.T) {
+		descriptor := fmt.Sprintf("wpkh([d34db33f/84'/0'/0']%s/0/*)#checksum", bip84Zpub)
+		assert.Equal(t, deriveTest(t, bip84Zpub, 0, 5), deriveTest(t, descriptor, 0, 5))
+		assert.Equal(t, deriveTest(t, bip84Zpub, 1, 5), deriveTest(t, descriptor, 1, 5))
+	})
+
+	t.Run("can parse multipath descriptor", func(t *testing.T) {
+		descriptor, err := parseWallet(fmt.Sprintf("wpkh(%s/<0;1>/*)", bip84Zpub), &chaincfg.MainNetParams)
+		require.NoError(t, err)
+		assert.Equal(t, 2, descriptor.branches())
+	})
+
+	t.Run("sortedmulti does not depend on key order", func(t *testing.T) {
+		first := mockXpub(t, &chaincfg.MainNetParams)
+		second := mockXpub(t, &chaincfg.MainNetParams)
+
+		address := deriveTest(t, fmt.Sprintf("wsh(sortedmulti(1,%s/0/*,%s/0/*))", first, second), 0, 0)
+		assert.Equal(t, address, deriveTest(t, fmt.Sprintf("wsh(sortedmulti(1,%s/0/*,%s/0/*))", second, first), 0, 0))
+		assert.Len(t, address, 62, "expected P2WSH address")
+	})
+
+	for name, identifier := range map[string]string{
+		"rejects taproot script trees":   fmt.Sprintf("tr(%s/0/*,pk(%s/1/*))", bip86Xpub, bip86Xpub),
+		"rejects unranged keys":          fmt.Sprintf("wpkh(%s/0/1)", bip84Zpub),
+		"rejects hardened derivation":    fmt.Sprintf("wpkh(%s/0'/*)", bip84Zpub),
+		"rejects too high threshold":     fmt.Sprintf("wsh(multi(2,%s/0/*))", bip84Zpub),
+		"rejects keys for other network": mockXpub(t, &chaincfg.TestNet3Params),
+		"rejects private keys":           mockExtendedKey(t, &chaincfg.MainNetParams).String(),
+	} {
+		identifier := identifier
+		t.Run(name, func(t *testing.T) {
+			_, err := parseWallet(identifier, &chaincfg.MainNetParams)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,198 +1,580 @@
 package listeners
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"sync"
 
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 
-	"github.com/bjornoj/txnotify/email"
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/outbox"
 )
 
 var log = logrus.New()
 
-func WatchIdentifier(network *chaincfg.Params, identifier string, to Notification, description string, wantConfirmations int64) error {
-	address, err := btcutil.DecodeAddress(identifier, network)
+// ValidateIdentifier checks that the identifier is something we know how to watch
+func ValidateIdentifier(network *chaincfg.Params, identifier string) error {
+	if _, err := decodeAddress(identifier, network); err == nil {
+		return nil
+	}
+	if _, err := chainhash.NewHashFromStr(identifier); err == nil {
+		return nil
+	}
+	if _, err := parseOutpoint(identifier); err == nil {
+		return nil
+	}
+	if _, err := parseWallet(identifier, network); err == nil {
+		return nil
+	} else if isDescriptor(identifier) {
+		return fmt.Errorf("invalid output descriptor: %w", err)
+	}
+
+	return errors.New("Identifier was neither a bitcoin address, a bitcoin txid, an outpoint or a wallet.")
+}
+
+// IsAddressIdentifier checks if the identifier is watched through addresses, i.e. it is an
+// address or a wallet, rather than a txid or an outpoint
+func IsAddressIdentifier(network *chaincfg.Params, identifier string) bool {
+	if _, err := decodeAddress(identifier, network); err == nil {
+		return true
+	}
+	_, err := parseWallet(identifier, network)
+	return err == nil
+}
+
+// decodeAddress decodes an address, making sure it belongs to the network. btcutil only
+// checks this for base58 addresses, not bech32 ones.
+func decodeAddress(encoded string, network *chaincfg.Params) (btcutil.Address, error) {
+	address, err := btcutil.DecodeAddress(encoded, network)
 	if err != nil {
-		err := AddTXFromString(identifier, wantConfirmations, to, description)
+		return nil, err
+	}
+	if !address.IsForNet(network) {
+		return nil, fmt.Errorf("address %s is not for %s", encoded, network.Name)
+	}
+	return address, nil
+}
+
+// WatchIdentifier starts watching the identifier of a saved notification
+func WatchIdentifier(database *db.DB, source backend.ChainSource, network *chaincfg.Params,
+	notification db.Notification) error {
+	if outpoint, err := parseOutpoint(notification.Identifier); err == nil {
+		WatchOutpoint(outpoint, outpointWatch(notification))
+		return nil
+	}
+
+	if descriptor, err := parseWallet(notification.Identifier, network); err == nil {
+		addresses, err := watchWallet(descriptor, network, addressWatch(notification), nil)
+		if err != nil {
+			return fmt.Errorf("could not watch wallet: %w", err)
+		}
+		go seedWallet(source, database, network.Name, addresses)
+		return nil
+	}
+
+	address, err := decodeAddress(notification.Identifier, network)
+	if err != nil {
+		err := AddTXFromString(database, network.Name, notification.ID, notification.Identifier,
+			notificationMilestones(notification), notificationChannels(notification), notification.Description,
+			notification.FollowReplacements)
 		if err != nil {
-			return errors.New("Identifier was neither a bitcoin address or a bitcoin txid.")
+			return errors.New("Identifier was neither a bitcoin address, a bitcoin txid, an outpoint or a wallet.")
+		}
+
+		// the transaction might be in the mempool already, in which case we won't see it
+		// again until it confirms
+		if txid, err := chainhash.NewHashFromStr(notification.Identifier); err == nil {
+			go indexMempoolTx(source, database, network.Name, *txid)
 		}
 		return nil
 	}
 
-	WatchAddress(address, to, description, wantConfirmations)
+	WatchAddress(address, addressWatch(notification))
+	go seedOutpoints(source, database, network.Name, address)
 	return nil
 }
 
 type AddressWatch struct {
-	ID                uuid.UUID
-	Notify            Notification
-	WantConfirmations int64
-	Description       string
+	// ID is the ID of the notification this watch belongs to
+	ID uuid.UUID
+	// Network is the name of the network the address belongs to. Some networks share address
+	// encodings, so we need to tell them apart.
+	Network string
+	Notify  Notification
+	// Milestones are the confirmation counts to notify at, in ascending order
+	Milestones  []int64
+	Description string
+	// FollowReplacements moves the watches of transactions paying to the address over to
+	// their replacements, if they are replaced or double-spent
+	FollowReplacements bool
+	// MinAmount and MaxAmount limit which payments to the address we notify about. Zero
+	// means no limit.
+	MinAmount btcutil.Amount
+	MaxAmount btcutil.Amount
+}
+
+// inRange checks if the amount is within the amount limits of the watch
+func (w AddressWatch) inRange(amount btcutil.Amount) bool {
+	if w.MinAmount != 0 && amount < w.MinAmount {
+		return false
+	}
+	if w.MaxAmount != 0 && amount > w.MaxAmount {
+		return false
+	}
+	return true
 }
 
 var (
 	mu sync.Mutex
-	// WatchedAddresses is a map connecting bitcoin addresses to emails
-	WatchedAddresses = make(map[string]AddressWatch) // map[bitcoin address]email
+	// WatchedAddresses is a map connecting bitcoin addresses to every subscription watching
+	// them, keyed by notification ID
+	WatchedAddresses = make(map[string]map[uuid.UUID]AddressWatch) // map[bitcoin address]map[notification ID]
 )
 
-func WatchAddress(address btcutil.Address, to Notification, description string, wantConfirmations int64) {
+func WatchAddress(address btcutil.Address, watch AddressWatch) {
 	mu.Lock()
 	defer mu.Unlock()
 
 	log.WithField("address", address.String()).Info("starting to watch address")
 
-	addr := AddressWatch{
-		ID:                uuid.New(),
-		Notify:            to,
-		WantConfirmations: wantConfirmations,
-		Description:       description,
+	if _, ok := WatchedAddresses[address.String()]; !ok {
+		WatchedAddresses[address.String()] = make(map[uuid.UUID]AddressWatch)
+	}
+	WatchedAddresses[address.String()][watch.ID] = watch
+}
+
+// addressWatches returns every subscription watching the given address on the network
+func addressWatches(address, network string) []AddressWatch {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var watches []AddressWatch
+	for _, watch := range WatchedAddresses[address] {
+		if watch.Network == network {
+			watches = append(watches, watch)
+		}
+	}
+	return watches
+}
+
+// IsWatchedAddress checks if anyone is watching the address on the network
+func IsWatchedAddress(address, network string) bool {
+	return len(addressWatches(address, network)) > 0
+}
+
+// ListWatchedAddresses lists every address someone is watching on the network
+func ListWatchedAddresses(network string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	addresses := make([]string, 0, len(WatchedAddresses))
+	for address, watches := range WatchedAddresses {
+		for _, watch := range watches {
+			if watch.Network == network {
+				addresses = append(addresses, address)
+				break
+			}
+		}
 	}
-	WatchedAddresses[address.String()] = addr
+	return addresses
 }
 
 // OnchainTx checks if a transaction is being watched
-func OnchainTx(zmqTxs <-chan *wire.MsgTx, sender email.EmailSender, btc *rpcclient.Client,
-	network chaincfg.Params) {
+func OnchainTx(source backend.ChainSource, database *db.DB, network chaincfg.Params) {
+	for tx := range source.Transactions() {
+
+		// conflicts go first, so watches following a replacement are in place before we
+		// look at what the replacement pays to
+		matchConflicts(database, tx)
+		forgetReplacedOutputs(database, network.Name, tx)
+		matchSpends(database, tx, network, nil)
+		matchOutpointSpends(database, tx, network.Name)
+		matchAddresses(source, database, tx, network, nil)
+		matchTxids(database, tx, network.Name)
+		indexInputs(tx, network.Name)
+	}
+}
 
-	for {
-		tx := <-zmqTxs
-		txid := tx.TxHash()
+// matchTxids notifies the txid watches waiting for the transaction to enter the mempool, i.e.
+// the ones whose next milestone is 0 confirmations. Address and outpoint watches send that
+// milestone as they are created.
+func matchTxids(database *db.DB, tx *wire.MsgTx, network string) {
+	txid := tx.TxHash()
 
-		log := log.WithFields(
-			logrus.Fields{
-				"txid": txid.String(),
-			})
+	txidMu.Lock()
+	var seen []TxWatch
+	for _, watch := range WatchedTxids[txid.String()] {
+		if watch.network != network || watch.address != "" || watch.spends != nil ||
+			watch.confirmedAtBlock != nil || watch.milestonesSent >= len(watch.milestones) ||
+			watch.wantConfirmations() != 0 {
+			continue
+		}
+
+		// we might see the transaction from the mempool index and the source at the same
+		// time, so the milestone is claimed before we let go of the lock
+		claimed := watch
+		claimed.milestonesSent++
+		setTxWatch(claimed)
+		seen = append(seen, watch)
+	}
+	txidMu.Unlock()
+
+	for _, watch := range seen {
+		log := log.WithFields(logrus.Fields{
+			"txid": txid.String(),
+			"ID":   watch.ID,
+		})
+		log.Info("watched transaction entered the mempool")
+
+		_, err := fire(database, watch, func(q db.Querier) error {
+			return SendTxSeen(q, watch)
+		})
+		if err != nil {
+			// the milestone is sent once the transaction confirms instead
+			log.WithError(err).Error("could not notify about transaction in mempool")
+			unclaimMilestone(watch)
+		}
+	}
+}
+
+// unclaimMilestone gives back a milestone claimed by matchTxids that could not be sent
+func unclaimMilestone(watch TxWatch) {
+	txidMu.Lock()
+	defer txidMu.Unlock()
 
-		// To listen for deposits, we loop through every output of
-		// the tx, and check if any of the addresses exists in our database
-		for vout, output := range tx.TxOut {
-			log = log.WithField("vout", vout)
+	current, ok := WatchedTxids[watch.txid.String()][watch.ID]
+	if !ok {
+		return
+	}
+	current.milestonesSent = watch.milestonesSent
+	setTxWatch(current)
+}
+
+// matchAddresses starts watching the transaction for every watched address it pays to, and
+// keeps track of the outputs so we know when they are spent. Watches with amount limits only
+// match if the total the transaction pays to the address is within them, so a payment split
+// over several outputs is judged as a whole. height is nil for transactions from the mempool.
+//
+// Wallet addresses being used move the lookahead of their wallet, and the addresses derived
+// because of that are scanned for outputs they already own, like when the wallet was added.
+func matchAddresses(source backend.ChainSource, database *db.DB, tx *wire.MsgTx, network chaincfg.Params,
+	height *int64) {
+	txid := tx.TxHash()
+
+	log := log.WithFields(
+		logrus.Fields{
+			"txid": txid.String(),
+		})
+
+	totals := addressTotals(tx, network)
+	// firstOutputs are the first output paying to each watched address, in the order they
+	// appear in the transaction
+	var paidAddresses []string
+	firstOutputs := make(map[string]int)
+	var derived []btcutil.Address
+
+	// To listen for deposits, we loop through every output of
+	// the tx, and check if any of the addresses exists in our database
+	for vout, output := range tx.TxOut {
+		log := log.WithField("vout", vout)
+
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(output.PkScript, &network)
+		if err != nil {
+			// we don't log anything here, as all non standard TXs would fail
+			// this step, cluttering our logs
+			continue
+		}
 
-			_, addresses, _, err := txscript.ExtractPkScriptAddrs(output.PkScript, &network)
+		for _, address := range addresses {
+			if len(addressWatches(address.String(), network.Name)) == 0 {
+				continue
+			}
+
+			outpoint := wire.OutPoint{Hash: txid, Index: uint32(vout)}
+			err := trackOutpoint(database, network.Name, outpoint, address.String(), btcutil.Amount(output.Value), height)
 			if err != nil {
-				// we don't log anything here, as all non standard TXs would fail
-				// this step, cluttering our logs
+				log.WithError(err).Error("could not track outpoint")
+			}
+
+			// if the address belongs to a wallet, we need to look further ahead
+			derived = append(derived, useWalletAddress(database, address.String())...)
+
+			if _, ok := firstOutputs[address.String()]; !ok {
+				firstOutputs[address.String()] = vout
+				paidAddresses = append(paidAddresses, address.String())
+			}
+		}
+	}
+	if len(derived) > 0 {
+		go seedWallet(source, database, network.Name, derived)
+	}
+
+	for _, address := range paidAddresses {
+		vout, total := firstOutputs[address], totals[address]
+		log := log.WithField("address", address)
+
+		// every subscription gets its own watch, with its own confirmation target,
+		// description and channels
+		for _, watchedAddress := range addressWatches(address, network.Name) {
+			if !watchedAddress.inRange(total) {
+				log.WithField("ID", watchedAddress.ID).Debug("payment is outside the amount limits")
 				continue
 			}
 
-			for _, address := range addresses {
-				watchedAddress, ok := WatchedAddresses[address.String()]
-				if ok {
-					err := WatchTX(TxWatch{
-						txid:              txid,
-						notify:            watchedAddress.Notify,
-						wantConfirmations: watchedAddress.WantConfirmations,
-						description:       watchedAddress.Description,
-					})
-					if err != nil {
-						log.WithError(err).Error("could not add tx")
-					}
-				}
+			watch, err := trackTX(database, TxWatch{
+				notificationID:     watchedAddress.ID,
+				network:            network.Name,
+				txid:               txid,
+				address:            address,
+				notify:             watchedAddress.Notify,
+				milestones:         watchedAddress.Milestones,
+				description:        watchedAddress.Description,
+				followReplacements: watchedAddress.FollowReplacements,
+			})
+			switch {
+			case errors.Is(err, db.ErrTxWatchExists):
+				// we've already seen this transaction, bitcoind publishes it
+				// again when it is included in a block
+				continue
+			case err != nil:
+				log.WithError(err).Error("could not add tx")
+				continue
 			}
 
-			err = handleNewTX(sender, vout, btcutil.Amount(output.Value))
+			if watch.wantConfirmations() != 0 {
+				continue
+			}
+
+			err = handleNewTX(database, watch, vout, total)
 			if err != nil {
 				log.WithError(err).Error("could not send email")
 				continue
 			}
+		}
+	}
+
+	if len(paidAddresses) > 0 && height == nil {
+		rememberPendingTx(tx, network.Name)
+	}
+}
 
+// addressTotals sums up what the transaction pays to every address
+func addressTotals(tx *wire.MsgTx, network chaincfg.Params) map[string]btcutil.Amount {
+	totals := make(map[string]btcutil.Amount)
+	for _, output := range tx.TxOut {
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(output.PkScript, &network)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			totals[address.String()] += btcutil.Amount(output.Value)
 		}
 	}
+	return totals
 }
 
 // TODO: Create feature that sends email on a single tx confirmation
 //  It should double check that the transaction is not already confirmed
 
-// OnchainBlock checks if a block contains a transaction we're watching.
-func OnchainBlock(btc *rpcclient.Client, zmqBlocks <-chan *wire.MsgBlock, network chaincfg.Params,
-	sender email.EmailSender) {
-
-	for {
-		rawBlock := <-zmqBlocks
-		hash := rawBlock.Header.BlockHash()
+// OnchainBlock checks if a block contains a transaction we're watching. Before reading
+// any blocks from the source, we catch up on the blocks mined since the last block we
+// processed.
+func OnchainBlock(source backend.ChainSource, database *db.DB, network chaincfg.Params) {
+	if err := CatchUp(source, database, network); err != nil {
+		log.WithError(err).Error("could not catch up on missed blocks")
+	}
 
-		header, err := btc.GetBlockHeaderVerbose(&hash)
+	for event := range source.Blocks() {
+		var err error
+		if event.Disconnected {
+			err = handleDisconnect(database, network.Name, event)
+		} else {
+			err = handleBlock(source, database, network, event.Block, event.Height)
+		}
 		if err != nil {
-			log.WithError(err).Error("Could not query bitcoind for block")
-			continue
+			log.WithField("hash", event.Block.BlockHash()).WithError(err).Error("could not handle block")
 		}
+	}
+}
 
-		log := log.WithField("blockHeight", header.Height)
+// handleBlock processes a block connected to the best chain. If there's a gap between the
+// last block we processed and this one, e.g. because the connection to the source was down
+// for a while, we replay the blocks in between first.
+func handleBlock(source backend.ChainSource, database *db.DB, network chaincfg.Params,
+	block *wire.MsgBlock, height int64) error {
+	if tip, ok := recentBlocks(network.Name).tip(); ok && height > tip.height+1 {
+		if err := catchUp(source, database, network, height-1); err != nil {
+			return fmt.Errorf("could not catch up on missed blocks: %w", err)
+		}
+	}
 
-		for _, tx := range rawBlock.Transactions {
-			txid := tx.TxHash()
+	return processBlock(source, database, network, block, height)
+}
 
-			confirmTxIfExists(txid, int64(header.Height))
-		}
+// processBlock connects the block at the given height. If the block doesn't build on top of
+// the last block we processed, we first disconnect the blocks that are no longer part of
+// the best chain, and connect the ones we missed.
+func processBlock(source backend.ChainSource, database *db.DB, network chaincfg.Params,
+	block *wire.MsgBlock, height int64) error {
+	hash := block.BlockHash()
 
-		// we handle deep wantConfirmations after the block just in case some transactions
-		// were first seen in the fresh block
-		err = handleNewBlock(int64(header.Height), sender)
-		if err != nil {
-			log.WithError(err).Error("could not handle deep confirmation")
+	history := recentBlocks(network.Name)
+	if history.contains(blockRef{height: height, hash: hash}) {
+		log.WithField("hash", hash).Debug("block already processed")
+		return nil
+	}
+
+	if tip, ok := history.tip(); ok && block.Header.PrevBlock != tip.hash {
+		if err := reorganize(source, database, network, block.Header.PrevBlock); err != nil {
+			return fmt.Errorf("could not reorganize: %w", err)
 		}
+	}
+
+	connectBlock(source, database, network, block, height)
+	return nil
+}
+
+// connectBlock confirms the watched transactions found in the block, and sends out
+// notifications for every transaction that now has enough confirmations
+func connectBlock(source backend.ChainSource, database *db.DB, network chaincfg.Params, block *wire.MsgBlock,
+	height int64) {
+	log := log.WithFields(logrus.Fields{
+		"network":     network.Name,
+		"blockHeight": height,
+	})
 
+	for _, tx := range block.Transactions {
+		txid := tx.TxHash()
+
+		// the transaction might not have passed through the mempool while we were
+		// listening, so we look for deposits and spends here as well
+		matchConflicts(database, tx)
+		forgetReplacedOutputs(database, network.Name, tx)
+		matchSpends(database, tx, network, &height)
+		matchOutpointSpends(database, tx, network.Name)
+		matchAddresses(source, database, tx, network, &height)
+		confirmTxIfExists(database, network.Name, txid, height)
+		forgetConfirmedInputs(txid)
+	}
+
+	// we handle deep wantConfirmations after the block just in case some transactions
+	// were first seen in the fresh block
+	err := handleNewBlock(database, network.Name, height)
+	if err != nil {
+		log.WithError(err).Error("could not handle deep confirmation")
+	}
+
+	if err := markProcessed(database, network.Name, blockRef{height: height, hash: block.BlockHash()}); err != nil {
+		log.WithError(err).Error("could not persist processed block")
 	}
 }
 
-func confirmTxIfExists(hash chainhash.Hash, height int64) {
-	tx, ok := WatchedTxids[hash.String()]
+// confirmTxIfExists marks the watches of the transaction on the network as confirmed at the
+// given height
+func confirmTxIfExists(database *db.DB, network string, hash chainhash.Hash, height int64) {
+	txidMu.Lock()
+	defer txidMu.Unlock()
+
+	watches, ok := WatchedTxids[hash.String()]
 	if !ok {
 		return
 	}
 
-	log.WithFields(logrus.Fields{
+	log := log.WithFields(logrus.Fields{
 		"txid": hash.String(),
-	}).Info("found relevant transaction in new block")
+	})
+	log.Info("found relevant transaction in new block")
 
 	// TODO O: Write in email address received new transaction
 
-	tx.confirmedAtBlock = &height
-	WatchedTxids[hash.String()] = tx
+	for _, tx := range watches {
+		if tx.network != network {
+			continue
+		}
+		if err := db.SetTxWatchConfirmedAt(database, tx.ID, &height); err != nil {
+			log.WithError(err).Error("could not persist confirmation")
+		}
+
+		tx.confirmedAtBlock = &height
+		watches[tx.ID] = tx
+	}
 }
 
+// Notification is how the user wants to be notified
 type Notification struct {
-	Email       string
-	SlackURL    string
-	CallbackURL string
+	// Channels are the ways of contacting the user, delivered through the outbox
+	Channels db.ChannelConfigs
 }
 
 type TxWatch struct {
 	ID uuid.UUID
 
-	txid chainhash.Hash
+	// notificationID is the ID of the notification this watch belongs to
+	notificationID uuid.UUID
+	// network is the name of the network the transaction belongs to
+	network string
+	txid    chainhash.Hash
+	// address is the watched address the transaction pays to, if the watch belongs to an
+	// address notification
+	address string
 	// notify contains different ways of contacting the user
 	notify Notification
 	// if set, it means the transaction is confirmed.
 	confirmedAtBlock *int64
-	// how many wantConfirmations this transaction wants before a notification is sent
-	wantConfirmations int64
+	// milestones are the confirmation counts a notification is sent at, in ascending order
+	milestones []int64
+	// milestonesSent is how many of the milestones we've sent a notification for
+	milestonesSent int
 	// description is set by the user.
 	description string
+	// fired is set once the notification for the last milestone is sent. Confirmed watches
+	// are kept around after firing, in case their confirmation is rolled back by a reorg.
+	fired bool
+	// spends is set if the transaction spends an outpoint the notification is watching
+	spends *spend
+	// followReplacements moves the watch over to the replacement if the transaction is
+	// replaced or double-spent
+	followReplacements bool
+}
+
+// wantConfirmations is how many confirmations the transaction needs for the next milestone.
+// Once every milestone is sent, it is the last milestone.
+func (tx TxWatch) wantConfirmations() int64 {
+	if len(tx.milestones) == 0 {
+		return 0
+	}
+	if tx.milestonesSent < len(tx.milestones) {
+		return tx.milestones[tx.milestonesSent]
+	}
+	return tx.milestones[len(tx.milestones)-1]
+}
+
+// mempoolMilestones counts the milestones sent before the transaction is confirmed. These
+// stay sent if the transaction is unconfirmed by a reorg.
+func (tx TxWatch) mempoolMilestones() int {
+	var count int
+	for count < len(tx.milestones) && tx.milestones[count] == 0 {
+		count++
+	}
+	return count
 }
 
 var (
 	txidMu sync.Mutex
-	// WatchedTxids is a map connecting txids to contact info. This is the only thing that should be
-	// responsible for sending out emails
-	WatchedTxids = make(map[string]TxWatch)
+	// WatchedTxids is a map connecting txids to every watch waiting on them, keyed by watch ID.
+	// This is the only thing that should be responsible for sending out emails
+	WatchedTxids = make(map[string]map[uuid.UUID]TxWatch)
 )
 
+// WatchTX starts watching a transaction. The watch has to be persisted already, see trackTX.
 func WatchTX(tx TxWatch) error {
 
 	log.WithField("txid", tx.txid.String()).Info("starting to watch txid")
@@ -200,279 +582,373 @@ func WatchTX(tx TxWatch) error {
 	txidMu.Lock()
 	defer txidMu.Unlock()
 
-	tx.ID = uuid.New()
-	WatchedTxids[tx.txid.String()] = tx
+	setTxWatch(tx)
 
 	return nil
 }
 
-func AddTXFromString(txidString string, wantConfirmations int64, to Notification, description string) error {
+// setTxWatch adds or updates a watch. The caller must hold txidMu.
+func setTxWatch(tx TxWatch) {
+	if _, ok := WatchedTxids[tx.txid.String()]; !ok {
+		WatchedTxids[tx.txid.String()] = make(map[uuid.UUID]TxWatch)
+	}
+	WatchedTxids[tx.txid.String()][tx.ID] = tx
+}
+
+// deleteTxWatch stops watching for a single watch, leaving other watches for the same
+// transaction untouched. The caller must hold txidMu.
+func deleteTxWatch(tx TxWatch) {
+	watches := WatchedTxids[tx.txid.String()]
+	delete(watches, tx.ID)
+	if len(watches) == 0 {
+		delete(WatchedTxids, tx.txid.String())
+	}
+}
+
+// trackTX persists a new transaction watch before starting to watch it
+func trackTX(database *db.DB, tx TxWatch) (TxWatch, error) {
+	watch := db.TxWatch{
+		NotificationID: tx.notificationID,
+		Txid:           tx.txid.String(),
+	}
+	if tx.spends != nil {
+		watch.InputIndex = &tx.spends.inputIndex
+	}
+	if tx.address != "" {
+		watch.Address = &tx.address
+	}
+
+	saved, err := watch.Save(database)
+	if err != nil {
+		return TxWatch{}, fmt.Errorf("could not save tx watch: %w", err)
+	}
+
+	tx.ID = saved.ID
+	return tx, WatchTX(tx)
+}
+
+func AddTXFromString(database *db.DB, network string, notificationID uuid.UUID, txidString string, milestones []int64,
+	to Notification, description string, followReplacements bool) error {
 
 	txid, err := chainhash.NewHashFromStr(txidString)
 	if err != nil {
 		return fmt.Errorf("txid not a valid txid: %w", err)
 	}
 
-	return WatchTX(TxWatch{
-		txid:              *txid,
-		notify:            to,
-		wantConfirmations: wantConfirmations,
-		description:       description,
+	_, err = trackTX(database, TxWatch{
+		notificationID:     notificationID,
+		network:            network,
+		txid:               *txid,
+		notify:             to,
+		milestones:         milestones,
+		description:        description,
+		followReplacements: followReplacements,
 	})
+	return err
 }
 
-func handleNewBlock(height int64, sender email.EmailSender) error {
+// handleNewBlock notifies about the watched transactions on the network that have enough
+// confirmations at the given height. If a transaction reached several milestones at once,
+// e.g. because we were catching up on missed blocks, they are sent in order.
+func handleNewBlock(database *db.DB, network string, height int64) error {
 
-	for _, tx := range WatchedTxids {
-		if tx.confirmedAtBlock == nil {
-			return nil
+	txidMu.Lock()
+	var confirmed []TxWatch
+	for _, watches := range WatchedTxids {
+		for _, tx := range watches {
+			if tx.network != network || tx.confirmedAtBlock == nil {
+				continue
+			}
+
+			if tx.fired {
+				// the transaction is buried so deep that a reorg won't unconfirm it
+				if height-*tx.confirmedAtBlock >= maxReorgDepth {
+					deleteTxWatch(tx)
+				}
+				continue
+			}
+
+			if reachedMilestone(tx, height) {
+				confirmed = append(confirmed, tx)
+			}
 		}
+	}
+	txidMu.Unlock()
 
-		notifyAtHeight := *tx.confirmedAtBlock + tx.wantConfirmations - 1 // current block is 1 confirmation, so we negate 1
-		if height >= notifyAtHeight {
-			log.WithFields(logrus.Fields{
+	var failed int
+	var lastErr error
+	for _, tx := range confirmed {
+		for !tx.fired && reachedMilestone(tx, height) {
+			log := log.WithFields(logrus.Fields{
 				"txid":               tx.txid.String(),
-				"wantConfirmations":  tx.wantConfirmations,
+				"wantConfirmations":  tx.wantConfirmations(),
 				"txConfirmedAtBlock": *tx.confirmedAtBlock,
-			}).Info("found confirmed tx")
+			})
+			log.Info("found confirmed tx")
 
-			SendTxConfirmed(sender, tx)
-			// only delete if notification was successful
-			delete(WatchedTxids, tx.txid.String())
+			current := tx
+			next, err := fire(database, current, func(q db.Querier) error {
+				if current.spends != nil {
+					return SendOutpointSpent(q, current)
+				}
+				return SendTxConfirmed(q, current)
+			})
+			if err != nil {
+				// the watch is left as it was, so we try again on the next block
+				log.WithError(err).Error("could not notify about confirmed tx")
+				failed++
+				lastErr = err
+				break
+			}
+			tx = next
 		}
 	}
 
+	if failed > 0 {
+		return fmt.Errorf("could not notify about %d transactions: %w", failed, lastErr)
+	}
 	return nil
 }
 
-// handleNewTX makes sure to send notifications for every new TX
-func handleNewTX(sender email.EmailSender, vout int, amount btcutil.Amount) error {
-
-	for _, tx := range WatchedTxids {
-		// if we get here it means we just got a new tx that isn't confirmed yet. Sooo we only care about txs that are
-		// 0-conf here. That means new deposits to addresses.
-
-		if tx.wantConfirmations != 0 {
-			return nil
-		}
+// reachedMilestone checks if the confirmed transaction has enough confirmations for its next
+// milestone at the given height
+func reachedMilestone(tx TxWatch, height int64) bool {
+	notifyAtHeight := *tx.confirmedAtBlock + tx.wantConfirmations() - 1 // current block is 1 confirmation, so we negate 1
+	return height >= notifyAtHeight
+}
 
-		err := SendAddressReceivedTransaction(sender, tx.notify, tx.description, tx.txid, vout, amount)
-		if err != nil {
-			log.WithError(err).Error("could not send address received transaction email")
+// fire sends the next milestone of a TxWatch with send, and marks it as sent, returning the
+// updated watch. The message is queued in the same transaction as the milestone is marked,
+// so if either fails the watch is left as it was. The watch is kept until the last milestone
+// is sent. Then unconfirmed watches are dropped right away, while confirmed ones are kept
+// until they are too deep to be reorged out.
+func fire(database *db.DB, tx TxWatch, send func(q db.Querier) error) (TxWatch, error) {
+	sent := tx
+	sent.milestonesSent++
+	last := sent.milestonesSent >= len(sent.milestones)
+
+	err := database.Transact(func(q db.Querier) error {
+		if err := send(q); err != nil {
 			return err
 		}
-
-		// only delete if notification was successful
-		delete(WatchedTxids, tx.txid.String())
+		if !last {
+			return db.SetTxWatchMilestonesSent(q, sent.ID, sent.milestonesSent)
+		}
+		return db.MarkTxWatchFired(q, sent.ID)
+	})
+	if err != nil {
+		return tx, err
 	}
 
-	return nil
+	txidMu.Lock()
+	switch {
+	case !last:
+		setTxWatch(sent)
+	case sent.confirmedAtBlock == nil:
+		deleteTxWatch(sent)
+	default:
+		sent.fired = true
+		setTxWatch(sent)
+	}
+	txidMu.Unlock()
+
+	return sent, nil
 }
 
-func SendAddressReceivedTransaction(sender email.EmailSender, to Notification, description string,
-	txid chainhash.Hash, vout int, amount btcutil.Amount) error {
+// handleNewTX sends the notification for a 0-conf TxWatch
+func handleNewTX(database *db.DB, tx TxWatch, vout int, amount btcutil.Amount) error {
+	// if we get here it means we just got a new tx that isn't confirmed yet. Sooo we only care about txs that are
+	// 0-conf here. That means new deposits to addresses.
+
+	// the notification is in the outbox once fired, and will be delivered from there
+	_, err := fire(database, tx, func(q db.Querier) error {
+		return SendAddressReceivedTransaction(q, tx, vout, amount)
+	})
+	return err
+}
 
+// SendAddressReceivedTransaction notifies that a transaction paying to a watched address was
+// seen in the mempool. amount is the total the transaction pays to the address, and vout the
+// first output paying to it.
+func SendAddressReceivedTransaction(database db.Querier, tx TxWatch, vout int, amount btcutil.Amount) error {
 	log := log.WithFields(logrus.Fields{
-		"email":       to.Email,
-		"txid":        txid,
-		"vout":        vout,
-		"callbackURL": to.CallbackURL,
-		"slackURL":    to.SlackURL,
+		"channels": tx.notify.Channels,
+		"txid":     tx.txid,
+		"vout":     vout,
+		"ID":       tx.ID,
 	})
 
-	if err := sendAddressReceivedTransactionEmail(sender, to.Email, description, txid, vout, amount); err != nil {
-		log.Info("could not send email")
+	balance := addressBalance(tx.address, tx.network)
+	payload := txPayload(tx, eventAddressReceived)
+	payload["vout"] = vout
+	payload["amount"] = amount
+
+	err := outbox.EnqueueTx(database, tx.notify.Channels, outbox.Message{
+		NotificationID: tx.notificationID,
+		Subject:        "Address received transaction",
+		Text:           addressReceivedTransactionEmail(tx.description, tx.txid, vout, amount, balance),
+		Header:         "Address received transaction",
+		Payload:        payload,
+	})
+	if err != nil {
+		log.WithError(err).Error("could not queue notification")
+		return err
 	}
-	// TODO
-	// if err := postCallback( sender, to.callbackURL, description, txid, vout, amount); err != nil {
-	// 	log.Info("could not post callback")
-	// }
-	// if err := postSlack( sender, to.slackURL, description, txid, vout, amount); err != nil {
-	// 	log.Info("could not post slack")
-	// }
 	return nil
 }
 
-func sendAddressReceivedTransactionEmail(sender email.EmailSender, to, description string,
-	txid chainhash.Hash, vout int, amount btcutil.Amount) error {
-
-	if to == "" {
-		return nil
-	}
-
+func addressReceivedTransactionEmail(description string, txid chainhash.Hash, vout int, amount btcutil.Amount,
+	balance Balance) string {
 	body := fmt.Sprintf(`Address received new transaction with
 txid: %s
 vout: %d
 amount: %f BTC`, txid.String(), vout, amount.ToBTC())
+	body += balanceLines(balance)
 	if description != "" {
 		body += fmt.Sprintf("\ndescription: %s", description)
 	}
 
-	return sender.Send(to, "Address received transaction", body)
+	return body
 }
 
-func sendTxConfirmedEmail(sender email.EmailSender, tx TxWatch) error {
-	if tx.notify.Email == "" {
-		return nil
-	}
-
-	if tx.confirmedAtBlock == nil {
-		return errors.New("expected tx to be confirmed")
-	}
+// txConfirmedEmail describes the confirmation of the transaction. The transaction has to be
+// confirmed.
+func txConfirmedEmail(tx TxWatch) string {
 	body := fmt.Sprintf(`Transaction confirmed
 txid: %s
 confirmed in block: %d
-confirmations: %d`, tx.txid.String(), *tx.confirmedAtBlock, tx.wantConfirmations)
+confirmations: %d`, tx.txid.String(), *tx.confirmedAtBlock, tx.wantConfirmations())
 
 	if tx.description != "" {
 		body += fmt.Sprintf("\ndescription: %s", tx.description)
 	}
 
-	return sender.Send(tx.notify.Email, "Transaction was confirmed", body)
+	return body
 }
 
-func postCallback(tx TxWatch) error {
-
-	if tx.notify.CallbackURL == "" {
-		return nil
-	}
+// Events sent to callbacks, so the receiver can tell different kinds of notifications apart
+const (
+	eventAddressReceived = "address_received"
+	eventTxSeen          = "tx_seen_in_mempool"
+	eventTxConfirmed     = "tx_confirmed"
+	eventTxUnconfirmed   = "tx_unconfirmed_by_reorg"
+)
 
-	body := map[string]interface{}{
+// txPayload is the body we send to callbacks and Slack for events concerning a TxWatch. Watches
+// belonging to an address notification include the current balance of the address.
+func txPayload(tx TxWatch, event string) map[string]interface{} {
+	payload := map[string]interface{}{
 		"id":               tx.ID,
+		"event":            event,
+		"network":          tx.network,
 		"confirmedAtBlock": tx.confirmedAtBlock,
 		"txid":             tx.txid,
 		"description":      tx.description,
-		"confirmations":    tx.wantConfirmations,
+		"confirmations":    tx.wantConfirmations(),
+		"milestones":       tx.milestones,
 	}
-	marshalledBody, err := json.Marshal(body)
-	if err != nil {
-		log.WithError(err).Error("Could not marshal callback payload")
-		return err
+	if tx.address != "" {
+		payload["address"] = tx.address
+		payload["balance"] = addressBalance(tx.address, tx.network)
 	}
-	log := log.WithField("body", string(marshalledBody))
+	return payload
+}
 
-	const contentType = "application/json"
+// SendTxSeen notifies that a watched transaction entered the mempool
+func SendTxSeen(database db.Querier, tx TxWatch) error {
+	log := log.WithFields(logrus.Fields{
+		"channels": tx.notify.Channels,
+		"txid":     tx.txid,
+		"ID":       tx.ID,
+	})
 
-	reader := bytes.NewReader(marshalledBody)
-	// nolint gosec
-	res, err := http.Post(tx.notify.CallbackURL, contentType, reader)
+	err := outbox.EnqueueTx(database, tx.notify.Channels, outbox.Message{
+		NotificationID: tx.notificationID,
+		Subject:        "Transaction entered the mempool",
+		Text:           txSeenEmail(tx),
+		Header:         "Transaction seen in mempool",
+		Payload:        txPayload(tx, eventTxSeen),
+	})
 	if err != nil {
+		log.WithError(err).Error("could not queue notification")
 		return err
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode != 200 {
-		msg := fmt.Sprintf("callback response: %s", res.Status)
-		body, err := ioutil.ReadAll(res.Body)
-		if err == nil {
-			msg += fmt.Sprintf(": %s", string(body))
-		}
-		return errors.New(msg)
-	}
-
-	log.Info("posted callback")
-
 	return nil
 }
 
-func postSlack(tx TxWatch) error {
-
-	if tx.notify.SlackURL == "" {
-		return nil
-	}
+func txSeenEmail(tx TxWatch) string {
+	body := fmt.Sprintf(`Transaction entered the mempool
+txid: %s
 
-	// check out https://api.slack.com/block-kit for how you can format the posted message. It's quite extensive!
-	type innerSlackBlock struct {
-		Type string `json:"type,omitempty"`
-		Text string `json:"text,omitempty"`
-	}
-	type slackBlock struct {
-		Type string           `json:"type,omitempty"`
-		Text *innerSlackBlock `json:"text,omitempty"`
-	}
+It has no confirmations yet.`, tx.txid.String())
 
-	type slackFormat struct {
-		Blocks []slackBlock `json:"blocks,omitempty"`
-		Text   string       `json:"text,omitempty"`
+	if tx.description != "" {
+		body += fmt.Sprintf("\ndescription: %s", tx.description)
 	}
 
-	body := map[string]interface{}{
-		"id":               tx.ID,
-		"confirmedAtBlock": tx.confirmedAtBlock,
-		"txid":             tx.txid,
-		"description":      tx.description,
-		"confirmations":    tx.wantConfirmations,
-	}
-	marshalledBody, err := json.MarshalIndent(body, "\t", "")
-	if err != nil {
-		log.WithError(err).Error("Could not marshal callback payload")
-		return err
-	}
+	return body
+}
 
-	data, err := json.Marshal(&slackFormat{
-		Blocks: []slackBlock{
-			{
-				Type: "header",
-				Text: &innerSlackBlock{
-					Type: "plain_text",
-					Text: "Transaction confirmed",
-				},
-			},
-			{Type: "divider"},
-			{
-				Type: "section",
-				Text: &innerSlackBlock{
-					Type: "mrkdwn",
-					Text: string(marshalledBody),
-				},
-			},
-		},
+// SendTxConfirmed notifies that a watched transaction has reached a confirmation milestone
+func SendTxConfirmed(database db.Querier, tx TxWatch) error {
+	log := log.WithFields(logrus.Fields{
+		"channels": tx.notify.Channels,
+		"txid":     tx.txid,
+		"ID":       tx.ID,
 	})
-	if err != nil {
-		return err
-	}
 
-	request, err := http.NewRequest("POST", tx.notify.SlackURL, bytes.NewBuffer(data))
+	err := outbox.EnqueueTx(database, tx.notify.Channels, outbox.Message{
+		NotificationID: tx.notificationID,
+		Subject:        "Transaction was confirmed",
+		Text:           txConfirmedEmail(tx),
+		Header:         "Transaction confirmed",
+		Payload:        txPayload(tx, eventTxConfirmed),
+	})
 	if err != nil {
+		log.WithError(err).Error("could not queue notification")
 		return err
 	}
-	request.Header.Set("Content-Type", "application/json")
+	return nil
+}
 
-	// we don't really care about the response. Fire and forget!
-	res, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
+func txUnconfirmedEmail(tx TxWatch, block blockRef) string {
+	body := fmt.Sprintf(`Transaction was unconfirmed by a chain reorganization
+txid: %s
+was confirmed in block: %d (%s)
 
-	if res.StatusCode != 200 {
-		bodyBytes, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return fmt.Errorf("could not extract data from body: %w", err)
-		}
+You will be notified again when the transaction has %d confirmations on the new chain.`,
+		tx.txid.String(), block.height, block.hash.String(), tx.wantConfirmations())
 
-		return fmt.Errorf("could not post slack notification: %s", string(bodyBytes))
+	if tx.description != "" {
+		body += fmt.Sprintf("\ndescription: %s", tx.description)
 	}
 
-	return nil
+	return body
 }
 
-func SendTxConfirmed(sender email.EmailSender, tx TxWatch) {
+// SendTxUnconfirmed notifies that the block a watched transaction was confirmed in was
+// disconnected from the best chain
+func SendTxUnconfirmed(database db.Querier, tx TxWatch, block blockRef) error {
 	log := log.WithFields(logrus.Fields{
-		"email":       tx.notify.Email,
-		"txid":        tx.txid,
-		"ID":          tx.ID,
-		"callbackURL": tx.notify.CallbackURL,
-		"slackURL":    tx.notify.SlackURL,
+		"channels": tx.notify.Channels,
+		"txid":     tx.txid,
+		"ID":       tx.ID,
 	})
 
-	if err := sendTxConfirmedEmail(sender, tx); err != nil {
-		log.Info("could not send email")
-	}
-	if err := postCallback(tx); err != nil {
-		log.Info("could not post callback")
-	}
-	if err := postSlack(tx); err != nil {
-		log.Info("could not post slack")
+	payload := txPayload(tx, eventTxUnconfirmed)
+	payload["disconnectedBlock"] = block.hash.String()
+	payload["disconnectedHeight"] = block.height
+
+	err := outbox.EnqueueTx(database, tx.notify.Channels, outbox.Message{
+		NotificationID: tx.notificationID,
+		Subject:        "Transaction was unconfirmed by reorg",
+		Text:           txUnconfirmedEmail(tx, block),
+		Header:         "Transaction unconfirmed by reorg",
+		Payload:        payload,
+	})
+	if err != nil {
+		log.WithError(err).Error("could not queue notification")
+		return err
 	}
+	return nil
 }
@@ -2,35 +2,44 @@ package listeners
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil"
-	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
-	"github.com/bjornoj/txnotify/email"
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+	"github.com/bjornoj/txnotify/outbox"
 )
 
+var testDB = dbtest.New("listeners_test")
+
 func TestOnchainTx(t *testing.T) {
+	dbtest.Require(t, testDB)
+
 	t.Run("sends email when address receives new transaction", func(t *testing.T) {
 		// first we initialize everything we need, and create an address
-		sender := email.NewEmailSender(os.Getenv("EMAIL_PASSWORD"))
 		address := MockAddress()
 
 		// spawn the listener and add the address to the watch list
-		channel := make(chan *wire.MsgTx)
-		go OnchainTx(channel, sender, nil, chaincfg.RegressionNetParams)
-		WatchAddress(address, Notification{Email: "bo@jalborg.com"}, gofakeit.Sentence(3), 0)
+		source := backend.NewFake(chaincfg.RegressionNetParams)
+		require.NoError(t, source.Start())
+		go OnchainTx(source, testDB, chaincfg.RegressionNetParams)
+		notification := createNotificationTest(t, address.String(), 0)
+		WatchAddress(address, addressWatch(notification))
 		defer func() {
 			delete(WatchedAddresses, address.String())
 		}()
@@ -44,8 +53,8 @@ func TestOnchainTx(t *testing.T) {
 			PkScript: pkScript,
 		})
 
-		// send the transaction to the channel
-		channel <- &wireTx
+		// broadcast the transaction, so the listener sees it
+		source.Broadcast(&wireTx)
 
 		require.Eventually(t, func() bool {
 			return len(WatchedTxids) == 1
@@ -58,6 +67,88 @@ func TestOnchainTx(t *testing.T) {
 
 }
 
+func TestMatchAddressesAmountLimits(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	address := MockAddress()
+	notification := createNotificationTest(t, address.String(), 1)
+	watch := addressWatch(notification)
+	watch.MinAmount = 10_000
+	watch.MaxAmount = 100_000
+	WatchAddress(address, watch)
+	defer delete(WatchedAddresses, address.String())
+
+	pkScript, err := txscript.PayToAddrScript(address)
+	require.NoError(t, err)
+	payment := func(amounts ...int64) *wire.MsgTx {
+		tx := wire.NewMsgTx(2)
+		// a random input keeps the txids of the payments apart
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: gofakeit.Uint32()}, nil, nil))
+		for _, amount := range amounts {
+			tx.AddTxOut(wire.NewTxOut(amount, pkScript))
+		}
+		return tx
+	}
+
+	for _, test := range []struct {
+		name    string
+		amounts []int64
+		matches bool
+	}{
+		{name: "ignores dust", amounts: []int64{500}, matches: false},
+		{name: "matches payment within limits", amounts: []int64{50_000}, matches: true},
+		{name: "ignores payment above maximum", amounts: []int64{200_000}, matches: false},
+		{name: "ignores total above maximum", amounts: []int64{60_000, 60_000}, matches: false},
+		{name: "matches output within limits next to dust", amounts: []int64{500, 50_000}, matches: true},
+		{name: "matches payment split over outputs below minimum", amounts: []int64{6_000, 6_000}, matches: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tx := payment(test.amounts...)
+			matchAddresses(backend.NewFake(chaincfg.RegressionNetParams), testDB, tx, chaincfg.RegressionNetParams, nil)
+			defer delete(WatchedTxids, tx.TxHash().String())
+
+			_, ok := WatchedTxids[tx.TxHash().String()]
+			assert.Equal(t, test.matches, ok)
+		})
+	}
+}
+
+func TestAddressWatchInRange(t *testing.T) {
+	assert.True(t, AddressWatch{}.inRange(1))
+	assert.True(t, AddressWatch{MinAmount: 1000}.inRange(1000))
+	assert.False(t, AddressWatch{MinAmount: 1000}.inRange(999))
+	assert.True(t, AddressWatch{MaxAmount: 1000}.inRange(1000))
+	assert.False(t, AddressWatch{MaxAmount: 1000}.inRange(1001))
+}
+
+func TestValidateIdentifier(t *testing.T) {
+	hash := make([]byte, 20)
+	address := func(network chaincfg.Params) string {
+		encoded, err := btcutil.NewAddressWitnessPubKeyHash(hash, &network)
+		require.NoError(t, err)
+		return encoded.String()
+	}
+
+	t.Run("accepts addresses of the network", func(t *testing.T) {
+		assert.NoError(t, ValidateIdentifier(&chaincfg.SigNetParams, address(chaincfg.SigNetParams)))
+		assert.NoError(t, ValidateIdentifier(&chaincfg.RegressionNetParams, address(chaincfg.RegressionNetParams)))
+	})
+
+	t.Run("rejects bech32 addresses of other networks", func(t *testing.T) {
+		assert.Error(t, ValidateIdentifier(&chaincfg.SigNetParams, address(chaincfg.MainNetParams)))
+		assert.Error(t, ValidateIdentifier(&chaincfg.SigNetParams, address(chaincfg.RegressionNetParams)))
+	})
+}
+
+func TestIsAddressIdentifier(t *testing.T) {
+	network := &chaincfg.RegressionNetParams
+	txid := chainhash.DoubleHashH([]byte(gofakeit.Word()))
+
+	assert.True(t, IsAddressIdentifier(network, MockAddress().String()))
+	assert.False(t, IsAddressIdentifier(network, txid.String()))
+	assert.False(t, IsAddressIdentifier(network, txid.String()+":0"))
+}
+
 func TestWatchAddress(t *testing.T) {
 
 	address := MockAddress()
@@ -65,19 +156,27 @@ func TestWatchAddress(t *testing.T) {
 	description := gofakeit.Sentence(3)
 	confirmations := int64(gofakeit.Number(0, 100))
 
+	id := uuid.New()
+
 	t.Run("can add address", func(t *testing.T) {
 		require.Len(t, WatchedAddresses, 0)
 
-		WatchAddress(address, Notification{Email: email}, description, confirmations)
+		WatchAddress(address, AddressWatch{
+			ID:          id,
+			Network:     chaincfg.RegressionNetParams.Name,
+			Notify:      Notification{Channels: db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: email}}},
+			Milestones:  []int64{confirmations},
+			Description: description,
+		})
 
 		require.Len(t, WatchedAddresses, 1)
 	})
 
-	got, ok := WatchedAddresses[address.String()]
+	got, ok := WatchedAddresses[address.String()][id]
 	require.True(t, ok)
 
 	t.Run("can match on address", func(t *testing.T) {
-		assert.Equal(t, email, got.Notify.Email)
+		assert.Equal(t, email, got.Notify.Channels.Target(outbox.ChannelEmail))
 	})
 
 	t.Run("can add description", func(t *testing.T) {
@@ -85,28 +184,80 @@ func TestWatchAddress(t *testing.T) {
 	})
 
 	t.Run("can add confirmations", func(t *testing.T) {
-		assert.Equal(t, confirmations, got.WantConfirmations)
+		assert.Equal(t, []int64{confirmations}, got.Milestones)
+	})
+
+	t.Run("can add several subscriptions to the same address", func(t *testing.T) {
+		otherEmail := gofakeit.Email()
+		otherID := uuid.New()
+		WatchAddress(address, AddressWatch{
+			ID:          otherID,
+			Network:     chaincfg.RegressionNetParams.Name,
+			Notify:      Notification{Channels: db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: otherEmail}}},
+			Milestones:  []int64{confirmations + 1},
+			Description: gofakeit.Sentence(3),
+		})
+
+		watches := addressWatches(address.String(), chaincfg.RegressionNetParams.Name)
+		require.Len(t, watches, 2)
+
+		assert.Equal(t, email, WatchedAddresses[address.String()][id].Notify.Channels.Target(outbox.ChannelEmail))
+		assert.Equal(t, otherEmail, WatchedAddresses[address.String()][otherID].Notify.Channels.Target(outbox.ChannelEmail))
+		assert.Equal(t, []int64{confirmations + 1}, WatchedAddresses[address.String()][otherID].Milestones)
+	})
+
+	t.Run("keeps networks apart", func(t *testing.T) {
+		assert.Empty(t, addressWatches(address.String(), chaincfg.SigNetParams.Name))
+		assert.NotContains(t, ListWatchedAddresses(chaincfg.SigNetParams.Name), address.String())
+		assert.Contains(t, ListWatchedAddresses(chaincfg.RegressionNetParams.Name), address.String())
 	})
 }
 
 func TestOnchainBlock(t *testing.T) {
+	dbtest.Require(t, testDB)
+
 	// TODO: Test deep confirmation. From 1 - 10. Also make sure stuff isn't sent out twice
 	// TODO: Connect to local regtest node.. Shit, that's a large task, that I'm not ready for now.
 	// first we initialize everything we need, and create an address
-	sender := email.NewEmailSender(os.Getenv("EMAIL_PASSWORD"))
 	address := MockAddress()
 
 	// spawn the listener and add the address to the watch list
-	channel := make(chan *wire.MsgBlock)
-	go OnchainBlock(&rpcclient.Client{}, channel, chaincfg.RegressionNetParams, sender)
+	source := backend.NewFake(chaincfg.RegressionNetParams)
+	require.NoError(t, source.Start())
+	go OnchainBlock(source, testDB, chaincfg.RegressionNetParams)
 
 	confirmations := int64(gofakeit.Number(1, 10))
-	WatchAddress(address, Notification{Email: "bo@jalborg.com"}, gofakeit.Sentence(3), confirmations)
+	WatchAddress(address, AddressWatch{
+		ID:          uuid.New(),
+		Network:     chaincfg.RegressionNetParams.Name,
+		Notify:      Notification{Channels: db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: "bo@jalborg.com"}}},
+		Milestones:  []int64{confirmations},
+		Description: gofakeit.Sentence(3),
+	})
 
 	t.Run("sends out confirmation on deep confirmation", func(t *testing.T) {
 	})
 }
 
+// createNotificationTest saves a notification for the given identifier, along with the user owning it
+func createNotificationTest(t *testing.T, identifier string, confirmations uint32) db.Notification {
+	var userID uuid.UUID
+	err := testDB.QueryRow("INSERT INTO users DEFAULT VALUES RETURNING id").Scan(&userID)
+	require.NoError(t, err)
+
+	notification, err := db.Notification{
+		UserID:        userID,
+		Identifier:    identifier,
+		Confirmations: confirmations,
+		Description:   gofakeit.Sentence(3),
+		Channels:      db.ChannelConfigs{{Type: outbox.ChannelEmail, Target: "bo@jalborg.com"}},
+		Network:       chaincfg.RegressionNetParams.Name,
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	return notification
+}
+
 var (
 	keyLock sync.Mutex
 	// extendedKey is where we store our private key, see init function
@@ -125,10 +276,156 @@ var addressCounter uint32 = 0
 
 // MockAddress mocks a btc address from the extendedKey using child derivation
 func MockAddress() btcutil.Address {
-	address, err := extendedKey.Address(&chaincfg.RegressionNetParams)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	child, err := extendedKey.Derive(addressCounter)
+	if err != nil {
+		panic(fmt.Errorf("could not derive child key: %w", err))
+	}
+	addressCounter++
+
+	address, err := child.Address(&chaincfg.RegressionNetParams)
 	if err != nil {
 		panic(fmt.Errorf("could not create address: %w", err))
 	}
 
 	return address
 }
+
+func TestTxWatchMilestones(t *testing.T) {
+	watch := TxWatch{milestones: []int64{0, 1, 6}}
+	assert.Equal(t, int64(0), watch.wantConfirmations())
+	assert.Equal(t, 1, watch.mempoolMilestones())
+
+	watch.milestonesSent = 2
+	assert.Equal(t, int64(6), watch.wantConfirmations())
+
+	watch.milestonesSent = 3
+	assert.Equal(t, int64(6), watch.wantConfirmations())
+
+	assert.Equal(t, 0, TxWatch{milestones: []int64{1, 6}}.mempoolMilestones())
+}
+
+func TestHandleNewBlockMilestones(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	network := chaincfg.RegressionNetParams.Name
+	txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+	confirmedAt := int64(gofakeit.Number(1, 1000))
+
+	require.NoError(t, WatchTX(TxWatch{
+		ID:               uuid.New(),
+		notificationID:   uuid.New(),
+		network:          network,
+		txid:             txid,
+		confirmedAtBlock: &confirmedAt,
+		milestones:       []int64{1, 2, 6},
+	}))
+	defer delete(WatchedTxids, txid.String())
+
+	watch := func() TxWatch {
+		for _, watch := range WatchedTxids[txid.String()] {
+			return watch
+		}
+		t.Fatal("watch was removed")
+		return TxWatch{}
+	}
+
+	t.Run("fires the first milestone", func(t *testing.T) {
+		require.NoError(t, handleNewBlock(testDB, network, confirmedAt))
+		assert.Equal(t, 1, watch().milestonesSent)
+		assert.False(t, watch().fired)
+	})
+
+	t.Run("fires every milestone reached at once", func(t *testing.T) {
+		require.NoError(t, handleNewBlock(testDB, network, confirmedAt+5))
+		assert.Equal(t, 3, watch().milestonesSent)
+		assert.True(t, watch().fired)
+	})
+
+	t.Run("does not fire again", func(t *testing.T) {
+		require.NoError(t, handleNewBlock(testDB, network, confirmedAt+6))
+		assert.Equal(t, 3, watch().milestonesSent)
+	})
+}
+
+func TestMatchTxids(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	network := chaincfg.RegressionNetParams.Name
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: gofakeit.Uint32()}, nil, nil))
+	txid := tx.TxHash()
+
+	watchID := uuid.New()
+	require.NoError(t, WatchTX(TxWatch{
+		ID:             watchID,
+		notificationID: uuid.New(),
+		network:        network,
+		txid:           txid,
+		milestones:     []int64{0, 1},
+	}))
+	defer delete(WatchedTxids, txid.String())
+
+	t.Run("ignores other networks", func(t *testing.T) {
+		matchTxids(testDB, tx, chaincfg.SigNetParams.Name)
+		assert.Equal(t, 0, WatchedTxids[txid.String()][watchID].milestonesSent)
+	})
+
+	t.Run("fires milestone 0 when the transaction is seen", func(t *testing.T) {
+		matchTxids(testDB, tx, network)
+		assert.Equal(t, 1, WatchedTxids[txid.String()][watchID].milestonesSent)
+	})
+
+	t.Run("does not fire again when the transaction is seen again", func(t *testing.T) {
+		matchTxids(testDB, tx, network)
+		assert.Equal(t, 1, WatchedTxids[txid.String()][watchID].milestonesSent)
+	})
+
+	t.Run("drops watches with no milestones left", func(t *testing.T) {
+		other := uuid.New()
+		require.NoError(t, WatchTX(TxWatch{
+			ID:             other,
+			notificationID: uuid.New(),
+			network:        network,
+			txid:           txid,
+			milestones:     []int64{0},
+		}))
+
+		matchTxids(testDB, tx, network)
+		_, ok := WatchedTxids[txid.String()][other]
+		assert.False(t, ok)
+	})
+}
+
+func TestFireFailure(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	network := chaincfg.RegressionNetParams.Name
+	txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+	confirmedAt := int64(gofakeit.Number(1, 1000))
+	watch := TxWatch{
+		ID:               uuid.New(),
+		notificationID:   uuid.New(),
+		network:          network,
+		txid:             txid,
+		confirmedAtBlock: &confirmedAt,
+		milestones:       []int64{1, 6},
+	}
+	require.NoError(t, WatchTX(watch))
+	defer delete(WatchedTxids, txid.String())
+
+	t.Run("leaves the watch alone when the message can't be queued", func(t *testing.T) {
+		_, err := fire(testDB, watch, func(db.Querier) error {
+			return errors.New("outbox is down")
+		})
+		require.Error(t, err)
+		assert.Equal(t, 0, WatchedTxids[txid.String()][watch.ID].milestonesSent)
+	})
+
+	t.Run("retries on the next block", func(t *testing.T) {
+		require.NoError(t, handleNewBlock(testDB, network, confirmedAt+1))
+		assert.Equal(t, 1, WatchedTxids[txid.String()][watch.ID].milestonesSent)
+	})
+}
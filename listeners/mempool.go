@@ -0,0 +1,159 @@
+package listeners
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/outbox"
+)
+
+const eventTxDropped = "tx_dropped_from_mempool"
+
+// Reasons a transaction was removed from the mempool. The source doesn't tell us, so we make
+// an educated guess.
+const (
+	removalExpired = "expired"
+	removalUnknown = "unknown"
+)
+
+const (
+	// mempoolExpiry is how long bitcoind keeps transactions in the mempool by default
+	mempoolExpiry = 336 * time.Hour
+
+	// replacementMemory is how long we remember that a transaction was replaced
+	replacementMemory = time.Hour
+)
+
+// removalGracePeriod is how long we wait before handling a removal. A replacement might be
+// delivered separately from the removal, and lag slightly behind. Tests shorten it.
+var removalGracePeriod = 10 * time.Second
+
+// recentlyReplaced are the watched transactions we have notified were replaced, along with
+// when it happened. There's no need to tell the user they were dropped from the mempool as well.
+var recentlyReplaced = make(map[chainhash.Hash]time.Time)
+
+// rememberReplaced records that the transaction was replaced. The caller must hold conflictMu.
+func rememberReplaced(txid chainhash.Hash) {
+	for replaced, at := range recentlyReplaced {
+		if time.Since(at) > replacementMemory {
+			delete(recentlyReplaced, replaced)
+		}
+	}
+	recentlyReplaced[txid] = time.Now()
+}
+
+// removalReason guesses why the transaction was removed from the mempool. It returns false
+// if we've already told the watchers about it, because it was replaced.
+func removalReason(txid chainhash.Hash) (string, bool) {
+	conflictMu.Lock()
+	defer conflictMu.Unlock()
+
+	if _, ok := recentlyReplaced[txid]; ok {
+		return "", false
+	}
+
+	if indexed, ok := mempoolTxs[txid]; ok && time.Since(indexed.firstSeen) >= mempoolExpiry {
+		return removalExpired, true
+	}
+
+	// most likely evicted because the mempool is full
+	return removalUnknown, true
+}
+
+// OnMempoolRemoval notifies the watchers of transactions removed from the mempool for other
+// reasons than being included in a block, e.g. expiry or the mempool being full. The watches
+// are kept, as the transaction might be broadcast again.
+//
+// Sources that can't tell when transactions are removed from the mempool have no removals
+// to deliver, in which case this returns immediately.
+func OnMempoolRemoval(source backend.ChainSource, database *db.DB, network chaincfg.Params) {
+	removals := source.MempoolRemovals()
+	if removals == nil {
+		log.Warn("chain source doesn't report mempool removals, transactions dropped from the mempool won't be noticed")
+		return
+	}
+
+	for txid := range removals {
+		if !isWatchedUnconfirmed(txid) {
+			continue
+		}
+
+		txid := txid
+		time.AfterFunc(removalGracePeriod, func() {
+			handleRemoval(database, network.Name, txid)
+		})
+	}
+}
+
+// handleRemoval notifies the watchers on the network waiting for the transaction to confirm
+func handleRemoval(database *db.DB, network string, txid chainhash.Hash) {
+	reason, ok := removalReason(txid)
+	if !ok {
+		return
+	}
+
+	txidMu.Lock()
+	var dropped []TxWatch
+	for _, watch := range WatchedTxids[txid.String()] {
+		if watch.network == network && watch.confirmedAtBlock == nil {
+			dropped = append(dropped, watch)
+		}
+	}
+	txidMu.Unlock()
+
+	for _, watch := range dropped {
+		err := database.Transact(func(q db.Querier) error {
+			return SendTxDropped(q, watch, reason)
+		})
+		if err != nil {
+			log.WithField("txid", txid.String()).WithError(err).Error("could not notify about dropped tx")
+		}
+	}
+}
+
+func txDroppedEmail(tx TxWatch, reason string) string {
+	body := fmt.Sprintf(`Transaction was dropped from the mempool
+txid: %s
+reason: %s
+
+The transaction will not confirm unless it is broadcast again. We keep watching it in case that happens.`,
+		tx.txid.String(), reason)
+	if tx.description != "" {
+		body += fmt.Sprintf("\ndescription: %s", tx.description)
+	}
+
+	return body
+}
+
+// SendTxDropped notifies that a watched transaction was removed from the mempool
+func SendTxDropped(database db.Querier, tx TxWatch, reason string) error {
+	log := log.WithFields(logrus.Fields{
+		"channels": tx.notify.Channels,
+		"txid":     tx.txid,
+		"ID":       tx.ID,
+		"reason":   reason,
+	})
+	log.Info("watched transaction dropped from mempool")
+
+	payload := txPayload(tx, eventTxDropped)
+	payload["reason"] = reason
+
+	err := outbox.EnqueueTx(database, tx.notify.Channels, outbox.Message{
+		NotificationID: tx.notificationID,
+		Subject:        "Transaction was dropped from mempool",
+		Text:           txDroppedEmail(tx, reason),
+		Header:         "Transaction dropped from mempool",
+		Payload:        payload,
+	})
+	if err != nil {
+		log.WithError(err).Error("could not queue notification")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package listeners
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+	"github.com/bjornoj/txnotify/outbox"
+)
+
+func TestRemovalReason(t *testing.T) {
+	t.Run("skips replaced transactions", func(t *testing.T) {
+		txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+		conflictMu.Lock()
+		rememberReplaced(txid)
+		conflictMu.Unlock()
+		defer delete(recentlyReplaced, txid)
+
+		_, ok := removalReason(txid)
+		assert.False(t, ok)
+	})
+
+	t.Run("transactions older than mempool expiry have expired", func(t *testing.T) {
+		txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+		mempoolTxs[txid] = &mempoolTx{txid: txid, firstSeen: time.Now().Add(-mempoolExpiry)}
+		defer delete(mempoolTxs, txid)
+
+		reason, ok := removalReason(txid)
+		assert.True(t, ok)
+		assert.Equal(t, removalExpired, reason)
+	})
+
+	t.Run("reason is unknown for other transactions", func(t *testing.T) {
+		txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+		mempoolTxs[txid] = &mempoolTx{txid: txid, firstSeen: time.Now()}
+		defer delete(mempoolTxs, txid)
+
+		reason, ok := removalReason(txid)
+		assert.True(t, ok)
+		assert.Equal(t, removalUnknown, reason)
+	})
+}
+
+// droppedChannel records the notifications we tried to send, and refuses to queue them so
+// nothing ends up in the outbox
+type droppedChannel struct {
+	mu       *sync.Mutex
+	rendered map[uuid.UUID]chainhash.Hash
+}
+
+func (droppedChannel) Name() string {
+	return "dropped"
+}
+
+func (droppedChannel) Validate(target string) error {
+	return nil
+}
+
+func (d droppedChannel) Render(message outbox.Message) (string, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rendered[message.NotificationID] = message.Payload["txid"].(chainhash.Hash)
+	return "", "", errors.New("not queueing test messages")
+}
+
+func (droppedChannel) Deliver(message db.OutboxMessage) (outbox.Result, error) {
+	return outbox.Result{}, nil
+}
+
+func TestOnMempoolRemoval(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	gracePeriod := removalGracePeriod
+	removalGracePeriod = 0
+	defer func() { removalGracePeriod = gracePeriod }()
+
+	channel := droppedChannel{mu: &sync.Mutex{}, rendered: make(map[uuid.UUID]chainhash.Hash)}
+	outbox.Register(channel)
+
+	source := backend.NewFake(chaincfg.RegressionNetParams)
+	require.NoError(t, source.Start())
+	go OnMempoolRemoval(source, testDB, chaincfg.RegressionNetParams)
+
+	t.Run("notifies every transaction removed in the same batch", func(t *testing.T) {
+		watches := make(map[uuid.UUID]chainhash.Hash)
+		for i := 0; i < 2; i++ {
+			tx := wire.NewMsgTx(2)
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: gofakeit.Uint32()}, nil, nil))
+			source.Broadcast(tx)
+
+			watch := TxWatch{
+				ID:             uuid.New(),
+				notificationID: uuid.New(),
+				network:        chaincfg.RegressionNetParams.Name,
+				txid:           tx.TxHash(),
+				milestones:     []int64{1},
+				notify:         Notification{Channels: db.ChannelConfigs{{Type: channel.Name()}}},
+			}
+			require.NoError(t, WatchTX(watch))
+			defer delete(WatchedTxids, watch.txid.String())
+			watches[watch.notificationID] = watch.txid
+		}
+
+		for _, txid := range watches {
+			source.Evict(txid)
+		}
+
+		require.Eventually(t, func() bool {
+			channel.mu.Lock()
+			defer channel.mu.Unlock()
+			return len(channel.rendered) == len(watches)
+		}, time.Second, 10*time.Millisecond)
+
+		channel.mu.Lock()
+		defer channel.mu.Unlock()
+		assert.Equal(t, watches, channel.rendered)
+	})
+}
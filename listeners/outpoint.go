@@ -0,0 +1,225 @@
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/outbox"
+)
+
+const eventOutpointSpent = "outpoint_spent"
+
+// parseOutpoint parses an identifier on the form txid:vout
+func parseOutpoint(identifier string) (wire.OutPoint, error) {
+	parts := strings.Split(identifier, ":")
+	if len(parts) != 2 {
+		return wire.OutPoint{}, errors.New("outpoint must be on the form txid:vout")
+	}
+
+	txid, err := chainhash.NewHashFromStr(parts[0])
+	if err != nil {
+		return wire.OutPoint{}, fmt.Errorf("invalid outpoint txid: %w", err)
+	}
+
+	vout, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return wire.OutPoint{}, fmt.Errorf("invalid outpoint vout: %w", err)
+	}
+
+	return wire.OutPoint{Hash: *txid, Index: uint32(vout)}, nil
+}
+
+// spend is the input of a transaction spending a watched outpoint
+type spend struct {
+	outpoint   wire.OutPoint
+	inputIndex uint32
+}
+
+type OutpointWatch struct {
+	// ID is the ID of the notification this watch belongs to
+	ID uuid.UUID
+	// Network is the name of the network the outpoint belongs to
+	Network string
+	Notify  Notification
+	// Milestones are the confirmation counts to notify at, in ascending order
+	Milestones  []int64
+	Description string
+}
+
+var (
+	outpointWatchMu sync.Mutex
+	// WatchedOutpoints is a map connecting outpoints to every subscription waiting for them
+	// to be spent, keyed by notification ID. Once we see the spending transaction the
+	// subscription is replaced by a TxWatch for that transaction.
+	WatchedOutpoints = make(map[wire.OutPoint]map[uuid.UUID]OutpointWatch)
+)
+
+// WatchOutpoint starts watching for a transaction spending the outpoint.
+//
+// NOTE: Outpoints spent before we start watching them are not detected.
+func WatchOutpoint(outpoint wire.OutPoint, watch OutpointWatch) {
+	outpointWatchMu.Lock()
+	defer outpointWatchMu.Unlock()
+
+	log.WithField("outpoint", outpoint.String()).Info("starting to watch outpoint")
+
+	if _, ok := WatchedOutpoints[outpoint]; !ok {
+		WatchedOutpoints[outpoint] = make(map[uuid.UUID]OutpointWatch)
+	}
+	WatchedOutpoints[outpoint][watch.ID] = watch
+}
+
+// outpointWatches returns every subscription watching the given outpoint
+func outpointWatches(outpoint wire.OutPoint) []OutpointWatch {
+	outpointWatchMu.Lock()
+	defer outpointWatchMu.Unlock()
+
+	var watches []OutpointWatch
+	for _, watch := range WatchedOutpoints[outpoint] {
+		watches = append(watches, watch)
+	}
+	return watches
+}
+
+// ListWatchedOutpoints lists every outpoint on the network we need to see being spent: the
+// ones someone is watching, and the unspent outputs paying to watched addresses
+func ListWatchedOutpoints(network string) []wire.OutPoint {
+	outpointWatchMu.Lock()
+	var outpoints []wire.OutPoint
+	for outpoint, watches := range WatchedOutpoints {
+		for _, watch := range watches {
+			if watch.Network == network {
+				outpoints = append(outpoints, outpoint)
+				break
+			}
+		}
+	}
+	outpointWatchMu.Unlock()
+
+	outpointMu.Lock()
+	defer outpointMu.Unlock()
+	for key := range ownedOutpoints {
+		if key.network == network {
+			outpoints = append(outpoints, key.outpoint)
+		}
+	}
+	return outpoints
+}
+
+// unwatchOutpoint removes a single subscription from the outpoint
+func unwatchOutpoint(outpoint wire.OutPoint, notificationID uuid.UUID) {
+	outpointWatchMu.Lock()
+	defer outpointWatchMu.Unlock()
+
+	watches := WatchedOutpoints[outpoint]
+	delete(watches, notificationID)
+	if len(watches) == 0 {
+		delete(WatchedOutpoints, outpoint)
+	}
+}
+
+// matchOutpointSpends looks for inputs spending watched outpoints. The spending transaction
+// is watched on behalf of every subscription, so they are notified once it has the number of
+// confirmations they want. Only watches on the network the transaction was seen on match.
+func matchOutpointSpends(database *db.DB, tx *wire.MsgTx, network string) {
+	txid := tx.TxHash()
+
+	for index, input := range tx.TxIn {
+		for _, watch := range outpointWatches(input.PreviousOutPoint) {
+			if watch.Network != network {
+				continue
+			}
+
+			log := log.WithFields(logrus.Fields{
+				"txid":     txid.String(),
+				"outpoint": input.PreviousOutPoint.String(),
+				"ID":       watch.ID,
+			})
+
+			spending, err := trackTX(database, TxWatch{
+				notificationID: watch.ID,
+				network:        watch.Network,
+				txid:           txid,
+				notify:         watch.Notify,
+				milestones:     watch.Milestones,
+				description:    watch.Description,
+				spends: &spend{
+					outpoint:   input.PreviousOutPoint,
+					inputIndex: uint32(index),
+				},
+			})
+			if err != nil && !errors.Is(err, db.ErrTxWatchExists) {
+				log.WithError(err).Error("could not watch spending transaction")
+				continue
+			}
+
+			// the spending transaction is watched from now on
+			unwatchOutpoint(input.PreviousOutPoint, watch.ID)
+			if err != nil || spending.wantConfirmations() != 0 {
+				continue
+			}
+
+			// if this fails, the milestone is sent once the transaction confirms
+			_, err = fire(database, spending, func(q db.Querier) error {
+				return SendOutpointSpent(q, spending)
+			})
+			if err != nil {
+				log.WithError(err).Error("could not notify about spent outpoint")
+			}
+		}
+	}
+}
+
+func outpointSpentEmail(tx TxWatch) string {
+	body := fmt.Sprintf(`Outpoint was spent
+outpoint: %s
+spent by txid: %s
+input index: %d`, tx.spends.outpoint.String(), tx.txid.String(), tx.spends.inputIndex)
+	if tx.confirmedAtBlock != nil {
+		body += fmt.Sprintf("\nconfirmed in block: %d\nconfirmations: %d", *tx.confirmedAtBlock,
+			tx.wantConfirmations())
+	}
+	if tx.description != "" {
+		body += fmt.Sprintf("\ndescription: %s", tx.description)
+	}
+
+	return body
+}
+
+// SendOutpointSpent notifies that a watched outpoint was spent, and the spending transaction
+// has the wanted number of confirmations
+func SendOutpointSpent(database db.Querier, tx TxWatch) error {
+	log := log.WithFields(logrus.Fields{
+		"channels": tx.notify.Channels,
+		"txid":     tx.txid,
+		"outpoint": tx.spends.outpoint.String(),
+		"ID":       tx.ID,
+	})
+	log.Info("watched outpoint spent")
+
+	payload := txPayload(tx, eventOutpointSpent)
+	payload["outpoint"] = tx.spends.outpoint.String()
+	payload["inputIndex"] = tx.spends.inputIndex
+
+	err := outbox.EnqueueTx(database, tx.notify.Channels, outbox.Message{
+		NotificationID: tx.notificationID,
+		Subject:        "Outpoint was spent",
+		Text:           outpointSpentEmail(tx),
+		Header:         "Outpoint spent",
+		Payload:        payload,
+	})
+	if err != nil {
+		log.WithError(err).Error("could not queue notification")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package listeners
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/db/dbtest"
+)
+
+func TestParseOutpoint(t *testing.T) {
+	txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+
+	t.Run("can parse outpoint", func(t *testing.T) {
+		outpoint, err := parseOutpoint(fmt.Sprintf("%s:%d", txid, 3))
+		require.NoError(t, err)
+
+		assert.Equal(t, txid, outpoint.Hash)
+		assert.Equal(t, uint32(3), outpoint.Index)
+	})
+
+	t.Run("txid is not an outpoint", func(t *testing.T) {
+		_, err := parseOutpoint(txid.String())
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid vout returns error", func(t *testing.T) {
+		_, err := parseOutpoint(txid.String() + ":-1")
+		assert.Error(t, err)
+	})
+}
+
+func TestMatchOutpointSpends(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	outpoint := wire.OutPoint{
+		Hash:  chainhash.DoubleHashH([]byte(gofakeit.Sentence(5))),
+		Index: uint32(gofakeit.Number(0, 10)),
+	}
+	notification := createNotificationTest(t, outpoint.String(), 2)
+	WatchOutpoint(outpoint, outpointWatch(notification))
+
+	// the watched outpoint is the second input of the spending transaction
+	var spending wire.MsgTx
+	spending.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))},
+		nil, nil))
+	spending.AddTxIn(wire.NewTxIn(&outpoint, nil, nil))
+	txid := spending.TxHash()
+	defer delete(WatchedTxids, txid.String())
+
+	t.Run("ignores spends on other networks", func(t *testing.T) {
+		matchOutpointSpends(testDB, &spending, chaincfg.SigNetParams.Name)
+
+		_, ok := WatchedOutpoints[outpoint]
+		assert.True(t, ok)
+		assert.Empty(t, WatchedTxids[txid.String()])
+	})
+
+	matchOutpointSpends(testDB, &spending, chaincfg.RegressionNetParams.Name)
+
+	t.Run("stops watching the outpoint", func(t *testing.T) {
+		_, ok := WatchedOutpoints[outpoint]
+		assert.False(t, ok)
+	})
+
+	t.Run("watches the spending transaction", func(t *testing.T) {
+		watches := WatchedTxids[txid.String()]
+		require.Len(t, watches, 1)
+
+		for _, watch := range watches {
+			assert.Equal(t, notification.ID, watch.notificationID)
+			assert.Equal(t, int64(2), watch.wantConfirmations())
+			require.NotNil(t, watch.spends)
+			assert.Equal(t, outpoint, watch.spends.outpoint)
+			assert.Equal(t, uint32(1), watch.spends.inputIndex)
+		}
+	})
+}
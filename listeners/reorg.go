@@ -0,0 +1,251 @@
+package listeners
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+)
+
+// maxReorgDepth is how many blocks we remember. Reorgs deeper than this are not handled.
+const maxReorgDepth = 100
+
+// blockRef identifies a block on the chain
+type blockRef struct {
+	height int64
+	hash   chainhash.Hash
+}
+
+// blockHistory keeps track of the most recent blocks we've processed, so we can tell when
+// a new block doesn't build on top of the previous one
+type blockHistory struct {
+	mu sync.Mutex
+	// blocks is sorted by height, the last one being our tip
+	blocks []blockRef
+}
+
+var (
+	historyMu sync.Mutex
+	// histories are the recent blocks of every network, keyed by network name
+	histories = make(map[string]*blockHistory)
+)
+
+// recentBlocks returns the blocks we've processed on the network
+func recentBlocks(network string) *blockHistory {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	history, ok := histories[network]
+	if !ok {
+		history = &blockHistory{}
+		histories[network] = history
+	}
+	return history
+}
+
+// tip returns the last block we processed
+func (b *blockHistory) tip() (blockRef, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.blocks) == 0 {
+		return blockRef{}, false
+	}
+	return b.blocks[len(b.blocks)-1], true
+}
+
+func (b *blockHistory) contains(block blockRef) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, known := range b.blocks {
+		if known == block {
+			return true
+		}
+	}
+	return false
+}
+
+// add makes the block our new tip
+func (b *blockHistory) add(block blockRef) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.blocks = append(b.blocks, block)
+	if len(b.blocks) > maxReorgDepth {
+		b.blocks = b.blocks[len(b.blocks)-maxReorgDepth:]
+	}
+}
+
+// disconnectAbove removes every block above the given height, returning the removed blocks
+// with the highest one first
+func (b *blockHistory) disconnectAbove(height int64) []blockRef {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var disconnected []blockRef
+	for len(b.blocks) > 0 && b.blocks[len(b.blocks)-1].height > height {
+		disconnected = append(disconnected, b.blocks[len(b.blocks)-1])
+		b.blocks = b.blocks[:len(b.blocks)-1]
+	}
+	return disconnected
+}
+
+// markProcessed makes the block our new tip, and persists it so we know where to continue
+// from after a restart
+func markProcessed(database *db.DB, network string, block blockRef) error {
+	recentBlocks(network).add(block)
+
+	err := db.Block{Network: network, Height: block.height, Hash: block.hash.String()}.Save(database)
+	if err != nil {
+		return err
+	}
+
+	if err := db.PruneBlocks(database, network, block.height-maxReorgDepth+1); err != nil {
+		return err
+	}
+	// outpoints spent below the blocks we remember can't be unspent by a reorg anymore
+	return db.PruneSpentOutpoints(database, network, block.height-maxReorgDepth+1)
+}
+
+// findFork walks backwards from the given block until it finds a block we have processed.
+// It returns the height of that block, along with the blocks between it and the given block
+// that we have not processed yet, lowest first.
+func findFork(source backend.ChainSource, network string, from chainhash.Hash) (int64, []blockRef, error) {
+	var missing []blockRef
+
+	hash := from
+	for i := 0; i < maxReorgDepth; i++ {
+		header, height, err := source.BlockHeader(hash)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		block := blockRef{height: height, hash: hash}
+		if recentBlocks(network).contains(block) {
+			// reverse, so the lowest block comes first
+			for left, right := 0, len(missing)-1; left < right; left, right = left+1, right-1 {
+				missing[left], missing[right] = missing[right], missing[left]
+			}
+			return block.height, missing, nil
+		}
+		missing = append(missing, block)
+
+		hash = header.PrevBlock
+	}
+
+	return 0, nil, fmt.Errorf("could not find fork point within %d blocks", maxReorgDepth)
+}
+
+// reorganize makes the given block our new tip. Blocks we processed that are not part of
+// the chain leading up to it are disconnected, and blocks we haven't seen yet are fetched
+// from the source and connected.
+func reorganize(source backend.ChainSource, database *db.DB, network chaincfg.Params, newTip chainhash.Hash) error {
+	forkHeight, missing, err := findFork(source, network.Name, newTip)
+	if err != nil {
+		return err
+	}
+
+	disconnected := recentBlocks(network.Name).disconnectAbove(forkHeight)
+	if err := db.DeleteBlocksAbove(database, network.Name, forkHeight); err != nil {
+		return fmt.Errorf("could not delete disconnected blocks: %w", err)
+	}
+	if len(disconnected) > 0 {
+		log.WithFields(logrus.Fields{
+			"forkHeight":   forkHeight,
+			"disconnected": len(disconnected),
+			"connected":    len(missing),
+		}).Warn("chain reorganization detected")
+	}
+
+	for _, block := range disconnected {
+		disconnectBlock(database, network.Name, block)
+	}
+
+	for _, ref := range missing {
+		block, err := source.Block(ref.hash)
+		if err != nil {
+			return err
+		}
+
+		connectBlock(source, database, network, block, ref.height)
+	}
+
+	return nil
+}
+
+// handleDisconnect rolls back a block the source tells us was disconnected from the best
+// chain. Blocks other than our tip are ignored, a reorg below our tip is noticed once the
+// block replacing it arrives.
+func handleDisconnect(database *db.DB, network string, event backend.BlockEvent) error {
+	block := blockRef{height: event.Height, hash: event.Block.BlockHash()}
+	history := recentBlocks(network)
+	if tip, ok := history.tip(); !ok || tip != block {
+		log.WithField("hash", block.hash).Debug("disconnected block is not our tip")
+		return nil
+	}
+
+	history.disconnectAbove(block.height - 1)
+	if err := db.DeleteBlocksAbove(database, network, block.height-1); err != nil {
+		return fmt.Errorf("could not delete disconnected block: %w", err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"height": block.height,
+		"hash":   block.hash.String(),
+	}).Warn("block disconnected")
+
+	disconnectBlock(database, network, block)
+	return nil
+}
+
+// disconnectBlock rolls back the confirmation of every watched transaction on the network
+// confirmed in the given block. The watches are rearmed, so they fire again once the
+// transactions have enough confirmations on the new chain. The outputs of watched addresses
+// confirmed or spent in the block are rolled back as well.
+func disconnectBlock(database *db.DB, network string, block blockRef) {
+	if err := disconnectOutpoints(database, network, block.height); err != nil {
+		log.WithField("blockHeight", block.height).WithError(err).Error("could not roll back outpoints")
+	}
+
+	txidMu.Lock()
+	var unconfirmed []TxWatch
+	for _, watches := range WatchedTxids {
+		for id, tx := range watches {
+			if tx.network != network || tx.confirmedAtBlock == nil || *tx.confirmedAtBlock != block.height {
+				continue
+			}
+
+			tx.confirmedAtBlock = nil
+			tx.fired = false
+			tx.milestonesSent = tx.mempoolMilestones()
+			watches[id] = tx
+			unconfirmed = append(unconfirmed, tx)
+		}
+	}
+	txidMu.Unlock()
+
+	for _, tx := range unconfirmed {
+		log := log.WithFields(logrus.Fields{
+			"txid":        tx.txid.String(),
+			"blockHeight": block.height,
+			"blockHash":   block.hash.String(),
+		})
+		log.Info("transaction unconfirmed by reorg")
+
+		err := database.Transact(func(q db.Querier) error {
+			if err := db.UnconfirmTxWatch(q, tx.ID, tx.milestonesSent); err != nil {
+				return fmt.Errorf("could not persist unconfirmed tx watch: %w", err)
+			}
+			return SendTxUnconfirmed(q, tx, block)
+		})
+		if err != nil {
+			log.WithError(err).Error("could not unconfirm tx watch")
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package listeners
+
+import (
+	"testing"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+)
+
+func mockBlockRef(height int64) blockRef {
+	return blockRef{
+		height: height,
+		hash:   chainhash.DoubleHashH([]byte(gofakeit.Sentence(5))),
+	}
+}
+
+func TestBlockHistory(t *testing.T) {
+	history := &blockHistory{}
+
+	_, ok := history.tip()
+	require.False(t, ok)
+
+	var blocks []blockRef
+	for height := int64(1); height <= 10; height++ {
+		block := mockBlockRef(height)
+		blocks = append(blocks, block)
+		history.add(block)
+	}
+
+	t.Run("last block is the tip", func(t *testing.T) {
+		tip, ok := history.tip()
+		require.True(t, ok)
+		assert.Equal(t, blocks[9], tip)
+	})
+
+	t.Run("contains added blocks", func(t *testing.T) {
+		assert.True(t, history.contains(blocks[4]))
+		assert.False(t, history.contains(mockBlockRef(5)))
+	})
+
+	t.Run("disconnects blocks above height, highest first", func(t *testing.T) {
+		disconnected := history.disconnectAbove(7)
+		assert.Equal(t, []blockRef{blocks[9], blocks[8], blocks[7]}, disconnected)
+
+		tip, ok := history.tip()
+		require.True(t, ok)
+		assert.Equal(t, blocks[6], tip)
+	})
+
+	t.Run("forgets blocks deeper than the max reorg depth", func(t *testing.T) {
+		for height := int64(8); height <= maxReorgDepth+20; height++ {
+			history.add(mockBlockRef(height))
+		}
+
+		assert.Len(t, history.blocks, maxReorgDepth)
+		assert.False(t, history.contains(blocks[0]))
+	})
+}
+
+func TestDisconnectBlock(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+	notification := createNotificationTest(t, txid.String(), 1)
+
+	block := mockBlockRef(int64(gofakeit.Number(1, 1000)))
+	saved, err := db.TxWatch{
+		NotificationID:   notification.ID,
+		Txid:             txid.String(),
+		ConfirmedAtBlock: &block.height,
+		Fired:            true,
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	require.NoError(t, WatchTX(TxWatch{
+		ID:               saved.ID,
+		notificationID:   notification.ID,
+		network:          notification.Network,
+		txid:             txid,
+		confirmedAtBlock: &block.height,
+		milestones:       []int64{1},
+		milestonesSent:   1,
+		fired:            true,
+	}))
+	defer delete(WatchedTxids, txid.String())
+
+	disconnectBlock(testDB, notification.Network, block)
+
+	t.Run("rolls back confirmation and rearms watch", func(t *testing.T) {
+		watch := WatchedTxids[txid.String()][saved.ID]
+		assert.Nil(t, watch.confirmedAtBlock)
+		assert.False(t, watch.fired)
+	})
+
+	t.Run("persists the rollback", func(t *testing.T) {
+		watches, err := db.ListUnfiredTxWatches(testDB)
+		require.NoError(t, err)
+
+		var found bool
+		for _, watch := range watches {
+			if watch.ID == saved.ID {
+				found = true
+				assert.Nil(t, watch.ConfirmedAtBlock)
+			}
+		}
+		assert.True(t, found)
+	})
+}
+
+func TestFindFork(t *testing.T) {
+	network := chaincfg.RegressionNetParams.Name
+	histories[network] = &blockHistory{}
+	defer delete(histories, network)
+
+	source := backend.NewFake(chaincfg.RegressionNetParams)
+	for i := 0; i < 5; i++ {
+		block := source.Mine()
+		recentBlocks(network).add(blockRef{height: int64(i + 1), hash: block.BlockHash()})
+	}
+
+	source.Disconnect()
+	source.Disconnect()
+	var replacements []chainhash.Hash
+	for i := 0; i < 3; i++ {
+		replacements = append(replacements, source.Mine().BlockHash())
+	}
+
+	forkHeight, missing, err := findFork(source, network, replacements[2])
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(3), forkHeight)
+	require.Len(t, missing, 3)
+	for i, block := range missing {
+		assert.Equal(t, forkHeight+int64(i)+1, block.height)
+		assert.Equal(t, replacements[i], block.hash)
+	}
+}
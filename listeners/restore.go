@@ -0,0 +1,214 @@
+package listeners
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/db"
+)
+
+// Restore rebuilds the watch state of every network from the database, so a restart doesn't
+// lose any notifications. Notifications and blocks saved before we served several networks
+// belong to the first network. It has to be called before we start reading events from the
+// chain sources.
+func Restore(database *db.DB, networks []chaincfg.Params) error {
+	if len(networks) == 0 {
+		return errors.New("no networks to restore")
+	}
+	if err := db.ClaimNetwork(database, networks[0].Name); err != nil {
+		return fmt.Errorf("could not assign notifications to %s: %w", networks[0].Name, err)
+	}
+
+	if err := restoreOutpoints(database); err != nil {
+		return fmt.Errorf("could not restore outpoints: %w", err)
+	}
+
+	notifications, err := db.ListAllNotifications(database)
+	if err != nil {
+		return err
+	}
+
+	byNetwork := make(map[string][]db.Notification)
+	for _, notification := range notifications {
+		byNetwork[notification.Network] = append(byNetwork[notification.Network], notification)
+	}
+
+	for _, network := range networks {
+		if err := restoreNetwork(database, network, byNetwork[network.Name]); err != nil {
+			return fmt.Errorf("could not restore %s: %w", network.Name, err)
+		}
+		delete(byNetwork, network.Name)
+	}
+
+	for name, notifications := range byNetwork {
+		log.WithFields(logrus.Fields{
+			"network":       name,
+			"notifications": len(notifications),
+		}).Warn("not serving network, its notifications are not watched")
+	}
+
+	return nil
+}
+
+// restoreNetwork rebuilds the watch state of a single network
+func restoreNetwork(database *db.DB, network chaincfg.Params, notifications []db.Notification) error {
+	if err := restoreBlocks(database, network.Name); err != nil {
+		return fmt.Errorf("could not restore processed blocks: %w", err)
+	}
+
+	byID := make(map[uuid.UUID]db.Notification, len(notifications))
+	var addresses, outpoints, wallets int
+	for _, notification := range notifications {
+		byID[notification.ID] = notification
+
+		if outpoint, err := parseOutpoint(notification.Identifier); err == nil {
+			// once the outpoint is spent, the spending transaction is restored from the tx
+			// watches beneath instead
+			spent, err := db.HasTxWatch(database, notification.ID)
+			if err != nil {
+				return err
+			}
+			if !spent {
+				WatchOutpoint(outpoint, outpointWatch(notification))
+				outpoints++
+			}
+			continue
+		}
+
+		if descriptor, err := parseWallet(notification.Identifier, &network); err == nil {
+			// a single broken wallet shouldn't keep us from watching everything else
+			if err := restoreWallet(database, notification, descriptor, &network); err != nil {
+				log.WithError(err).WithField("notification", notification.ID).Error("could not restore wallet")
+				continue
+			}
+			wallets++
+			continue
+		}
+
+		address, err := decodeAddress(notification.Identifier, &network)
+		if err != nil {
+			// not an address, meaning this is a txid. those are restored
+			// from the tx watches beneath
+			continue
+		}
+
+		WatchAddress(address, addressWatch(notification))
+		addresses++
+	}
+
+	// fired watches that could still be reorged out are restored as well, so we can
+	// tell the user if that happens
+	var confirmedSince int64
+	history := recentBlocks(network.Name)
+	if tip, ok := history.tip(); ok {
+		confirmedSince = tip.height - maxReorgDepth + 1
+	}
+
+	watches, err := db.ListActiveTxWatches(database, network.Name, confirmedSince)
+	if err != nil {
+		return err
+	}
+
+	for _, watch := range watches {
+		log := log.WithFields(logrus.Fields{
+			"id":   watch.ID,
+			"txid": watch.Txid,
+		})
+
+		notification, ok := byID[watch.NotificationID]
+		if !ok {
+			log.Warn("tx watch belongs to unknown notification")
+			continue
+		}
+
+		txid, err := chainhash.NewHashFromStr(watch.Txid)
+		if err != nil {
+			log.WithError(err).Error("could not restore tx watch")
+			continue
+		}
+
+		tx := TxWatch{
+			ID:                 watch.ID,
+			notificationID:     notification.ID,
+			network:            notification.Network,
+			txid:               *txid,
+			notify:             notificationChannels(notification),
+			confirmedAtBlock:   watch.ConfirmedAtBlock,
+			milestones:         notificationMilestones(notification),
+			milestonesSent:     watch.MilestonesSent,
+			description:        notification.Description,
+			fired:              watch.Fired,
+			followReplacements: notification.FollowReplacements,
+		}
+		if watch.Address != nil {
+			tx.address = *watch.Address
+		}
+		if watch.InputIndex != nil {
+			outpoint, err := parseOutpoint(notification.Identifier)
+			if err != nil {
+				log.WithError(err).Error("could not restore spent outpoint")
+				continue
+			}
+			tx.spends = &spend{outpoint: outpoint, inputIndex: *watch.InputIndex}
+		}
+
+		if err := WatchTX(tx); err != nil {
+			log.WithError(err).Error("could not restore tx watch")
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"network":   network.Name,
+		"addresses": addresses,
+		"outpoints": outpoints,
+		"wallets":   wallets,
+		"txids":     len(watches),
+		"blocks":    len(history.blocks),
+	}).Info("restored watches from database")
+
+	return nil
+}
+
+// addressWatch creates the watch for an address, or an address derived from a wallet
+func addressWatch(notification db.Notification) AddressWatch {
+	return AddressWatch{
+		ID:                 notification.ID,
+		Network:            notification.Network,
+		Notify:             notificationChannels(notification),
+		Milestones:         notificationMilestones(notification),
+		Description:        notification.Description,
+		FollowReplacements: notification.FollowReplacements,
+		MinAmount:          btcutil.Amount(notification.MinAmount),
+		MaxAmount:          btcutil.Amount(notification.MaxAmount),
+	}
+}
+
+func outpointWatch(notification db.Notification) OutpointWatch {
+	return OutpointWatch{
+		ID:          notification.ID,
+		Network:     notification.Network,
+		Notify:      notificationChannels(notification),
+		Milestones:  notificationMilestones(notification),
+		Description: notification.Description,
+	}
+}
+
+// notificationMilestones lists the confirmation counts to notify at. Notifications without
+// milestones are notified once, at the number of confirmations they want.
+func notificationMilestones(notification db.Notification) []int64 {
+	if len(notification.Milestones) > 0 {
+		return notification.Milestones
+	}
+	return []int64{int64(notification.Confirmations)}
+}
+
+// notificationChannels extracts the different ways of contacting the user from a notification
+func notificationChannels(notification db.Notification) Notification {
+	return Notification{Channels: notification.Channels}
+}
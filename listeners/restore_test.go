@@ -0,0 +1,85 @@
+package listeners
+
+import (
+	"testing"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+)
+
+func TestRestore(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	address := MockAddress()
+	addressNotification := createNotificationTest(t, address.String(), 3)
+
+	txid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+	txidNotification := createNotificationTest(t, txid.String(), 6)
+
+	confirmedAt := int64(gofakeit.Number(1, 1000))
+	txWatch, err := db.TxWatch{
+		NotificationID:   txidNotification.ID,
+		Txid:             txid.String(),
+		ConfirmedAtBlock: &confirmedAt,
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	firedTxid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+	fired, err := db.TxWatch{
+		NotificationID: addressNotification.ID,
+		Txid:           firedTxid.String(),
+	}.Save(testDB)
+	require.NoError(t, err)
+	require.NoError(t, db.MarkTxWatchFired(testDB, fired.ID))
+
+	signetTxid := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+	signetNotification := createNotificationTest(t, signetTxid.String(), 1)
+	_, err = testDB.Exec("UPDATE notifications SET network = $1 WHERE id = $2", chaincfg.SigNetParams.Name,
+		signetNotification.ID)
+	require.NoError(t, err)
+	_, err = db.TxWatch{NotificationID: signetNotification.ID, Txid: signetTxid.String()}.Save(testDB)
+	require.NoError(t, err)
+
+	require.NoError(t, Restore(testDB, []chaincfg.Params{chaincfg.RegressionNetParams}))
+	defer func() {
+		delete(WatchedAddresses, address.String())
+		delete(WatchedTxids, txid.String())
+	}()
+
+	t.Run("restores address watches", func(t *testing.T) {
+		watch, ok := WatchedAddresses[address.String()][addressNotification.ID]
+		require.True(t, ok)
+
+		assert.Equal(t, addressNotification.ID, watch.ID)
+		assert.Equal(t, addressNotification.Channels, watch.Notify.Channels)
+		assert.Equal(t, addressNotification.Description, watch.Description)
+		assert.Equal(t, []int64{3}, watch.Milestones)
+		assert.Equal(t, chaincfg.RegressionNetParams.Name, watch.Network)
+	})
+
+	t.Run("restores confirmation progress", func(t *testing.T) {
+		watch, ok := WatchedTxids[txid.String()][txWatch.ID]
+		require.True(t, ok)
+
+		assert.Equal(t, txWatch.ID, watch.ID)
+		require.NotNil(t, watch.confirmedAtBlock)
+		assert.Equal(t, confirmedAt, *watch.confirmedAtBlock)
+		assert.Equal(t, int64(6), watch.wantConfirmations())
+	})
+
+	t.Run("does not restore fired watches", func(t *testing.T) {
+		_, ok := WatchedTxids[firedTxid.String()]
+		assert.False(t, ok)
+	})
+
+	t.Run("does not restore networks we're not serving", func(t *testing.T) {
+		_, ok := WatchedTxids[signetTxid.String()]
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,526 @@
+package listeners
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/outbox"
+)
+
+const eventAddressSpent = "address_spent"
+
+// ownedOutput is an output paying to a watched address
+type ownedOutput struct {
+	address string
+	amount  btcutil.Amount
+	// confirmedAt is the height of the block the output was confirmed in. Nil if the output
+	// is unconfirmed.
+	confirmedAt *int64
+	// spentBy is set if we've seen an unconfirmed transaction spending the output
+	spentBy *chainhash.Hash
+}
+
+// networkOutpoint is an outpoint on a given network. Test networks can share transactions
+// with each other, so the outpoint alone doesn't tell which network it belongs to.
+type networkOutpoint struct {
+	network  string
+	outpoint wire.OutPoint
+}
+
+var (
+	outpointMu sync.Mutex
+	// ownedOutpoints are the outputs paying to watched addresses that are not spent in a block yet
+	ownedOutpoints = make(map[networkOutpoint]ownedOutput)
+	// pendingInputs connects the inputs of unconfirmed transactions paying to or spending from
+	// watched addresses to the transaction spending them. Any other transaction spending one of
+	// these inputs on the same network replaces the transaction.
+	pendingInputs = make(map[networkOutpoint]chainhash.Hash)
+)
+
+// trackOutpoint starts keeping track of an output paying to a watched address. height is nil
+// for outputs that are not confirmed yet. Outputs we already know about are marked as
+// confirmed once we see them in a block.
+func trackOutpoint(database *db.DB, network string, outpoint wire.OutPoint, address string, amount btcutil.Amount,
+	height *int64) error {
+	outpointMu.Lock()
+	defer outpointMu.Unlock()
+
+	key := networkOutpoint{network: network, outpoint: outpoint}
+	if owned, ok := ownedOutpoints[key]; ok {
+		if height == nil || owned.confirmedAt != nil {
+			return nil
+		}
+
+		if err := db.MarkOutpointConfirmed(database, network, outpoint.Hash.String(), outpoint.Index, height); err != nil {
+			return fmt.Errorf("could not mark outpoint as confirmed: %w", err)
+		}
+		owned.confirmedAt = height
+		ownedOutpoints[key] = owned
+		return nil
+	}
+
+	err := db.Outpoint{
+		Network:          network,
+		Txid:             outpoint.Hash.String(),
+		Vout:             outpoint.Index,
+		Address:          address,
+		Amount:           int64(amount),
+		ConfirmedAtBlock: height,
+	}.Save(database)
+	if err != nil {
+		return fmt.Errorf("could not save outpoint: %w", err)
+	}
+
+	ownedOutpoints[key] = ownedOutput{
+		address:     address,
+		amount:      amount,
+		confirmedAt: height,
+	}
+	return nil
+}
+
+// rememberPendingTx indexes the inputs of an unconfirmed transaction paying to or spending
+// from a watched address, so we can tell if it is replaced later on
+func rememberPendingTx(tx *wire.MsgTx, network string) {
+	txid := tx.TxHash()
+
+	outpointMu.Lock()
+	defer outpointMu.Unlock()
+
+	for _, input := range tx.TxIn {
+		pendingInputs[networkOutpoint{network: network, outpoint: input.PreviousOutPoint}] = txid
+	}
+}
+
+// forgetReplacedOutputs looks for unconfirmed transactions paying to or spending from watched
+// addresses that conflict with the given transaction. The outputs of those transactions will
+// never confirm, and the outputs they spent are unspent again.
+func forgetReplacedOutputs(database *db.DB, network string, tx *wire.MsgTx) {
+	txid := tx.TxHash()
+
+	outpointMu.Lock()
+	replaced := make(map[chainhash.Hash]bool)
+	for _, input := range tx.TxIn {
+		key := networkOutpoint{network: network, outpoint: input.PreviousOutPoint}
+		spender, ok := pendingInputs[key]
+		if !ok {
+			continue
+		}
+		delete(pendingInputs, key)
+		if spender != txid {
+			replaced[spender] = true
+		}
+	}
+
+	var unspent []wire.OutPoint
+	if len(replaced) > 0 {
+		for input, spender := range pendingInputs {
+			if input.network == network && replaced[spender] {
+				delete(pendingInputs, input)
+			}
+		}
+
+		for key, owned := range ownedOutpoints {
+			if key.network != network {
+				continue
+			}
+
+			switch {
+			case replaced[key.outpoint.Hash] && owned.confirmedAt == nil:
+				delete(ownedOutpoints, key)
+			case owned.spentBy != nil && replaced[*owned.spentBy]:
+				owned.spentBy = nil
+				ownedOutpoints[key] = owned
+				unspent = append(unspent, key.outpoint)
+			}
+		}
+	}
+	outpointMu.Unlock()
+
+	for replacedTxid := range replaced {
+		log := log.WithFields(logrus.Fields{
+			"txid":        replacedTxid.String(),
+			"replacement": txid.String(),
+		})
+		log.Info("transaction paying to or spending from watched address was replaced")
+
+		if err := db.DeleteUnconfirmedOutpoints(database, network, replacedTxid.String()); err != nil {
+			log.WithError(err).Error("could not delete outpoints of replaced transaction")
+		}
+	}
+	for _, outpoint := range unspent {
+		if err := db.MarkOutpointUnspent(database, network, outpoint.Hash.String(), outpoint.Index); err != nil {
+			log.WithField("outpoint", outpoint).WithError(err).Error("could not mark outpoint as unspent")
+		}
+	}
+}
+
+// Balance is what an address owns, as seen from the mempool and the best chain
+type Balance struct {
+	Confirmed btcutil.Amount `json:"confirmed"`
+	// Unconfirmed is the change to the balance from mempool transactions. It is negative if
+	// the mempool spends more than it pays to the address.
+	Unconfirmed btcutil.Amount `json:"unconfirmed"`
+}
+
+// AddressUtxo is an output paying to a watched address that is not spent in a block
+type AddressUtxo struct {
+	Outpoint wire.OutPoint
+	Amount   btcutil.Amount
+	// ConfirmedAtBlock is nil if the output is unconfirmed
+	ConfirmedAtBlock *int64
+	// SpentBy is set if an unconfirmed transaction spends the output
+	SpentBy *chainhash.Hash
+}
+
+// AddressBalance sums up the outputs the address owns on the network. Confirmed outputs count
+// towards the confirmed balance, even if they're spent by a mempool transaction. Spending them
+// subtracts from the unconfirmed balance instead.
+func AddressBalance(address, network string) (Balance, []AddressUtxo) {
+	outpointMu.Lock()
+	defer outpointMu.Unlock()
+
+	var balance Balance
+	var utxos []AddressUtxo
+	for key, owned := range ownedOutpoints {
+		if owned.address != address || key.network != network {
+			continue
+		}
+
+		switch {
+		case owned.confirmedAt != nil:
+			balance.Confirmed += owned.amount
+			if owned.spentBy != nil {
+				balance.Unconfirmed -= owned.amount
+			}
+		case owned.spentBy == nil:
+			balance.Unconfirmed += owned.amount
+		}
+
+		utxos = append(utxos, AddressUtxo{
+			Outpoint:         key.outpoint,
+			Amount:           owned.amount,
+			ConfirmedAtBlock: owned.confirmedAt,
+			SpentBy:          owned.spentBy,
+		})
+	}
+
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Outpoint.Hash != utxos[j].Outpoint.Hash {
+			return utxos[i].Outpoint.Hash.String() < utxos[j].Outpoint.Hash.String()
+		}
+		return utxos[i].Outpoint.Index < utxos[j].Outpoint.Index
+	})
+	return balance, utxos
+}
+
+// addressBalance is the balance of the address, without the outputs
+func addressBalance(address, network string) Balance {
+	balance, _ := AddressBalance(address, network)
+	return balance
+}
+
+// seedOutpoints adds the outputs the addresses already own. Without this we wouldn't know
+// about funds sent to the addresses before we started watching them. The addresses found
+// to own outputs are returned.
+//
+// NOTE: Depending on the source, this might scan the entire UTXO set and take a few minutes.
+func seedOutpoints(source backend.ChainSource, database *db.DB, network string, addresses ...btcutil.Address) []string {
+	log := log.WithField("addresses", len(addresses))
+	if len(addresses) == 1 {
+		log = log.WithField("address", addresses[0].String())
+	}
+
+	unspent, err := source.Unspent(addresses)
+	if err != nil {
+		log.WithError(err).Error("could not look up unspent outputs")
+		return nil
+	}
+
+	var used []string
+	seen := make(map[string]bool)
+	for _, utxo := range unspent {
+		var height *int64
+		if utxo.Height > 0 {
+			height = &utxo.Height
+		}
+		if err := trackOutpoint(database, network, utxo.Outpoint, utxo.Address, utxo.Amount, height); err != nil {
+			log.WithError(err).Error("could not track outpoint")
+		}
+
+		if !seen[utxo.Address] {
+			seen[utxo.Address] = true
+			used = append(used, utxo.Address)
+		}
+	}
+
+	log.WithField("outpoints", len(unspent)).Info("looked up unspent outputs for addresses")
+	return used
+}
+
+// destination is an output of a transaction spending from a watched address
+type destination struct {
+	Address string         `json:"address"`
+	Amount  btcutil.Amount `json:"amount"`
+}
+
+// txDestinations lists where a transaction sends its funds
+func txDestinations(tx *wire.MsgTx, network chaincfg.Params) []destination {
+	var destinations []destination
+	for _, output := range tx.TxOut {
+		address := "non-standard script"
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(output.PkScript, &network)
+		if err == nil && len(addresses) == 1 {
+			address = addresses[0].String()
+		}
+
+		destinations = append(destinations, destination{
+			Address: address,
+			Amount:  btcutil.Amount(output.Value),
+		})
+	}
+
+	return destinations
+}
+
+// matchSpends looks for inputs spending outputs owned by watched addresses, and notifies
+// whoever is watching those addresses. height is nil for transactions from the mempool.
+func matchSpends(database *db.DB, tx *wire.MsgTx, network chaincfg.Params, height *int64) {
+	txid := tx.TxHash()
+
+	// an address can have several outputs spent by the same transaction, so we sum them
+	// up and send a single notification per address
+	spent := make(map[string]btcutil.Amount)
+	var addresses []string
+	var outpoints []wire.OutPoint
+
+	outpointMu.Lock()
+	for _, input := range tx.TxIn {
+		key := networkOutpoint{network: network.Name, outpoint: input.PreviousOutPoint}
+		owned, ok := ownedOutpoints[key]
+		if !ok {
+			continue
+		}
+		outpoints = append(outpoints, input.PreviousOutPoint)
+
+		// we've already notified about this spend when it entered the mempool
+		notified := owned.spentBy != nil && *owned.spentBy == txid
+
+		if height == nil {
+			owned.spentBy = &txid
+			ownedOutpoints[key] = owned
+			pendingInputs[key] = txid
+		} else {
+			delete(ownedOutpoints, key)
+		}
+
+		if notified {
+			continue
+		}
+		if _, ok := spent[owned.address]; !ok {
+			addresses = append(addresses, owned.address)
+		}
+		spent[owned.address] += owned.amount
+	}
+	outpointMu.Unlock()
+
+	for _, outpoint := range outpoints {
+		err := db.MarkOutpointSpent(database, network.Name, outpoint.Hash.String(), outpoint.Index, txid.String(), height)
+		if err != nil {
+			log.WithField("outpoint", outpoint).WithError(err).Error("could not mark outpoint as spent")
+		}
+	}
+
+	if len(addresses) == 0 {
+		return
+	}
+
+	destinations := txDestinations(tx, network)
+	for _, address := range addresses {
+		for _, watch := range addressWatches(address, network.Name) {
+			err := database.Transact(func(q db.Querier) error {
+				return SendAddressSpent(q, watch, address, txid, spent[address], destinations)
+			})
+			if err != nil {
+				log.WithField("address", address).WithError(err).Error("could not notify about spent funds")
+			}
+		}
+	}
+}
+
+func addressSpentEmail(watch AddressWatch, address string, txid chainhash.Hash,
+	amount btcutil.Amount, destinations []destination, balance Balance) string {
+	body := fmt.Sprintf(`Funds were spent from address
+address: %s
+txid: %s
+amount: %f BTC
+destinations:`, address, txid.String(), amount.ToBTC())
+	for _, destination := range destinations {
+		body += fmt.Sprintf("\n  %s: %f BTC", destination.Address, destination.Amount.ToBTC())
+	}
+	body += balanceLines(balance)
+	if watch.Description != "" {
+		body += fmt.Sprintf("\ndescription: %s", watch.Description)
+	}
+
+	return body
+}
+
+// SendAddressSpent notifies that funds were spent from a watched address
+func SendAddressSpent(database db.Querier, watch AddressWatch, address string, txid chainhash.Hash,
+	amount btcutil.Amount, destinations []destination) error {
+	balance := addressBalance(address, watch.Network)
+
+	log := log.WithFields(logrus.Fields{
+		"channels": watch.Notify.Channels,
+		"address":  address,
+		"txid":     txid,
+		"ID":       watch.ID,
+	})
+	log.Info("funds spent from watched address")
+
+	payload := map[string]interface{}{
+		"id":           watch.ID,
+		"event":        eventAddressSpent,
+		"network":      watch.Network,
+		"address":      address,
+		"txid":         txid,
+		"amount":       amount,
+		"destinations": destinations,
+		"description":  watch.Description,
+		"balance":      balance,
+	}
+
+	err := outbox.EnqueueTx(database, watch.Notify.Channels, outbox.Message{
+		NotificationID: watch.ID,
+		Subject:        "Funds spent from address",
+		Text:           addressSpentEmail(watch, address, txid, amount, destinations, balance),
+		Header:         "Funds spent from address",
+		Payload:        payload,
+	})
+	if err != nil {
+		log.WithError(err).Error("could not queue notification")
+		return err
+	}
+	return nil
+}
+
+// restoreOutpoints loads the outputs owned by watched addresses that are not spent yet
+func restoreOutpoints(database *db.DB) error {
+	outpoints, err := db.ListUnspentOutpoints(database)
+	if err != nil {
+		return err
+	}
+
+	outpointMu.Lock()
+	defer outpointMu.Unlock()
+
+	for _, outpoint := range outpoints {
+		txid, err := chainhash.NewHashFromStr(outpoint.Txid)
+		if err != nil {
+			return fmt.Errorf("invalid outpoint txid %s: %w", outpoint.Txid, err)
+		}
+
+		key := networkOutpoint{
+			network:  outpoint.Network,
+			outpoint: wire.OutPoint{Hash: *txid, Index: outpoint.Vout},
+		}
+		owned := ownedOutput{
+			address:     outpoint.Address,
+			amount:      btcutil.Amount(outpoint.Amount),
+			confirmedAt: outpoint.ConfirmedAtBlock,
+		}
+		if outpoint.SpentByTxid != nil {
+			spentBy, err := chainhash.NewHashFromStr(*outpoint.SpentByTxid)
+			if err != nil {
+				return fmt.Errorf("invalid spending txid %s: %w", *outpoint.SpentByTxid, err)
+			}
+			owned.spentBy = spentBy
+			pendingInputs[key] = *spentBy
+		}
+
+		ownedOutpoints[key] = owned
+	}
+
+	return nil
+}
+
+// balanceLines formats the balance for emails
+func balanceLines(balance Balance) string {
+	return fmt.Sprintf("\nconfirmed balance: %f BTC\nunconfirmed balance: %f BTC",
+		balance.Confirmed.ToBTC(), balance.Unconfirmed.ToBTC())
+}
+
+// disconnectOutpoints rolls back the outputs on the network confirmed or spent in the block at
+// the given height. Outputs spent in the block are unspent again, but the spending transaction
+// is back in the mempool.
+func disconnectOutpoints(database *db.DB, network string, height int64) error {
+	spent, err := db.ListOutpointsSpentAt(database, network, height)
+	if err != nil {
+		return fmt.Errorf("could not list outpoints spent in block: %w", err)
+	}
+
+	outpointMu.Lock()
+	for _, outpoint := range spent {
+		if outpoint.SpentByTxid == nil {
+			continue
+		}
+		txid, err := chainhash.NewHashFromStr(outpoint.Txid)
+		if err != nil {
+			outpointMu.Unlock()
+			return fmt.Errorf("invalid outpoint txid %s: %w", outpoint.Txid, err)
+		}
+		spentBy, err := chainhash.NewHashFromStr(*outpoint.SpentByTxid)
+		if err != nil {
+			outpointMu.Unlock()
+			return fmt.Errorf("invalid spending txid %s: %w", *outpoint.SpentByTxid, err)
+		}
+
+		key := networkOutpoint{network: network, outpoint: wire.OutPoint{Hash: *txid, Index: outpoint.Vout}}
+		ownedOutpoints[key] = ownedOutput{
+			address:     outpoint.Address,
+			amount:      btcutil.Amount(outpoint.Amount),
+			confirmedAt: outpoint.ConfirmedAtBlock,
+			spentBy:     spentBy,
+		}
+		pendingInputs[key] = *spentBy
+	}
+
+	var unconfirmed []wire.OutPoint
+	for key, owned := range ownedOutpoints {
+		if key.network != network || owned.confirmedAt == nil || *owned.confirmedAt != height {
+			continue
+		}
+		owned.confirmedAt = nil
+		ownedOutpoints[key] = owned
+		unconfirmed = append(unconfirmed, key.outpoint)
+	}
+	outpointMu.Unlock()
+
+	for _, outpoint := range spent {
+		if outpoint.SpentByTxid == nil {
+			continue
+		}
+		err := db.MarkOutpointSpent(database, network, outpoint.Txid, outpoint.Vout, *outpoint.SpentByTxid, nil)
+		if err != nil {
+			return fmt.Errorf("could not mark outpoint as spent in mempool: %w", err)
+		}
+	}
+	for _, op := range unconfirmed {
+		if err := db.MarkOutpointConfirmed(database, network, op.Hash.String(), op.Index, nil); err != nil {
+			return fmt.Errorf("could not mark outpoint as unconfirmed: %w", err)
+		}
+	}
+
+	return nil
+}
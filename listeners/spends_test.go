@@ -0,0 +1,259 @@
+package listeners
+
+import (
+	"testing"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+)
+
+func TestMatchSpends(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	address := MockAddress()
+	WatchAddress(address, AddressWatch{
+		ID:          uuid.New(),
+		Network:     chaincfg.RegressionNetParams.Name,
+		Description: gofakeit.Sentence(3),
+	})
+	defer func() {
+		delete(WatchedAddresses, address.String())
+	}()
+
+	outpoint := wire.OutPoint{
+		Hash:  chainhash.DoubleHashH([]byte(gofakeit.Sentence(5))),
+		Index: uint32(gofakeit.Number(0, 10)),
+	}
+	require.NoError(t, trackOutpoint(testDB, chaincfg.RegressionNetParams.Name, outpoint, address.String(), 100_000, nil))
+
+	// create a transaction spending the outpoint to some other address
+	pkScript, err := txscript.PayToAddrScript(MockAddress())
+	require.NoError(t, err)
+	var spend wire.MsgTx
+	spend.AddTxIn(wire.NewTxIn(&outpoint, nil, nil))
+	spend.AddTxOut(wire.NewTxOut(90_000, pkScript))
+	spendTxid := spend.TxHash()
+	key := networkOutpoint{network: chaincfg.RegressionNetParams.Name, outpoint: outpoint}
+
+	t.Run("ignores spends on other networks", func(t *testing.T) {
+		matchSpends(testDB, &spend, chaincfg.SigNetParams, nil)
+
+		owned, ok := ownedOutpoints[key]
+		require.True(t, ok)
+		assert.Nil(t, owned.spentBy)
+	})
+
+	t.Run("marks outpoint as spent by mempool transaction", func(t *testing.T) {
+		matchSpends(testDB, &spend, chaincfg.RegressionNetParams, nil)
+
+		owned, ok := ownedOutpoints[key]
+		require.True(t, ok)
+		require.NotNil(t, owned.spentBy)
+		assert.Equal(t, spendTxid, *owned.spentBy)
+	})
+
+	t.Run("forgets outpoint once spent in a block", func(t *testing.T) {
+		height := int64(gofakeit.Number(1, 1000))
+		matchSpends(testDB, &spend, chaincfg.RegressionNetParams, &height)
+
+		_, ok := ownedOutpoints[key]
+		assert.False(t, ok)
+	})
+}
+
+func TestTxDestinations(t *testing.T) {
+	address := MockAddress()
+	pkScript, err := txscript.PayToAddrScript(address)
+	require.NoError(t, err)
+
+	var tx wire.MsgTx
+	tx.AddTxOut(wire.NewTxOut(50_000, pkScript))
+	tx.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN}))
+
+	destinations := txDestinations(&tx, chaincfg.RegressionNetParams)
+	require.Len(t, destinations, 2)
+
+	assert.Equal(t, address.String(), destinations[0].Address)
+	assert.Equal(t, btcutil.Amount(50_000), destinations[0].Amount)
+	assert.Equal(t, "non-standard script", destinations[1].Address)
+}
+
+func TestAddressBalance(t *testing.T) {
+	address := MockAddress().String()
+	network := chaincfg.RegressionNetParams.Name
+	height := int64(gofakeit.Number(1, 1000))
+	spender := chainhash.DoubleHashH([]byte(gofakeit.Sentence(5)))
+
+	shared := mockOutpoint()
+	owned := map[networkOutpoint]ownedOutput{
+		// confirmed
+		{network, shared}: {address: address, amount: 100_000, confirmedAt: &height},
+		// confirmed, but spent in the mempool
+		{network, mockOutpoint()}: {address: address, amount: 20_000, confirmedAt: &height, spentBy: &spender},
+		// unconfirmed
+		{network, mockOutpoint()}: {address: address, amount: 5_000},
+		// unconfirmed and spent in the mempool
+		{network, mockOutpoint()}: {address: address, amount: 1_000, spentBy: &spender},
+		// another address
+		{network, mockOutpoint()}: {address: MockAddress().String(), amount: 7_000, confirmedAt: &height},
+		// the same outpoint on another network
+		{chaincfg.SigNetParams.Name, shared}: {address: address, amount: 3_000, confirmedAt: &height},
+	}
+	outpointMu.Lock()
+	for outpoint, output := range owned {
+		ownedOutpoints[outpoint] = output
+	}
+	outpointMu.Unlock()
+	defer func() {
+		outpointMu.Lock()
+		for outpoint := range owned {
+			delete(ownedOutpoints, outpoint)
+		}
+		outpointMu.Unlock()
+	}()
+
+	balance, utxos := AddressBalance(address, network)
+	assert.Equal(t, Balance{Confirmed: 120_000, Unconfirmed: -15_000}, balance)
+	assert.Len(t, utxos, 4)
+
+	t.Run("unknown address has no balance", func(t *testing.T) {
+		balance, utxos := AddressBalance(MockAddress().String(), network)
+		assert.Equal(t, Balance{}, balance)
+		assert.Empty(t, utxos)
+	})
+}
+
+func TestTrackOutpointConfirms(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	network := chaincfg.RegressionNetParams.Name
+	address := MockAddress().String()
+	outpoint := mockOutpoint()
+	defer func() {
+		outpointMu.Lock()
+		delete(ownedOutpoints, networkOutpoint{network: network, outpoint: outpoint})
+		outpointMu.Unlock()
+	}()
+
+	require.NoError(t, trackOutpoint(testDB, network, outpoint, address, 50_000, nil))
+	balance, _ := AddressBalance(address, network)
+	assert.Equal(t, Balance{Unconfirmed: 50_000}, balance)
+
+	height := int64(gofakeit.Number(1, 1000))
+	require.NoError(t, trackOutpoint(testDB, network, outpoint, address, 50_000, &height))
+	balance, utxos := AddressBalance(address, network)
+	assert.Equal(t, Balance{Confirmed: 50_000}, balance)
+	require.Len(t, utxos, 1)
+	require.NotNil(t, utxos[0].ConfirmedAtBlock)
+	assert.Equal(t, height, *utxos[0].ConfirmedAtBlock)
+
+	t.Run("rolls back confirmation when block is disconnected", func(t *testing.T) {
+		require.NoError(t, disconnectOutpoints(testDB, network, height))
+
+		balance, _ := AddressBalance(address, network)
+		assert.Equal(t, Balance{Unconfirmed: 50_000}, balance)
+	})
+}
+
+func TestForgetReplacedOutputs(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	network := chaincfg.RegressionNetParams
+	address := MockAddress()
+	WatchAddress(address, AddressWatch{
+		ID:      uuid.New(),
+		Network: network.Name,
+	})
+	defer func() {
+		delete(WatchedAddresses, address.String())
+	}()
+
+	pkScript, err := txscript.PayToAddrScript(address)
+	require.NoError(t, err)
+
+	// a mempool transaction paying to the address
+	input := mockOutpoint()
+	var original wire.MsgTx
+	original.AddTxIn(wire.NewTxIn(&input, nil, nil))
+	original.AddTxOut(wire.NewTxOut(40_000, pkScript))
+	matchAddresses(backend.NewFake(network), testDB, &original, network, nil)
+
+	balance, _ := AddressBalance(address.String(), network.Name)
+	require.Equal(t, Balance{Unconfirmed: 40_000}, balance)
+
+	// the replacement spends the same input somewhere else
+	var replacement wire.MsgTx
+	replacement.AddTxIn(wire.NewTxIn(&input, nil, nil))
+	replacement.AddTxOut(wire.NewTxOut(39_000, []byte{txscript.OP_TRUE}))
+	forgetReplacedOutputs(testDB, network.Name, &replacement)
+
+	balance, utxos := AddressBalance(address.String(), network.Name)
+	assert.Equal(t, Balance{}, balance)
+	assert.Empty(t, utxos)
+}
+
+func TestPruneSpentOutpoints(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	// the same outpoint on two networks
+	network, other := "prune-"+gofakeit.UUID(), "prune-"+gofakeit.UUID()
+	outpoint := mockOutpoint()
+	for _, name := range []string{network, other} {
+		require.NoError(t, db.Outpoint{
+			Network: name,
+			Txid:    outpoint.Hash.String(),
+			Vout:    outpoint.Index,
+			Address: MockAddress().String(),
+			Amount:  10_000,
+		}.Save(testDB))
+	}
+
+	height := int64(gofakeit.Number(1, 1000))
+	require.NoError(t, db.MarkOutpointSpent(testDB, network, outpoint.Hash.String(), outpoint.Index,
+		mockOutpoint().Hash.String(), &height))
+
+	t.Run("keeps spent outpoints while they can be reorged out", func(t *testing.T) {
+		require.NoError(t, markProcessed(testDB, network, mockBlockRef(height+maxReorgDepth-1)))
+
+		spent, err := db.ListOutpointsSpentAt(testDB, network, height)
+		require.NoError(t, err)
+		assert.Len(t, spent, 1)
+	})
+
+	t.Run("prunes spent outpoints below the blocks we remember", func(t *testing.T) {
+		require.NoError(t, markProcessed(testDB, network, mockBlockRef(height+maxReorgDepth)))
+
+		spent, err := db.ListOutpointsSpentAt(testDB, network, height)
+		require.NoError(t, err)
+		assert.Empty(t, spent)
+	})
+
+	t.Run("leaves the outpoint of the other network alone", func(t *testing.T) {
+		unspent, err := db.ListUnspentOutpoints(testDB)
+		require.NoError(t, err)
+
+		var found bool
+		for _, o := range unspent {
+			found = found || (o.Network == other && o.Txid == outpoint.Hash.String() && o.Vout == outpoint.Index)
+		}
+		assert.True(t, found)
+	})
+}
+
+func mockOutpoint() wire.OutPoint {
+	return wire.OutPoint{
+		Hash:  chainhash.DoubleHashH([]byte(gofakeit.Sentence(5))),
+		Index: uint32(gofakeit.Number(0, 10)),
+	}
+}
@@ -0,0 +1,176 @@
+package listeners
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+)
+
+// GapLimit is how many unused addresses we derive past the last used address on every branch
+// of a watched wallet
+var GapLimit = 20
+
+// walletWatch is a wallet we derive addresses for. The derived addresses are watched just
+// like any other address, on behalf of the notification watching the wallet.
+type walletWatch struct {
+	descriptor walletDescriptor
+	network    *chaincfg.Params
+	// watch is used for every derived address
+	watch AddressWatch
+
+	// derived is how many addresses we have derived on every branch
+	derived []uint32
+	// lastUsed is the index of the last used address on every branch, -1 if none are used
+	lastUsed []int64
+}
+
+// walletAddress is the position of a derived address within a wallet
+type walletAddress struct {
+	notificationID uuid.UUID
+	branch         int
+	index          uint32
+}
+
+var (
+	walletMu sync.Mutex
+	// watchedWallets are the watched wallets, keyed by notification ID
+	watchedWallets = make(map[uuid.UUID]*walletWatch)
+	// walletAddresses connects derived addresses to their position in every wallet deriving
+	// them
+	walletAddresses = make(map[string][]walletAddress)
+)
+
+// watchWallet starts watching a wallet, deriving addresses up to GapLimit past the last used
+// address on every branch. lastUsed is keyed by branch, and can be empty for new wallets.
+// The derived addresses are returned.
+func watchWallet(descriptor walletDescriptor, network *chaincfg.Params, watch AddressWatch,
+	lastUsed map[int]int64) ([]btcutil.Address, error) {
+	wallet := &walletWatch{
+		descriptor: descriptor,
+		network:    network,
+		watch:      watch,
+		derived:    make([]uint32, descriptor.branches()),
+		lastUsed:   make([]int64, descriptor.branches()),
+	}
+	for branch := range wallet.lastUsed {
+		wallet.lastUsed[branch] = -1
+		if index, ok := lastUsed[branch]; ok {
+			wallet.lastUsed[branch] = index
+		}
+	}
+
+	walletMu.Lock()
+	defer walletMu.Unlock()
+
+	watchedWallets[watch.ID] = wallet
+	return wallet.extend()
+}
+
+// extend derives addresses until there are GapLimit unused addresses after the last used one
+// on every branch. The caller must hold walletMu.
+func (w *walletWatch) extend() ([]btcutil.Address, error) {
+	var derived []btcutil.Address
+	for branch := range w.derived {
+		for int64(w.derived[branch]) <= w.lastUsed[branch]+int64(GapLimit) {
+			index := w.derived[branch]
+			address, err := w.descriptor.address(branch, index, w.network)
+			if err != nil {
+				return derived, fmt.Errorf("could not derive address %d on branch %d: %w", index, branch, err)
+			}
+
+			walletAddresses[address.String()] = append(walletAddresses[address.String()], walletAddress{
+				notificationID: w.watch.ID,
+				branch:         branch,
+				index:          index,
+			})
+			WatchAddress(address, w.watch)
+
+			derived = append(derived, address)
+			w.derived[branch]++
+		}
+	}
+
+	return derived, nil
+}
+
+// useWalletAddress marks a derived address as used, extending the lookahead of every wallet
+// deriving it. The newly derived addresses are returned.
+func useWalletAddress(database *db.DB, address string) []btcutil.Address {
+	walletMu.Lock()
+	defer walletMu.Unlock()
+
+	var derived []btcutil.Address
+	for _, position := range walletAddresses[address] {
+		wallet, ok := watchedWallets[position.notificationID]
+		if !ok || int64(position.index) <= wallet.lastUsed[position.branch] {
+			continue
+		}
+
+		log := log.WithFields(logrus.Fields{
+			"ID":      wallet.watch.ID,
+			"address": address,
+			"branch":  position.branch,
+			"index":   position.index,
+		})
+
+		wallet.lastUsed[position.branch] = int64(position.index)
+		err := db.WalletBranch{
+			NotificationID: wallet.watch.ID,
+			Branch:         position.branch,
+			LastUsedIndex:  int64(position.index),
+		}.Save(database)
+		if err != nil {
+			log.WithError(err).Error("could not persist last used wallet address")
+		}
+
+		addresses, err := wallet.extend()
+		if err != nil {
+			log.WithError(err).Error("could not extend wallet lookahead")
+		}
+		derived = append(derived, addresses...)
+	}
+
+	return derived
+}
+
+// seedWallet adds the outputs the wallet already owns. Every address found to own outputs
+// is marked as used, and the addresses derived because of that are scanned as well.
+//
+// NOTE: Addresses that have been emptied are not found by scanning the UTXO set, meaning
+// funds sent to an address beyond GapLimit unused addresses before we started watching
+// the wallet might go unnoticed.
+func seedWallet(source backend.ChainSource, database *db.DB, network string, addresses []btcutil.Address) {
+	for len(addresses) > 0 {
+		used := seedOutpoints(source, database, network, addresses...)
+
+		var derived []btcutil.Address
+		for _, address := range used {
+			derived = append(derived, useWalletAddress(database, address)...)
+		}
+		addresses = derived
+	}
+}
+
+// restoreWallet starts watching a wallet again, continuing from where we were before the restart
+func restoreWallet(database *db.DB, notification db.Notification, descriptor walletDescriptor,
+	network *chaincfg.Params) error {
+	branches, err := db.ListWalletBranches(database, notification.ID)
+	if err != nil {
+		return err
+	}
+
+	lastUsed := make(map[int]int64, len(branches))
+	for _, branch := range branches {
+		lastUsed[branch.Branch] = branch.LastUsedIndex
+	}
+
+	_, err = watchWallet(descriptor, network, addressWatch(notification), lastUsed)
+	return err
+}
@@ -0,0 +1,97 @@
+package listeners
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/backend"
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+)
+
+func TestWatchWallet(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	gapLimit := GapLimit
+	GapLimit = 3
+	defer func() { GapLimit = gapLimit }()
+
+	xpub := mockXpub(t, &chaincfg.RegressionNetParams)
+	notification := createNotificationTest(t, xpub, 1)
+
+	descriptor, err := parseWallet(xpub, &chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	addresses, err := watchWallet(descriptor, &chaincfg.RegressionNetParams, addressWatch(notification), nil)
+	require.NoError(t, err)
+	defer func() {
+		for address := range walletAddresses {
+			delete(WatchedAddresses, address)
+		}
+		walletAddresses = make(map[string][]walletAddress)
+		delete(watchedWallets, notification.ID)
+	}()
+
+	t.Run("derives gap limit addresses on receive and change branch", func(t *testing.T) {
+		require.Len(t, addresses, 2*(GapLimit+1))
+		for _, address := range addresses {
+			assert.Len(t, addressWatches(address.String(), chaincfg.RegressionNetParams.Name), 1)
+		}
+	})
+
+	t.Run("extends lookahead when address is used", func(t *testing.T) {
+		used, err := descriptor.address(0, 2, &chaincfg.RegressionNetParams)
+		require.NoError(t, err)
+
+		derived := useWalletAddress(testDB, used.String())
+		assert.Len(t, derived, 3)
+		assert.Equal(t, uint32(2+GapLimit+1), watchedWallets[notification.ID].derived[0])
+		assert.Equal(t, uint32(GapLimit+1), watchedWallets[notification.ID].derived[1])
+	})
+
+	t.Run("persists last used index", func(t *testing.T) {
+		branches, err := db.ListWalletBranches(testDB, notification.ID)
+		require.NoError(t, err)
+		require.Len(t, branches, 1)
+
+		assert.Equal(t, 0, branches[0].Branch)
+		assert.Equal(t, int64(2), branches[0].LastUsedIndex)
+	})
+
+	t.Run("seeds outputs of addresses derived when a payment moves the lookahead", func(t *testing.T) {
+		payTo := func(index uint32) *wire.MsgTx {
+			address, err := descriptor.address(0, index, &chaincfg.RegressionNetParams)
+			require.NoError(t, err)
+			pkScript, err := txscript.PayToAddrScript(address)
+			require.NoError(t, err)
+
+			tx := wire.NewMsgTx(2)
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: gofakeit.Uint32()}, nil, nil))
+			tx.AddTxOut(wire.NewTxOut(50_000, pkScript))
+			return tx
+		}
+
+		// the address after the next one is funded before we derive it
+		source := backend.NewFake(chaincfg.RegressionNetParams)
+		source.Mine(payTo(7))
+		unseen, err := descriptor.address(0, 7, &chaincfg.RegressionNetParams)
+		require.NoError(t, err)
+
+		// paying to the last derived address derives up to index 8
+		payment := payTo(5)
+		matchAddresses(source, testDB, payment, chaincfg.RegressionNetParams, nil)
+		defer delete(WatchedTxids, payment.TxHash().String())
+
+		assert.Eventually(t, func() bool {
+			balance, _ := AddressBalance(unseen.String(), chaincfg.RegressionNetParams.Name)
+			return balance.Confirmed == 50_000
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -1,26 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	grpcmiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
-	"github.com/lightninglabs/gozmq"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/net/http2"
@@ -28,9 +27,11 @@ import (
 	"google.golang.org/grpc"
 
 	"github.com/bjornoj/txnotify/api"
+	"github.com/bjornoj/txnotify/backend"
 	"github.com/bjornoj/txnotify/db"
 	"github.com/bjornoj/txnotify/email"
 	"github.com/bjornoj/txnotify/listeners"
+	"github.com/bjornoj/txnotify/outbox"
 	rpc "github.com/bjornoj/txnotify/proto"
 )
 
@@ -45,6 +46,7 @@ func main() {
 	app.EnableBashCompletion = true
 	commands := []*cli.Command{
 		Serve(),
+		Outbox(),
 	}
 
 	app.Commands = commands
@@ -84,21 +86,56 @@ func Serve() *cli.Command {
 				return err
 			}
 
-			bitcoin, err := newBitcoinConnection(c)
+			network, rpcPort, err := readNetwork(c)
 			if err != nil {
 				return err
 			}
 
 			emailSender := email.NewEmailSender(c.String("email-password"))
 
+			source, err := newChainSource(c, network, rpcPort, emailSender)
+			if err != nil {
+				return err
+			}
+
+			networks := []api.Network{{
+				Params: network,
+				Source: source,
+				// Electrum servers only tell us about transactions touching watched addresses
+				AddressesOnly: c.String("backend") == "electrum",
+			}}
+			for _, raw := range c.StringSlice("network.additional") {
+				additional, err := newAdditionalNetwork(c, raw, emailSender)
+				if err != nil {
+					return err
+				}
+				for _, served := range networks {
+					if served.Params.Name == additional.Params.Name {
+						return fmt.Errorf("network %s is given more than once", additional.Params.Name)
+					}
+				}
+				networks = append(networks, additional)
+			}
+
+			listeners.GapLimit = c.Int("gap-limit")
+			outbox.RegisterBuiltin(database, emailSender)
+
+			params := make([]chaincfg.Params, 0, len(networks))
+			for _, network := range networks {
+				params = append(params, network.Params)
+			}
+			if err := listeners.Restore(database, params); err != nil {
+				return fmt.Errorf("could not restore watches: %w", err)
+			}
+
 			grpcServer := grpc.NewServer(UnaryServerInterceptor())
-			rpc.RegisterNotifyServer(grpcServer, api.NewNotifyService(database, bitcoin.network, bitcoin.btcctl, emailSender))
-			rpc.RegisterUserServer(grpcServer, api.NewUserService(database, bitcoin.network, bitcoin.btcctl, emailSender))
+			rpc.RegisterNotifyServer(grpcServer, api.NewNotifyService(database, networks, emailSender))
+			rpc.RegisterUserServer(grpcServer, api.NewUserService(database, network, source, emailSender))
 
 			server := Server{
 				database:   database,
 				grpcServer: grpcServer,
-				bitcoind:   bitcoin,
+				networks:   networks,
 			}
 
 			restMux, err := server.registerRESTServiceHandlers()
@@ -119,14 +156,20 @@ func Serve() *cli.Command {
 
 			log.Info("listening on localhost:9002")
 
-			err = bitcoin.StartZmq(bitcoin.btcctl, ZmqConfig{
-				Transactions: c.Int("bitcoind.zmqpubrawtx"),
-				Blocks:       c.Int("bitcoind.zmqpubrawblock"),
-			}, bitcoin.network, emailSender)
-			if err != nil {
-				return err
+			for _, network := range networks {
+				if err := network.Source.Start(); err != nil {
+					return fmt.Errorf("could not start %s: %w", network.Params.Name, err)
+				}
+
+				go listeners.OnchainBlock(network.Source, database, network.Params)
+				go listeners.OnchainTx(network.Source, database, network.Params)
+				go listeners.OnMempoolRemoval(network.Source, database, network.Params)
 			}
 
+			worker := outbox.NewWorker(database)
+			worker.MaxAttempts = c.Int("outbox.max-attempts")
+			go worker.Run(c.Int("outbox.workers"))
+
 			return server.httpServer.ListenAndServe()
 		},
 		Flags: []cli.Flag{
@@ -144,14 +187,12 @@ func Serve() *cli.Command {
 
 			// bitcoind flags start here
 			&cli.StringFlag{
-				Name:     "bitcoind.rpcuser",
-				Usage:    "The bitcoind RPC username",
-				Required: true,
+				Name:  "bitcoind.rpcuser",
+				Usage: "The bitcoind RPC username. Required with the zmq, polling and btcd backends",
 			},
 			&cli.StringFlag{
-				Name:     "bitcoind.rpcpassword",
-				Usage:    "The bitcoind RPC password",
-				Required: true,
+				Name:  "bitcoind.rpcpassword",
+				Usage: "The bitcoind RPC password. Required with the zmq, polling and btcd backends",
 			},
 			&cli.IntFlag{
 				Name:  "bitcoind.rpcport",
@@ -162,27 +203,121 @@ func Serve() *cli.Command {
 				Usage: "The bitcoind RPC host",
 				Value: "localhost",
 			},
+			&cli.StringFlag{
+				Name: "backend",
+				Usage: "Where to get blocks and transactions from: zmq, polling for bitcoind nodes without ZMQ, " +
+					"esplora for an Esplora compatible API, electrum for an Electrum server (addresses and wallets only), or btcd for btcd " +
+					"websocket notifications. The bitcoind RPC flags are used to connect to btcd",
+				Value: "zmq",
+			},
+			&cli.IntFlag{
+				Name:  "bitcoind.zmqpubrawblock",
+				Usage: "The port listening for ZMQ connections to deliver raw block notifications. Required with the zmq backend",
+			},
 			&cli.IntFlag{
-				Name:     "bitcoind.zmqpubrawblock",
-				Usage:    "The port listening for ZMQ connections to deliver raw block notifications",
-				Required: true,
+				Name:  "bitcoind.zmqpubrawtx",
+				Usage: "The port listening for ZMQ connections to deliver raw transaction notifications. Required with the zmq backend",
 			},
 			&cli.IntFlag{
-				Name:     "bitcoind.zmqpubrawtx",
-				Usage:    "The port listening for ZMQ connections to deliver raw transaction notifications",
-				Required: true,
+				Name: "bitcoind.zmqpubsequence",
+				Usage: "The port listening for ZMQ connections to deliver mempool sequence notifications. " +
+					"If not set, we won't notice transactions being dropped from the mempool",
+			},
+			&cli.StringSliceFlag{
+				Name: "bitcoind.failover",
+				Usage: "Another node to fail over to, given as user:password@host:rpcport?zmqpubrawblock=28332" +
+					"&zmqpubrawtx=28333&zmqpubsequence=28334&priority=1. Anything left out is the same as for the " +
+					"primary node. Can be given multiple times",
+			},
+			&cli.DurationFlag{
+				Name:  "bitcoind.healthcheckinterval",
+				Usage: "How often to check the health of the nodes when failing over between several",
+				Value: 10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "bitcoind.staleafter",
+				Usage: "How long the node we follow can be behind the best tip before we fail over to another",
+				Value: 2 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:  "bitcoind.zmqalertafter",
+				Usage: "How long a ZMQ subscription can be down before we email the operator",
+				Value: 10 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name: "poll-interval",
+				Usage: "How often to poll for new blocks and transactions with the polling and esplora backends. " +
+					"The electrum backend is pushed changes, and polls in case a notification goes missing. " +
+					"The btcd backend loads newly watched addresses into its transaction filter this often",
+				Value: 5 * time.Second,
+			},
+
+			// esplora flags start here
+			&cli.StringFlag{
+				Name:  "esplora.url",
+				Usage: "The URL of the Esplora API, e.g. https://mempool.space/api. Required with the esplora backend",
+			},
+
+			// electrum flags start here
+			&cli.StringFlag{
+				Name:  "electrum.server",
+				Usage: "The host:port of the Electrum server, e.g. electrs or Fulcrum. Required with the electrum backend",
+			},
+			&cli.BoolFlag{
+				Name:  "electrum.tls",
+				Usage: "Connect to the Electrum server over TLS",
+			},
+
+			// btcd flags start here
+			&cli.StringFlag{
+				Name:  "btcd.rpccert",
+				Usage: "Path to btcd's TLS certificate, usually rpc.cert in the btcd directory. TLS is disabled if not set",
 			},
 			&cli.StringFlag{
 				Name:  "network",
-				Usage: "the network lnd is running on e.g. mainnet, testnet, etc.",
+				Usage: "the network bitcoind is running on: mainnet, testnet, testnet4, signet or regtest",
 				Value: "regtest",
 			},
+			&cli.StringFlag{
+				Name: "network.config",
+				Usage: "Path to a JSON file defining the parameters of a custom network, e.g. a signet with " +
+					"its own challenge. Overrides --network",
+			},
+			&cli.StringSliceFlag{
+				Name: "network.additional",
+				Usage: "Another network to serve, given as network=user:password@host:rpcport?zmqpubrawblock=28332" +
+					"&zmqpubrawtx=28333&zmqpubsequence=28334, e.g. testnet=user:password@localhost. The node is " +
+					"connected to with the zmq or polling backend, following --backend. Notifications not " +
+					"specifying a network use --network. Can be given multiple times",
+			},
 
 			// util flags
 			&cli.StringFlag{
 				Name:  "email-password",
 				Usage: "Email password for the email account specified in the code",
 			},
+			&cli.StringFlag{
+				Name:  "operator-email",
+				Usage: "Where to send alerts about txnotify itself, e.g. losing the connection to bitcoind",
+			},
+			&cli.IntFlag{
+				Name:  "gap-limit",
+				Usage: "How many unused addresses to look ahead when watching a wallet",
+				Value: 20,
+			},
+
+			// outbox flags start here
+			&cli.IntFlag{
+				Name:  "outbox.workers",
+				Usage: "How many messages to users we deliver concurrently",
+				Value: 4,
+			},
+			&cli.IntFlag{
+				Name: "outbox.max-attempts",
+				Usage: "How many times we try to deliver a message to a user before marking it as dead. " +
+					"Dead messages can be requeued with the outbox command",
+				Value: 10,
+			},
 		},
 	}
 
@@ -195,8 +330,9 @@ type Server struct {
 	grpcServer *grpc.Server
 	httpServer *http.Server // server HTTP and gRPC over the same port
 
-	// TODO: Add database
-	bitcoind BitcoinConn
+	// networks are the networks we serve, along with where we get their blocks and
+	// transactions from
+	networks []api.Network
 }
 
 func (s *Server) registerRESTServiceHandlers() (http.Handler, error) {
@@ -218,10 +354,59 @@ func (s *Server) registerRESTServiceHandlers() (http.Handler, error) {
 	mux := http.NewServeMux()
 	// serve gRPC REST gateway under /
 	mux.Handle("/", grpcMux)
+	mux.HandleFunc("/status", s.serveStatus)
 
 	return mux, nil
 }
 
+// serveStatus reports the state of the connection to the chain backend of every network,
+// for monitoring
+func (s *Server) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	healthy := true
+	networks := map[string]interface{}{}
+	for _, network := range s.networks {
+		status := sourceStatus(network.Source)
+		healthy = healthy && status["healthy"].(bool)
+		networks[network.Params.Name] = status
+	}
+	status := map[string]interface{}{
+		"healthy":  healthy,
+		"networks": networks,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.WithError(err).Error("could not write status")
+	}
+}
+
+// sourceStatus reports the state of the connection to a chain backend
+func sourceStatus(source backend.ChainSource) map[string]interface{} {
+	healthy := true
+	status := map[string]interface{}{}
+	if zmq, ok := source.(*backend.Zmq); ok {
+		subscriptions := zmq.State()
+		for _, subscription := range subscriptions {
+			healthy = healthy && subscription.Connected
+		}
+		status["zmq"] = subscriptions
+	}
+	if failover, ok := source.(*backend.Failover); ok {
+		nodes := failover.State()
+		active := false
+		for _, node := range nodes {
+			active = active || (node.Active && node.Healthy)
+		}
+		healthy = healthy && active
+		status["nodes"] = nodes
+	}
+	status["healthy"] = healthy
+	return status
+}
+
 var corsHeaders = strings.Join([]string{
 	"Content-Type", "Accept",
 	"Authorization", "Access-Control-Allow-Origin",
@@ -267,339 +452,263 @@ func splitGrpcAndRest(grpcServer *grpc.Server, restHandler http.Handler) http.Ha
 	})
 }
 
-// bitcoinConfig contains everything we need to reliably start a bitcoind node.
-type bitcoinConfig struct {
-	RpcPort  int
-	RpcHost  string
-	P2pPort  int
-	User     string
-	Password string
-	// Network is the network we're running on
-	Network chaincfg.Params
-}
-
-// ToConnConfig converts this BitcoindConfig to the format the rpcclient
-// library expects.
-func (conf *bitcoinConfig) ToConnConfig() *rpcclient.ConnConfig {
-	host := conf.RpcHost
-	if host == "" {
-		host = "127.0.0.1"
-	}
-
-	log.WithFields(logrus.Fields{
-		"host":    conf.RpcHost,
-		"user":    conf.User,
-		"network": conf.Network.Name,
-		"p2pport": conf.P2pPort,
-		"rpcport": conf.RpcPort,
-	}).Info("converting config to rpc config")
-
-	return &rpcclient.ConnConfig{
-		Host:         fmt.Sprintf("%s:%d", host, conf.RpcPort),
-		User:         conf.User,
-		Pass:         conf.Password,
-		DisableTLS:   true, // Bitcoin Core doesn't do TLS
-		HTTPPostMode: true, // Bitcoin Core only supports HTTP POST mode
+// newChainSource connects to the chain backend selected by the flags. rpcPort is the default
+// RPC port of the network, if the backends don't know it.
+func newChainSource(c *cli.Context, network chaincfg.Params, rpcPort int,
+	sender email.EmailSender) (backend.ChainSource, error) {
+	conf := backend.BitcoindConfig{
+		RpcHost:  c.String("bitcoind.rpchost"),
+		RpcPort:  c.Int("bitcoind.rpcport"),
+		Password: c.String("bitcoind.rpcpassword"),
+		User:     c.String("bitcoind.rpcuser"),
+		Network:  network,
 	}
-}
-
-// readNetwork reads the network flag, erroring if an invalid value is passed
-func readNetwork(c *cli.Context) (chaincfg.Params, error) {
-	var network chaincfg.Params
-	networkString := c.String("network")
-	switch networkString {
-	case "mainnet":
-		network = chaincfg.MainNetParams
-	case "testnet", "testnet3":
-		network = chaincfg.TestNet3Params
-	case "regtest", "":
-		network = chaincfg.RegressionNetParams
-	default:
-		return chaincfg.Params{}, fmt.Errorf("unknown network: %s. Valid: mainnet, testnet, regtest", networkString)
+	if conf.RpcPort == 0 {
+		conf.RpcPort = rpcPort
 	}
-	return network, nil
-}
-
-// Conn represents a persistent client connection to a bitcoind node
-// that listens for events read from a ZMQ connection
-type BitcoinConn struct {
-	// btcctl is a bitcoind rpc connection
-	btcctl *rpcclient.Client
-
-	// zmqBlockConn is the ZMQ connection we'll use to read raw block
-	// events
-	zmqBlockConn *gozmq.Conn
-	// zmqTxConn is the ZMQ connection we'll use to read raw new
-	// transaction events
-	zmqTxConn *gozmq.Conn
-
-	// config is the config used for this connection
-	config bitcoinConfig
-	// network is the network this cnonection is running on
-	network chaincfg.Params
-}
-
-// ZmqConfig contains what we need to connect to bitcoind ZMQ channels
-type ZmqConfig struct {
-	Transactions int
-	Blocks       int
-}
 
-// StartZmq attempts to establish a ZMQ connection to a bitcoind node. If
-// successful, a goroutine is spawned to read events from the ZMQ connection.
-// It's possible for this function to fail due to a limited number of connection
-// attempts. This is done to prevent waiting forever on the connection to be
-// established in the case that the node is down.
-// Blocks and txs is the URLs to connect to for block and transaction messages, respectively
-func (c *BitcoinConn) StartZmq(btc *rpcclient.Client, config ZmqConfig, network chaincfg.Params,
-	sender email.EmailSender) error {
-	const timeout = time.Second
-	var err error
-
-	// Establish two different ZMQ connections to bitcoind to retrieve block
-	// and transaction event notifications. We'll use two as a separation of
-	// concern to ensure one type of event isn't dropped from the connection
-	// queue due to another type of event filling it up.
-
-	blockUrl := fmt.Sprintf("tcp://%s:%d", c.config.RpcHost, config.Blocks)
-	c.zmqBlockConn, err = gozmq.Subscribe(blockUrl, []string{"rawblock"}, timeout)
-	if err != nil {
-		return fmt.Errorf("gozmq.Subscribe rawblock: %w", err)
+	backendName := c.String("backend")
+	switch backendName {
+	case "esplora":
+		if !c.IsSet("esplora.url") {
+			return nil, errors.New("--esplora.url is required with the esplora backend")
+		}
+		return backend.NewEsplora(c.String("esplora.url"), c.Duration("poll-interval"),
+			watchedAddresses(network)), nil
+	case "electrum":
+		if !c.IsSet("electrum.server") {
+			return nil, errors.New("--electrum.server is required with the electrum backend")
+		}
+		return backend.NewElectrum(c.String("electrum.server"), c.Bool("electrum.tls"), network,
+			c.Duration("poll-interval"), watchedAddresses(network))
 	}
 
-	txUrl := fmt.Sprintf("tcp://%s:%d", c.config.RpcHost, config.Transactions)
-	c.zmqTxConn, err = gozmq.Subscribe(txUrl, []string{"rawtx"}, timeout)
-	if err != nil {
-		if err := c.zmqBlockConn.Close(); err != nil {
-			log.WithError(err).Error("could not close ZMQ block connection", err)
+	for _, flag := range []string{"bitcoind.rpcuser", "bitcoind.rpcpassword"} {
+		if !c.IsSet(flag) {
+			return nil, fmt.Errorf("--%s is required with the %s backend", flag, backendName)
 		}
-		return fmt.Errorf("gozmq.Subscribe rawtx: %w", err)
 	}
 
-	zmqTxCh := make(chan *wire.MsgTx)
-	zmqBlockCh := make(chan *wire.MsgBlock)
-
-	go c.blockEventHandler(zmqBlockCh)
-	go c.txEventHandler(zmqTxCh)
+	zmqConfig := baseZmqConfig(c, network, sender)
+	zmqConfig.Transactions = c.Int("bitcoind.zmqpubrawtx")
+	zmqConfig.Blocks = c.Int("bitcoind.zmqpubrawblock")
+	zmqConfig.Sequence = c.Int("bitcoind.zmqpubsequence")
 
-	go listeners.OnchainBlock(btc, zmqBlockCh, network, sender)
-	go listeners.OnchainTx(zmqTxCh, sender, btc, network)
-
-	return nil
-}
-
-// blockEventHandler reads raw blocks events from the ZMQ block socket and
-// forwards them to the channel registered on the Conn
-//
-// NOTE: This must be run as a goroutine.
-func (c *BitcoinConn) blockEventHandler(channel chan<- *wire.MsgBlock) {
-	log.Info("started listening for ZMQ block notifications")
-
-	for {
-		// Poll an event from the ZMQ socket. This is where the goroutine
-		// will hang until new messages are received
-		var bufs [][]byte
-		msgBytes, err := c.zmqBlockConn.Receive(bufs)
-		if err != nil {
-			// EOF should only be returned if the connection was
-			// explicitly closed, so we can exit at this point.
-			if err == io.EOF {
-				return
+	switch backendName {
+	case "zmq", "":
+		for _, flag := range []string{"bitcoind.zmqpubrawblock", "bitcoind.zmqpubrawtx"} {
+			if !c.IsSet(flag) {
+				return nil, fmt.Errorf("--%s is required with the zmq backend", flag)
 			}
-
-			// It's possible that the connection to the socket
-			// continuously times out, so we'll prevent logging this
-			// error to prevent spamming the logs.
-			netErr, ok := err.(net.Error)
-			if ok && netErr.Timeout() {
-				continue
-			}
-
-			if !strings.Contains(err.Error(), "cannot receive from a closed connection") {
-				log.WithError(err).Error("Unable to receive ZMQ rawblock message")
-			}
-
-			return
 		}
+	case "polling":
+	case "btcd":
+		if c.IsSet("bitcoind.failover") {
+			return nil, errors.New("--bitcoind.failover is only supported with the zmq and polling backends")
+		}
+		return backend.NewBtcd(backend.BtcdConfig{
+			RpcHost:     conf.RpcHost,
+			RpcPort:     conf.RpcPort,
+			User:        conf.User,
+			Password:    conf.Password,
+			Certificate: c.String("btcd.rpccert"),
+			Network:     network,
+		}, c.Duration("poll-interval"), watchedAddresses(network), watchedOutpoints(network))
+	default:
+		return nil, fmt.Errorf("unknown backend: %s. Valid: zmq, polling, esplora, electrum, btcd", backendName)
+	}
 
-		// We have an event! We'll now ensure it is a block event,
-		// deserialize it, and report it to the zmq block channel
-		// the other end is (hopefully) listening at
-		eventType := string(msgBytes[0])
-		switch eventType {
-		case "rawblock":
-			block := &wire.MsgBlock{}
-			r := bytes.NewReader(msgBytes[1])
-			if err := block.Deserialize(r); err != nil {
-				log.WithError(err).Error("Unable to deserialize block")
-				continue
-			}
-
-			log.WithField("hash", block.BlockHash()).Trace("received new block")
-			// send the deserialized block to the block channel
-			channel <- block
-
-		default:
-			// It's possible that the message wasn't fully read if
-			// bitcoind shuts down, which will produce an unreadable
-			// event type. To prevent from logging it, we'll make
-			// sure it conforms to the ASCII standard.
-			if eventType == "" {
-				continue
-			}
+	if !c.IsSet("bitcoind.failover") {
+		return newBitcoindSource(c, backendName, conf, zmqConfig)
+	}
 
-			log.WithField("eventType", eventType).Warn("Received unexpected event type from rawblock subscription")
+	// the node configured with the bitcoind flags is preferred, and the failover nodes
+	// follow in the order they are given unless they have a priority
+	type node struct {
+		backend.FailoverNode
+		conf      backend.BitcoindConfig
+		zmqConfig backend.ZmqConfig
+	}
+	name := func(conf backend.BitcoindConfig) string {
+		if conf.RpcPort == 0 {
+			return conf.RpcHost
 		}
+		return fmt.Sprintf("%s:%d", conf.RpcHost, conf.RpcPort)
 	}
-}
-
-// txEventHandler reads raw blocks events from the ZMQ block socket and
-// forwards them to the zmqTxCh found in the Conn
-//
-// NOTE: This must be run as a goroutine.
-func (c *BitcoinConn) txEventHandler(channel chan<- *wire.MsgTx) {
-	log.Info("started listening for ZMQ transaction notifications")
-
-	for {
-		// Poll an event from the ZMQ socket
-		var bufs [][]byte
-		msgBytes, err := c.zmqTxConn.Receive(bufs)
+	nodes := []node{{
+		FailoverNode: backend.FailoverNode{Name: name(conf), Priority: 0},
+		conf:         conf,
+		zmqConfig:    zmqConfig,
+	}}
+	for i, raw := range c.StringSlice("bitcoind.failover") {
+		failoverConf, failoverZmq, priority, err := parseNode(raw, i+1, conf, zmqConfig)
 		if err != nil {
-			// EOF should only be returned if the connection was
-			// explicitly closed, so we can exit at this point.
-			if err == io.EOF {
-				return
-			}
-
-			// It's possible that the connection to the socket
-			// continuously times out, so we'll prevent logging this
-			// error to prevent spamming the logs.
-			netErr, ok := err.(net.Error)
-			if ok && netErr.Timeout() {
-				continue
-			}
-
-			if strings.Contains(err.Error(), "cannot receive from a closed connection") {
-				continue
-			}
-
-			log.WithError(err).Error("Unable to receive ZMQ rawblock message")
-
-			return
+			return nil, err
 		}
+		nodes = append(nodes, node{
+			FailoverNode: backend.FailoverNode{Name: name(failoverConf), Priority: priority},
+			conf:         failoverConf,
+			zmqConfig:    failoverZmq,
+		})
+	}
 
-		// We have an event! We'll now ensure it is a transaction event,
-		// deserialize it, and report it to the different rescan
-		// clients.
-		eventType := string(msgBytes[0])
-		switch eventType {
-		case "rawtx":
-			tx := &wire.MsgTx{}
-			r := bytes.NewReader(msgBytes[1])
-			// Deserialize the bytes from reader r into tx
-			if err := tx.Deserialize(r); err != nil {
-				log.WithError(err).Error("Unable to deserialize transaction")
-				continue
-			}
-
-			// send the tx event to the channel
-			channel <- tx
-
-		default:
-			// It's possible that the message wasn't fully read if
-			// bitcoind shuts down, which will produce an unreadable
-			// event type. To prevent from logging it, we'll make
-			// sure it conforms to the ASCII standard.
-			if eventType == "" {
-				continue
-			}
-
-			log.WithField("event", eventType).Warn("Received unexpected event type from rawtx subscription")
+	// nodes we can't reach right now are left out, as long as we can reach one of them
+	var failoverNodes []backend.FailoverNode
+	for _, node := range nodes {
+		source, err := newBitcoindSource(c, backendName, node.conf, node.zmqConfig)
+		if err != nil {
+			log.WithField("node", node.Name).WithError(err).Error("could not connect to node, leaving it out")
+			continue
 		}
-
+		node.Source = source
+		failoverNodes = append(failoverNodes, node.FailoverNode)
 	}
-}
 
-// awaitBitcoind tries to get a RPC response from bitcoind, returning an error
-// if that isn't possible within a set of attempts
-func awaitBitcoind(conn *BitcoinConn) error {
-	log := log.WithFields(logrus.Fields{
-		"host": conn.config.RpcHost,
-		"port": conn.config.RpcPort,
-		"user": conn.config.User,
-	})
+	return backend.NewFailover(failoverNodes, c.Duration("bitcoind.healthcheckinterval"),
+		c.Duration("bitcoind.staleafter"))
+}
 
-	var err error
-	const attempts = 10
-	for i := 0; i < attempts; i++ {
-		_, err = conn.btcctl.GetNetworkInfo()
-		switch {
-		case err == nil:
-			return nil
+// newAdditionalNetwork connects to the node of a network served next to the main one, given
+// as network=user:password@host:rpcport?zmqpubrawblock=28332&zmqpubrawtx=28333. The node is
+// connected to with the backend of the main network, which has to be zmq or polling.
+func newAdditionalNetwork(c *cli.Context, raw string, sender email.EmailSender) (api.Network, error) {
+	backendName := c.String("backend")
+	switch backendName {
+	case "zmq", "", "polling":
+	default:
+		return api.Network{}, fmt.Errorf("--network.additional is only supported with the zmq and polling backends")
+	}
 
-			// invalid credentials, no point in continuing
-		case strings.Contains(err.Error(), "status code: 401"):
-			return errors.New("invalid bitcoind credentials")
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 {
+		return api.Network{}, fmt.Errorf("invalid network %q, expected network=user:password@host:rpcport", raw)
+	}
 
-		default:
-			err = fmt.Errorf("awaitBitcoind(%+v): %w", conn, err)
-		}
+	network, err := knownNetwork(parts[0])
+	if err != nil {
+		return api.Network{}, err
+	}
+	if err := registerNetwork(&network); err != nil {
+		return api.Network{}, err
+	}
 
-		log.WithField("attempt", i).WithError(err).Error("tried connecting to bitcoin")
+	// the RPC port defaults to the one of the network, and ZMQ has to be given explicitly
+	base := backend.BitcoindConfig{
+		RpcHost:  c.String("bitcoind.rpchost"),
+		User:     c.String("bitcoind.rpcuser"),
+		Password: c.String("bitcoind.rpcpassword"),
+		Network:  network,
+	}
+	conf, zmqConfig, _, err := parseNode(parts[1], 0, base, baseZmqConfig(c, network, sender))
+	if err != nil {
+		return api.Network{}, err
+	}
+	if backendName != "polling" && (zmqConfig.Blocks == 0 || zmqConfig.Transactions == 0) {
+		return api.Network{}, fmt.Errorf("zmqpubrawblock and zmqpubrawtx are required for network %s with the zmq backend",
+			network.Name)
+	}
 
-		time.Sleep(time.Second)
+	source, err := newBitcoindSource(c, backendName, conf, zmqConfig)
+	if err != nil {
+		return api.Network{}, fmt.Errorf("could not connect to %s: %w", network.Name, err)
 	}
+	return api.Network{Params: network, Source: source}, nil
+}
 
-	log.WithError(err).Error("error is")
-	return err
+// baseZmqConfig is the ZMQ configuration shared by every node of the network, apart from the ports
+func baseZmqConfig(c *cli.Context, network chaincfg.Params, sender email.EmailSender) backend.ZmqConfig {
+	return backend.ZmqConfig{
+		AlertAfter: c.Duration("bitcoind.zmqalertafter"),
+		Alert:      operatorAlert(c.String("operator-email"), sender),
+		MempoolTxids: func() []chainhash.Hash {
+			return listeners.ListMempoolTxids(network.Name)
+		},
+	}
 }
 
-func newBitcoinConnection(c *cli.Context) (BitcoinConn, error) {
-	network, err := readNetwork(c)
-	if err != nil {
-		return BitcoinConn{}, err
+// watchedAddresses lists the addresses watched on the network, for backends that need to
+// know which addresses to look for
+func watchedAddresses(network chaincfg.Params) func() []string {
+	return func() []string {
+		return listeners.ListWatchedAddresses(network.Name)
 	}
+}
 
-	conf := bitcoinConfig{
-		RpcHost:  c.String("bitcoind.rpchost"),
-		RpcPort:  c.Int("bitcoind.rpcport"),
-		Password: c.String("bitcoind.rpcpassword"),
-		User:     c.String("bitcoind.rpcuser"),
-		Network:  network,
+// watchedOutpoints lists the outpoints we need to see spent on the network, for backends that
+// need to know which outpoints to look for
+func watchedOutpoints(network chaincfg.Params) func() []wire.OutPoint {
+	return func() []wire.OutPoint {
+		return listeners.ListWatchedOutpoints(network.Name)
 	}
+}
 
-	if conf.RpcPort == 0 {
-		switch conf.Network.Name {
-		case chaincfg.MainNetParams.Name:
-			conf.RpcPort = 8332
-		case chaincfg.TestNet3Params.Name:
-			conf.RpcPort = 18332
-		case chaincfg.RegressionNetParams.Name:
-			conf.RpcPort = 18443
-		default:
-			return BitcoinConn{}, errors.New("network is not set")
-		}
+// newBitcoindSource connects to a bitcoind node, getting events over ZMQ or by polling
+func newBitcoindSource(c *cli.Context, backendName string, conf backend.BitcoindConfig,
+	zmqConfig backend.ZmqConfig) (backend.ChainSource, error) {
+	if backendName == "polling" {
+		return backend.NewPolling(conf, c.Duration("poll-interval"))
 	}
+	return backend.NewZmq(conf, zmqConfig)
+}
 
-	client, err := rpcclient.New(conf.ToConnConfig(), nil)
+// parseNode parses a bitcoind node given as
+// user:password@host:rpcport?zmqpubrawblock=28332&zmqpubrawtx=28333&priority=1. Anything
+// left out is the same as for the primary node, apart from the priority, which defaults
+// to the position of the node in the list.
+func parseNode(raw string, position int, primary backend.BitcoindConfig,
+	primaryZmq backend.ZmqConfig) (backend.BitcoindConfig, backend.ZmqConfig, int, error) {
+	parsed, err := url.Parse("bitcoind://" + raw)
 	if err != nil {
-		return BitcoinConn{}, fmt.Errorf("could not create new bitcoind rpcclient,"+
-			"is bitcoind running? %w", err)
+		return backend.BitcoindConfig{}, backend.ZmqConfig{}, 0, fmt.Errorf("invalid node %q: %w", raw, err)
 	}
 
-	conn := &BitcoinConn{
-		btcctl:  client,
-		config:  conf,
-		network: conf.Network,
+	conf, zmqConfig, priority := primary, primaryZmq, position
+	conf.RpcHost = parsed.Hostname()
+	if parsed.User != nil {
+		conf.User = parsed.User.Username()
+		if password, ok := parsed.User.Password(); ok {
+			conf.Password = password
+		}
 	}
 
-	if err = awaitBitcoind(conn); err != nil {
-		return BitcoinConn{}, err
+	query := parsed.Query()
+	fields := []struct {
+		value  string
+		target *int
+	}{
+		{parsed.Port(), &conf.RpcPort},
+		{query.Get("zmqpubrawblock"), &zmqConfig.Blocks},
+		{query.Get("zmqpubrawtx"), &zmqConfig.Transactions},
+		{query.Get("zmqpubsequence"), &zmqConfig.Sequence},
+		{query.Get("priority"), &priority},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(field.value)
+		if err != nil {
+			return backend.BitcoindConfig{}, backend.ZmqConfig{}, 0,
+				fmt.Errorf("invalid node %q: %s is not a number", raw, field.value)
+		}
+		*field.target = number
 	}
 
-	log.Info("successfully connected to bitcoind")
+	return conf, zmqConfig, priority, nil
+}
 
-	return *conn, nil
+// operatorAlert returns a function emailing alerts to the operator. If no operator email
+// is configured, alerts are only logged.
+func operatorAlert(operatorEmail string, sender email.EmailSender) func(subject, message string) {
+	return func(subject, message string) {
+		if operatorEmail == "" {
+			log.WithField("subject", subject).Warn("no operator email configured, not sending alert")
+			return
+		}
+		if err := sender.Send(operatorEmail, "txnotify: "+subject, message); err != nil {
+			log.WithError(err).WithField("subject", subject).Error("could not send operator alert")
+		}
+	}
 }
 
 // UnaryServerInterceptor creates the standard server interceptor, along with any custom interceptors given.
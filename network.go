@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/urfave/cli/v2"
+)
+
+// testNet4GenesisBlock is the genesis block of testnet4, as defined in BIP 94
+var testNet4GenesisBlock = func() *wire.MsgBlock {
+	message := "03/May/2024 000000000000000000001ebd58c244970b3aa9d783bb001011fbe8ea8e98e00e"
+	signatureScript := append([]byte{0x04, 0xff, 0xff, 0x00, 0x1d, 0x01, 0x04, 0x4c, byte(len(message))},
+		message...)
+	// the coinbase pays to a public key of all zeroes
+	pkScript := append(append([]byte{0x21}, make([]byte, 33)...), 0xac)
+
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), signatureScript, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50_0000_0000, pkScript))
+
+	merkleRoot := coinbase.TxHash()
+	block := wire.NewMsgBlock(wire.NewBlockHeader(1, &chainhash.Hash{}, &merkleRoot, 0x1d00ffff, 393743547))
+	block.Header.Timestamp = time.Unix(1714777860, 0)
+	if err := block.AddTransaction(coinbase); err != nil {
+		panic(err)
+	}
+	return block
+}()
+
+// testNet4Params are the parameters of testnet4. Apart from the genesis block, the magic
+// and the ports, they are the same as for testnet3.
+var testNet4Params = func() chaincfg.Params {
+	params := chaincfg.TestNet3Params
+	params.Name = "testnet4"
+	params.Net = wire.BitcoinNet(0x283f161c)
+	params.DefaultPort = "48333"
+	params.DNSSeeds = nil
+	params.Checkpoints = nil
+	params.GenesisBlock = testNet4GenesisBlock
+	genesisHash := testNet4GenesisBlock.BlockHash()
+	params.GenesisHash = &genesisHash
+	return params
+}()
+
+// customNetwork is a network defined in a config file. Everything left out is taken from
+// the base network.
+type customNetwork struct {
+	Name string `json:"name"`
+	// Base is the network the parameters are derived from, signet if not set
+	Base string `json:"base"`
+	// SignetChallenge is the hex encoded block challenge script of a custom signet. The
+	// magic of the network is derived from it, while the address prefixes are those of Base.
+	SignetChallenge string `json:"signetchallenge"`
+
+	PubKeyHashAddrID *byte  `json:"pubkeyhashaddrid"`
+	ScriptHashAddrID *byte  `json:"scripthashaddrid"`
+	PrivateKeyID     *byte  `json:"privatekeyid"`
+	Bech32HRP        string `json:"bech32hrp"`
+	// HDPublicKeyID and HDPrivateKeyID are the hex encoded version bytes of extended keys
+	HDPublicKeyID  string `json:"hdpublickeyid"`
+	HDPrivateKeyID string `json:"hdprivatekeyid"`
+
+	GenesisHash string `json:"genesishash"`
+	// Port is the default P2P port
+	Port string `json:"port"`
+	// RpcPort is the default bitcoind RPC port
+	RpcPort int `json:"rpcport"`
+}
+
+// knownNetwork looks up one of the networks we know the parameters of
+func knownNetwork(name string) (chaincfg.Params, error) {
+	switch name {
+	case "mainnet":
+		return chaincfg.MainNetParams, nil
+	case "testnet", "testnet3":
+		return chaincfg.TestNet3Params, nil
+	case "testnet4":
+		return testNet4Params, nil
+	case "signet":
+		return chaincfg.SigNetParams, nil
+	case "regtest", "":
+		return chaincfg.RegressionNetParams, nil
+	default:
+		return chaincfg.Params{}, fmt.Errorf("unknown network: %s. Valid: mainnet, testnet, testnet4, signet, regtest", name)
+	}
+}
+
+// readNetwork reads the network flag, erroring if an invalid value is passed. If a network
+// config file is given, the network is read from that instead. The default bitcoind RPC
+// port of the network is returned if it's not one the backends know about already.
+func readNetwork(c *cli.Context) (chaincfg.Params, int, error) {
+	var network chaincfg.Params
+	var rpcPort int
+	var err error
+	if path := c.String("network.config"); path != "" {
+		network, rpcPort, err = loadNetwork(path)
+	} else {
+		network, err = knownNetwork(c.String("network"))
+	}
+	if err != nil {
+		return chaincfg.Params{}, 0, err
+	}
+
+	if err := registerNetwork(&network); err != nil {
+		return chaincfg.Params{}, 0, err
+	}
+	return network, rpcPort, nil
+}
+
+// registerNetwork makes the address prefixes of the network known to btcutil, which is
+// needed to decode bech32 addresses. The default networks are registered already.
+func registerNetwork(network *chaincfg.Params) error {
+	err := chaincfg.Register(network)
+	if errors.Is(err, chaincfg.ErrDuplicateNet) {
+		// we can't tell if it's the same network registered twice, or two networks sharing
+		// magic, so we check that the prefix we need was registered
+		if network.Bech32HRPSegwit != "" && !chaincfg.IsBech32SegwitPrefix(network.Bech32HRPSegwit+"1") {
+			return fmt.Errorf("network %s has the same magic as another network", network.Name)
+		}
+		return nil
+	}
+	return err
+}
+
+// loadNetwork reads the parameters of a custom network from a JSON config file
+func loadNetwork(path string) (chaincfg.Params, int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return chaincfg.Params{}, 0, fmt.Errorf("could not read network config: %w", err)
+	}
+
+	var custom customNetwork
+	if err := json.Unmarshal(contents, &custom); err != nil {
+		return chaincfg.Params{}, 0, fmt.Errorf("could not parse network config: %w", err)
+	}
+
+	params, err := custom.params()
+	if err != nil {
+		return chaincfg.Params{}, 0, fmt.Errorf("invalid network config %s: %w", path, err)
+	}
+	return params, custom.RpcPort, nil
+}
+
+func (n customNetwork) params() (chaincfg.Params, error) {
+	if n.Name == "" {
+		return chaincfg.Params{}, errors.New("name is required")
+	}
+	if n.Base == "" {
+		n.Base = "signet"
+	}
+
+	params, err := knownNetwork(n.Base)
+	if err != nil {
+		return chaincfg.Params{}, err
+	}
+	if n.SignetChallenge != "" {
+		challenge, err := hex.DecodeString(n.SignetChallenge)
+		if err != nil {
+			return chaincfg.Params{}, fmt.Errorf("invalid signet challenge: %w", err)
+		}
+		// the challenge makes it a signet, but it keeps the address prefixes of its base
+		signet := chaincfg.CustomSignetParams(challenge, nil)
+		signet.PubKeyHashAddrID = params.PubKeyHashAddrID
+		signet.ScriptHashAddrID = params.ScriptHashAddrID
+		signet.PrivateKeyID = params.PrivateKeyID
+		signet.Bech32HRPSegwit = params.Bech32HRPSegwit
+		signet.HDPublicKeyID = params.HDPublicKeyID
+		signet.HDPrivateKeyID = params.HDPrivateKeyID
+		signet.HDCoinType = params.HDCoinType
+		params = signet
+	}
+	params.Name = n.Name
+
+	if n.PubKeyHashAddrID != nil {
+		params.PubKeyHashAddrID = *n.PubKeyHashAddrID
+	}
+	if n.ScriptHashAddrID != nil {
+		params.ScriptHashAddrID = *n.ScriptHashAddrID
+	}
+	if n.PrivateKeyID != nil {
+		params.PrivateKeyID = *n.PrivateKeyID
+	}
+	if n.Bech32HRP != "" {
+		params.Bech32HRPSegwit = n.Bech32HRP
+	}
+
+	for _, keyID := range []struct {
+		encoded string
+		target  *[4]byte
+	}{
+		{n.HDPublicKeyID, &params.HDPublicKeyID},
+		{n.HDPrivateKeyID, &params.HDPrivateKeyID},
+	} {
+		if keyID.encoded == "" {
+			continue
+		}
+		decoded, err := hex.DecodeString(keyID.encoded)
+		if err != nil || len(decoded) != 4 {
+			return chaincfg.Params{}, fmt.Errorf("invalid extended key version %s", keyID.encoded)
+		}
+		copy(keyID.target[:], decoded)
+	}
+
+	if n.GenesisHash != "" {
+		genesisHash, err := chainhash.NewHashFromStr(n.GenesisHash)
+		if err != nil {
+			return chaincfg.Params{}, fmt.Errorf("invalid genesis hash: %w", err)
+		}
+		if *genesisHash != *params.GenesisHash {
+			// we only know the hash of the genesis block
+			params.GenesisHash = genesisHash
+			params.GenesisBlock = nil
+		}
+	}
+	if n.Port != "" {
+		params.DefaultPort = n.Port
+	}
+
+	return params, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestNet4Params(t *testing.T) {
+	assert.Equal(t, "00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043",
+		testNet4Params.GenesisHash.String())
+	assert.Equal(t, "7aa0a7ae1e223414cb807e40cd57e667b718e42aaf9306db9102fe28912b7b4e",
+		testNet4GenesisBlock.Header.MerkleRoot.String())
+}
+
+func TestLoadNetwork(t *testing.T) {
+	write := func(t *testing.T, config string) string {
+		path := filepath.Join(t.TempDir(), "network.json")
+		require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+		return path
+	}
+
+	t.Run("custom signet", func(t *testing.T) {
+		network, rpcPort, err := loadNetwork(write(t, `{
+			"name": "mutinynet",
+			"signetchallenge": "512102f7561d208dd9ae99bf497273e16f389bdbd6c4742ddb8e6b216e64fa2928ad8f51ae",
+			"rpcport": 38332
+		}`))
+		require.NoError(t, err)
+		assert.Equal(t, "mutinynet", network.Name)
+		assert.Equal(t, 38332, rpcPort)
+		assert.NotEqual(t, chaincfg.SigNetParams.Net, network.Net)
+		assert.Equal(t, chaincfg.SigNetParams.GenesisHash, network.GenesisHash)
+	})
+
+	t.Run("custom address prefixes", func(t *testing.T) {
+		network, _, err := loadNetwork(write(t, `{
+			"name": "custom",
+			"base": "regtest",
+			"signetchallenge": "51",
+			"bech32hrp": "sb",
+			"pubkeyhashaddrid": 125,
+			"genesishash": "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6"
+		}`))
+		require.NoError(t, err)
+		assert.Equal(t, "sb", network.Bech32HRPSegwit)
+		assert.Equal(t, byte(125), network.PubKeyHashAddrID)
+		require.NoError(t, registerNetwork(&network))
+
+		address, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &network)
+		require.NoError(t, err)
+		decoded, err := btcutil.DecodeAddress(address.String(), &network)
+		require.NoError(t, err)
+		assert.True(t, decoded.IsForNet(&network))
+	})
+
+	t.Run("signet keeps the prefixes of its base", func(t *testing.T) {
+		network, _, err := loadNetwork(write(t, `{
+			"name": "mainnet-signet",
+			"base": "mainnet",
+			"signetchallenge": "51"
+		}`))
+		require.NoError(t, err)
+		assert.Equal(t, chaincfg.MainNetParams.Bech32HRPSegwit, network.Bech32HRPSegwit)
+		assert.Equal(t, chaincfg.MainNetParams.PubKeyHashAddrID, network.PubKeyHashAddrID)
+		assert.Equal(t, chaincfg.MainNetParams.HDPublicKeyID, network.HDPublicKeyID)
+		assert.NotEqual(t, chaincfg.MainNetParams.Net, network.Net)
+		assert.Equal(t, chaincfg.SigNetParams.GenesisHash, network.GenesisHash)
+	})
+
+	t.Run("requires a name", func(t *testing.T) {
+		_, _, err := loadNetwork(write(t, `{"base": "signet"}`))
+		assert.Error(t, err)
+	})
+}
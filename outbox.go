@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+	"github.com/urfave/cli/v2"
+
+	"github.com/bjornoj/txnotify/db"
+)
+
+// Outbox lets operators inspect and requeue the messages to users we gave up delivering
+func Outbox() *cli.Command {
+	return &cli.Command{
+		Name:  "outbox",
+		Usage: "Inspect and requeue messages that could not be delivered",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "db.host",
+				Usage: "Host the database runs on",
+				Value: "0.0.0.0",
+			},
+			&cli.IntFlag{
+				Name:  "db.port",
+				Usage: "Port database runs on",
+				Value: 5432,
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "dead",
+				Usage: "Lists the messages that used up their delivery attempts",
+				Action: func(c *cli.Context) error {
+					database, err := db.New(c)
+					if err != nil {
+						return fmt.Errorf("could not open db: %w", err)
+					}
+
+					messages, err := db.ListDeadOutboxMessages(database)
+					if err != nil {
+						return err
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					_, _ = fmt.Fprintln(w, "ID\tNOTIFICATION\tCHANNEL\tDESTINATION\tATTEMPTS\tCREATED\tLAST ERROR")
+					for _, message := range messages {
+						lastError := ""
+						if message.LastError != nil {
+							lastError = *message.LastError
+						}
+						_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", message.ID, message.NotificationID,
+							message.Channel, message.Destination, message.Attempts,
+							message.CreatedAt.Format("2006-01-02 15:04:05"), lastError)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "requeue",
+				Usage:     "Gives dead messages a fresh set of delivery attempts",
+				ArgsUsage: "[message ID...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "Requeue every dead message",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Bool("all") == c.Args().Present() {
+						return errors.New("give either message IDs or --all")
+					}
+
+					var ids []uuid.UUID
+					for _, arg := range c.Args().Slice() {
+						id, err := uuid.Parse(arg)
+						if err != nil {
+							return fmt.Errorf("invalid message ID %q: %w", arg, err)
+						}
+						ids = append(ids, id)
+					}
+
+					database, err := db.New(c)
+					if err != nil {
+						return fmt.Errorf("could not open db: %w", err)
+					}
+
+					if c.Bool("all") {
+						requeued, err := db.RequeueDeadOutboxMessages(database)
+						if err != nil {
+							return err
+						}
+						fmt.Printf("requeued %d messages\n", requeued)
+						return nil
+					}
+
+					for _, id := range ids {
+						if err := db.RequeueOutboxMessage(database, id); err != nil {
+							return fmt.Errorf("could not requeue %s: %w", id, err)
+						}
+						fmt.Printf("requeued %s\n", id)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,232 @@
+package outbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/email"
+)
+
+// Names of the channels we ship with
+const (
+	ChannelEmail    = "email"
+	ChannelCallback = "callback"
+	ChannelSlack    = "slack"
+)
+
+// RegisterBuiltin registers the channels we ship with
+func RegisterBuiltin(database *db.DB, sender email.EmailSender) {
+	client := &http.Client{Timeout: requestTimeout}
+
+	Register(emailChannel{sender: sender})
+	Register(callbackChannel{database: database, client: client})
+	Register(slackChannel{client: client})
+}
+
+// emailChannel sends the text of messages as emails
+type emailChannel struct {
+	sender email.EmailSender
+}
+
+func (emailChannel) Name() string {
+	return ChannelEmail
+}
+
+func (emailChannel) Validate(target string) error {
+	_, err := mail.ParseAddress(target)
+	return err
+}
+
+func (emailChannel) Render(message Message) (string, string, error) {
+	return message.Subject, message.Text, nil
+}
+
+func (e emailChannel) Deliver(message db.OutboxMessage) (Result, error) {
+	return Result{Request: message.Body}, e.sender.Send(message.Destination, message.Subject, message.Body)
+}
+
+// callbackChannel posts the payload of messages to a URL, signed with the signing secret of
+// the notification
+type callbackChannel struct {
+	database *db.DB
+	client   *http.Client
+}
+
+func (callbackChannel) Name() string {
+	return ChannelCallback
+}
+
+func (callbackChannel) Validate(target string) error {
+	return validateURL(target)
+}
+
+func (callbackChannel) Render(message Message) (string, string, error) {
+	payload, err := json.Marshal(message.Payload)
+	if err != nil {
+		return "", "", fmt.Errorf("could not marshal payload: %w", err)
+	}
+	return "", string(payload), nil
+}
+
+func (c callbackChannel) Deliver(message db.OutboxMessage) (Result, error) {
+	notification, err := db.GetNotification(c.database, message.NotificationID)
+	if err != nil {
+		return Result{}, fmt.Errorf("could not get notification: %w", err)
+	}
+
+	body := []byte(message.Body)
+	req, err := http.NewRequest(http.MethodPost, message.Destination, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, message.ID.String())
+
+	// notifications created before we signed callbacks don't have a secret
+	now := time.Now()
+	if secrets := notification.SigningSecrets(now); len(secrets) > 0 {
+		req.Header.Set(SignatureHeader, Sign(secrets, now, body))
+	}
+
+	sent, err := post(c.client, req, body)
+	if err != nil {
+		return sent, err
+	}
+
+	if sent.Status < 200 || sent.Status >= 300 {
+		msg := fmt.Sprintf("callback response: %d %s", sent.Status, http.StatusText(sent.Status))
+		if len(sent.Response) > 0 {
+			msg += fmt.Sprintf(": %s", sent.Response)
+		}
+		return sent, errors.New(msg)
+	}
+
+	return sent, nil
+}
+
+// slackChannel posts messages to a Slack webhook, with the payload pretty printed below the
+// header
+type slackChannel struct {
+	client *http.Client
+}
+
+func (slackChannel) Name() string {
+	return ChannelSlack
+}
+
+func (slackChannel) Validate(target string) error {
+	return validateURL(target)
+}
+
+func (slackChannel) Render(message Message) (string, string, error) {
+	payload, err := json.Marshal(message.Payload)
+	if err != nil {
+		return "", "", fmt.Errorf("could not marshal payload: %w", err)
+	}
+	return message.Header, string(payload), nil
+}
+
+func (s slackChannel) Deliver(message db.OutboxMessage) (Result, error) {
+	// check out https://api.slack.com/block-kit for how you can format the posted message. It's quite extensive!
+	type innerSlackBlock struct {
+		Type string `json:"type,omitempty"`
+		Text string `json:"text,omitempty"`
+	}
+	type slackBlock struct {
+		Type string           `json:"type,omitempty"`
+		Text *innerSlackBlock `json:"text,omitempty"`
+	}
+
+	type slackFormat struct {
+		Blocks []slackBlock `json:"blocks,omitempty"`
+		Text   string       `json:"text,omitempty"`
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(message.Body), "\t", ""); err != nil {
+		return Result{}, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	data, err := json.Marshal(&slackFormat{
+		Blocks: []slackBlock{
+			{
+				Type: "header",
+				Text: &innerSlackBlock{
+					Type: "plain_text",
+					Text: message.Subject,
+				},
+			},
+			{Type: "divider"},
+			{
+				Type: "section",
+				Text: &innerSlackBlock{
+					Type: "mrkdwn",
+					Text: indented.String(),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	request, err := http.NewRequest("POST", message.Destination, bytes.NewBuffer(data))
+	if err != nil {
+		return Result{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	sent, err := post(s.client, request, data)
+	if err != nil {
+		return sent, err
+	}
+
+	if sent.Status != 200 {
+		return sent, fmt.Errorf("could not post slack notification: %s", sent.Response)
+	}
+
+	return sent, nil
+}
+
+// validateURL checks that the target is an absolute HTTP(S) URL
+func validateURL(target string) error {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%s is not an HTTP(S) URL", target)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%s has no host", target)
+	}
+	return nil
+}
+
+// post sends a request with the given body, reading the start of the response
+func post(client *http.Client, request *http.Request, body []byte) (Result, error) {
+	sent := Result{Request: string(body)}
+
+	res, err := client.Do(request)
+	if err != nil {
+		return sent, err
+	}
+	defer res.Body.Close()
+
+	sent.Status = res.StatusCode
+	// the response is only kept for debugging, so we don't fail the delivery if we can't read it
+	excerpt, _ := ioutil.ReadAll(io.LimitReader(res.Body, responseExcerpt))
+	sent.Response = strings.ToValidUTF8(string(excerpt), "\uFFFD")
+
+	return sent, nil
+}
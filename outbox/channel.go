@@ -0,0 +1,83 @@
+package outbox
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bjornoj/txnotify/db"
+)
+
+// Channel is a way of delivering messages to users. Notifications pick the channels they
+// want by name, so a new transport only has to implement Channel and be registered.
+type Channel interface {
+	// Name is what notifications call the channel, e.g. email
+	Name() string
+	// Validate checks that the channel can deliver to the given target
+	Validate(target string) error
+	// Render turns a message into the subject and body stored in the outbox
+	Render(message Message) (subject, body string, err error)
+	// Deliver sends a rendered message to its destination
+	Deliver(message db.OutboxMessage) (Result, error)
+}
+
+// Result is what we sent in a delivery attempt, and what we got back. It ends up in the
+// delivery log.
+type Result struct {
+	Request string
+	// Status is the HTTP status of the response, or 0 if there was none
+	Status int
+	// Response is the start of the response body
+	Response string
+}
+
+var (
+	channelsMu sync.RWMutex
+	channels   = make(map[string]Channel)
+)
+
+// Register makes the channel available to notifications, replacing any channel registered
+// with the same name
+func Register(channel Channel) {
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+
+	channels[channel.Name()] = channel
+}
+
+// Lookup finds the registered channel with the given name
+func Lookup(name string) (Channel, error) {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+
+	channel, ok := channels[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown channel %q", name)
+	}
+	return channel, nil
+}
+
+// Channels lists the names of the registered channels, sorted
+func Channels() []string {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that the channel of the config is registered, and can deliver to its target
+func Validate(config db.ChannelConfig) error {
+	channel, err := Lookup(config.Type)
+	if err != nil {
+		return err
+	}
+	if err := channel.Validate(config.Target); err != nil {
+		return fmt.Errorf("invalid %s target: %w", config.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package outbox
+
+import (
+	"testing"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/email"
+)
+
+// recordingChannel delivers messages by remembering them
+type recordingChannel struct {
+	delivered *[]db.OutboxMessage
+}
+
+func (recordingChannel) Name() string {
+	return "recording"
+}
+
+func (recordingChannel) Validate(target string) error {
+	return nil
+}
+
+func (recordingChannel) Render(message Message) (string, string, error) {
+	return message.Header, message.Text, nil
+}
+
+func (r recordingChannel) Deliver(message db.OutboxMessage) (Result, error) {
+	*r.delivered = append(*r.delivered, message)
+	return Result{Request: message.Body}, nil
+}
+
+func TestRegister(t *testing.T) {
+	var delivered []db.OutboxMessage
+	Register(recordingChannel{delivered: &delivered})
+
+	channel, err := Lookup("recording")
+	require.NoError(t, err)
+	assert.Equal(t, "recording", channel.Name())
+	assert.Contains(t, Channels(), "recording")
+
+	t.Run("worker delivers through registered channel", func(t *testing.T) {
+		sent, err := NewWorker(nil).deliver(db.OutboxMessage{Channel: "recording", Body: "hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "hello", sent.Request)
+		require.Len(t, delivered, 1)
+	})
+
+	t.Run("rejects unknown channel", func(t *testing.T) {
+		_, err := Lookup(gofakeit.Word())
+		assert.Error(t, err)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	RegisterBuiltin(nil, email.EmailSender{})
+
+	for _, test := range []struct {
+		config db.ChannelConfig
+		valid  bool
+	}{
+		{db.ChannelConfig{Type: ChannelEmail, Target: gofakeit.Email()}, true},
+		{db.ChannelConfig{Type: ChannelEmail, Target: gofakeit.Word()}, false},
+		{db.ChannelConfig{Type: ChannelCallback, Target: "https://example.com/callback"}, true},
+		{db.ChannelConfig{Type: ChannelCallback, Target: "ftp://example.com/callback"}, false},
+		{db.ChannelConfig{Type: ChannelSlack, Target: "https://hooks.slack.com/services/T0/B0/X"}, true},
+		{db.ChannelConfig{Type: ChannelSlack, Target: "/services/T0/B0/X"}, false},
+		{db.ChannelConfig{Type: gofakeit.Word(), Target: gofakeit.URL()}, false},
+	} {
+		err := Validate(test.config)
+		if test.valid {
+			assert.NoError(t, err, "%+v", test.config)
+		} else {
+			assert.Error(t, err, "%+v", test.config)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Package outbox delivers the messages we send to users. Messages are written to the outbox
+// table first, so they survive restarts, and are delivered by background workers retrying
+// failed deliveries with exponential backoff. Messages that fail too many times are marked
+// as dead, for operators to inspect and requeue.
+//
+// Messages are delivered through channels, such as email or callbacks. New transports are
+// added by implementing Channel and registering it.
+package outbox
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bjornoj/txnotify/db"
+)
+
+var log = logrus.New()
+
+const (
+	// claimLease is how long a worker has to deliver the messages it claimed before other
+	// workers pick them up
+	claimLease = 5 * time.Minute
+
+	// requestTimeout limits how long we wait for callbacks and Slack to respond
+	requestTimeout = 30 * time.Second
+
+	// responseExcerpt is how much of a response body we keep in the delivery log
+	responseExcerpt = 1024
+)
+
+// Message is what we tell the user about an event
+type Message struct {
+	// NotificationID is the notification the message belongs to
+	NotificationID uuid.UUID
+	// Subject is the subject of the email
+	Subject string
+	// Text is the body of the email
+	Text string
+	// Header is the header of the Slack message
+	Header string
+	// Payload is posted to callbacks and Slack
+	Payload map[string]interface{}
+}
+
+// Enqueue writes the message to the outbox, once for every channel of the notification. The
+// messages are written in a single transaction, so either every channel is notified or none.
+func Enqueue(database *db.DB, to db.ChannelConfigs, message Message) error {
+	return database.Transact(func(tx db.Querier) error {
+		return EnqueueTx(tx, to, message)
+	})
+}
+
+// EnqueueTx writes the message to the outbox as part of a transaction, so it is only sent if
+// whatever it is about is committed along with it
+func EnqueueTx(tx db.Querier, to db.ChannelConfigs, message Message) error {
+	for _, config := range to {
+		channel, err := Lookup(config.Type)
+		if err != nil {
+			// a channel that's no longer available shouldn't keep the others from being notified
+			log.WithError(err).WithField("notification", message.NotificationID).Warn("skipping channel")
+			continue
+		}
+
+		subject, body, err := channel.Render(message)
+		if err != nil {
+			return fmt.Errorf("could not render %s message: %w", config.Type, err)
+		}
+
+		outgoing := db.OutboxMessage{
+			NotificationID: message.NotificationID,
+			Channel:        config.Type,
+			Destination:    config.Target,
+			Subject:        subject,
+			Body:           body,
+		}
+		if _, err := outgoing.Save(tx); err != nil {
+			return fmt.Errorf("could not save %s message: %w", outgoing.Channel, err)
+		}
+	}
+	return nil
+}
+
+// Worker delivers the messages in the outbox
+type Worker struct {
+	database *db.DB
+
+	// MaxAttempts is how many times we try to deliver a message before giving up on it
+	MaxAttempts int
+	// BaseDelay is how long we wait after the first failed attempt. The delay doubles with
+	// every failed attempt after that, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// PollInterval is how often we look for due messages when there is nothing to deliver
+	PollInterval time.Duration
+	// BatchSize is how many messages a worker claims at a time
+	BatchSize int
+}
+
+// NewWorker creates a worker with sensible defaults
+func NewWorker(database *db.DB) *Worker {
+	return &Worker{
+		database:     database,
+		MaxAttempts:  10,
+		BaseDelay:    10 * time.Second,
+		MaxDelay:     time.Hour,
+		PollInterval: time.Second,
+		BatchSize:    10,
+	}
+}
+
+// Run delivers messages with the given number of concurrent workers. It never returns.
+func (w *Worker) Run(workers int) {
+	for i := 1; i < workers; i++ {
+		go w.loop()
+	}
+	w.loop()
+}
+
+func (w *Worker) loop() {
+	for {
+		delivered, err := w.deliverDue()
+		if err != nil {
+			log.WithError(err).Error("could not deliver outbox messages")
+		}
+		if delivered == 0 {
+			time.Sleep(w.PollInterval)
+		}
+	}
+}
+
+// deliverDue claims a batch of due messages and attempts to deliver them, returning how
+// many messages were claimed
+func (w *Worker) deliverDue() (int, error) {
+	messages, err := db.ClaimOutboxMessages(w.database, w.BatchSize, claimLease)
+	if err != nil {
+		return 0, fmt.Errorf("could not claim messages: %w", err)
+	}
+
+	for _, message := range messages {
+		w.attempt(message)
+	}
+	return len(messages), nil
+}
+
+// attempt delivers a single message, and records how it went
+func (w *Worker) attempt(message db.OutboxMessage) {
+	log := log.WithFields(logrus.Fields{
+		"id":          message.ID,
+		"channel":     message.Channel,
+		"destination": message.Destination,
+		"attempt":     message.Attempts + 1,
+	})
+
+	start := time.Now()
+	sent, deliveryErr := w.deliver(message)
+	w.logDelivery(message, sent, time.Since(start), deliveryErr)
+
+	var err error
+	switch {
+	case deliveryErr == nil:
+		log.Info("delivered message")
+		err = db.MarkOutboxDelivered(w.database, message.ID)
+	case message.Attempts+1 >= w.MaxAttempts:
+		log.WithError(deliveryErr).Warn("giving up on message")
+		err = db.MarkOutboxDead(w.database, message.ID, deliveryErr.Error())
+	default:
+		delay := w.backoff(message.Attempts + 1)
+		log.WithError(deliveryErr).WithField("retryIn", delay).Info("could not deliver message")
+		err = db.MarkOutboxFailed(w.database, message.ID, time.Now().Add(delay), deliveryErr.Error())
+	}
+	if err != nil {
+		log.WithError(err).Error("could not record delivery attempt")
+	}
+}
+
+// backoff is how long to wait before the next attempt, after the given number of failed
+// attempts. Half the delay is random, so messages failing together don't retry together.
+func (w *Worker) backoff(attempts int) time.Duration {
+	delay := w.BaseDelay
+	for i := 1; i < attempts && delay < w.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.MaxDelay {
+		delay = w.MaxDelay
+	}
+
+	half := delay / 2
+	// nolint gosec
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// logDelivery adds a delivery attempt to the delivery log. Failing to do so doesn't change
+// the outcome of the attempt.
+func (w *Worker) logDelivery(message db.OutboxMessage, sent Result, latency time.Duration, deliveryErr error) {
+	delivery := db.Delivery{
+		OutboxID:       message.ID,
+		NotificationID: message.NotificationID,
+		Channel:        message.Channel,
+		Destination:    message.Destination,
+		Attempt:        message.Attempts + 1,
+		RequestBody:    sent.Request,
+		ResponseBody:   sent.Response,
+		LatencyMs:      latency.Milliseconds(),
+	}
+	if sent.Status != 0 {
+		status := sent.Status
+		delivery.ResponseStatus = &status
+	}
+	if deliveryErr != nil {
+		reason := deliveryErr.Error()
+		delivery.Error = &reason
+	}
+
+	if _, err := delivery.Save(w.database); err != nil {
+		log.WithError(err).WithField("id", message.ID).Error("could not log delivery attempt")
+	}
+}
+
+// deliver sends the message through its channel
+func (w *Worker) deliver(message db.OutboxMessage) (Result, error) {
+	channel, err := Lookup(message.Channel)
+	if err != nil {
+		return Result{}, err
+	}
+	return channel.Deliver(message)
+}
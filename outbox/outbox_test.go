@@ -0,0 +1,341 @@
+package outbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bjornoj/txnotify/db"
+	"github.com/bjornoj/txnotify/db/dbtest"
+	"github.com/bjornoj/txnotify/email"
+)
+
+var testDB = dbtest.New("outbox_test")
+
+func TestBackoff(t *testing.T) {
+	worker := NewWorker(nil)
+	worker.BaseDelay = time.Second
+	worker.MaxDelay = time.Minute
+
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		7:  time.Minute,
+		50: time.Minute,
+	} {
+		for i := 0; i < 10; i++ {
+			delay := worker.backoff(attempts)
+			assert.GreaterOrEqual(t, int64(delay), int64(want/2), "attempts: %d", attempts)
+			assert.LessOrEqual(t, int64(delay), int64(want), "attempts: %d", attempts)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"tx_confirmed"}`)
+	timestamp := time.Unix(1700000000, 0)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000."))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	assert.Equal(t, "t=1700000000,v1="+signature, Sign([]string{"secret"}, timestamp, body))
+	assert.Equal(t, "t=1700000000", Sign(nil, timestamp, body))
+
+	both := Sign([]string{"other", "secret"}, timestamp, body)
+	assert.True(t, strings.HasSuffix(both, ",v1="+signature), both)
+	assert.NotEqual(t, Sign([]string{"secret"}, timestamp.Add(time.Second), body), Sign([]string{"secret"}, timestamp, body))
+
+	first, err := NewSigningSecret()
+	require.NoError(t, err)
+	second, err := NewSigningSecret()
+	require.NoError(t, err)
+	assert.Len(t, first, 64)
+	assert.NotEqual(t, first, second)
+}
+
+func TestDeliver(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	RegisterBuiltin(testDB, email.EmailSender{})
+	worker := NewWorker(testDB)
+	payload := `{"event":"tx_confirmed","txid":"abc"}`
+
+	var userID uuid.UUID
+	require.NoError(t, testDB.QueryRow("INSERT INTO users DEFAULT VALUES RETURNING id").Scan(&userID))
+	secret, err := NewSigningSecret()
+	require.NoError(t, err)
+	notification, err := db.Notification{
+		UserID:        userID,
+		Identifier:    gofakeit.UUID(),
+		SigningSecret: secret,
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	t.Run("posts signed callback", func(t *testing.T) {
+		var received []byte
+		var header http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received, _ = ioutil.ReadAll(r.Body)
+			header = r.Header
+		}))
+		defer server.Close()
+
+		messageID := uuid.New()
+		sent, err := worker.deliver(db.OutboxMessage{
+			ID:             messageID,
+			NotificationID: notification.ID,
+			Channel:        ChannelCallback,
+			Destination:    server.URL,
+			Body:           payload,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, payload, sent.Request)
+		assert.Equal(t, http.StatusOK, sent.Status)
+		assert.JSONEq(t, payload, string(received))
+		assert.Equal(t, messageID.String(), header.Get(EventIDHeader))
+
+		signature := header.Get(SignatureHeader)
+		require.Regexp(t, `^t=\d+,v1=[0-9a-f]{64}$`, signature)
+		timestamp, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+		require.NoError(t, err)
+		assert.Equal(t, Sign([]string{secret}, time.Unix(timestamp, 0), received), signature)
+	})
+
+	t.Run("signs with both secrets while rotating", func(t *testing.T) {
+		next, err := NewSigningSecret()
+		require.NoError(t, err)
+		require.NoError(t, db.RotateSigningSecret(testDB, notification.ID, next, time.Now().Add(time.Hour)))
+
+		var signature string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signature = r.Header.Get(SignatureHeader)
+		}))
+		defer server.Close()
+
+		_, err = worker.deliver(db.OutboxMessage{
+			ID:             uuid.New(),
+			NotificationID: notification.ID,
+			Channel:        ChannelCallback,
+			Destination:    server.URL,
+			Body:           payload,
+		})
+		require.NoError(t, err)
+		parts := strings.Split(signature, ",")
+		require.Len(t, parts, 3)
+		timestamp, err := strconv.ParseInt(strings.TrimPrefix(parts[0], "t="), 10, 64)
+		require.NoError(t, err)
+		assert.Equal(t, Sign([]string{next, secret}, time.Unix(timestamp, 0), []byte(payload)), signature)
+	})
+
+	t.Run("fails on error response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		sent, err := worker.deliver(db.OutboxMessage{
+			NotificationID: notification.ID,
+			Channel:        ChannelCallback,
+			Destination:    server.URL,
+			Body:           payload,
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "down for maintenance")
+		assert.Equal(t, http.StatusServiceUnavailable, sent.Status)
+		assert.Equal(t, "down for maintenance\n", sent.Response)
+	})
+
+	t.Run("posts slack message with header", func(t *testing.T) {
+		var received struct {
+			Blocks []struct {
+				Type string `json:"type"`
+				Text *struct {
+					Text string `json:"text"`
+				} `json:"text"`
+			} `json:"blocks"`
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewDecoder(r.Body).Decode(&received)
+		}))
+		defer server.Close()
+
+		sent, err := worker.deliver(db.OutboxMessage{
+			Channel:     ChannelSlack,
+			Destination: server.URL,
+			Subject:     "Transaction confirmed",
+			Body:        payload,
+		})
+		require.NoError(t, err)
+		assert.Contains(t, sent.Request, `"blocks"`)
+		require.Len(t, received.Blocks, 3)
+		assert.Equal(t, "Transaction confirmed", received.Blocks[0].Text.Text)
+		assert.Contains(t, received.Blocks[2].Text.Text, `"txid": "abc"`)
+	})
+
+	t.Run("rejects unknown channel", func(t *testing.T) {
+		_, err := worker.deliver(db.OutboxMessage{Channel: gofakeit.Word()})
+		assert.Error(t, err)
+	})
+}
+
+func TestWorker(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	var userID uuid.UUID
+	require.NoError(t, testDB.QueryRow("INSERT INTO users DEFAULT VALUES RETURNING id").Scan(&userID))
+	notification, err := db.Notification{
+		UserID:     userID,
+		Identifier: gofakeit.UUID(),
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	RegisterBuiltin(testDB, email.EmailSender{})
+	require.NoError(t, Enqueue(testDB, db.ChannelConfigs{{Type: ChannelCallback, Target: server.URL}}, Message{
+		NotificationID: notification.ID,
+		Payload:        map[string]interface{}{"event": "tx_confirmed"},
+	}))
+
+	worker := NewWorker(testDB)
+	worker.MaxAttempts = 2
+	// retry right away
+	worker.BaseDelay = 0
+	worker.MaxDelay = 0
+
+	message := func() db.OutboxMessage {
+		var message db.OutboxMessage
+		require.NoError(t, testDB.Get(&message, `SELECT * FROM outbox WHERE notification_id = $1`, notification.ID))
+		return message
+	}
+
+	t.Run("retries failed delivery", func(t *testing.T) {
+		_, err := worker.deliverDue()
+		require.NoError(t, err)
+
+		assert.Equal(t, db.OutboxPending, message().Status)
+		assert.Equal(t, 1, message().Attempts)
+		require.NotNil(t, message().LastError)
+	})
+
+	t.Run("marks message as dead after the last attempt", func(t *testing.T) {
+		_, err := worker.deliverDue()
+		require.NoError(t, err)
+
+		assert.Equal(t, db.OutboxDead, message().Status)
+		assert.Equal(t, 2, message().Attempts)
+
+		dead, err := db.ListDeadOutboxMessages(testDB)
+		require.NoError(t, err)
+		assert.NotEmpty(t, dead)
+	})
+
+	t.Run("delivers requeued message", func(t *testing.T) {
+		failing = false
+		require.NoError(t, db.RequeueOutboxMessage(testDB, message().ID))
+
+		_, err := worker.deliverDue()
+		require.NoError(t, err)
+
+		assert.Equal(t, db.OutboxDelivered, message().Status)
+		assert.NotNil(t, message().DeliveredAt)
+	})
+
+	t.Run("logs every delivery attempt", func(t *testing.T) {
+		deliveries, err := db.ListDeliveries(testDB, notification.ID, time.Time{}, time.Now().Add(time.Minute), 10)
+		require.NoError(t, err)
+		require.Len(t, deliveries, 3)
+
+		// newest first
+		delivered := deliveries[0]
+		assert.Equal(t, message().ID, delivered.OutboxID)
+		assert.Equal(t, ChannelCallback, delivered.Channel)
+		assert.Equal(t, server.URL, delivered.Destination)
+		assert.JSONEq(t, `{"event":"tx_confirmed"}`, delivered.RequestBody)
+		require.NotNil(t, delivered.ResponseStatus)
+		assert.Equal(t, http.StatusOK, *delivered.ResponseStatus)
+		assert.Nil(t, delivered.Error)
+
+		failed := deliveries[2]
+		assert.Equal(t, 1, failed.Attempt)
+		require.NotNil(t, failed.ResponseStatus)
+		assert.Equal(t, http.StatusInternalServerError, *failed.ResponseStatus)
+		require.NotNil(t, failed.Error)
+
+		deliveries, err = db.ListDeliveries(testDB, notification.ID, time.Now().Add(time.Minute), time.Now().Add(time.Hour), 10)
+		require.NoError(t, err)
+		assert.Empty(t, deliveries)
+	})
+
+	t.Run("only requeues dead messages", func(t *testing.T) {
+		err := db.RequeueOutboxMessage(testDB, message().ID)
+		assert.ErrorIs(t, err, db.ErrOutboxMessageNotFound)
+	})
+}
+
+// brokenChannel can't render any message
+type brokenChannel struct{}
+
+func (brokenChannel) Name() string {
+	return "broken"
+}
+
+func (brokenChannel) Validate(target string) error {
+	return nil
+}
+
+func (brokenChannel) Render(message Message) (string, string, error) {
+	return "", "", errors.New("could not render")
+}
+
+func (brokenChannel) Deliver(message db.OutboxMessage) (Result, error) {
+	return Result{}, errors.New("could not deliver")
+}
+
+func TestEnqueue(t *testing.T) {
+	dbtest.Require(t, testDB)
+
+	var userID uuid.UUID
+	require.NoError(t, testDB.QueryRow("INSERT INTO users DEFAULT VALUES RETURNING id").Scan(&userID))
+	notification, err := db.Notification{
+		UserID:     userID,
+		Identifier: gofakeit.UUID(),
+	}.Save(testDB)
+	require.NoError(t, err)
+
+	RegisterBuiltin(testDB, email.EmailSender{})
+	Register(brokenChannel{})
+
+	err = Enqueue(testDB, db.ChannelConfigs{
+		{Type: ChannelCallback, Target: "https://example.com/callback"},
+		{Type: "broken"},
+	}, Message{NotificationID: notification.ID})
+	require.Error(t, err)
+
+	var queued int
+	require.NoError(t, testDB.Get(&queued, `SELECT count(*) FROM outbox WHERE notification_id = $1`, notification.ID))
+	assert.Zero(t, queued, "no channel is notified if one of them fails")
+}
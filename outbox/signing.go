@@ -0,0 +1,46 @@
+package outbox
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the signatures of a callback, on the form
+	// t=<unix timestamp>,v1=<signature>. The signature is the hex encoded HMAC-SHA256 of
+	// "<timestamp>.<body>", keyed with the signing secret of the notification. While a secret
+	// is being rotated there is one v1 entry per valid secret.
+	SignatureHeader = "X-Txnotify-Signature"
+
+	// EventIDHeader identifies the event a callback is about. It stays the same when a
+	// delivery is retried, so receivers can skip events they've already handled.
+	EventIDHeader = "X-Txnotify-Event-Id"
+)
+
+// NewSigningSecret generates a secret for signing callbacks
+func NewSigningSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("could not generate signing secret: %w", err)
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Sign builds the signature header of a callback body sent at the given time
+func Sign(secrets []string, timestamp time.Time, body []byte) string {
+	unix := fmt.Sprintf("%d", timestamp.Unix())
+
+	parts := []string{"t=" + unix}
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(unix + "."))
+		mac.Write(body)
+		parts = append(parts, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(parts, ",")
+}
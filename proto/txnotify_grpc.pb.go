@@ -105,6 +105,16 @@ type NotifyClient interface {
 	CreateNotification(ctx context.Context, in *Notification, opts ...grpc.CallOption) (*CreateNotificationResponse, error)
 	// ListNotifications can be used to list all your current active notifications
 	ListNotifications(ctx context.Context, in *ListNotificationsRequest, opts ...grpc.CallOption) (*ListNotificationsResponse, error)
+	// GetAddressBalance returns the balance of a watched address, along with the outputs
+	// making up the balance
+	GetAddressBalance(ctx context.Context, in *GetAddressBalanceRequest, opts ...grpc.CallOption) (*GetAddressBalanceResponse, error)
+	// RotateSigningSecret replaces the secret callbacks of a notification are signed with. The
+	// previous secret keeps signing callbacks alongside the new one during the overlap window,
+	// so you can switch over without rejecting any callbacks.
+	RotateSigningSecret(ctx context.Context, in *RotateSigningSecretRequest, opts ...grpc.CallOption) (*RotateSigningSecretResponse, error)
+	// ListDeliveries lists the attempts at delivering the messages of a notification, newest
+	// first. Useful for finding out why your endpoint didn't get a callback.
+	ListDeliveries(ctx context.Context, in *ListDeliveriesRequest, opts ...grpc.CallOption) (*ListDeliveriesResponse, error)
 }
 
 type notifyClient struct {
@@ -133,6 +143,33 @@ func (c *notifyClient) ListNotifications(ctx context.Context, in *ListNotificati
 	return out, nil
 }
 
+func (c *notifyClient) GetAddressBalance(ctx context.Context, in *GetAddressBalanceRequest, opts ...grpc.CallOption) (*GetAddressBalanceResponse, error) {
+	out := new(GetAddressBalanceResponse)
+	err := c.cc.Invoke(ctx, "/rpc.Notify/GetAddressBalance", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *notifyClient) RotateSigningSecret(ctx context.Context, in *RotateSigningSecretRequest, opts ...grpc.CallOption) (*RotateSigningSecretResponse, error) {
+	out := new(RotateSigningSecretResponse)
+	err := c.cc.Invoke(ctx, "/rpc.Notify/RotateSigningSecret", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *notifyClient) ListDeliveries(ctx context.Context, in *ListDeliveriesRequest, opts ...grpc.CallOption) (*ListDeliveriesResponse, error) {
+	out := new(ListDeliveriesResponse)
+	err := c.cc.Invoke(ctx, "/rpc.Notify/ListDeliveries", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // NotifyServer is the server API for Notify service.
 // All implementations must embed UnimplementedNotifyServer
 // for forward compatibility
@@ -142,6 +179,16 @@ type NotifyServer interface {
 	CreateNotification(context.Context, *Notification) (*CreateNotificationResponse, error)
 	// ListNotifications can be used to list all your current active notifications
 	ListNotifications(context.Context, *ListNotificationsRequest) (*ListNotificationsResponse, error)
+	// GetAddressBalance returns the balance of a watched address, along with the outputs
+	// making up the balance
+	GetAddressBalance(context.Context, *GetAddressBalanceRequest) (*GetAddressBalanceResponse, error)
+	// RotateSigningSecret replaces the secret callbacks of a notification are signed with. The
+	// previous secret keeps signing callbacks alongside the new one during the overlap window,
+	// so you can switch over without rejecting any callbacks.
+	RotateSigningSecret(context.Context, *RotateSigningSecretRequest) (*RotateSigningSecretResponse, error)
+	// ListDeliveries lists the attempts at delivering the messages of a notification, newest
+	// first. Useful for finding out why your endpoint didn't get a callback.
+	ListDeliveries(context.Context, *ListDeliveriesRequest) (*ListDeliveriesResponse, error)
 	mustEmbedUnimplementedNotifyServer()
 }
 
@@ -155,6 +202,15 @@ func (UnimplementedNotifyServer) CreateNotification(context.Context, *Notificati
 func (UnimplementedNotifyServer) ListNotifications(context.Context, *ListNotificationsRequest) (*ListNotificationsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListNotifications not implemented")
 }
+func (UnimplementedNotifyServer) GetAddressBalance(context.Context, *GetAddressBalanceRequest) (*GetAddressBalanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAddressBalance not implemented")
+}
+func (UnimplementedNotifyServer) RotateSigningSecret(context.Context, *RotateSigningSecretRequest) (*RotateSigningSecretResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateSigningSecret not implemented")
+}
+func (UnimplementedNotifyServer) ListDeliveries(context.Context, *ListDeliveriesRequest) (*ListDeliveriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDeliveries not implemented")
+}
 func (UnimplementedNotifyServer) mustEmbedUnimplementedNotifyServer() {}
 
 // UnsafeNotifyServer may be embedded to opt out of forward compatibility for this service.
@@ -204,6 +260,60 @@ func _Notify_ListNotifications_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Notify_GetAddressBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetAddressBalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NotifyServer).GetAddressBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rpc.Notify/GetAddressBalance",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NotifyServer).GetAddressBalance(ctx, req.(*GetAddressBalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Notify_RotateSigningSecret_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateSigningSecretRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NotifyServer).RotateSigningSecret(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rpc.Notify/RotateSigningSecret",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NotifyServer).RotateSigningSecret(ctx, req.(*RotateSigningSecretRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Notify_ListDeliveries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDeliveriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NotifyServer).ListDeliveries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rpc.Notify/ListDeliveries",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NotifyServer).ListDeliveries(ctx, req.(*ListDeliveriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Notify_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "rpc.Notify",
 	HandlerType: (*NotifyServer)(nil),
@@ -216,6 +326,18 @@ var _Notify_serviceDesc = grpc.ServiceDesc{
 			MethodName: "ListNotifications",
 			Handler:    _Notify_ListNotifications_Handler,
 		},
+		{
+			MethodName: "GetAddressBalance",
+			Handler:    _Notify_GetAddressBalance_Handler,
+		},
+		{
+			MethodName: "RotateSigningSecret",
+			Handler:    _Notify_RotateSigningSecret_Handler,
+		},
+		{
+			MethodName: "ListDeliveries",
+			Handler:    _Notify_ListDeliveries_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/txnotify.proto",